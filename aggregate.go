@@ -0,0 +1,954 @@
+package keradb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// ============================================================================
+// Aggregation
+// ============================================================================
+
+// pipelineStage is a compiled aggregation stage. Stages never modify the
+// documents they are given, since $facet feeds the same documents to
+// several sub-pipelines.
+type pipelineStage func(ctx context.Context, docs []Document) ([]Document, error)
+
+// Aggregate runs an aggregation pipeline over the collection and returns a
+// cursor over its output
+func (c *Collection) Aggregate(pipeline []M) (*Cursor, error) {
+	return c.AggregateContext(context.Background(), pipeline)
+}
+
+// AggregateContext runs an aggregation pipeline over the collection.
+//
+// Supported stages are $match, $project, $addFields, $group, $sort, $skip,
+// $limit, $unwind, $count, $facet and $lookup. Expressions use the same
+// syntax as $expr. The leading $match stages, and a $sort, $skip and $limit
+// directly after them, run as a query while the collection is read, so
+// they can use an index and only the documents they select are loaded.
+// The rest of the pipeline runs in memory over those documents.
+func (c *Collection) AggregateContext(ctx context.Context, pipeline []M) (*Cursor, error) {
+	c = c.forContext(ctx)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	compiled, err := c.compilePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	filter, opts, pushed := pushdownPipeline(pipeline)
+
+	cursor, err := c.FindContext(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := cursor.All()
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err = runPipeline(ctx, compiled[pushed:], docs)
+	if err != nil {
+		return nil, err
+	}
+	out := NewCursor(docs)
+	out.registry = c.registry
+	return out, nil
+}
+
+// pushdownPipeline turns the start of a compiled pipeline into a query: the
+// leading $match stages become its filter, and a $sort, $skip and $limit
+// that follow, in that order, become its options. It returns the number of
+// stages the query replaces.
+func pushdownPipeline(pipeline []M) (M, *FindOptions, int) {
+	var matches []M
+	opts := NewFindOptions()
+	n := 0
+	for ; n < len(pipeline); n++ {
+		arg, ok := pipeline[n]["$match"]
+		if !ok {
+			break
+		}
+		filter, _ := toFilter(arg)
+		matches = append(matches, filter)
+	}
+	if n < len(pipeline) {
+		if arg, ok := pipeline[n]["$sort"]; ok {
+			spec, _ := stageSortSpec(arg)
+			opts.SetSort(spec)
+			n++
+		}
+	}
+	if n < len(pipeline) {
+		if arg, ok := pipeline[n]["$skip"]; ok {
+			skip, _ := toFloat(arg)
+			opts.SetSkip(int64(skip))
+			n++
+		}
+	}
+	if n < len(pipeline) {
+		if arg, ok := pipeline[n]["$limit"]; ok {
+			limit, _ := toFloat(arg)
+			opts.SetLimit(int64(limit))
+			n++
+		}
+	}
+
+	var filter M
+	switch len(matches) {
+	case 0:
+	case 1:
+		filter = matches[0]
+	default:
+		filter = M{"$and": matches}
+	}
+	return filter, opts, n
+}
+
+func runPipeline(ctx context.Context, stages []pipelineStage, docs []Document) ([]Document, error) {
+	for _, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var err error
+		docs, err = stage(ctx, docs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func (c *Collection) compilePipeline(pipeline []M) ([]pipelineStage, error) {
+	stages := make([]pipelineStage, 0, len(pipeline))
+	for i, spec := range pipeline {
+		if len(spec) != 1 {
+			return nil, fmt.Errorf("pipeline stage %d must have exactly one field", i)
+		}
+		for name, arg := range spec {
+			stage, err := c.compileStage(name, arg)
+			if err != nil {
+				return nil, fmt.Errorf("pipeline stage %d (%s): %w", i, name, err)
+			}
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+func (c *Collection) compileStage(name string, arg interface{}) (pipelineStage, error) {
+	switch name {
+	case "$match":
+		filter, ok := toFilter(arg)
+		if !ok {
+			return nil, errors.New("$match needs a document")
+		}
+		match, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, docs []Document) ([]Document, error) {
+			out := make([]Document, 0, len(docs))
+			for _, doc := range docs {
+				if match(doc) {
+					out = append(out, doc)
+				}
+			}
+			return out, nil
+		}, nil
+
+	case "$project":
+		return compileProjectStage(arg)
+
+	case "$addFields":
+		return compileAddFieldsStage(arg)
+
+	case "$group":
+		return compileGroupStage(arg)
+
+	case "$sort":
+		spec, err := stageSortSpec(arg)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := parseSort(spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, errors.New("$sort needs at least one field")
+		}
+		return func(ctx context.Context, docs []Document) ([]Document, error) {
+			out := append([]Document(nil), docs...)
+			if err := sortDocuments(out, spec); err != nil {
+				return nil, err
+			}
+			return out, nil
+		}, nil
+
+	case "$skip", "$limit":
+		n, ok := toFloat(arg)
+		if !ok || n < 0 || n != math.Trunc(n) || (name == "$limit" && n == 0) {
+			return nil, fmt.Errorf("%s needs a non-negative integer", name)
+		}
+		count := int(n)
+		return func(ctx context.Context, docs []Document) ([]Document, error) {
+			if name == "$skip" {
+				if count >= len(docs) {
+					return []Document{}, nil
+				}
+				return docs[count:], nil
+			}
+			if count < len(docs) {
+				return docs[:count], nil
+			}
+			return docs, nil
+		}, nil
+
+	case "$unwind":
+		return compileUnwindStage(arg)
+
+	case "$count":
+		field, ok := arg.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return nil, errors.New("$count needs a field name")
+		}
+		return func(ctx context.Context, docs []Document) ([]Document, error) {
+			if len(docs) == 0 {
+				return []Document{}, nil
+			}
+			return []Document{{field: int64(len(docs))}}, nil
+		}, nil
+
+	case "$facet":
+		return c.compileFacetStage(arg)
+
+	case "$lookup":
+		return c.compileLookupStage(arg)
+	}
+	return nil, fmt.Errorf("unknown pipeline stage: %s", name)
+}
+
+// toPipeline converts a pipeline, or a sub-pipeline argument such as the
+// value of a $facet field, to []M
+func toPipeline(v interface{}) ([]M, error) {
+	if p, ok := v.([]M); ok || v == nil {
+		return p, nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil, errors.New("pipeline must be an array of stages")
+	}
+	pipeline := make([]M, rv.Len())
+	for i := range pipeline {
+		stage, ok := toFilter(rv.Index(i).Interface())
+		if !ok {
+			return nil, errors.New("pipeline stages must be documents")
+		}
+		pipeline[i] = stage
+	}
+	return pipeline, nil
+}
+
+// stageSortSpec returns the sort order of a $sort stage. A D keeps the
+// order of its keys; an M is only accepted with a single key, since a map
+// does not preserve the precedence of several keys.
+func stageSortSpec(arg interface{}) (D, error) {
+	if d, ok := arg.(D); ok {
+		return d, nil
+	}
+	m, ok := asMap(arg)
+	if !ok {
+		return nil, errors.New("$sort needs a document")
+	}
+	if len(m) > 1 {
+		return nil, errors.New("$sort on several fields needs a D to fix their order")
+	}
+	var spec D
+	for k, v := range m {
+		spec = append(spec, E{Key: k, Value: v})
+	}
+	return spec, nil
+}
+
+// copyDocument returns a deep copy of doc that stages can modify
+func copyDocument(doc Document) map[string]interface{} {
+	out, _ := normalizeLiteral(map[string]interface{}(doc)).(map[string]interface{})
+	if out == nil {
+		out = map[string]interface{}{}
+	}
+	return out
+}
+
+// embedDocuments converts documents to values that can be stored in a field
+func embedDocuments(docs []Document) []interface{} {
+	out := make([]interface{}, len(docs))
+	for i, d := range docs {
+		out[i] = map[string]interface{}(d)
+	}
+	return out
+}
+
+// ----------------------------------------------------------------------------
+// $project and $addFields
+// ----------------------------------------------------------------------------
+
+// projectField is one entry of a $project stage; a nil expr includes or
+// excludes the field as it is
+type projectField struct {
+	path string
+	expr exprFunc
+}
+
+// flattenProjection turns nested projection documents such as
+// {"a": {"b": 1}} into dot-notation paths
+func flattenProjection(prefix string, spec map[string]interface{}, out map[string]interface{}) {
+	for k, v := range spec {
+		if m, ok := asMap(v); ok && len(m) > 0 {
+			if _, isOp := isOperatorMap(m); !isOp {
+				flattenProjection(prefix+k+".", m, out)
+				continue
+			}
+		}
+		out[prefix+k] = v
+	}
+}
+
+func compileProjectStage(arg interface{}) (pipelineStage, error) {
+	spec, ok := asMap(normalizeLiteral(arg))
+	if !ok || len(spec) == 0 {
+		return nil, errors.New("$project needs a non-empty document")
+	}
+	flat := map[string]interface{}{}
+	flattenProjection("", spec, flat)
+
+	var fields []projectField
+	var include, exclude, excludeID bool
+	for _, path := range sortedKeys(flat) {
+		v := flat[path]
+		if _, isBool := v.(bool); isBool || isNumber(v) {
+			if !isTruthy(v) {
+				if path == "_id" {
+					excludeID = true
+				} else {
+					exclude = true
+					fields = append(fields, projectField{path: path})
+				}
+				continue
+			}
+			include = true
+			fields = append(fields, projectField{path: path})
+			continue
+		}
+		expr, err := compileExpr(v)
+		if err != nil {
+			return nil, err
+		}
+		include = true
+		fields = append(fields, projectField{path: path, expr: expr})
+	}
+	if include && exclude {
+		return nil, errors.New("cannot mix inclusion and exclusion in projection")
+	}
+
+	return func(ctx context.Context, docs []Document) ([]Document, error) {
+		out := make([]Document, len(docs))
+		for i, doc := range docs {
+			var result map[string]interface{}
+			if include {
+				result = map[string]interface{}{}
+				if id, ok := doc["_id"]; ok && !excludeID {
+					result["_id"] = id
+				}
+				for _, f := range fields {
+					if f.expr != nil {
+						if err := setPath(result, f.path, f.expr(doc)); err != nil {
+							return nil, err
+						}
+						continue
+					}
+					if v, ok := getPath(doc, f.path); ok {
+						if err := setPath(result, f.path, normalizeLiteral(v)); err != nil {
+							return nil, err
+						}
+					}
+				}
+			} else {
+				result = copyDocument(doc)
+				for _, f := range fields {
+					unsetPath(result, f.path)
+				}
+				if excludeID {
+					delete(result, "_id")
+				}
+			}
+			out[i] = Document(result)
+		}
+		return out, nil
+	}, nil
+}
+
+func compileAddFieldsStage(arg interface{}) (pipelineStage, error) {
+	spec, ok := asMap(normalizeLiteral(arg))
+	if !ok || len(spec) == 0 {
+		return nil, errors.New("$addFields needs a non-empty document")
+	}
+	var fields []projectField
+	for _, path := range sortedKeys(spec) {
+		if err := checkUpdatePath(path); err != nil {
+			return nil, err
+		}
+		expr, err := compileExpr(spec[path])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, projectField{path: path, expr: expr})
+	}
+
+	return func(ctx context.Context, docs []Document) ([]Document, error) {
+		out := make([]Document, len(docs))
+		for i, doc := range docs {
+			result := copyDocument(doc)
+			for _, f := range fields {
+				if err := setPath(result, f.path, f.expr(doc)); err != nil {
+					return nil, err
+				}
+			}
+			out[i] = Document(result)
+		}
+		return out, nil
+	}, nil
+}
+
+// ----------------------------------------------------------------------------
+// $group
+// ----------------------------------------------------------------------------
+
+// accumulator collects the values of one $group output field
+type accumulator interface {
+	add(v interface{})
+	result() interface{}
+}
+
+type sumAccumulator struct{ total interface{} }
+
+func (a *sumAccumulator) add(v interface{}) {
+	if !isNumber(v) {
+		return
+	}
+	a.total, _ = addNumbers(a.total, v)
+}
+func (a *sumAccumulator) result() interface{} { return a.total }
+
+type avgAccumulator struct {
+	sum float64
+	n   int
+}
+
+func (a *avgAccumulator) add(v interface{}) {
+	if f, ok := toFloat(v); ok {
+		a.sum += f
+		a.n++
+	}
+}
+func (a *avgAccumulator) result() interface{} {
+	if a.n == 0 {
+		return nil
+	}
+	return a.sum / float64(a.n)
+}
+
+type extremeAccumulator struct {
+	max   bool
+	value interface{}
+}
+
+func (a *extremeAccumulator) add(v interface{}) {
+	if v == nil {
+		return
+	}
+	if a.value == nil {
+		a.value = v
+		return
+	}
+	c := compareValues(v, a.value)
+	if (a.max && c > 0) || (!a.max && c < 0) {
+		a.value = v
+	}
+}
+func (a *extremeAccumulator) result() interface{} { return a.value }
+
+type pushAccumulator struct {
+	unique bool
+	values []interface{}
+}
+
+func (a *pushAccumulator) add(v interface{}) {
+	if a.unique {
+		for _, existing := range a.values {
+			if valuesEqual(existing, v) {
+				return
+			}
+		}
+	}
+	a.values = append(a.values, v)
+}
+func (a *pushAccumulator) result() interface{} {
+	if a.values == nil {
+		return []interface{}{}
+	}
+	return a.values
+}
+
+type firstAccumulator struct {
+	set   bool
+	value interface{}
+}
+
+func (a *firstAccumulator) add(v interface{}) {
+	if !a.set {
+		a.set, a.value = true, v
+	}
+}
+func (a *firstAccumulator) result() interface{} { return a.value }
+
+type lastAccumulator struct{ value interface{} }
+
+func (a *lastAccumulator) add(v interface{})   { a.value = v }
+func (a *lastAccumulator) result() interface{} { return a.value }
+
+type countAccumulator struct{ n int64 }
+
+func (a *countAccumulator) add(interface{})     { a.n++ }
+func (a *countAccumulator) result() interface{} { return a.n }
+
+// newAccumulator returns an empty accumulator for a $group operator
+func newAccumulator(op string) accumulator {
+	switch op {
+	case "$sum":
+		return &sumAccumulator{total: int64(0)}
+	case "$avg":
+		return &avgAccumulator{}
+	case "$min":
+		return &extremeAccumulator{}
+	case "$max":
+		return &extremeAccumulator{max: true}
+	case "$push":
+		return &pushAccumulator{}
+	case "$addToSet":
+		return &pushAccumulator{unique: true}
+	case "$first":
+		return &firstAccumulator{}
+	case "$last":
+		return &lastAccumulator{}
+	case "$count":
+		return &countAccumulator{}
+	}
+	return nil
+}
+
+// groupField is an output field of a $group stage
+type groupField struct {
+	name string
+	op   string
+	expr exprFunc
+}
+
+type group struct {
+	id   interface{}
+	accs []accumulator
+}
+
+func compileGroupStage(arg interface{}) (pipelineStage, error) {
+	spec, ok := asMap(normalizeLiteral(arg))
+	if !ok {
+		return nil, errors.New("$group needs a document")
+	}
+	idArg, ok := spec["_id"]
+	if !ok {
+		return nil, errors.New("$group needs an _id")
+	}
+	idExpr, err := compileExpr(idArg)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []groupField
+	for _, name := range sortedKeys(spec) {
+		if name == "_id" {
+			continue
+		}
+		if strings.Contains(name, ".") {
+			return nil, fmt.Errorf("$group field %q must not contain '.'", name)
+		}
+		acc, ok := asMap(spec[name])
+		if !ok || len(acc) != 1 {
+			return nil, fmt.Errorf("$group field %q must be a single accumulator", name)
+		}
+		for op, accArg := range acc {
+			if newAccumulator(op) == nil {
+				return nil, fmt.Errorf("unknown group accumulator: %s", op)
+			}
+			field := groupField{name: name, op: op}
+			if op == "$count" {
+				if m, ok := asMap(accArg); !ok || len(m) != 0 {
+					return nil, errors.New("$count accumulator takes an empty document")
+				}
+			} else {
+				expr, err := compileExpr(accArg)
+				if err != nil {
+					return nil, err
+				}
+				field.expr = expr
+			}
+			fields = append(fields, field)
+		}
+	}
+
+	return func(ctx context.Context, docs []Document) ([]Document, error) {
+		groups := map[string]*group{}
+		var order []*group
+		for _, doc := range docs {
+			id := idExpr(doc)
+			key, err := groupKey(id)
+			if err != nil {
+				return nil, err
+			}
+			g, ok := groups[key]
+			if !ok {
+				g = &group{id: id, accs: make([]accumulator, len(fields))}
+				for i, f := range fields {
+					g.accs[i] = newAccumulator(f.op)
+				}
+				groups[key] = g
+				order = append(order, g)
+			}
+			for i, f := range fields {
+				var v interface{}
+				if f.expr != nil {
+					v = f.expr(doc)
+				}
+				g.accs[i].add(v)
+			}
+		}
+
+		out := make([]Document, len(order))
+		for i, g := range order {
+			doc := Document{"_id": g.id}
+			for j, f := range fields {
+				doc[f.name] = g.accs[j].result()
+			}
+			out[i] = doc
+		}
+		return out, nil
+	}, nil
+}
+
+// groupKey returns a string that is equal for equal group ids. JSON
+// encoding sorts map keys and writes equal numbers alike, whatever their
+// Go type.
+func groupKey(id interface{}) (string, error) {
+	if f, ok := toFloat(id); ok {
+		id = f
+	}
+	data, err := json.Marshal(id)
+	if err != nil {
+		return "", fmt.Errorf("invalid group id: %w", err)
+	}
+	return string(data), nil
+}
+
+// ----------------------------------------------------------------------------
+// $unwind
+// ----------------------------------------------------------------------------
+
+func compileUnwindStage(arg interface{}) (pipelineStage, error) {
+	var path, indexField string
+	var preserve bool
+	switch a := normalizeLiteral(arg).(type) {
+	case string:
+		path = a
+	case map[string]interface{}:
+		for k, v := range a {
+			switch k {
+			case "path":
+				path, _ = v.(string)
+			case "includeArrayIndex":
+				s, ok := v.(string)
+				if !ok || s == "" || strings.HasPrefix(s, "$") {
+					return nil, errors.New("includeArrayIndex must be a field name")
+				}
+				indexField = s
+			case "preserveNullAndEmptyArrays":
+				b, ok := v.(bool)
+				if !ok {
+					return nil, errors.New("preserveNullAndEmptyArrays must be a boolean")
+				}
+				preserve = b
+			default:
+				return nil, fmt.Errorf("unknown $unwind option: %s", k)
+			}
+		}
+	default:
+		return nil, errors.New("$unwind needs a field path or a document")
+	}
+	if !strings.HasPrefix(path, "$") || len(path) == 1 {
+		return nil, errors.New("$unwind path must be a field path starting with '$'")
+	}
+	path = path[1:]
+
+	return func(ctx context.Context, docs []Document) ([]Document, error) {
+		out := make([]Document, 0, len(docs))
+		// emit outputs doc with the unwound field set to value, or removed
+		// if set is false
+		emit := func(doc Document, value interface{}, set bool, index interface{}) error {
+			result := copyDocument(doc)
+			if set {
+				if err := setPath(result, path, value); err != nil {
+					return err
+				}
+			} else {
+				unsetPath(result, path)
+			}
+			if indexField != "" {
+				if err := setPath(result, indexField, index); err != nil {
+					return err
+				}
+			}
+			out = append(out, Document(result))
+			return nil
+		}
+
+		for _, doc := range docs {
+			v, ok := getPath(doc, path)
+			arr, isArray := v.([]interface{})
+			switch {
+			case !ok || v == nil || (isArray && len(arr) == 0):
+				// A null field is kept as it is; an empty array is removed
+				if preserve {
+					if err := emit(doc, v, ok && v == nil, nil); err != nil {
+						return nil, err
+					}
+				}
+			case !isArray:
+				if err := emit(doc, v, true, nil); err != nil {
+					return nil, err
+				}
+			default:
+				for i, elem := range arr {
+					if err := emit(doc, elem, true, int64(i)); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		return out, nil
+	}, nil
+}
+
+// ----------------------------------------------------------------------------
+// $facet and $lookup
+// ----------------------------------------------------------------------------
+
+func (c *Collection) compileFacetStage(arg interface{}) (pipelineStage, error) {
+	spec, ok := asMap(arg)
+	if !ok || len(spec) == 0 {
+		return nil, errors.New("$facet needs a non-empty document")
+	}
+
+	facets := make(map[string][]pipelineStage, len(spec))
+	for name, v := range spec {
+		pipeline, err := toPipeline(v)
+		if err != nil {
+			return nil, fmt.Errorf("facet %q: %w", name, err)
+		}
+		for _, stage := range pipeline {
+			for stageName := range stage {
+				if stageName == "$facet" {
+					return nil, fmt.Errorf("facet %q: $facet cannot be nested", name)
+				}
+			}
+		}
+		stages, err := c.compilePipeline(pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("facet %q: %w", name, err)
+		}
+		facets[name] = stages
+	}
+
+	return func(ctx context.Context, docs []Document) ([]Document, error) {
+		result := Document{}
+		for name, stages := range facets {
+			out, err := runPipeline(ctx, stages, docs)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = embedDocuments(out)
+		}
+		return []Document{result}, nil
+	}, nil
+}
+
+// compileLookupStage compiles a $lookup, which joins each document with the
+// documents of another collection in the same database. The joined
+// documents are those whose foreignField equals the document's localField,
+// optionally run through a pipeline, or with only a pipeline, the output of
+// that pipeline over the whole collection. A single $in query reads the
+// foreign documents that match any local value, rather than the whole
+// foreign collection.
+func (c *Collection) compileLookupStage(arg interface{}) (pipelineStage, error) {
+	spec, ok := asMap(arg)
+	if !ok {
+		return nil, errors.New("$lookup needs a document")
+	}
+
+	var from, localField, foreignField, as string
+	var pipeline []pipelineStage
+	var pipelineSpec []M
+	hasPipeline := false
+	for k, v := range spec {
+		switch k {
+		case "from", "localField", "foreignField", "as":
+			s, ok := v.(string)
+			if !ok || s == "" {
+				return nil, fmt.Errorf("$lookup %s must be a non-empty string", k)
+			}
+			switch k {
+			case "from":
+				from = s
+			case "localField":
+				localField = s
+			case "foreignField":
+				foreignField = s
+			default:
+				as = s
+			}
+		case "pipeline":
+			p, err := toPipeline(v)
+			if err != nil {
+				return nil, err
+			}
+			stages, err := c.compilePipeline(p)
+			if err != nil {
+				return nil, err
+			}
+			pipeline, pipelineSpec, hasPipeline = stages, p, true
+		case "let":
+			return nil, errors.New("$lookup let variables are not supported")
+		default:
+			return nil, fmt.Errorf("unknown $lookup field: %s", k)
+		}
+	}
+	if from == "" || as == "" {
+		return nil, errors.New("$lookup needs from and as")
+	}
+	if (localField == "") != (foreignField == "") {
+		return nil, errors.New("$lookup needs both localField and foreignField")
+	}
+	if localField == "" && !hasPipeline {
+		return nil, errors.New("$lookup needs localField and foreignField, or a pipeline")
+	}
+	if err := checkUpdatePath(as); err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, docs []Document) ([]Document, error) {
+		foreign := c.sibling(from)
+
+		// Without a localField every document joins the same documents:
+		// the output of the pipeline over the whole foreign collection
+		if localField == "" {
+			cursor, err := foreign.AggregateContext(ctx, pipelineSpec)
+			if err != nil {
+				return nil, err
+			}
+			joined, err := cursor.All()
+			if err != nil {
+				return nil, err
+			}
+			out := make([]Document, len(docs))
+			for i, doc := range docs {
+				result := copyDocument(doc)
+				if err := setPath(result, as, embedDocuments(joined)); err != nil {
+					return nil, err
+				}
+				out[i] = Document(result)
+			}
+			return out, nil
+		}
+
+		// Otherwise read only the foreign documents that can match: one
+		// query for every local value in the batch
+		var locals []interface{}
+		for _, doc := range docs {
+			locals = append(locals, lookupValues(doc, localField)...)
+		}
+		var candidates []Document
+		if len(locals) > 0 {
+			cursor, err := foreign.FindContext(ctx, M{foreignField: M{"$in": locals}})
+			if err != nil {
+				return nil, err
+			}
+			if candidates, err = cursor.All(); err != nil {
+				return nil, err
+			}
+		}
+
+		out := make([]Document, len(docs))
+		for i, doc := range docs {
+			matched := lookupMatches(doc, localField, candidates, foreignField)
+			if hasPipeline {
+				var err error
+				if matched, err = runPipeline(ctx, pipeline, matched); err != nil {
+					return nil, err
+				}
+			}
+			result := copyDocument(doc)
+			if err := setPath(result, as, embedDocuments(matched)); err != nil {
+				return nil, err
+			}
+			out[i] = Document(result)
+		}
+		return out, nil
+	}, nil
+}
+
+// lookupMatches returns the foreign documents whose foreignField equals a
+// value of the document's localField. Arrays match element by element, and
+// a missing local field matches foreign documents where the field is null
+// or missing.
+func lookupMatches(doc Document, localField string, foreign []Document, foreignField string) []Document {
+	locals := lookupValues(doc, localField)
+	var matched []Document
+	for _, f := range foreign {
+		values := lookupPath(f, foreignField)
+		for _, local := range locals {
+			if matchesEqual(values, local) {
+				matched = append(matched, f)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// lookupValues returns the values of a document's localField that $lookup
+// joins on, with arrays expanded into their elements
+func lookupValues(doc Document, localField string) []interface{} {
+	var locals []interface{}
+	for _, pv := range lookupPath(doc, localField) {
+		if arr, ok := pv.value.([]interface{}); ok {
+			locals = append(locals, arr...)
+		} else {
+			locals = append(locals, pv.value)
+		}
+	}
+	return locals
+}
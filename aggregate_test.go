@@ -0,0 +1,218 @@
+package keradb
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	orders := client.Database().Collection("orders")
+	users := client.Database().Collection("users")
+	_, err := users.InsertMany([]interface{}{
+		M{"_id": "u1", "name": "Ann"},
+		M{"_id": "u2", "name": "Bob"},
+		M{"_id": "u3", "name": "Cy", "tags": []string{"b"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = orders.InsertMany([]interface{}{
+		M{"_id": "o1", "user": "u1", "amount": 10, "tags": []string{"a", "b"}, "st": "ok"},
+		M{"_id": "o2", "user": "u1", "amount": 30, "tags": []string{"b"}, "st": "ok"},
+		M{"_id": "o3", "user": "u2", "amount": 5, "tags": []string{}, "st": "ok"},
+		M{"_id": "o4", "user": "u2", "amount": 100, "st": "void"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		pipeline []M
+		want     string
+	}{
+		{
+			name:     "match sort skip limit",
+			pipeline: []M{{"$match": M{"st": "ok"}}, {"$sort": M{"amount": -1}}, {"$skip": 1}, {"$limit": 1}, {"$project": M{"amount": 1}}},
+			want:     `[{"_id":"o1","amount":10}]`,
+		},
+		{
+			name:     "several matches",
+			pipeline: []M{{"$match": M{"st": "ok"}}, {"$match": M{"amount": M{"$gt": 5}}}, {"$count": "n"}},
+			want:     `[{"n":2}]`,
+		},
+		{
+			name:     "limit before sort",
+			pipeline: []M{{"$limit": 2}, {"$sort": M{"amount": 1}}, {"$project": M{"_id": 1}}},
+			want:     `[{"_id":"o1"},{"_id":"o2"}]`,
+		},
+		{
+			name:     "match after group",
+			pipeline: []M{{"$group": M{"_id": "$user", "total": M{"$sum": "$amount"}}}, {"$match": M{"total": M{"$gt": 50}}}},
+			want:     `[{"_id":"u2","total":105}]`,
+		},
+		{
+			name: "group and accumulators",
+			pipeline: []M{
+				{"$match": M{"st": "ok"}},
+				{"$group": M{"_id": "$user", "total": M{"$sum": "$amount"}, "avg": M{"$avg": "$amount"},
+					"max": M{"$max": "$amount"}, "all": M{"$push": "$amount"}, "first": M{"$first": "$amount"}, "n": M{"$count": M{}}}},
+				{"$sort": M{"total": -1}},
+			},
+			want: `[{"_id":"u1","total":40,"avg":20,"max":30,"all":[10,30],"first":10,"n":2},
+				{"_id":"u2","total":5,"avg":5,"max":5,"all":[5],"first":5,"n":1}]`,
+		},
+		{
+			name: "lookup and unwind",
+			pipeline: []M{
+				{"$match": M{"st": "ok"}},
+				{"$lookup": M{"from": "users", "localField": "user", "foreignField": "_id", "as": "u"}},
+				{"$unwind": "$u"},
+				{"$project": M{"_id": 0, "name": "$u.name", "double": M{"$multiply": []interface{}{"$amount", 2}}}},
+			},
+			want: `[{"name":"Ann","double":20},{"name":"Ann","double":60},{"name":"Bob","double":10}]`,
+		},
+		{
+			name: "lookup on an array field",
+			pipeline: []M{
+				{"$match": M{"_id": "o1"}},
+				{"$lookup": M{"from": "users", "localField": "tags", "foreignField": "tags", "as": "u"}},
+				{"$project": M{"_id": 0, "u": 1}},
+			},
+			want: `[{"u":[{"_id":"u3","name":"Cy","tags":["b"]}]}]`,
+		},
+		{
+			name: "lookup without matches",
+			pipeline: []M{
+				{"$match": M{"_id": "o3"}},
+				{"$lookup": M{"from": "users", "localField": "tags", "foreignField": "_id", "as": "u"}},
+				{"$project": M{"_id": 0, "u": 1}},
+			},
+			want: `[{"u":[]}]`,
+		},
+		{
+			name: "lookup with only a pipeline",
+			pipeline: []M{
+				{"$match": M{"_id": "o4"}},
+				{"$lookup": M{"from": "users", "pipeline": []M{{"$match": M{"name": M{"$ne": "Ann"}}}, {"$count": "n"}}, "as": "u"}},
+				{"$project": M{"_id": 0, "u": 1}},
+			},
+			want: `[{"u":[{"n":2}]}]`,
+		},
+		{
+			name: "unwind and facet",
+			pipeline: []M{
+				{"$unwind": M{"path": "$tags", "includeArrayIndex": "idx", "preserveNullAndEmptyArrays": true}},
+				{"$facet": M{
+					"count": []M{{"$count": "n"}},
+					"byTag": []M{{"$match": M{"tags": M{"$exists": true}}}, {"$group": M{"_id": "$tags", "c": M{"$sum": 1}}}, {"$sort": M{"_id": 1}}},
+				}},
+			},
+			want: `[{"count":[{"n":5}],"byTag":[{"_id":"a","c":1},{"_id":"b","c":2}]}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := orders.Aggregate(tt.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs, err := cursor.All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := json.Marshal(docs)
+			if !reflect.DeepEqual(jsonValue(t, data), jsonValue(t, []byte(tt.want))) {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline []M
+	}{
+		{name: "unknown stage", pipeline: []M{{"$bogus": 1}}},
+		{name: "two stages in one document", pipeline: []M{{"$skip": 1, "$limit": 1}}},
+		{name: "group without _id", pipeline: []M{{"$group": M{"x": 1}}}},
+		{name: "invalid match", pipeline: []M{{"$match": M{"a": M{"$zz": 1}}}}},
+		{name: "invalid match after pushdown", pipeline: []M{{"$match": M{}}, {"$limit": 1}, {"$match": M{"a": M{"$zz": 1}}}}},
+		{name: "sort on several keys of an M", pipeline: []M{{"$sort": M{"a": 1, "b": 1}}}},
+		{name: "mixed projection", pipeline: []M{{"$project": M{"a": 1, "b": 0}}}},
+		{name: "zero limit", pipeline: []M{{"$limit": 0}}},
+		{name: "lookup let", pipeline: []M{{"$lookup": M{"from": "x", "let": M{}, "pipeline": []M{}, "as": "y"}}}},
+	}
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := coll.Aggregate(tt.pipeline); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAggregatePushdown(t *testing.T) {
+	engine := newScanCountingEngine()
+	db := newMemoryClient(t, engine).Database()
+	orders, users := db.Collection("orders"), db.Collection("users")
+	for i := 0; i < 200; i++ {
+		if _, err := users.InsertOne(M{"_id": fmt.Sprintf("u%03d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := orders.InsertOne(M{"user": fmt.Sprintf("u%03d", i), "i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := orders.Indexes().CreateOne(IndexModel{Keys: D{{Key: "i", Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		pipeline    []M
+		wantDocs    int
+		wantOrders  int // most order documents the scans may return
+		wantForeign int // most user documents the scans may return
+	}{
+		{name: "leading limit", pipeline: []M{{"$limit": 3}}, wantDocs: 3, wantOrders: 3},
+		{name: "indexed match", pipeline: []M{{"$match": M{"i": M{"$lt": 5}}}, {"$sort": M{"i": -1}}}, wantDocs: 5},
+		{name: "lookup reads matching ids", pipeline: []M{
+			{"$match": M{"i": 7}},
+			{"$lookup": M{"from": "users", "localField": "user", "foreignField": "_id", "as": "u"}},
+			{"$unwind": "$u"},
+		}, wantDocs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine.mu.Lock()
+			engine.scanned = map[string]int{}
+			engine.mu.Unlock()
+
+			cursor, err := orders.Aggregate(tt.pipeline)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs, err := cursor.All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != tt.wantDocs {
+				t.Errorf("got %d documents, want %d", len(docs), tt.wantDocs)
+			}
+			engine.mu.Lock()
+			defer engine.mu.Unlock()
+			if n := engine.scanned["orders"]; n > tt.wantOrders {
+				t.Errorf("scans read %d orders, want at most %d", n, tt.wantOrders)
+			}
+			if n := engine.scanned["users"]; n > tt.wantForeign {
+				t.Errorf("scans read %d users, want at most %d", n, tt.wantForeign)
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/keradb/golang-sdk/benchmark
 
-go 1.21
+go 1.23
 
 require (
 	github.com/keradb/golang-sdk v0.2.0
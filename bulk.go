@@ -0,0 +1,371 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ============================================================================
+// Bulk Write
+// ============================================================================
+
+// WriteModel is one write of a BulkWrite: an *InsertOneModel,
+// *UpdateOneModel, *UpdateManyModel, *ReplaceOneModel, *DeleteOneModel or
+// *DeleteManyModel. A model whose filter was never set fails rather than
+// match every document; set an empty filter such as M{} for that.
+type WriteModel interface {
+	writeModel()
+}
+
+// InsertOneModel inserts a document
+type InsertOneModel struct {
+	Document interface{}
+}
+
+// NewInsertOneModel creates an empty InsertOneModel
+func NewInsertOneModel() *InsertOneModel {
+	return &InsertOneModel{}
+}
+
+// SetDocument sets the document to insert
+func (m *InsertOneModel) SetDocument(doc interface{}) *InsertOneModel {
+	m.Document = doc
+	return m
+}
+
+// UpdateOneModel updates the first document matching a filter
+type UpdateOneModel struct {
+	Filter Filter
+	Update Update
+	Upsert *bool
+}
+
+// NewUpdateOneModel creates an empty UpdateOneModel
+func NewUpdateOneModel() *UpdateOneModel {
+	return &UpdateOneModel{}
+}
+
+// SetFilter sets the filter
+func (m *UpdateOneModel) SetFilter(filter Filter) *UpdateOneModel {
+	m.Filter = filter
+	return m
+}
+
+// SetUpdate sets the update document
+func (m *UpdateOneModel) SetUpdate(update Update) *UpdateOneModel {
+	m.Update = update
+	return m
+}
+
+// SetUpsert sets whether to insert a document when none matches
+func (m *UpdateOneModel) SetUpsert(upsert bool) *UpdateOneModel {
+	m.Upsert = &upsert
+	return m
+}
+
+// UpdateManyModel updates every document matching a filter
+type UpdateManyModel struct {
+	Filter Filter
+	Update Update
+	Upsert *bool
+}
+
+// NewUpdateManyModel creates an empty UpdateManyModel
+func NewUpdateManyModel() *UpdateManyModel {
+	return &UpdateManyModel{}
+}
+
+// SetFilter sets the filter
+func (m *UpdateManyModel) SetFilter(filter Filter) *UpdateManyModel {
+	m.Filter = filter
+	return m
+}
+
+// SetUpdate sets the update document
+func (m *UpdateManyModel) SetUpdate(update Update) *UpdateManyModel {
+	m.Update = update
+	return m
+}
+
+// SetUpsert sets whether to insert a document when none matches
+func (m *UpdateManyModel) SetUpsert(upsert bool) *UpdateManyModel {
+	m.Upsert = &upsert
+	return m
+}
+
+// ReplaceOneModel replaces the first document matching a filter
+type ReplaceOneModel struct {
+	Filter      Filter
+	Replacement interface{}
+	Upsert      *bool
+}
+
+// NewReplaceOneModel creates an empty ReplaceOneModel
+func NewReplaceOneModel() *ReplaceOneModel {
+	return &ReplaceOneModel{}
+}
+
+// SetFilter sets the filter
+func (m *ReplaceOneModel) SetFilter(filter Filter) *ReplaceOneModel {
+	m.Filter = filter
+	return m
+}
+
+// SetReplacement sets the replacement document
+func (m *ReplaceOneModel) SetReplacement(replacement interface{}) *ReplaceOneModel {
+	m.Replacement = replacement
+	return m
+}
+
+// SetUpsert sets whether to insert the replacement when nothing matches
+func (m *ReplaceOneModel) SetUpsert(upsert bool) *ReplaceOneModel {
+	m.Upsert = &upsert
+	return m
+}
+
+// DeleteOneModel deletes the first document matching a filter
+type DeleteOneModel struct {
+	Filter Filter
+}
+
+// NewDeleteOneModel creates an empty DeleteOneModel
+func NewDeleteOneModel() *DeleteOneModel {
+	return &DeleteOneModel{}
+}
+
+// SetFilter sets the filter
+func (m *DeleteOneModel) SetFilter(filter Filter) *DeleteOneModel {
+	m.Filter = filter
+	return m
+}
+
+// DeleteManyModel deletes every document matching a filter
+type DeleteManyModel struct {
+	Filter Filter
+}
+
+// NewDeleteManyModel creates an empty DeleteManyModel
+func NewDeleteManyModel() *DeleteManyModel {
+	return &DeleteManyModel{}
+}
+
+// SetFilter sets the filter
+func (m *DeleteManyModel) SetFilter(filter Filter) *DeleteManyModel {
+	m.Filter = filter
+	return m
+}
+
+func (*InsertOneModel) writeModel()  {}
+func (*UpdateOneModel) writeModel()  {}
+func (*UpdateManyModel) writeModel() {}
+func (*ReplaceOneModel) writeModel() {}
+func (*DeleteOneModel) writeModel()  {}
+func (*DeleteManyModel) writeModel() {}
+
+// ----------------------------------------------------------------------------
+// Results and Errors
+// ----------------------------------------------------------------------------
+
+// BulkWriteResult is the result of a BulkWrite. After a failure it counts
+// the writes that succeeded.
+type BulkWriteResult struct {
+	InsertedCount int64
+	MatchedCount  int64
+	ModifiedCount int64
+	DeletedCount  int64
+	UpsertedCount int64
+	// InsertedIDs maps the index of each InsertOneModel that succeeded to
+	// the _id of the document it inserted
+	InsertedIDs map[int64]string
+	// UpsertedIDs maps the index of each model that upserted to the _id of
+	// the document it inserted
+	UpsertedIDs map[int64]string
+}
+
+// BulkWriteError is the failure of one write of a BulkWrite
+type BulkWriteError struct {
+	// Index is the position of the model in the slice given to BulkWrite
+	Index int
+	// Err is why the write failed
+	Err error
+	// Request is the model that failed
+	Request WriteModel
+}
+
+func (e BulkWriteError) Error() string {
+	return fmt.Sprintf("write %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the cause, so that errors.Is and errors.As see it
+func (e BulkWriteError) Unwrap() error {
+	return e.Err
+}
+
+// BulkWriteException is returned by BulkWrite and InsertMany when writes
+// failed. The writes that succeeded are counted in Result.
+type BulkWriteException struct {
+	// WriteErrors lists the failed writes in model order
+	WriteErrors []BulkWriteError
+	// Result counts the writes that succeeded
+	Result *BulkWriteResult
+}
+
+func (e *BulkWriteException) Error() string {
+	msgs := make([]string, len(e.WriteErrors))
+	for i, we := range e.WriteErrors {
+		msgs[i] = we.Error()
+	}
+	return "bulk write failed: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the write errors, so that errors.Is and errors.As match
+// any of them, as in errors.Is(err, ErrDuplicateKey)
+func (e *BulkWriteException) Unwrap() []error {
+	errs := make([]error, len(e.WriteErrors))
+	for i, we := range e.WriteErrors {
+		errs[i] = we
+	}
+	return errs
+}
+
+// ----------------------------------------------------------------------------
+// BulkWrite
+// ----------------------------------------------------------------------------
+
+// BulkWrite runs a list of writes
+func (c *Collection) BulkWrite(models []WriteModel, opts ...*BulkWriteOptions) (*BulkWriteResult, error) {
+	return c.BulkWriteContext(context.Background(), models, opts...)
+}
+
+// BulkWriteContext runs a list of writes in order. An ordered bulk write,
+// the default, stops at the first failed write; an unordered one attempts
+// every write. Either way, failed writes are reported in a
+// *BulkWriteException, and the result counts the writes that succeeded. If
+// ctx is done, the writes stop and the context error is returned with the
+// counts so far.
+//
+// Each write is atomic on its own, as if made by the matching Collection
+// method; the bulk write as a whole is not. Run it inside a transaction to
+// apply all writes or none.
+func (c *Collection) BulkWriteContext(ctx context.Context, models []WriteModel, opts ...*BulkWriteOptions) (*BulkWriteResult, error) {
+	c = c.forContext(ctx)
+
+	if len(models) == 0 {
+		return nil, errors.New("bulk write needs at least one model")
+	}
+	options := mergeBulkWriteOptions(opts...)
+	ordered := options.Ordered == nil || *options.Ordered
+
+	result := &BulkWriteResult{
+		InsertedIDs: map[int64]string{},
+		UpsertedIDs: map[int64]string{},
+	}
+	var writeErrors []BulkWriteError
+	for i, model := range models {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if err := c.runWriteModel(ctx, int64(i), model, result); err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return result, err
+			}
+			writeErrors = append(writeErrors, BulkWriteError{Index: i, Err: err, Request: model})
+			if ordered {
+				break
+			}
+		}
+	}
+
+	if len(writeErrors) > 0 {
+		return result, &BulkWriteException{WriteErrors: writeErrors, Result: result}
+	}
+	return result, nil
+}
+
+// runWriteModel makes one write of a bulk write and adds its counts to
+// result, including those of a many-document write that failed part way
+func (c *Collection) runWriteModel(ctx context.Context, index int64, model WriteModel, result *BulkWriteResult) error {
+	if model == nil || reflect.ValueOf(model).IsNil() {
+		return errors.New("write model is nil")
+	}
+	var updated *UpdateResult
+	var err error
+	switch m := model.(type) {
+	case *InsertOneModel:
+		if m.Document == nil {
+			return errors.New("InsertOneModel needs a document")
+		}
+		inserted, err := c.InsertOneContext(ctx, m.Document)
+		if err != nil {
+			return err
+		}
+		result.InsertedCount++
+		result.InsertedIDs[index] = inserted.InsertedID
+		c.finalID(inserted.InsertedID, func(id string) { result.InsertedIDs[index] = id })
+		return nil
+
+	case *UpdateOneModel:
+		if m.Filter == nil {
+			return errors.New("UpdateOneModel needs a filter")
+		}
+		if m.Update == nil {
+			return errors.New("UpdateOneModel needs an update")
+		}
+		updated, err = c.UpdateOneContext(ctx, m.Filter, m.Update, &UpdateOptions{Upsert: m.Upsert})
+
+	case *UpdateManyModel:
+		if m.Filter == nil {
+			return errors.New("UpdateManyModel needs a filter")
+		}
+		if m.Update == nil {
+			return errors.New("UpdateManyModel needs an update")
+		}
+		updated, err = c.UpdateManyContext(ctx, m.Filter, m.Update, &UpdateOptions{Upsert: m.Upsert})
+
+	case *ReplaceOneModel:
+		if m.Filter == nil {
+			return errors.New("ReplaceOneModel needs a filter")
+		}
+		if m.Replacement == nil {
+			return errors.New("ReplaceOneModel needs a replacement")
+		}
+		updated, err = c.ReplaceOneContext(ctx, m.Filter, m.Replacement, &ReplaceOptions{Upsert: m.Upsert})
+
+	case *DeleteOneModel:
+		if m.Filter == nil {
+			return errors.New("DeleteOneModel needs a filter")
+		}
+		deleted, err := c.DeleteOneContext(ctx, m.Filter)
+		if deleted != nil {
+			result.DeletedCount += deleted.DeletedCount
+		}
+		return err
+
+	case *DeleteManyModel:
+		if m.Filter == nil {
+			return errors.New("DeleteManyModel needs a filter")
+		}
+		deleted, err := c.DeleteManyContext(ctx, m.Filter)
+		if deleted != nil {
+			result.DeletedCount += deleted.DeletedCount
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unsupported write model %T", model)
+	}
+
+	if updated != nil {
+		result.MatchedCount += updated.MatchedCount
+		result.ModifiedCount += updated.ModifiedCount
+		result.UpsertedCount += updated.UpsertedCount
+		if updated.UpsertedCount > 0 {
+			result.UpsertedIDs[index] = updated.UpsertedID
+			c.finalID(updated.UpsertedID, func(id string) { result.UpsertedIDs[index] = id })
+		}
+	}
+	return err
+}
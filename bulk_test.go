@@ -0,0 +1,228 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestBulkWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		models    []WriteModel
+		unordered bool
+		want      BulkWriteResult
+		wantErrs  []int // indexes of the failed writes
+		wantIDs   []string
+	}{
+		{
+			name: "every model",
+			models: []WriteModel{
+				NewInsertOneModel().SetDocument(M{"_id": "d", "n": 4}),
+				NewUpdateOneModel().SetFilter(M{"_id": "a"}).SetUpdate(M{"$set": M{"n": 10}}),
+				NewUpdateManyModel().SetFilter(M{"n": M{"$gte": 3}}).SetUpdate(M{"$set": M{"big": true}}),
+				NewReplaceOneModel().SetFilter(M{"_id": "b"}).SetReplacement(M{"n": 20}),
+				NewDeleteOneModel().SetFilter(M{"_id": "c"}),
+				NewDeleteManyModel().SetFilter(M{"big": true}),
+			},
+			want: BulkWriteResult{InsertedCount: 1, MatchedCount: 5, ModifiedCount: 5, DeletedCount: 3,
+				InsertedIDs: map[int64]string{0: "d"}, UpsertedIDs: map[int64]string{}},
+			wantIDs: []string{"b"},
+		},
+		{
+			name: "upserts",
+			models: []WriteModel{
+				NewUpdateOneModel().SetFilter(M{"_id": "x"}).SetUpdate(M{"$set": M{"n": 1}}).SetUpsert(true),
+				NewReplaceOneModel().SetFilter(M{"_id": "y"}).SetReplacement(M{"n": 2}).SetUpsert(true),
+				NewUpdateManyModel().SetFilter(M{"_id": "a"}).SetUpdate(M{"$set": M{"n": 5}}).SetUpsert(true),
+			},
+			want: BulkWriteResult{MatchedCount: 1, ModifiedCount: 1, UpsertedCount: 2,
+				InsertedIDs: map[int64]string{}, UpsertedIDs: map[int64]string{0: "x", 1: "y"}},
+			wantIDs: []string{"a", "b", "c", "x", "y"},
+		},
+		{
+			name: "ordered stops at the first failure",
+			models: []WriteModel{
+				NewInsertOneModel().SetDocument(M{"_id": "x"}),
+				NewInsertOneModel().SetDocument(M{"_id": "a"}),
+				NewInsertOneModel().SetDocument(M{"_id": "y"}),
+			},
+			want:     BulkWriteResult{InsertedCount: 1, InsertedIDs: map[int64]string{0: "x"}, UpsertedIDs: map[int64]string{}},
+			wantErrs: []int{1},
+			wantIDs:  []string{"a", "b", "c", "x"},
+		},
+		{
+			name: "unordered attempts every write",
+			models: []WriteModel{
+				NewInsertOneModel().SetDocument(M{"_id": "x"}),
+				NewInsertOneModel().SetDocument(M{"_id": "a"}),
+				NewInsertOneModel().SetDocument(M{"_id": "y"}),
+			},
+			unordered: true,
+			want:      BulkWriteResult{InsertedCount: 2, InsertedIDs: map[int64]string{0: "x", 2: "y"}, UpsertedIDs: map[int64]string{}},
+			wantErrs:  []int{1},
+			wantIDs:   []string{"a", "b", "c", "x", "y"},
+		},
+		{
+			name: "unordered reports every failure",
+			models: []WriteModel{
+				NewUpdateOneModel().SetFilter(M{"_id": "a"}),
+				NewDeleteOneModel().SetFilter(M{"_id": "a"}),
+				NewInsertOneModel().SetDocument(M{"_id": "b"}),
+				NewInsertOneModel(),
+				NewDeleteManyModel().SetFilter(M{"n": M{"$gt": 1}}),
+			},
+			unordered: true,
+			want:      BulkWriteResult{DeletedCount: 3, InsertedIDs: map[int64]string{}, UpsertedIDs: map[int64]string{}},
+			wantErrs:  []int{0, 2, 3},
+			wantIDs:   []string{},
+		},
+		{
+			name: "unset filters are rejected",
+			models: []WriteModel{
+				NewDeleteManyModel(),
+				NewDeleteOneModel(),
+				NewUpdateManyModel().SetUpdate(M{"$set": M{"n": 0}}),
+				NewUpdateOneModel().SetUpdate(M{"$set": M{"n": 0}}),
+				NewReplaceOneModel().SetReplacement(M{"n": 0}),
+			},
+			unordered: true,
+			want:      BulkWriteResult{InsertedIDs: map[int64]string{}, UpsertedIDs: map[int64]string{}},
+			wantErrs:  []int{0, 1, 2, 3, 4},
+			wantIDs:   []string{"a", "b", "c"},
+		},
+		{
+			name: "nil models",
+			models: []WriteModel{
+				(*InsertOneModel)(nil),
+				nil,
+				(*DeleteManyModel)(nil),
+				NewDeleteOneModel().SetFilter(M{"_id": "a"}),
+			},
+			unordered: true,
+			want:      BulkWriteResult{DeletedCount: 1, InsertedIDs: map[int64]string{}, UpsertedIDs: map[int64]string{}},
+			wantErrs:  []int{0, 1, 2},
+			wantIDs:   []string{"b", "c"},
+		},
+		{
+			name: "updates without operators",
+			models: []WriteModel{
+				NewUpdateOneModel().SetFilter(M{"_id": "a"}).SetUpdate(M{}),
+				NewUpdateManyModel().SetFilter(M{}).SetUpdate(M{"n": 0}),
+			},
+			unordered: true,
+			want:      BulkWriteResult{InsertedIDs: map[int64]string{}, UpsertedIDs: map[int64]string{}},
+			wantErrs:  []int{0, 1},
+			wantIDs:   []string{"a", "b", "c"},
+		},
+		{
+			name: "no match",
+			models: []WriteModel{
+				NewUpdateOneModel().SetFilter(M{"_id": "zz"}).SetUpdate(M{"$set": M{"n": 1}}),
+				NewDeleteManyModel().SetFilter(M{"n": 99}),
+			},
+			want:    BulkWriteResult{InsertedIDs: map[int64]string{}, UpsertedIDs: map[int64]string{}},
+			wantIDs: []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := NewMemoryEngine()
+			coll := newMemoryClient(t, engine).Database().Collection("c")
+			if _, err := coll.InsertMany([]interface{}{M{"_id": "a", "n": 1}, M{"_id": "b", "n": 2}, M{"_id": "c", "n": 3}}); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := coll.BulkWrite(tt.models, NewBulkWriteOptions().SetOrdered(!tt.unordered))
+			if !reflect.DeepEqual(*res, tt.want) {
+				t.Errorf("result %+v, want %+v", *res, tt.want)
+			}
+
+			var bulkErr *BulkWriteException
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if !errors.As(err, &bulkErr) {
+				t.Fatalf("got %v, want a BulkWriteException", err)
+			} else {
+				var got []int
+				for _, we := range bulkErr.WriteErrors {
+					got = append(got, we.Index)
+					if we.Request != tt.models[we.Index] {
+						t.Errorf("write %d reports model %v", we.Index, we.Request)
+					}
+				}
+				if !reflect.DeepEqual(got, tt.wantErrs) {
+					t.Errorf("failed writes %v, want %v", got, tt.wantErrs)
+				}
+				if bulkErr.Result != res {
+					t.Error("the exception does not carry the result")
+				}
+			}
+
+			data, err := engine.FindAll("c", -1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := storedIDs(t, data)
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("stored %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestBulkWriteErrors(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	if _, err := coll.InsertOne(M{"_id": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		run    func() error
+		want   error
+		wantEx bool
+	}{
+		{name: "no models", run: func() error {
+			_, err := coll.BulkWrite(nil)
+			return err
+		}},
+		{name: "duplicate key", run: func() error {
+			_, err := coll.BulkWrite([]WriteModel{NewInsertOneModel().SetDocument(M{"_id": "a"})})
+			return err
+		}, want: ErrDuplicateKey, wantEx: true},
+		{name: "InsertMany duplicate key", run: func() error {
+			_, err := coll.InsertMany([]interface{}{M{"_id": "b"}, M{"_id": "a"}})
+			return err
+		}, want: ErrDuplicateKey, wantEx: true},
+		{name: "canceled context", run: func() error {
+			_, err := coll.BulkWriteContext(canceled, []WriteModel{NewInsertOneModel().SetDocument(M{"_id": "z"})})
+			return err
+		}, want: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			var bulkErr *BulkWriteException
+			if errors.As(err, &bulkErr) != tt.wantEx {
+				t.Errorf("got %v: BulkWriteException = %v, want %v", err, !tt.wantEx, tt.wantEx)
+			}
+		})
+	}
+	if n, err := coll.CountDocuments(M{"_id": "z"}); err != nil || n != 0 {
+		t.Errorf("canceled bulk write stored %d documents, %v", n, err)
+	}
+}
@@ -0,0 +1,556 @@
+package keradb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Change Streams
+// ============================================================================
+
+// Every write made through a Collection, and every committed transaction,
+// records one event per document in the change log, a capped collection
+// kept in the database next to the documents. A ChangeStream reads events
+// from the log as they are added. Because the log is stored, a resume token
+// stays valid across restarts for as long as its event is among the most
+// recent ChangeLogSize events.
+//
+// The log is on by default and keeps defaultChangeLogSize events. While it
+// is on, every write also inserts its event into the log, and deletes the
+// oldest event once the log is full, and the retained events are held in
+// memory; ClientOptions.SetChangeLogSize(0) turns it off.
+//
+// An event is logged right after its write. A write whose event cannot be
+// logged still succeeds; its number is left out of the log instead, and a
+// stream that reaches the gap fails with ErrChangeHistoryLost rather than
+// pass over the change. If the process stops between a write and its
+// event, the event is lost without a trace.
+//
+// Each stored event carries its resume token in a "seq" field, so the log
+// does not depend on the engine keeping the _id it is given. Clients sharing
+// a database number their events from the same log: a Client whose number
+// is taken reloads the log and takes the next one. Otherwise a Client reads
+// the stored log only once, when it first needs it, so its streams see the
+// events logged through it and not, as they happen, those of other Clients;
+// a stream opened on a new Client with SetResumeAfter picks those up.
+
+// changeCollection holds the change log
+const changeCollection = reservedPrefix + "changes"
+
+// defaultChangeLogSize is the number of events kept when
+// ClientOptions.ChangeLogSize is not set
+const defaultChangeLogSize = 10000
+
+// maxChangeLogAttempts bounds how often record takes a new number for an
+// event whose number another Client has used
+const maxChangeLogAttempts = 5
+
+// ResumeToken identifies an event of a change stream. It is the _id of the
+// event and can be stored and passed to SetResumeAfter to continue a stream
+// after that event.
+type ResumeToken string
+
+func tokenFor(seq uint64) ResumeToken {
+	return ResumeToken(fmt.Sprintf("%016x", seq))
+}
+
+func (t ResumeToken) seq() (uint64, error) {
+	seq, err := strconv.ParseUint(string(t), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resume token %q", string(t))
+	}
+	return seq, nil
+}
+
+// ChangeEvent is a change stream event, ready to be decoded into with
+// ChangeStream.Decode
+type ChangeEvent struct {
+	// ID is the resume token of the event
+	ID ResumeToken `json:"_id"`
+	// OperationType is "insert", "update", "replace" or "delete"
+	OperationType string `json:"operationType"`
+	// ClusterTime is when the change was logged
+	ClusterTime time.Time `json:"clusterTime"`
+	// Namespace names the collection changed
+	Namespace ChangeNamespace `json:"ns"`
+	// DocumentKey holds the _id of the document changed
+	DocumentKey Document `json:"documentKey"`
+	// FullDocument is the document after an insert or replace, and after an
+	// update if the stream asked for it
+	FullDocument Document `json:"fullDocument,omitempty"`
+	// UpdateDescription lists the fields an update changed
+	UpdateDescription *UpdateDescription `json:"updateDescription,omitempty"`
+}
+
+// ChangeNamespace names the collection of a change event
+type ChangeNamespace struct {
+	Coll string `json:"coll"`
+}
+
+// UpdateDescription lists the top-level fields an update set or removed
+type UpdateDescription struct {
+	UpdatedFields Document `json:"updatedFields"`
+	RemovedFields []string `json:"removedFields"`
+}
+
+// ----------------------------------------------------------------------------
+// Change Log
+// ----------------------------------------------------------------------------
+
+// changeLog appends events to changeCollection and keeps the retained ones
+// in memory for the streams reading them. Events are numbered from 1 in the
+// order they are logged. A nil *changeLog records nothing.
+type changeLog struct {
+	engine Engine
+	size   int
+
+	mu      sync.Mutex
+	loaded  bool
+	closed  bool
+	entries []changeEntry // retained events, oldest first
+	last    uint64        // number of the newest event
+	wake    chan struct{} // closed and replaced when an event is added
+}
+
+// changeEntry is a logged event as stored
+type changeEntry struct {
+	seq        uint64
+	id         string // _id the engine stored the event under
+	collection string
+	data       []byte
+}
+
+func newChangeLog(engine Engine, size int) *changeLog {
+	return &changeLog{engine: engine, size: size, wake: make(chan struct{})}
+}
+
+// load reads the stored log once. The caller holds l.mu.
+func (l *changeLog) load() error {
+	if l.loaded {
+		return nil
+	}
+	data, err := l.engine.FindAll(changeCollection, -1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to load change log: %w", err)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to load change log: %w", err)
+	}
+
+	entries := make([]changeEntry, 0, len(raw))
+	for _, r := range raw {
+		var head struct {
+			ID  string      `json:"_id"`
+			Seq ResumeToken `json:"seq"`
+			NS  struct {
+				Coll string `json:"coll"`
+			} `json:"ns"`
+		}
+		if err := json.Unmarshal(r, &head); err != nil {
+			return fmt.Errorf("failed to load change log: %w", err)
+		}
+		if head.Seq == "" {
+			// Logged before events carried their number
+			head.Seq = ResumeToken(head.ID)
+		}
+		seq, err := head.Seq.seq()
+		if err != nil {
+			return fmt.Errorf("failed to load change log: %w", err)
+		}
+		entries = append(entries, changeEntry{seq: seq, id: head.ID, collection: head.NS.Coll, data: r})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+
+	l.entries = entries
+	if len(entries) > 0 {
+		l.last = max(l.last, entries[len(entries)-1].seq)
+	}
+	l.loaded = true
+	l.trim()
+	return nil
+}
+
+// trim drops the oldest events beyond the log size. An event the engine
+// fails to delete is kept, to be dropped by a later trim. The caller holds
+// l.mu.
+func (l *changeLog) trim() {
+	for len(l.entries) > l.size {
+		if _, err := l.engine.Delete(changeCollection, l.entries[0].id); err != nil {
+			return
+		}
+		l.entries = l.entries[1:]
+	}
+}
+
+// record logs a change to the document id. before and after are the
+// document's versions; nil for an insert or a delete. A change that cannot
+// be logged leaves a gap in the log.
+func (l *changeLog) record(collection, op, id string, before, after Document) {
+	if l == nil {
+		return
+	}
+	event := D{
+		{Key: "operationType", Value: op},
+		{Key: "clusterTime", Value: time.Now().UTC()},
+		{Key: "ns", Value: D{{Key: "coll", Value: collection}}},
+		{Key: "documentKey", Value: D{{Key: "_id", Value: id}}},
+	}
+	if after != nil {
+		event = append(event, E{Key: "fullDocument", Value: after})
+	}
+	if op == "update" {
+		event = append(event, E{Key: "updateDescription", Value: describeUpdate(before, after)})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.load() != nil {
+		// The write raced Close, or the log is unreadable and so has no
+		// number to give; streams of this Client fail the same way
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		seq := l.last + 1
+		token := string(tokenFor(seq))
+		data, err := marshalStored(append(D{{Key: "_id", Value: token}, {Key: "seq", Value: token}}, event...))
+		if err != nil {
+			l.lose(seq)
+			return
+		}
+		stored, err := l.engine.Insert(changeCollection, data)
+		if err != nil && attempt < maxChangeLogAttempts && l.taken(err, token) {
+			// Another Client logged an event under this number
+			l.loaded = false
+			if l.load() != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			l.lose(seq)
+			return
+		}
+		l.last = seq
+		l.entries = append(l.entries, changeEntry{seq: seq, id: stored, collection: collection, data: data})
+		l.wakeStreams()
+		l.trim()
+		return
+	}
+}
+
+// taken reports whether logging the event numbered token failed with err
+// because another Client has logged an event under that number. An engine
+// that does not report the clash as ErrDuplicateKey is asked whether the
+// number is stored. The caller holds l.mu.
+func (l *changeLog) taken(err error, token string) bool {
+	if errors.Is(err, ErrDuplicateKey) {
+		return true
+	}
+	doc, err := l.engine.FindByID(changeCollection, token)
+	return err == nil && doc != nil
+}
+
+// lose gives up on the event numbered seq, leaving a gap in the log. The
+// caller holds l.mu.
+func (l *changeLog) lose(seq uint64) {
+	l.last = seq
+	l.wakeStreams()
+}
+
+// wakeStreams wakes the streams waiting for an event. The caller holds
+// l.mu.
+func (l *changeLog) wakeStreams() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// skip leaves a gap for a change that cannot be logged, such as one whose
+// document cannot be decoded
+func (l *changeLog) skip() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed && l.load() == nil {
+		l.lose(l.last + 1)
+	}
+}
+
+// position returns the number of the newest event
+func (l *changeLog) position() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.load(); err != nil {
+		return 0, err
+	}
+	return l.last, nil
+}
+
+// since returns the events after seq, and a channel that is closed when
+// another is added
+func (l *changeLog) since(seq uint64) ([]changeEntry, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, nil, ErrClosed
+	}
+	if err := l.load(); err != nil {
+		return nil, nil, err
+	}
+	if seq > l.last {
+		return nil, nil, fmt.Errorf("%w: resume token %s is newer than the change log", ErrChangeHistoryLost, tokenFor(seq))
+	}
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].seq > seq })
+	if seq < l.last && (i == len(l.entries) || l.entries[i].seq != seq+1) {
+		return nil, nil, fmt.Errorf("%w: the event after resume token %s has been dropped", ErrChangeHistoryLost, tokenFor(seq))
+	}
+	return l.entries[i:len(l.entries):len(l.entries)], l.wake, nil
+}
+
+// close wakes the streams waiting for events, which then fail with
+// ErrClosed
+func (l *changeLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.wake)
+	}
+}
+
+// describeUpdate lists the top-level fields that differ between two
+// versions of a document
+func describeUpdate(before, after Document) D {
+	updated := M{}
+	removed := []string{}
+	for k, v := range after {
+		if old, ok := before[k]; k != "_id" && (!ok || !valuesEqual(old, v)) {
+			updated[k] = v
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	return D{{Key: "updatedFields", Value: updated}, {Key: "removedFields", Value: removed}}
+}
+
+// recordChange logs a write to the document id for change streams
+func (c *Collection) recordChange(op, id string, before, after Document) {
+	c.changes.record(c.name, op, id, before, after)
+}
+
+// ----------------------------------------------------------------------------
+// ChangeStream
+// ----------------------------------------------------------------------------
+
+// changeStreamStages are the pipeline stages a change stream accepts; each
+// works on one event at a time
+var changeStreamStages = map[string]bool{"$match": true, "$project": true, "$addFields": true}
+
+// ChangeStream iterates over change events. Next, TryNext and Decode must
+// be called from one goroutine; Close may be called from any.
+type ChangeStream struct {
+	log          *changeLog
+	collection   string // empty to watch every collection
+	pipeline     []pipelineStage
+	fullDocument FullDocument
+	registry     *Registry
+	useNumber    bool
+
+	position  uint64 // number of the last event read
+	current   Document
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Watch returns a stream of the changes to the collection. The pipeline
+// may hold $match, $project and $addFields stages, which are applied to
+// each event. The stream starts with the next change, or after the event
+// given by SetResumeAfter. It follows the writes made through this Client;
+// writes through other Clients of the database are not seen as they happen.
+func (c *Collection) Watch(ctx context.Context, pipeline interface{}, opts ...*ChangeStreamOptions) (*ChangeStream, error) {
+	return newChangeStream(ctx, c.changes, c.name, c.registry, c.useNumber, pipeline, opts)
+}
+
+// Watch returns a stream of the changes to every collection of the
+// database. See Collection.Watch.
+func (d *Database) Watch(ctx context.Context, pipeline interface{}, opts ...*ChangeStreamOptions) (*ChangeStream, error) {
+	return newChangeStream(ctx, d.changes, "", d.registry, d.useNumber, pipeline, opts)
+}
+
+func newChangeStream(ctx context.Context, log *changeLog, collection string, registry *Registry, useNumber bool, pipeline interface{}, opts []*ChangeStreamOptions) (*ChangeStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if log == nil {
+		return nil, errors.New("change streams are turned off for this client; see ClientOptions.SetChangeLogSize")
+	}
+
+	stages, err := toPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	for i, stage := range stages {
+		for name := range stage {
+			if !changeStreamStages[name] {
+				return nil, fmt.Errorf("pipeline stage %d: %s is not allowed in a change stream", i, name)
+			}
+		}
+	}
+	compiled, err := (&Collection{registry: registry}).compilePipeline(stages)
+	if err != nil {
+		return nil, err
+	}
+
+	options := mergeChangeStreamOptions(opts...)
+	cs := &ChangeStream{
+		log:          log,
+		collection:   collection,
+		pipeline:     compiled,
+		fullDocument: FullDocumentDefault,
+		registry:     registry,
+		useNumber:    useNumber,
+		done:         make(chan struct{}),
+	}
+	if options.FullDocument != nil {
+		cs.fullDocument = *options.FullDocument
+	}
+	if options.ResumeAfter != nil {
+		if cs.position, err = options.ResumeAfter.seq(); err != nil {
+			return nil, err
+		}
+		if _, _, err := log.since(cs.position); err != nil {
+			return nil, err
+		}
+	} else if cs.position, err = log.position(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Next waits for the next event and makes it current. It returns false if
+// ctx is done, the stream or client is closed, or an error occurred; Err
+// tells which.
+func (cs *ChangeStream) Next(ctx context.Context) bool {
+	return cs.next(ctx, true)
+}
+
+// TryNext is like Next but does not wait: it returns false at once if no
+// event is available, leaving Err nil.
+func (cs *ChangeStream) TryNext(ctx context.Context) bool {
+	return cs.next(ctx, false)
+}
+
+func (cs *ChangeStream) next(ctx context.Context, wait bool) bool {
+	cs.current = nil
+	for cs.err == nil {
+		select {
+		case <-cs.done:
+			return false
+		default:
+		}
+		if err := ctx.Err(); err != nil {
+			cs.err = err
+			return false
+		}
+
+		entries, wake, err := cs.log.since(cs.position)
+		if err != nil {
+			cs.err = err
+			return false
+		}
+		for _, e := range entries {
+			if e.seq != cs.position+1 {
+				cs.err = fmt.Errorf("%w: the event after resume token %s was not logged", ErrChangeHistoryLost, tokenFor(cs.position))
+				return false
+			}
+			event, err := cs.deliver(ctx, e)
+			if err != nil {
+				cs.err = err
+				return false
+			}
+			cs.position = e.seq
+			if event != nil {
+				cs.current = event
+				return true
+			}
+		}
+
+		if !wait {
+			return false
+		}
+		select {
+		case <-wake:
+		case <-cs.done:
+		case <-ctx.Done():
+		}
+	}
+	return false
+}
+
+// deliver turns a logged event into the event the stream returns, or nil
+// if the stream skips it
+func (cs *ChangeStream) deliver(ctx context.Context, e changeEntry) (Document, error) {
+	if cs.collection != "" && e.collection != cs.collection {
+		return nil, nil
+	}
+	event, err := unmarshalDocument(e.data, cs.useNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode change event: %w", err)
+	}
+	event["_id"] = string(tokenFor(e.seq))
+	delete(event, "seq")
+	if event["operationType"] == "update" && cs.fullDocument != FullDocumentUpdateLookup {
+		delete(event, "fullDocument")
+	}
+	if len(cs.pipeline) == 0 {
+		return event, nil
+	}
+	out, err := runPipeline(ctx, cs.pipeline, []Document{event})
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+// Decode decodes the current event into v, such as a *ChangeEvent
+func (cs *ChangeStream) Decode(v interface{}) error {
+	if cs.current == nil {
+		return errors.New("change stream has no current event")
+	}
+	return cs.registry.decodeDocument(cs.current, v)
+}
+
+// ResumeToken returns the token to resume the stream from where it is: the
+// token of the current event, or of the last event passed over
+func (cs *ChangeStream) ResumeToken() ResumeToken {
+	return tokenFor(cs.position)
+}
+
+// Err returns the error that stopped the stream, if any
+func (cs *ChangeStream) Err() error {
+	return cs.err
+}
+
+// Close stops the stream. A Next waiting for an event returns false.
+func (cs *ChangeStream) Close(ctx context.Context) error {
+	cs.closeOnce.Do(func() { close(cs.done) })
+	return nil
+}
@@ -0,0 +1,519 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// changeFailingEngine fails inserts into the change log while failing is set
+type changeFailingEngine struct {
+	*MemoryEngine
+	mu      sync.Mutex
+	failing bool
+}
+
+func (e *changeFailingEngine) setFailing(failing bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failing = failing
+}
+
+func (e *changeFailingEngine) Insert(collection string, doc []byte) (string, error) {
+	e.mu.Lock()
+	failing := e.failing
+	e.mu.Unlock()
+	if failing && collection == changeCollection {
+		return "", errEngineFailed
+	}
+	return e.MemoryEngine.Insert(collection, doc)
+}
+
+// changeIDEngine chooses its own _id for change log events and, like
+// sharedEngine, stays open when a Client closes
+type changeIDEngine struct{ *MemoryEngine }
+
+func (e changeIDEngine) Insert(collection string, doc []byte) (string, error) {
+	if collection == changeCollection {
+		return idReplacingEngine{e.MemoryEngine}.Insert(collection, doc)
+	}
+	return e.MemoryEngine.Insert(collection, doc)
+}
+
+func (changeIDEngine) Close() error { return nil }
+
+func newChangeClient(t *testing.T, engine Engine, size int) *Client {
+	t.Helper()
+	client, err := Connect("memory.ndb", NewClientOptions().SetEngine(engine).SetChangeLogSize(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// drain returns the events available on the stream without waiting
+func drain(t *testing.T, cs *ChangeStream) []ChangeEvent {
+	t.Helper()
+	events := []ChangeEvent{}
+	for cs.TryNext(context.Background()) {
+		var event ChangeEvent
+		if err := cs.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func eventKeys(events []ChangeEvent) []string {
+	keys := []string{}
+	for _, e := range events {
+		keys = append(keys, e.OperationType+" "+e.Namespace.Coll+"/"+e.DocumentKey["_id"].(string))
+	}
+	return keys
+}
+
+func TestChangeLogSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *ClientOptions
+		wantOff bool
+	}{
+		{name: "on by default", opts: NewClientOptions()},
+		{name: "turned off", opts: NewClientOptions().SetChangeLogSize(0), wantOff: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := Connect("memory.ndb", tt.opts.SetEngine(NewMemoryEngine()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			db := client.Database()
+			coll := db.Collection("c")
+
+			cs, err := coll.Watch(context.Background(), nil)
+			if tt.wantOff {
+				if err == nil {
+					t.Fatal("Watch succeeded without a change log")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				defer cs.Close(context.Background())
+			}
+			if _, err := coll.InsertOne(M{"_id": "a"}); err != nil {
+				t.Fatal(err)
+			}
+			if cs != nil {
+				if got := eventKeys(drain(t, cs)); !reflect.DeepEqual(got, []string{"insert c/a"}) {
+					t.Errorf("events %v, want [insert c/a]", got)
+				}
+			}
+
+			// The log is hidden from the collection list
+			names, err := db.ListCollectionNames()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, []string{"c"}) {
+				t.Errorf("ListCollectionNames = %v, want [c]", names)
+			}
+		})
+	}
+}
+
+func TestChangeStreamEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		watch    func(db *Database) (*ChangeStream, error)
+		write    func(ctx context.Context, db *Database) error
+		want     []string
+		wantFull bool
+	}{
+		{
+			name:  "insert",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Collection("c").Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				_, err := db.Collection("c").InsertOne(M{"_id": "b", "n": 1})
+				return err
+			},
+			want:     []string{"insert c/b"},
+			wantFull: true,
+		},
+		{
+			name:  "update",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Collection("c").Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				_, err := db.Collection("c").UpdateOne(M{"_id": "a"}, M{"$set": M{"n": 2}})
+				return err
+			},
+			want: []string{"update c/a"},
+		},
+		{
+			name: "update with full document",
+			watch: func(db *Database) (*ChangeStream, error) {
+				return db.Collection("c").Watch(context.Background(), nil, NewChangeStreamOptions().SetFullDocument(FullDocumentUpdateLookup))
+			},
+			write: func(ctx context.Context, db *Database) error {
+				_, err := db.Collection("c").UpdateOne(M{"_id": "a"}, M{"$set": M{"n": 2}})
+				return err
+			},
+			want:     []string{"update c/a"},
+			wantFull: true,
+		},
+		{
+			name:  "replace and delete",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Collection("c").Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				if _, err := db.Collection("c").ReplaceOne(M{"_id": "a"}, M{"n": 3}); err != nil {
+					return err
+				}
+				_, err := db.Collection("c").DeleteOne(M{"_id": "a"})
+				return err
+			},
+			want:     []string{"replace c/a", "delete c/a"},
+			wantFull: true,
+		},
+		{
+			name:  "other collections are skipped",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Collection("c").Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				if _, err := db.Collection("other").InsertOne(M{"_id": "x"}); err != nil {
+					return err
+				}
+				_, err := db.Collection("c").DeleteOne(M{"_id": "a"})
+				return err
+			},
+			want: []string{"delete c/a"},
+		},
+		{
+			name:  "database stream",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				if _, err := db.Collection("other").InsertOne(M{"_id": "x"}); err != nil {
+					return err
+				}
+				_, err := db.Collection("c").DeleteOne(M{"_id": "a"})
+				return err
+			},
+			want:     []string{"insert other/x", "delete c/a"},
+			wantFull: true,
+		},
+		{
+			name: "pipeline",
+			watch: func(db *Database) (*ChangeStream, error) {
+				return db.Collection("c").Watch(context.Background(), []M{{"$match": M{"operationType": "delete"}}})
+			},
+			write: func(ctx context.Context, db *Database) error {
+				if _, err := db.Collection("c").InsertOne(M{"_id": "b"}); err != nil {
+					return err
+				}
+				_, err := db.Collection("c").DeleteOne(M{"_id": "a"})
+				return err
+			},
+			want: []string{"delete c/a"},
+		},
+		{
+			name:  "transaction",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Collection("c").Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				if _, err := db.Collection("c").InsertOneContext(ctx, M{"_id": "b"}); err != nil {
+					return err
+				}
+				_, err := db.Collection("c").UpdateOneContext(ctx, M{"_id": "a"}, M{"$set": M{"n": 2}})
+				return err
+			},
+			want:     []string{"insert c/b", "update c/a"},
+			wantFull: true,
+		},
+		{
+			name:  "replace in a transaction",
+			watch: func(db *Database) (*ChangeStream, error) { return db.Collection("c").Watch(context.Background(), nil) },
+			write: func(ctx context.Context, db *Database) error {
+				_, err := db.Collection("c").ReplaceOneContext(ctx, M{"_id": "a"}, M{"n": 3})
+				return err
+			},
+			want:     []string{"replace c/a"},
+			wantFull: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newChangeClient(t, NewMemoryEngine(), 100)
+			db := client.Database()
+			if _, err := db.Collection("c").InsertOne(M{"_id": "a", "n": 1}); err != nil {
+				t.Fatal(err)
+			}
+			cs, err := tt.watch(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Close(context.Background())
+
+			session, err := client.StartSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.EndSession(context.Background())
+			_, err = session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+				return nil, tt.write(ctx, db)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			events := drain(t, cs)
+			if err := cs.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if got := eventKeys(events); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("events %v, want %v", got, tt.want)
+			}
+			if hasFull := events[0].FullDocument != nil; hasFull != tt.wantFull {
+				t.Errorf("first event has fullDocument = %v, want %v", hasFull, tt.wantFull)
+			}
+			if cs.ResumeToken() != events[len(events)-1].ID {
+				t.Errorf("ResumeToken() = %s, want the last event's %s", cs.ResumeToken(), events[len(events)-1].ID)
+			}
+		})
+	}
+}
+
+func TestChangeStreamResume(t *testing.T) {
+	engines := []struct {
+		name   string
+		engine func() Engine
+	}{
+		{name: "engine keeps _id", engine: func() Engine { return sharedEngine{NewMemoryEngine()} }},
+		{name: "engine assigns _id", engine: func() Engine { return changeIDEngine{NewMemoryEngine()} }},
+	}
+	for _, e := range engines {
+		t.Run(e.name, func(t *testing.T) {
+			engine := e.engine()
+
+			// The first client logs five inserts into a log of three events
+			first := newChangeClient(t, engine, 3)
+			cs, err := first.Database().Watch(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tokens []ResumeToken
+			for _, id := range []string{"1", "2", "3", "4", "5"} {
+				if _, err := first.Database().Collection("c").InsertOne(M{"_id": id}); err != nil {
+					t.Fatal(err)
+				}
+				for _, event := range drain(t, cs) {
+					tokens = append(tokens, event.ID)
+				}
+			}
+			if len(tokens) != 5 {
+				t.Fatalf("%d events, want 5", len(tokens))
+			}
+			if err := first.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := engine.Count(changeCollection); err != nil || n != 3 {
+				t.Fatalf("change log holds %d events, %v, want 3", n, err)
+			}
+
+			// A second client loads the log and resumes from the tokens
+			second := newChangeClient(t, engine, 3)
+			tests := []struct {
+				name    string
+				token   ResumeToken
+				want    []string
+				wantErr error
+			}{
+				{name: "oldest kept event next", token: tokens[1], want: []string{"insert c/3", "insert c/4", "insert c/5"}},
+				{name: "middle", token: tokens[3], want: []string{"insert c/5"}},
+				{name: "newest", token: tokens[4], want: []string{}},
+				{name: "next event trimmed", token: tokens[0], wantErr: ErrChangeHistoryLost},
+				{name: "newer than the log", token: tokenFor(99), wantErr: ErrChangeHistoryLost},
+				{name: "invalid token", token: "not a token", wantErr: errors.New("invalid")},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					cs, err := second.Database().Watch(context.Background(), nil, NewChangeStreamOptions().SetResumeAfter(tt.token))
+					if tt.wantErr != nil {
+						if err == nil || (errors.Is(tt.wantErr, ErrChangeHistoryLost) != errors.Is(err, ErrChangeHistoryLost)) {
+							t.Fatalf("got error %v, want %v", err, tt.wantErr)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer cs.Close(context.Background())
+					if got := eventKeys(drain(t, cs)); !reflect.DeepEqual(got, tt.want) {
+						t.Errorf("events %v, want %v", got, tt.want)
+					}
+				})
+			}
+
+			// The second client numbers its events after the loaded ones
+			cs, err = second.Database().Watch(context.Background(), nil, NewChangeStreamOptions().SetResumeAfter(tokens[4]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Close(context.Background())
+			if _, err := second.Database().Collection("c").InsertOne(M{"_id": "6"}); err != nil {
+				t.Fatal(err)
+			}
+			events := drain(t, cs)
+			if got := eventKeys(events); !reflect.DeepEqual(got, []string{"insert c/6"}) {
+				t.Fatalf("events %v, want [insert c/6]", got)
+			}
+			if events[0].ID <= tokens[4] {
+				t.Errorf("token %s does not follow %s", events[0].ID, tokens[4])
+			}
+			if n, err := engine.Count(changeCollection); err != nil || n != 3 {
+				t.Errorf("change log holds %d events, %v, want 3", n, err)
+			}
+		})
+	}
+}
+
+// opaqueDuplicateEngine reports a duplicate _id with an error that is not
+// ErrDuplicateKey, as an engine whose messages are not recognized does
+type opaqueDuplicateEngine struct{ sharedEngine }
+
+func (e opaqueDuplicateEngine) Insert(collection string, doc []byte) (string, error) {
+	id, err := e.sharedEngine.Insert(collection, doc)
+	if errors.Is(err, ErrDuplicateKey) {
+		return "", errors.New("insert failed")
+	}
+	return id, err
+}
+
+func TestChangeLogSharedByClients(t *testing.T) {
+	tests := []struct {
+		name   string
+		engine Engine
+	}{
+		{name: "duplicate key error", engine: sharedEngine{NewMemoryEngine()}},
+		{name: "unrecognized error", engine: opaqueDuplicateEngine{sharedEngine{NewMemoryEngine()}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newChangeClient(t, tt.engine, 100).Database().Collection("c")
+			b := newChangeClient(t, tt.engine, 100).Database().Collection("c")
+
+			// Each client's next number is taken by the other's previous event
+			for _, write := range []struct {
+				coll *Collection
+				id   string
+			}{{a, "a1"}, {b, "b1"}, {a, "a2"}, {b, "b2"}} {
+				if _, err := write.coll.InsertOne(M{"_id": write.id}); err != nil {
+					t.Fatalf("insert %s: %v", write.id, err)
+				}
+			}
+
+			reader := newChangeClient(t, tt.engine, 100)
+			cs, err := reader.Database().Watch(context.Background(), nil, NewChangeStreamOptions().SetResumeAfter(tokenFor(0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Close(context.Background())
+			want := []string{"insert c/a1", "insert c/b1", "insert c/a2", "insert c/b2"}
+			if got := eventKeys(drain(t, cs)); !reflect.DeepEqual(got, want) {
+				t.Errorf("events %v, want %v", got, want)
+			}
+
+			// The reader's stream follows its own client, not the others
+			if _, err := a.InsertOne(M{"_id": "a3"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := eventKeys(drain(t, cs)); len(got) != 0 {
+				t.Errorf("stream saw %v written through another client", got)
+			}
+			if _, err := reader.Database().Collection("c").InsertOne(M{"_id": "r1"}); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := eventKeys(drain(t, cs)), []string{"insert c/a3", "insert c/r1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("after a clash, events %v, want %v", got, want)
+			}
+			if err := cs.Err(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestChangeLogFailureKeepsWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(client *Client, id string) error
+	}{
+		{name: "insert", write: func(client *Client, id string) error {
+			_, err := client.Database().Collection("c").InsertOne(M{"_id": id})
+			return err
+		}},
+		{name: "update", write: func(client *Client, id string) error {
+			_, err := client.Database().Collection("c").UpdateOne(M{"_id": "a"}, M{"$set": M{"last": id}})
+			return err
+		}},
+		{name: "delete", write: func(client *Client, id string) error {
+			_, err := client.Database().Collection("c").DeleteOne(M{"_id": "a"})
+			return err
+		}},
+		{name: "transaction", write: func(client *Client, id string) error {
+			session, err := client.StartSession()
+			if err != nil {
+				return err
+			}
+			defer session.EndSession(context.Background())
+			_, err = session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+				return client.Database().Collection("c").InsertOneContext(ctx, M{"_id": id})
+			})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &changeFailingEngine{MemoryEngine: NewMemoryEngine()}
+			client := newChangeClient(t, engine, 100)
+			coll := client.Database().Collection("c")
+			if _, err := coll.InsertOne(M{"_id": "a"}); err != nil {
+				t.Fatal(err)
+			}
+			before, err := coll.Watch(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer before.Close(context.Background())
+
+			engine.setFailing(true)
+			if err := tt.write(client, "lost"); err != nil {
+				t.Fatalf("write failed with the change log: %v", err)
+			}
+			engine.setFailing(false)
+			after, err := coll.Watch(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer after.Close(context.Background())
+			if _, err := coll.InsertOne(M{"_id": "later"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// A stream that would pass over the lost event fails
+			if events := drain(t, before); len(events) != 0 {
+				t.Errorf("stream read %v across the lost event", eventKeys(events))
+			}
+			if !errors.Is(before.Err(), ErrChangeHistoryLost) {
+				t.Errorf("got %v, want ErrChangeHistoryLost", before.Err())
+			}
+			// A stream started after it does not
+			if got := eventKeys(drain(t, after)); !reflect.DeepEqual(got, []string{"insert c/later"}) {
+				t.Errorf("events %v, want [insert c/later]", got)
+			}
+			if err := after.Err(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
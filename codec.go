@@ -0,0 +1,700 @@
+package keradb
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Struct Codec
+// ============================================================================
+
+// structCodec converts between a struct type and Documents field by field,
+// without a JSON round trip.
+//
+// Fields are described by `keradb:"name,omitempty,inline"` tags. A field
+// without a keradb tag falls back to its json tag, so structs written for
+// encoding/json are stored as the same documents. "-" skips a field,
+// omitempty leaves out empty values, and inline promotes the fields of a
+// struct field into the parent document; an inline map[string]T field
+// collects keys no other field claims. Untagged embedded structs are
+// inlined, as in encoding/json.
+//
+// A Registry can take over the conversion of individual types. Otherwise,
+// time.Time, []byte and Decimal values are kept as they are, to be stored
+// as Extended JSON, and values whose type implements json.Marshaler or
+// encoding.TextMarshaler are converted through those methods.
+type structCodec struct {
+	fields []codecField
+	byName map[string]*codecField
+	byFold map[string]*codecField // lower-cased names, matched as encoding/json does
+	id     *codecField            // the field stored as _id, if any
+	inline *codecField            // the inline map, if any
+}
+
+// codecField is one document field of a struct
+type codecField struct {
+	name      string
+	index     []int // field index path, through embedded structs
+	omitEmpty bool
+	tagged    bool
+	depth     int
+}
+
+// codecs caches a *structCodec per struct type
+var codecs sync.Map
+
+// codecFor returns the codec of a struct type, building it on first use
+func codecFor(t reflect.Type) *structCodec {
+	if c, ok := codecs.Load(t); ok {
+		return c.(*structCodec)
+	}
+	c, _ := codecs.LoadOrStore(t, buildCodec(t))
+	return c.(*structCodec)
+}
+
+func buildCodec(t reflect.Type) *structCodec {
+	var candidates []codecField
+	var inlineMap *codecField
+	var walk func(t reflect.Type, index []int, depth int, visiting map[reflect.Type]bool)
+	walk = func(t reflect.Type, index []int, depth int, visiting map[reflect.Type]bool) {
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag, ok := sf.Tag.Lookup("keradb")
+			if !ok {
+				tag = sf.Tag.Get("json")
+			}
+			name, omitEmpty, inline, skip := parseFieldTag(tag)
+			if skip || (!sf.IsExported() && !sf.Anonymous) {
+				continue
+			}
+			path := append(append([]int(nil), index...), i)
+
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && (inline || (sf.Anonymous && name == "")) {
+				if !visiting[ft] {
+					walk(ft, path, depth+1, visiting)
+				}
+				continue
+			}
+			if !sf.IsExported() {
+				continue
+			}
+			if inline && sf.Type.Kind() == reflect.Map && sf.Type.Key().Kind() == reflect.String {
+				if inlineMap == nil || depth < inlineMap.depth {
+					inlineMap = &codecField{index: path, depth: depth}
+				}
+				continue
+			}
+
+			field := codecField{name: name, index: path, omitEmpty: omitEmpty, tagged: name != "", depth: depth}
+			if field.name == "" {
+				field.name = sf.Name
+			}
+			candidates = append(candidates, field)
+		}
+	}
+	walk(t, nil, 0, map[reflect.Type]bool{})
+
+	// Like encoding/json, the shallowest field of a name wins, a tagged
+	// field beats untagged ones at the same depth, and any other tie hides
+	// the name altogether
+	byName := map[string][]codecField{}
+	var order []string
+	for _, f := range candidates {
+		if _, ok := byName[f.name]; !ok {
+			order = append(order, f.name)
+		}
+		byName[f.name] = append(byName[f.name], f)
+	}
+
+	c := &structCodec{byName: map[string]*codecField{}, byFold: map[string]*codecField{}, inline: inlineMap}
+	for _, name := range order {
+		if f, ok := dominantField(byName[name]); ok {
+			c.fields = append(c.fields, f)
+		}
+	}
+	for i := range c.fields {
+		f := &c.fields[i]
+		c.byName[f.name] = f
+		if _, ok := c.byFold[strings.ToLower(f.name)]; !ok {
+			c.byFold[strings.ToLower(f.name)] = f
+		}
+		if f.name == "_id" {
+			c.id = f
+		}
+	}
+	return c
+}
+
+func dominantField(fields []codecField) (codecField, bool) {
+	best := fields[0].depth
+	for _, f := range fields {
+		if f.depth < best {
+			best = f.depth
+		}
+	}
+	var shallow []codecField
+	for _, f := range fields {
+		if f.depth == best {
+			shallow = append(shallow, f)
+		}
+	}
+	if len(shallow) == 1 {
+		return shallow[0], true
+	}
+	var tagged []codecField
+	for _, f := range shallow {
+		if f.tagged {
+			tagged = append(tagged, f)
+		}
+	}
+	if len(tagged) == 1 {
+		return tagged[0], true
+	}
+	return codecField{}, false
+}
+
+// parseFieldTag splits a keradb or json struct tag into the field name and
+// its options
+func parseFieldTag(tag string) (name string, omitEmpty, inline, skip bool) {
+	if tag == "-" {
+		return "", false, false, true
+	}
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "omitempty":
+			omitEmpty = true
+		case "inline":
+			inline = true
+		}
+	}
+	return parts[0], omitEmpty, inline, false
+}
+
+// lookup returns the field a document key decodes into
+func (c *structCodec) lookup(name string) *codecField {
+	if f, ok := c.byName[name]; ok {
+		return f
+	}
+	return c.byFold[strings.ToLower(name)]
+}
+
+// ----------------------------------------------------------------------------
+// Encoding
+// ----------------------------------------------------------------------------
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	jsonNumberType      = reflect.TypeOf(json.Number(""))
+	dType               = reflect.TypeOf(D{})
+	decimalType         = reflect.TypeOf(Decimal(""))
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// encode converts a struct value to a D with the fields in declaration
+// order. Keys of an inline map follow in sorted order.
+func (c *structCodec) encode(r *Registry, v reflect.Value) (D, error) {
+	doc := make(D, 0, len(c.fields))
+	for _, f := range c.fields {
+		fv, ok := fieldForEncode(v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		value, err := r.encodeValue(fv)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+		doc = append(doc, E{Key: f.name, Value: value})
+	}
+
+	if c.inline != nil {
+		fv, ok := fieldForEncode(v, c.inline.index)
+		if ok && !fv.IsNil() {
+			taken := make(map[string]bool, len(doc))
+			for _, e := range doc {
+				taken[e.Key] = true
+			}
+			extra := make(D, 0, fv.Len())
+			iter := fv.MapRange()
+			for iter.Next() {
+				key := iter.Key().String()
+				if taken[key] {
+					continue
+				}
+				value, err := r.encodeValue(iter.Value())
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %w", key, err)
+				}
+				extra = append(extra, E{Key: key, Value: value})
+			}
+			sort.Slice(extra, func(i, j int) bool { return extra[i].Key < extra[j].Key })
+			doc = append(doc, extra...)
+		}
+	}
+	return doc, nil
+}
+
+// fieldForEncode follows a field index path. It reports false if the path
+// runs through a nil embedded pointer.
+func fieldForEncode(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// isEmptyValue reports whether omitempty leaves a value out
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// encodeValue converts a Go value to the shape a stored document holds:
+// nil, a bool, a string, a number, a time.Time, a []byte, a Decimal, a
+// []interface{}, a map[string]interface{} or, for a D or a struct, a D
+func (r *Registry) encodeValue(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if enc := r.encoder(v.Type()); enc != nil {
+		out, err := enc(v)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil || reflect.TypeOf(out) == v.Type() {
+			return out, nil
+		}
+		return r.encodeValue(reflect.ValueOf(out))
+	}
+	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+	}
+	switch v.Type() {
+	case jsonNumberType:
+		return json.Number(v.String()), nil
+	case decimalType:
+		return Decimal(v.String()), nil
+	case timeType:
+		return v.Interface(), nil
+	}
+	if v.Type() == dType {
+		out := make(D, v.Len())
+		for i, e := range v.Interface().(D) {
+			value, err := r.encodeValue(reflect.ValueOf(e.Value))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = E{Key: e.Key, Value: value}
+		}
+		return out, nil
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		return encodeViaJSON(v.Interface())
+	}
+	if v.CanAddr() && (v.Addr().Type().Implements(jsonMarshalerType) || v.Addr().Type().Implements(textMarshalerType)) {
+		return encodeViaJSON(v.Addr().Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int64:
+		return v.Int(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return int(v.Int()), nil
+	case reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return uint(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("unsupported value: %v", f)
+		}
+		return f, nil
+	case reflect.Pointer, reflect.Interface:
+		return r.encodeValue(v.Elem())
+	case reflect.Struct:
+		return codecFor(v.Type()).encode(r, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := encodeMapKey(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.encodeValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			out[key] = value
+		}
+		return out, nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			value, err := r.encodeValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = value
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %s", v.Type())
+}
+
+func encodeMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if k.Type().Implements(textMarshalerType) {
+		text, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type: %s", k.Type())
+}
+
+// encodeViaJSON converts a value with its own JSON encoding
+func encodeViaJSON(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ----------------------------------------------------------------------------
+// Decoding
+// ----------------------------------------------------------------------------
+
+// decode fills a struct value from a document. Keys without a matching
+// field go to the inline map, if there is one, and are ignored otherwise.
+func (c *structCodec) decode(r *Registry, doc map[string]interface{}, v reflect.Value) error {
+	for key, value := range doc {
+		f := c.lookup(key)
+		if f == nil {
+			if c.inline != nil {
+				if err := r.decodeValue(map[string]interface{}{key: value}, fieldForDecode(v, c.inline.index)); err != nil {
+					return fmt.Errorf("field %s: %w", key, err)
+				}
+			}
+			continue
+		}
+		if err := r.decodeValue(value, fieldForDecode(v, f.index)); err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// fieldForDecode follows a field index path, allocating nil embedded
+// pointers on the way
+func fieldForDecode(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// decodeValue stores a document value into dst, which must be settable.
+// Like encoding/json, null leaves non-nullable values unchanged.
+func (r *Registry) decodeValue(src interface{}, dst reflect.Value) error {
+	if dec := r.decoder(dst.Type()); dec != nil {
+		return dec(src, dst)
+	}
+	switch src.(type) {
+	case time.Time, Decimal, json.Number:
+		if reflect.TypeOf(src) == dst.Type() {
+			dst.Set(reflect.ValueOf(src))
+			return nil
+		}
+	}
+	if dst.Type() == dType {
+		if src == nil {
+			dst.Set(reflect.Zero(dType))
+			return nil
+		}
+		d, ok := orderLike(src, nil).(D)
+		if !ok {
+			return fmt.Errorf("cannot decode %T into %s", src, dType)
+		}
+		dst.Set(reflect.ValueOf(d))
+		return nil
+	}
+	if dst.CanAddr() {
+		ptr := dst.Addr()
+		if ptr.Type().Implements(jsonUnmarshalerType) {
+			data, err := json.Marshal(src)
+			if err != nil {
+				return err
+			}
+			return ptr.Interface().(json.Unmarshaler).UnmarshalJSON(data)
+		}
+		if s, ok := src.(string); ok && ptr.Type().Implements(textUnmarshalerType) {
+			return ptr.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+		}
+	}
+
+	if src == nil {
+		switch dst.Kind() {
+		case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+			dst.Set(reflect.Zero(dst.Type()))
+		}
+		return nil
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("cannot decode %T into %s", src, dst.Type())
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return r.decodeValue(src, dst.Elem())
+
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return mismatch()
+		}
+		dst.Set(reflect.ValueOf(normalizeLiteral(src)))
+
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return mismatch()
+		}
+		dst.SetBool(b)
+
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case json.Number:
+			dst.SetString(string(s))
+		case Decimal:
+			dst.SetString(string(s))
+		default:
+			return mismatch()
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := toInt64(src)
+		if !ok {
+			f, isNum := toFloat(src)
+			if !isNum || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return mismatch()
+			}
+			n = int64(f)
+		}
+		if dst.OverflowInt(n) {
+			return fmt.Errorf("value %d overflows %s", n, dst.Type())
+		}
+		dst.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		if d, ok := src.(Decimal); ok {
+			// A uint64 beyond int64 is stored as a Decimal
+			u, err := strconv.ParseUint(string(d), 10, 64)
+			if err != nil {
+				return mismatch()
+			}
+			n = u
+		} else {
+			f, ok := toFloat(src)
+			if !ok || f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return mismatch()
+			}
+			n = uint64(f)
+			if i, ok := toInt64(src); ok {
+				n = uint64(i)
+			}
+		}
+		if dst.OverflowUint(n) {
+			return fmt.Errorf("value %d overflows %s", n, dst.Type())
+		}
+		dst.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat(src)
+		if !ok {
+			return mismatch()
+		}
+		if dst.OverflowFloat(f) {
+			return fmt.Errorf("value %v overflows %s", f, dst.Type())
+		}
+		dst.SetFloat(f)
+
+	case reflect.Struct:
+		m, ok := asMap(src)
+		if !ok {
+			return mismatch()
+		}
+		return codecFor(dst.Type()).decode(r, m, dst)
+
+	case reflect.Map:
+		m, ok := asMap(src)
+		if !ok {
+			return mismatch()
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMapWithSize(dst.Type(), len(m)))
+		}
+		for k, v := range m {
+			key := reflect.New(dst.Type().Key()).Elem()
+			if err := decodeMapKey(k, key); err != nil {
+				return err
+			}
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := r.decodeValue(v, elem); err != nil {
+				return err
+			}
+			dst.SetMapIndex(key, elem)
+		}
+
+	case reflect.Slice:
+		if b, ok := src.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		if s, ok := src.(string); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return err
+			}
+			dst.SetBytes(b)
+			return nil
+		}
+		arr, ok := src.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		out := reflect.MakeSlice(dst.Type(), len(arr), len(arr))
+		for i, v := range arr {
+			if err := r.decodeValue(v, out.Index(i)); err != nil {
+				return err
+			}
+		}
+		dst.Set(out)
+
+	case reflect.Array:
+		arr, ok := src.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i := 0; i < dst.Len(); i++ {
+			if i >= len(arr) {
+				dst.Index(i).Set(reflect.Zero(dst.Type().Elem()))
+				continue
+			}
+			if err := r.decodeValue(arr[i], dst.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("unsupported type: %s", dst.Type())
+	}
+	return nil
+}
+
+func decodeMapKey(k string, dst reflect.Value) error {
+	if dst.Kind() == reflect.String {
+		dst.SetString(k)
+		return nil
+	}
+	if u, ok := dst.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(k))
+	}
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(k, 10, 64)
+		if err != nil || dst.OverflowInt(n) {
+			return fmt.Errorf("invalid map key %q for %s", k, dst.Type())
+		}
+		dst.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || dst.OverflowUint(n) {
+			return fmt.Errorf("invalid map key %q for %s", k, dst.Type())
+		}
+		dst.SetUint(n)
+		return nil
+	}
+	return fmt.Errorf("unsupported map key type: %s", dst.Type())
+}
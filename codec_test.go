@@ -0,0 +1,294 @@
+package keradb
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type codecAddress struct {
+	City string `keradb:"city"`
+	Zip  string `keradb:"zip,omitempty"`
+}
+
+type codecItem struct {
+	ID      string                 `keradb:"_id,omitempty" json:"id"`
+	Name    string                 `keradb:"name" json:"title"`
+	Empty   string                 `keradb:"empty,omitempty"`
+	Address codecAddress           `keradb:",inline"`
+	Rest    map[string]interface{} `keradb:",inline"`
+	Hidden  string                 `keradb:"-" json:"hidden"`
+	Legacy  int                    `json:"legacy"`
+	Plain   bool
+}
+
+type codecEmbedded struct {
+	codecAddress
+	Name string `keradb:"name"`
+}
+
+// codecUpper is stored as upper-case text through encoding.TextMarshaler
+type codecUpper string
+
+func (u codecUpper) MarshalText() ([]byte, error) { return []byte(strings.ToUpper(string(u))), nil }
+
+func (u *codecUpper) UnmarshalText(text []byte) error {
+	*u = codecUpper(strings.ToLower(string(text)))
+	return nil
+}
+
+type codecTypes struct {
+	When  time.Time    `keradb:"when"`
+	Bytes []byte       `keradb:"bytes"`
+	Dec   Decimal      `keradb:"dec"`
+	OID   ObjectID     `keradb:"oid"`
+	Upper codecUpper   `keradb:"upper"`
+	Ptr   *int         `keradb:"ptr"`
+	List  []codecUpper `keradb:"list"`
+}
+
+func TestStructEncode(t *testing.T) {
+	oid := mustObjectID("65a1b2c3d4e5f60718293a4b")
+	seven := 7
+	tests := []struct {
+		name string
+		doc  interface{}
+		want D
+	}{
+		{
+			name: "tags, omitempty and skip",
+			doc:  codecItem{Name: "a", Hidden: "h", Legacy: 2, Plain: true},
+			want: D{{Key: "name", Value: "a"}, {Key: "city", Value: ""}, {Key: "legacy", Value: 2}, {Key: "Plain", Value: true}},
+		},
+		{
+			name: "id, inline struct and inline map",
+			doc:  codecItem{ID: "x", Address: codecAddress{City: "Rome", Zip: "001"}, Rest: map[string]interface{}{"extra": 5}},
+			want: D{{Key: "_id", Value: "x"}, {Key: "name", Value: ""}, {Key: "city", Value: "Rome"}, {Key: "zip", Value: "001"},
+				{Key: "legacy", Value: 0}, {Key: "Plain", Value: false}, {Key: "extra", Value: 5}},
+		},
+		{
+			name: "embedded struct",
+			doc:  codecEmbedded{codecAddress: codecAddress{City: "Oslo"}, Name: "b"},
+			want: D{{Key: "city", Value: "Oslo"}, {Key: "name", Value: "b"}},
+		},
+		{
+			name: "special types",
+			doc: codecTypes{When: time.Unix(1700000000, 0).UTC(), Bytes: []byte{1, 2}, Dec: "1.50", OID: oid,
+				Upper: "abc", Ptr: &seven, List: []codecUpper{"x"}},
+			want: D{{Key: "when", Value: time.Unix(1700000000, 0).UTC()}, {Key: "bytes", Value: []byte{1, 2}},
+				{Key: "dec", Value: Decimal("1.50")}, {Key: "oid", Value: oid.Hex()}, {Key: "upper", Value: "ABC"},
+				{Key: "ptr", Value: 7}, {Key: "list", Value: []interface{}{"X"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DefaultRegistry.encodeOrdered(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tt.want) {
+				t.Errorf("got  %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     Document
+		target  func() interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name:   "tags and inline fields",
+			doc:    Document{"_id": "x", "name": "a", "city": "Rome", "legacy": 2.0, "Plain": true, "extra": 5.0, "hidden": "h"},
+			target: func() interface{} { return &codecItem{} },
+			want: &codecItem{ID: "x", Name: "a", Address: codecAddress{City: "Rome"}, Legacy: 2, Plain: true,
+				Rest: map[string]interface{}{"extra": 5.0, "hidden": "h"}},
+		},
+		{
+			name:   "names match case-insensitively",
+			doc:    Document{"NAME": "b", "plain": true},
+			target: func() interface{} { return &codecItem{} },
+			want:   &codecItem{Name: "b", Plain: true},
+		},
+		{
+			name:   "embedded struct",
+			doc:    Document{"city": "Oslo", "name": "b"},
+			target: func() interface{} { return &codecEmbedded{} },
+			want:   &codecEmbedded{codecAddress: codecAddress{City: "Oslo"}, Name: "b"},
+		},
+		{
+			name:   "special types",
+			doc:    Document{"oid": "65a1b2c3d4e5f60718293a4b", "upper": "ABC", "ptr": 7.0, "dec": Decimal("1.5"), "list": []interface{}{"Y"}},
+			target: func() interface{} { return &codecTypes{} },
+			want: func() interface{} {
+				seven := 7
+				return &codecTypes{OID: mustObjectID("65a1b2c3d4e5f60718293a4b"), Upper: "abc", Ptr: &seven,
+					Dec: "1.5", List: []codecUpper{"y"}}
+			}(),
+		},
+		{
+			name:    "wrong type",
+			doc:     Document{"legacy": "two"},
+			target:  func() interface{} { return &codecItem{} },
+			wantErr: true,
+		},
+		{
+			name:    "fraction into an int",
+			doc:     Document{"legacy": 2.5},
+			target:  func() interface{} { return &codecItem{} },
+			wantErr: true,
+		},
+		{
+			name:    "invalid ObjectID",
+			doc:     Document{"oid": "zz"},
+			target:  func() interface{} { return &codecTypes{} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.target()
+			err := DefaultRegistry.decodeDocument(tt.doc, got)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type codecColor int
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	RegisterEncoder(reg, func(c codecColor) (interface{}, error) {
+		if c < 0 || c > 1 {
+			return nil, fmt.Errorf("no color %d", c)
+		}
+		return []string{"red", "green"}[c], nil
+	})
+	RegisterDecoder(reg, func(src interface{}) (codecColor, error) {
+		switch src {
+		case "red":
+			return 0, nil
+		case "green":
+			return 1, nil
+		}
+		return 0, fmt.Errorf("bad color %v", src)
+	})
+	client, err := Connect("memory.ndb", NewClientOptions().SetEngine(NewMemoryEngine()).SetRegistry(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	coll := client.Database().Collection("items")
+
+	type item struct {
+		ID    string       `keradb:"_id,omitempty"`
+		Color codecColor   `keradb:"color"`
+		Many  []codecColor `keradb:"many"`
+	}
+
+	tests := []struct {
+		name    string
+		run     func() (interface{}, error)
+		want    interface{}
+		wantErr bool
+	}{
+		{
+			name: "encoded on insert",
+			run: func() (interface{}, error) {
+				res, err := coll.InsertOne(item{ID: "a", Color: 1, Many: []codecColor{0, 1}})
+				if err != nil {
+					return nil, err
+				}
+				var raw M
+				err = coll.FindOne(M{"_id": res.InsertedID}).Decode(&raw)
+				return raw, err
+			},
+			want: M{"_id": "a", "color": "green", "many": []interface{}{"red", "green"}},
+		},
+		{
+			name: "decoded into a struct",
+			run: func() (interface{}, error) {
+				var it item
+				err := coll.FindOne(M{"_id": "a"}).Decode(&it)
+				return it, err
+			},
+			want: item{ID: "a", Color: 1, Many: []codecColor{0, 1}},
+		},
+		{
+			name: "encoded in $set and filters",
+			run: func() (interface{}, error) {
+				if _, err := coll.UpdateOne(M{"_id": "a"}, M{"$set": M{"color": codecColor(0)}}); err != nil {
+					return nil, err
+				}
+				return coll.CountDocuments(M{"color": "red"})
+			},
+			want: int64(1),
+		},
+		{
+			name: "encoder error",
+			run: func() (interface{}, error) {
+				return coll.InsertOne(item{Color: 5})
+			},
+			wantErr: true,
+		},
+		{
+			name: "decoder error",
+			run: func() (interface{}, error) {
+				if _, err := coll.InsertOne(M{"_id": "b", "color": "blue"}); err != nil {
+					return nil, err
+				}
+				var it item
+				err := coll.FindOne(M{"_id": "b"}).Decode(&it)
+				return it, err
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.run()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	if err := NewRegistry().decodeDocument(Document{}, item{}); err == nil {
+		t.Errorf("decoding into a non-pointer: %v", err)
+	}
+}
+
+// mustObjectID parses a hex ObjectID known to be valid
+func mustObjectID(s string) ObjectID {
+	id, err := ObjectIDFromHex(s)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
@@ -0,0 +1,337 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests are meant to be run with the race detector:
+//
+//	go test -race -run Concurrent .
+
+func TestConcurrentCollectionCache(t *testing.T) {
+	db := newMemoryClient(t, NewMemoryEngine()).Database()
+
+	const goroutines = 16
+	got := make([]*Collection, goroutines)
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i] = db.Collection("users")
+		}()
+	}
+	wg.Wait()
+
+	for i, coll := range got {
+		if coll != got[0] {
+			t.Fatalf("goroutine %d got a different *Collection", i)
+		}
+	}
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("counters")
+	if _, err := coll.InsertOne(M{"_id": "hits", "n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coll.Indexes().CreateOne(IndexModel{Keys: D{{Key: "g", Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines, perGoroutine = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*perGoroutine*3)
+	for g := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perGoroutine {
+				if _, err := coll.UpdateOne(M{"_id": "hits"}, M{"$inc": M{"n": 1}}); err != nil {
+					errs <- err
+				}
+				if _, err := coll.InsertOne(M{"g": g, "i": i}); err != nil {
+					errs <- err
+				}
+				if _, err := coll.Find(M{"g": g}).All(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var counter struct{ N int }
+	if err := coll.FindOne(M{"_id": "hits"}).Decode(&counter); err != nil {
+		t.Fatal(err)
+	}
+	if counter.N != goroutines*perGoroutine {
+		t.Errorf("n = %d, want %d", counter.N, goroutines*perGoroutine)
+	}
+	count, err := coll.CountDocuments(M{"g": M{"$exists": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != goroutines*perGoroutine {
+		t.Errorf("inserted %d documents, want %d", count, goroutines*perGoroutine)
+	}
+}
+
+// blockingEngine holds FindAll calls until release is closed and records
+// whether Close ran while one was in progress
+type blockingEngine struct {
+	*MemoryEngine
+	entered chan struct{}
+	release chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	closedIn int // inFlight when Close was called
+	closes   int
+}
+
+func newBlockingEngine() *blockingEngine {
+	return &blockingEngine{
+		MemoryEngine: NewMemoryEngine(),
+		entered:      make(chan struct{}, 1),
+		release:      make(chan struct{}),
+	}
+}
+
+func (e *blockingEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	e.mu.Lock()
+	e.inFlight++
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		e.inFlight--
+		e.mu.Unlock()
+	}()
+
+	select {
+	case e.entered <- struct{}{}:
+	default:
+	}
+	<-e.release
+	return e.MemoryEngine.FindAll(collection, limit, skip)
+}
+
+func (e *blockingEngine) Close() error {
+	e.mu.Lock()
+	e.closedIn = e.inFlight
+	e.closes++
+	e.mu.Unlock()
+	return e.MemoryEngine.Close()
+}
+
+func TestConcurrentCloseWaitsForInFlightCalls(t *testing.T) {
+	engine := newBlockingEngine()
+	client := newMemoryClient(t, engine)
+	coll := client.Database().Collection("items")
+
+	found := make(chan error)
+	go func() {
+		_, err := coll.Find(nil).All()
+		found <- err
+	}()
+	<-engine.entered
+
+	closed := make(chan error, 2)
+	for range 2 {
+		go func() { closed <- client.Close() }()
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a call was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(engine.release)
+	if err := <-found; err != nil {
+		t.Fatalf("in-flight Find failed: %v", err)
+	}
+	for range 2 {
+		if err := <-closed; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if engine.closedIn != 0 {
+		t.Errorf("engine closed with %d calls in flight", engine.closedIn)
+	}
+	if engine.closes != 1 {
+		t.Errorf("engine closed %d times, want 1", engine.closes)
+	}
+}
+
+func TestConcurrentOperationsDuringClose(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	coll := client.Database().Collection("items")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				_, err := coll.InsertOne(M{"g": g, "i": i})
+				if err == nil {
+					_, err = coll.Find(M{"g": g}).All()
+				}
+				if err != nil {
+					if !errors.Is(err, ErrClosed) {
+						errs <- err
+					}
+					return
+				}
+			}
+		}()
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("want nil or ErrClosed, got %v", err)
+	}
+
+	if _, err := coll.InsertOne(M{"late": true}); !errors.Is(err, ErrClosed) {
+		t.Errorf("insert after Close: got %v, want ErrClosed", err)
+	}
+	if err := client.Sync(); !errors.Is(err, ErrClosed) {
+		t.Errorf("sync after Close: got %v, want ErrClosed", err)
+	}
+}
+
+// lastErrorEngine reports failures the way the native library does: a
+// failing call writes its message to one slot shared by every call through
+// the handle, and the error is built by reading the slot back afterwards.
+// Each call holds the handle's ffiLock, as the native engine does.
+type lastErrorEngine struct {
+	*MemoryEngine
+	ffi ffiLock
+
+	slotMu sync.Mutex // makes each access atomic, not a write and its read
+	slot   string
+}
+
+func (e *lastErrorEngine) setLastError(msg string) {
+	e.slotMu.Lock()
+	defer e.slotMu.Unlock()
+	e.slot = msg
+}
+
+func (e *lastErrorEngine) lastError() string {
+	e.slotMu.Lock()
+	defer e.slotMu.Unlock()
+	return e.slot
+}
+
+func (e *lastErrorEngine) GetVector(collection string, id VectorID) ([]byte, error) {
+	defer e.ffi.lock()()
+	e.setLastError(fmt.Sprintf("Collection '%s' not found", collection))
+	// Give a concurrent call the chance to overwrite the slot
+	runtime.Gosched()
+	return nil, &NativeError{Op: "keradb_get_vector", Message: e.lastError()}
+}
+
+func TestConcurrentErrorsReportTheirOwnCall(t *testing.T) {
+	client := newMemoryClient(t, &lastErrorEngine{MemoryEngine: NewMemoryEngine()})
+
+	const goroutines = 16
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("missing-%d", i)
+			for range 50 {
+				_, err := client.GetVector(name, 1)
+				if !errors.Is(err, ErrCollectionNotFound) {
+					t.Errorf("%s: got %v, want ErrCollectionNotFound", name, err)
+					return
+				}
+				if !strings.Contains(err.Error(), "'"+name+"'") {
+					t.Errorf("%s: error reports another call: %v", name, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentTransactionsRetryConflicts(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	accounts := client.Database().Collection("accounts")
+	for _, id := range []string{"a", "b"} {
+		if _, err := accounts.InsertOne(M{"_id": id, "balance": 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each transfer reads both balances and writes them back, so concurrent
+	// transfers conflict and must be retried for no money to be lost
+	transfer := func(ctx context.Context) (interface{}, error) {
+		var from, to struct{ Balance int }
+		if err := accounts.FindOneContext(ctx, M{"_id": "a"}).Decode(&from); err != nil {
+			return nil, err
+		}
+		if err := accounts.FindOneContext(ctx, M{"_id": "b"}).Decode(&to); err != nil {
+			return nil, err
+		}
+		if _, err := accounts.UpdateOneContext(ctx, M{"_id": "a"}, M{"$set": M{"balance": from.Balance - 1}}); err != nil {
+			return nil, err
+		}
+		_, err := accounts.UpdateOneContext(ctx, M{"_id": "b"}, M{"$set": M{"balance": to.Balance + 1}})
+		return nil, err
+	}
+
+	const goroutines, perGoroutine = 8, 10
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := client.StartSession()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer session.EndSession(context.Background())
+			for range perGoroutine {
+				if _, err := session.WithTransaction(context.Background(), transfer); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var a, b struct{ Balance int }
+	if err := accounts.FindOne(M{"_id": "a"}).Decode(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.FindOne(M{"_id": "b"}).Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 - goroutines*perGoroutine; a.Balance != want || a.Balance+b.Balance != 200 {
+		t.Errorf("balances %d and %d, want %d and %d", a.Balance, b.Balance, want, 200-want)
+	}
+}
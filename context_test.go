@@ -0,0 +1,200 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// cancelingEngine cancels a context once a number of documents have been
+// written to collection "c"
+type cancelingEngine struct {
+	*MemoryEngine
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	after  int
+	writes int
+}
+
+func (e *cancelingEngine) wrote() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writes++
+	if e.writes == e.after {
+		e.cancel()
+	}
+}
+
+func (e *cancelingEngine) Insert(collection string, doc []byte) (string, error) {
+	id, err := e.MemoryEngine.Insert(collection, doc)
+	if err == nil && collection == "c" {
+		e.wrote()
+	}
+	return id, err
+}
+
+func (e *cancelingEngine) Update(collection, id string, doc []byte) ([]byte, error) {
+	stored, err := e.MemoryEngine.Update(collection, id, doc)
+	if err == nil && collection == "c" {
+		e.wrote()
+	}
+	return stored, err
+}
+
+func (e *cancelingEngine) Delete(collection, id string) (int, error) {
+	n, err := e.MemoryEngine.Delete(collection, id)
+	if err == nil && collection == "c" {
+		e.wrote()
+	}
+	return n, err
+}
+
+func TestCanceledContext(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	coll := client.Database().Collection("c")
+	if _, err := coll.InsertOne(M{"_id": "a", "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{name: "InsertOne", run: func() error {
+			_, err := coll.InsertOneContext(ctx, M{"_id": "b"})
+			return err
+		}},
+		{name: "InsertMany", run: func() error {
+			_, err := coll.InsertManyContext(ctx, []interface{}{M{"_id": "b"}})
+			return err
+		}},
+		{name: "FindOne", run: func() error {
+			return coll.FindOneContext(ctx, M{"_id": "a"}).Err()
+		}},
+		{name: "Find", run: func() error {
+			_, err := coll.FindContext(ctx, M{})
+			return err
+		}},
+		{name: "UpdateOne", run: func() error {
+			_, err := coll.UpdateOneContext(ctx, M{"_id": "a"}, M{"$set": M{"n": 2}})
+			return err
+		}},
+		{name: "UpdateMany", run: func() error {
+			_, err := coll.UpdateManyContext(ctx, M{}, M{"$set": M{"n": 2}})
+			return err
+		}},
+		{name: "DeleteOne", run: func() error {
+			_, err := coll.DeleteOneContext(ctx, M{"_id": "a"})
+			return err
+		}},
+		{name: "DeleteMany", run: func() error {
+			_, err := coll.DeleteManyContext(ctx, M{})
+			return err
+		}},
+		{name: "CountDocuments", run: func() error {
+			_, err := coll.CountDocumentsContext(ctx, M{})
+			return err
+		}},
+		{name: "Drop", run: func() error {
+			return coll.DropContext(ctx)
+		}},
+		{name: "ListCollectionNames", run: func() error {
+			_, err := client.Database().ListCollectionNamesContext(ctx)
+			return err
+		}},
+		{name: "Sync", run: func() error {
+			return client.SyncContext(ctx)
+		}},
+		{name: "CreateVectorCollection", run: func() error {
+			return client.CreateVectorCollectionContext(ctx, "v", NewVectorConfig(3))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want context.Canceled", err)
+			}
+		})
+	}
+
+	var doc struct{ N int }
+	if err := coll.FindOne(M{"_id": "a"}).Decode(&doc); err != nil || doc.N != 1 {
+		t.Errorf("FindOne(_id a) = %+v, %v; want it unchanged", doc, err)
+	}
+	if n, err := coll.CountDocuments(M{}); err != nil || n != 1 {
+		t.Errorf("CountDocuments = %d, %v, want 1", n, err)
+	}
+}
+
+func TestContextCanceledMidway(t *testing.T) {
+	tests := []struct {
+		name string
+		// run makes a write of five documents and returns how many it
+		// reports done
+		run         func(ctx context.Context, coll *Collection) (int64, error)
+		written     M     // filter for the documents the write reached
+		wantWritten int64 // documents matching written afterwards
+		wantLeft    int64 // documents left in the collection
+	}{
+		{name: "InsertMany", run: func(ctx context.Context, coll *Collection) (int64, error) {
+			result, err := coll.InsertManyContext(ctx, []interface{}{M{"i": 5}, M{"i": 6}, M{"i": 7}, M{"i": 8}, M{"i": 9}})
+			if result == nil {
+				return -1, err
+			}
+			return int64(len(result.InsertedIDs)), err
+		}, written: M{"i": M{"$gte": 5}}, wantWritten: 2, wantLeft: 7},
+		{name: "UpdateMany", run: func(ctx context.Context, coll *Collection) (int64, error) {
+			result, err := coll.UpdateManyContext(ctx, M{}, M{"$set": M{"done": true}})
+			if result == nil {
+				return -1, err
+			}
+			if result.MatchedCount != 5 {
+				t.Errorf("MatchedCount = %d, want 5", result.MatchedCount)
+			}
+			return result.ModifiedCount, err
+		}, written: M{"done": true}, wantWritten: 2, wantLeft: 5},
+		{name: "DeleteMany", run: func(ctx context.Context, coll *Collection) (int64, error) {
+			result, err := coll.DeleteManyContext(ctx, M{})
+			if result == nil {
+				return -1, err
+			}
+			return result.DeletedCount, err
+		}, written: M{"i": M{"$lt": 2}}, wantWritten: 0, wantLeft: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &cancelingEngine{MemoryEngine: NewMemoryEngine()}
+			coll := newMemoryClient(t, engine).Database().Collection("c")
+			for i := 0; i < 5; i++ {
+				if _, err := coll.InsertOne(M{"i": i}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The context is canceled by the second write
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			engine.mu.Lock()
+			engine.cancel, engine.after, engine.writes = cancel, 2, 0
+			engine.mu.Unlock()
+
+			done, err := tt.run(ctx, coll)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want context.Canceled", err)
+			}
+			if done != 2 {
+				t.Errorf("reported %d documents written, want 2", done)
+			}
+			if n, err := coll.CountDocuments(M{}); err != nil || n != tt.wantLeft {
+				t.Errorf("CountDocuments = %d, %v, want %d", n, err, tt.wantLeft)
+			}
+			if n, err := coll.CountDocuments(tt.written); err != nil || n != tt.wantWritten {
+				t.Errorf("CountDocuments(%v) = %d, %v, want %d", tt.written, n, err, tt.wantWritten)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ============================================================================
+// Cursor
+// ============================================================================
+
+// defaultBatchSize is the number of documents fetched from the engine at a
+// time when FindOptions.BatchSize is not set
+const defaultBatchSize = 1000
+
+// Cursor allows iteration over query results.
+//
+// A cursor returned by Find pages through the collection lazily: it fetches
+// BatchSize documents at a time from the engine and filters each batch as it
+// goes, so only the current batch is held in memory. A sorted query is the
+// exception, since sorting needs every matching document.
+type Cursor struct {
+	// source; nil engine for a cursor over a fixed slice
+	ctx        context.Context
+	engine     Engine
+	view       *sync.RWMutex // taken shared around each batch; nil in a transaction
+	collection string
+	filter     M
+	match      docMatcher
+	plan       *queryPlan
+	ids        []string // documents of an id lookup or index scan not yet read
+	sort       D
+	proj       *projection
+	batchSize  int
+	registry   *Registry
+	useNumber  bool // read numbers as json.Number
+	ordered    bool // keep the stored field order of each document
+
+	skip  int
+	limit int // negative for no limit
+
+	started   bool
+	pushDown  bool // skip and limit are applied by the engine
+	offset    int  // engine position of the next batch
+	exhausted bool // the engine has no more documents
+	batch     []Document
+	skipped   int
+	returned  int
+	examined  int // documents read from the engine
+
+	orders       map[string]D // stored documents not yet returned by _id, when ordered
+	current      Document
+	currentOrder D
+	decoded      bool
+	err          error
+	closed       bool
+}
+
+// NewCursor creates a new cursor from documents
+func NewCursor(docs []Document) *Cursor {
+	return &Cursor{
+		ctx:       context.Background(),
+		registry:  DefaultRegistry,
+		batch:     docs,
+		limit:     -1,
+		started:   true,
+		exhausted: true,
+	}
+}
+
+// newErrorCursor returns an empty cursor whose Err reports err
+func newErrorCursor(err error) *Cursor {
+	c := NewCursor(nil)
+	c.err = err
+	return c
+}
+
+// Limit sets the maximum number of documents to return. It has no effect
+// once iteration has started.
+func (c *Cursor) Limit(n int) *Cursor {
+	if !c.started || c.engine == nil {
+		c.limit = n
+	}
+	return c
+}
+
+// Skip sets the number of documents to skip. It has no effect once
+// iteration has started.
+func (c *Cursor) Skip(n int) *Cursor {
+	if !c.started || c.engine == nil {
+		c.skip = n
+	}
+	return c
+}
+
+// All returns all remaining documents as a slice and closes the cursor
+func (c *Cursor) All() ([]Document, error) {
+	defer c.Close()
+
+	docs := []Document{}
+	for c.Next() {
+		docs = append(docs, c.current)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return docs, nil
+}
+
+// Next advances the cursor to the next document, fetching further batches
+// as needed. It returns false when the results are exhausted or an error
+// occurred; check Err to tell the two apart.
+func (c *Cursor) Next() bool {
+	return c.advance(true)
+}
+
+// TryNext is like Next but fetches at most one further batch. It returns
+// false if that batch held no matching document, even if later batches might.
+func (c *Cursor) TryNext() bool {
+	return c.advance(false)
+}
+
+// RemainingBatchLength returns the number of documents Next can return
+// from the current batch before another fetch is needed
+func (c *Cursor) RemainingBatchLength() int {
+	n := len(c.batch) - max(c.skip-c.skipped, 0)
+	if c.limit >= 0 {
+		n = min(n, c.limit-c.returned)
+	}
+	return max(n, 0)
+}
+
+// Err returns the error that stopped iteration, if any
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close releases the cursor's buffered documents. Next returns false
+// afterwards.
+func (c *Cursor) Close() error {
+	c.closed = true
+	c.batch = nil
+	c.orders = nil
+	c.current = nil
+	c.currentOrder = nil
+	return nil
+}
+
+// takeOrder returns the stored field order of a document read by an
+// ordered cursor and forgets it
+func (c *Cursor) takeOrder(doc Document) D {
+	if c.orders == nil {
+		return nil
+	}
+	id := doc.ID()
+	order := c.orders[id]
+	delete(c.orders, id)
+	return order
+}
+
+// allOrdered is All for an ordered cursor, also returning the stored field
+// order of each document
+func (c *Cursor) allOrdered() ([]Document, []D, error) {
+	defer c.Close()
+
+	docs := []Document{}
+	var orders []D
+	for c.Next() {
+		docs = append(docs, c.current)
+		orders = append(orders, c.currentOrder)
+	}
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+	return docs, orders, nil
+}
+
+// Decode decodes the current document into the provided value. If Next has
+// not been called since the last Decode, it advances the cursor first.
+// Decoding into a *D gives the fields in sorted order, or in stored order
+// for a cursor of FindRaw.
+func (c *Cursor) Decode(v interface{}) error {
+	if c.current == nil || c.decoded {
+		if !c.Next() {
+			if c.err != nil {
+				return c.err
+			}
+			return errors.New("cursor exhausted")
+		}
+	}
+	c.decoded = true
+	if d, ok := v.(*D); ok && c.currentOrder != nil {
+		*d = orderLike(c.current, c.currentOrder).(D)
+		return nil
+	}
+	return c.registry.decodeDocument(c.current, v)
+}
+
+func (c *Cursor) advance(wait bool) bool {
+	if c.closed || c.err != nil {
+		return false
+	}
+	if c.limit >= 0 && c.returned >= c.limit {
+		return false
+	}
+	if !c.started && !c.start() {
+		return false
+	}
+
+	for {
+		for len(c.batch) > 0 {
+			doc := c.batch[0]
+			c.batch = c.batch[1:]
+			order := c.takeOrder(doc)
+			if c.skipped < c.skip {
+				c.skipped++
+				continue
+			}
+			c.current = c.proj.apply(doc)
+			c.currentOrder = order
+			c.decoded = false
+			c.returned++
+			return true
+		}
+
+		if c.exhausted || !c.fill() {
+			c.current = nil
+			return false
+		}
+		if !wait && len(c.batch) == 0 {
+			return false
+		}
+	}
+}
+
+// start prepares an engine-backed cursor for its first fetch. Without a
+// filter or sort, skip and limit are pushed down to the engine. A sorted
+// cursor reads every matching document up front and sorts them.
+func (c *Cursor) start() bool {
+	c.started = true
+	c.pushDown = len(c.filter) == 0 && len(c.sort) == 0 && !c.readsIDs()
+	if c.pushDown {
+		c.offset = c.skip
+		c.skipped = c.skip
+	}
+	if len(c.sort) == 0 {
+		return true
+	}
+
+	var all []Document
+	for !c.exhausted {
+		if !c.fill() {
+			return false
+		}
+		all = append(all, c.batch...)
+	}
+	if err := sortDocuments(all, c.sort); err != nil {
+		c.err = err
+		return false
+	}
+	c.batch = all
+	return true
+}
+
+// fill fetches the next batch from the engine and filters it
+func (c *Cursor) fill() bool {
+	if err := c.ctx.Err(); err != nil {
+		c.err = err
+		return false
+	}
+
+	size := c.batchSize
+	if c.pushDown && c.limit >= 0 && c.limit-c.returned < size {
+		size = c.limit - c.returned
+	}
+
+	var docs []Document
+	var ordered []D
+	if c.readsIDs() {
+		var err error
+		if docs, ordered, err = c.fetchIDs(size); err != nil {
+			c.err = err
+			return false
+		}
+	} else {
+		unlock := rlock(c.view)
+		data, err := c.engine.FindAll(c.collection, size, c.offset)
+		unlock()
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if docs, ordered, err = c.decodeBatch(data); err != nil {
+			c.err = err
+			return false
+		}
+		c.offset += len(docs)
+		c.examined += len(docs)
+		if len(docs) < size {
+			c.exhausted = true
+		}
+	}
+
+	if c.match != nil {
+		kept := 0
+		for i, doc := range docs {
+			if err := c.ctx.Err(); err != nil {
+				c.err = err
+				return false
+			}
+			if c.match(doc) {
+				docs[kept] = doc
+				if ordered != nil {
+					ordered[kept] = ordered[i]
+				}
+				kept++
+			}
+		}
+		docs = docs[:kept]
+	}
+
+	if ordered != nil {
+		if c.orders == nil {
+			c.orders = make(map[string]D)
+		}
+		for i, doc := range docs {
+			c.orders[doc.ID()] = ordered[i]
+		}
+	}
+	c.batch = docs
+	return true
+}
+
+// decodeBatch decodes a JSON array of stored documents. An ordered cursor
+// also returns them as D values.
+func (c *Cursor) decodeBatch(data []byte) ([]Document, []D, error) {
+	if !c.ordered {
+		docs, err := unmarshalDocuments(data, c.useNumber)
+		return docs, nil, err
+	}
+	ordered, err := unmarshalOrderedDocuments(data, c.useNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	docs := make([]Document, len(ordered))
+	for i, d := range ordered {
+		docs[i] = documentFromD(d)
+	}
+	return docs, ordered, nil
+}
+
+// readsIDs reports whether the cursor reads documents by id rather than
+// scanning the collection
+func (c *Cursor) readsIDs() bool {
+	return c.plan != nil && c.plan.kind != PlanCollectionScan
+}
+
+// fetchIDs reads the next size documents chosen by the plan. Documents that
+// no longer exist are skipped.
+func (c *Cursor) fetchIDs(size int) ([]Document, []D, error) {
+	if size > len(c.ids) {
+		size = len(c.ids)
+	}
+	batch := c.ids[:size]
+	c.ids = c.ids[size:]
+	if len(c.ids) == 0 {
+		c.exhausted = true
+	}
+
+	defer rlock(c.view)()
+	docs := make([]Document, 0, len(batch))
+	var ordered []D
+	for _, id := range batch {
+		data, err := c.engine.FindByID(c.collection, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if data == nil {
+			continue
+		}
+		c.examined++
+		if !c.ordered {
+			doc, err := unmarshalDocument(data, c.useNumber)
+			if err != nil {
+				return nil, nil, err
+			}
+			docs = append(docs, doc)
+			continue
+		}
+		d, err := unmarshalOrdered(data, c.useNumber)
+		if err != nil {
+			return nil, nil, err
+		}
+		docs = append(docs, documentFromD(d))
+		ordered = append(ordered, d)
+	}
+	return docs, ordered, nil
+}
@@ -0,0 +1,195 @@
+package keradb
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// scanCountingEngine counts the documents each collection scan returns
+type scanCountingEngine struct {
+	*MemoryEngine
+	mu      sync.Mutex
+	scanned map[string]int
+}
+
+func newScanCountingEngine() *scanCountingEngine {
+	return &scanCountingEngine{MemoryEngine: NewMemoryEngine(), scanned: map[string]int{}}
+}
+
+func (e *scanCountingEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	data, err := e.MemoryEngine.FindAll(collection, limit, skip)
+	if err == nil {
+		var docs []json.RawMessage
+		json.Unmarshal(data, &docs)
+		e.mu.Lock()
+		e.scanned[collection] += len(docs)
+		e.mu.Unlock()
+	}
+	return data, err
+}
+
+// newBatchCollection returns a collection of ten documents {i: 0} to
+// {i: 9} whose engine counts the documents scanned
+func newBatchCollection(t *testing.T) (*Collection, *scanCountingEngine) {
+	t.Helper()
+	engine := newScanCountingEngine()
+	coll := newMemoryClient(t, engine).Database().Collection("c")
+	for i := 0; i < 10; i++ {
+		if _, err := coll.InsertOne(M{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine.scanned["c"] = 0
+	return coll, engine
+}
+
+func TestCursorFetchesLazily(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter M
+		opts   *FindOptions
+		// documents scanned and left in the batch after each Next
+		wantScanned   []int
+		wantRemaining []int
+	}{
+		{name: "batches", opts: NewFindOptions().SetBatchSize(4),
+			wantScanned: []int{4, 4, 4, 4, 8, 8, 8, 8, 10, 10}, wantRemaining: []int{3, 2, 1, 0, 3, 2, 1, 0, 1, 0}},
+		{name: "filtered", filter: M{"i": M{"$gte": 5}}, opts: NewFindOptions().SetBatchSize(4),
+			wantScanned: []int{8, 8, 8, 10, 10}, wantRemaining: []int{2, 1, 0, 1, 0}},
+		{name: "limit", opts: NewFindOptions().SetBatchSize(4).SetLimit(3),
+			wantScanned: []int{3, 3, 3}, wantRemaining: []int{2, 1, 0}},
+		{name: "sorted", opts: NewFindOptions().SetBatchSize(4).SetSort(D{{Key: "i", Value: -1}}).SetLimit(2),
+			wantScanned: []int{10, 10}, wantRemaining: []int{1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll, engine := newBatchCollection(t)
+			cur := coll.Find(tt.filter, tt.opts)
+			defer cur.Close()
+			if got := engine.scanned["c"]; got != 0 {
+				t.Fatalf("Find scanned %d documents before Next", got)
+			}
+
+			var scanned, remaining []int
+			for cur.Next() {
+				scanned = append(scanned, engine.scanned["c"])
+				remaining = append(remaining, cur.RemainingBatchLength())
+			}
+			if err := cur.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(scanned, tt.wantScanned) {
+				t.Errorf("scanned %v, want %v", scanned, tt.wantScanned)
+			}
+			if !reflect.DeepEqual(remaining, tt.wantRemaining) {
+				t.Errorf("RemainingBatchLength %v, want %v", remaining, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestCursorTryNext(t *testing.T) {
+	coll, engine := newBatchCollection(t)
+	cur := coll.Find(M{"i": M{"$gte": 7}}, NewFindOptions().SetBatchSize(3))
+	defer cur.Close()
+
+	// Each TryNext reads one batch and gives up if nothing in it matches
+	for _, want := range []int{3, 6} {
+		if cur.TryNext() {
+			t.Fatalf("TryNext found a document after scanning %d", engine.scanned["c"])
+		}
+		if err := cur.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if got := engine.scanned["c"]; got != want {
+			t.Errorf("scanned %d documents, want %d", got, want)
+		}
+	}
+
+	var got []int
+	for cur.TryNext() {
+		var doc struct{ I int }
+		if err := cur.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, doc.I)
+	}
+	if !reflect.DeepEqual(got, []int{7, 8, 9}) {
+		t.Errorf("TryNext returned %v, want [7 8 9]", got)
+	}
+	if cur.TryNext() || cur.Next() {
+		t.Error("the exhausted cursor returned a document")
+	}
+}
+
+func TestRemainingBatchLength(t *testing.T) {
+	docs := func() []Document {
+		var docs []Document
+		for _, id := range []string{"a", "b", "c", "d", "e"} {
+			docs = append(docs, Document{"_id": id})
+		}
+		return docs
+	}
+	tests := []struct {
+		name        string
+		skip, limit int
+		want        int
+		wantAfter   int // after one Next
+	}{
+		{name: "all", limit: -1, want: 5, wantAfter: 4},
+		{name: "skip", skip: 2, limit: -1, want: 3, wantAfter: 2},
+		{name: "limit", limit: 2, want: 2, wantAfter: 1},
+		{name: "skip and limit", skip: 3, limit: 4, want: 2, wantAfter: 1},
+		{name: "skip past the end", skip: 7, limit: -1, want: 0, wantAfter: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cur := NewCursor(docs()).Skip(tt.skip).Limit(tt.limit)
+			if got := cur.RemainingBatchLength(); got != tt.want {
+				t.Errorf("RemainingBatchLength() = %d, want %d", got, tt.want)
+			}
+			cur.Next()
+			if got := cur.RemainingBatchLength(); got != tt.wantAfter {
+				t.Errorf("after Next, RemainingBatchLength() = %d, want %d", got, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestCursorClose(t *testing.T) {
+	coll, _ := newBatchCollection(t)
+	cur, err := coll.find(context.Background(), M{"i": M{"$lt": 8}}, true, NewFindOptions().SetBatchSize(4).SetSkip(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stored order of each document is kept until it is returned
+	if !cur.Next() {
+		t.Fatal(cur.Err())
+	}
+	if cur.currentOrder == nil {
+		t.Error("the current document has no stored order")
+	}
+	if got := len(cur.orders); got != cur.RemainingBatchLength() {
+		t.Errorf("cursor keeps %d stored orders with %d documents left in the batch", got, cur.RemainingBatchLength())
+	}
+
+	if err := cur.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cur.orders != nil || cur.batch != nil || cur.current != nil {
+		t.Error("Close kept buffered documents")
+	}
+	if cur.Next() || cur.TryNext() {
+		t.Error("Next returned a document after Close")
+	}
+	if got := cur.RemainingBatchLength(); got != 0 {
+		t.Errorf("RemainingBatchLength() = %d after Close", got)
+	}
+	if err := cur.Err(); err != nil {
+		t.Errorf("Err() = %v after Close", err)
+	}
+}
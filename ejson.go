@@ -0,0 +1,249 @@
+package keradb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Extended JSON
+// ============================================================================
+
+// Documents cross the engine boundary as JSON, which has no integers beyond
+// 2^53, dates or binary data. Values that plain JSON cannot hold exactly are
+// stored in KeraDB Extended JSON instead:
+//
+//	int64, uint64            {"$numberLong": "42"}
+//	int, uint beyond ±2^53   {"$numberLong": "9007199254740993"}
+//	uint64 beyond int64      {"$decimal": "18446744073709551615"}
+//	time.Time                {"$date": "2024-01-02T03:04:05.123456789Z"}
+//	[]byte                   {"$binary": {"base64": "AQI=", "subType": "00"}}
+//	Decimal                  {"$decimal": "1.10"}
+//
+// Every int64 is wrapped, whatever its size, so a field written as an int64
+// reads back as an int64 rather than a float64. Smaller integer types are
+// plain JSON numbers while they fit in a float64. A uint64 too large for an
+// int64 is kept exact as a Decimal.
+//
+// Reading a document turns these wrappers back into the Go values. Plain
+// JSON numbers are read as float64, or as json.Number when the client was
+// created with SetUseJSONNumber(true); an integer too large for a float64
+// is read as an int64 either way.
+
+// Decimal is a decimal number kept as its exact text, such as "0.10". It is
+// stored as {"$decimal": "0.10"} and compares with other numbers by value.
+type Decimal string
+
+// ParseDecimal validates a decimal number
+func ParseDecimal(s string) (Decimal, error) {
+	if _, ok := new(big.Float).SetString(s); !ok {
+		return "", fmt.Errorf("invalid decimal: %q", s)
+	}
+	return Decimal(s), nil
+}
+
+// String returns the decimal text
+func (d Decimal) String() string {
+	return string(d)
+}
+
+// maxSafeInteger is the largest integer magnitude every value up to which
+// survives a round trip through float64
+const maxSafeInteger = 1 << 53
+
+// marshalStored encodes a document as the JSON the engine stores
+func marshalStored(doc interface{}) ([]byte, error) {
+	return json.Marshal(toExtendedJSON(doc))
+}
+
+// toExtendedJSON replaces the values plain JSON cannot hold exactly with
+// Extended JSON wrappers
+func toExtendedJSON(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, elem := range x {
+			out[k] = toExtendedJSON(elem)
+		}
+		return out
+	case Document:
+		return toExtendedJSON(map[string]interface{}(x))
+	case M:
+		return toExtendedJSON(map[string]interface{}(x))
+	case D:
+		out := make(D, len(x))
+		for i, e := range x {
+			out[i] = E{Key: e.Key, Value: toExtendedJSON(e.Value)}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, elem := range x {
+			out[i] = toExtendedJSON(elem)
+		}
+		return out
+	case time.Time:
+		return map[string]interface{}{"$date": x.UTC().Format(time.RFC3339Nano)}
+	case []byte:
+		return map[string]interface{}{"$binary": map[string]interface{}{
+			"base64":  base64.StdEncoding.EncodeToString(x),
+			"subType": "00",
+		}}
+	case Decimal:
+		return map[string]interface{}{"$decimal": string(x)}
+	case int64:
+		return map[string]interface{}{"$numberLong": strconv.FormatInt(x, 10)}
+	case uint64:
+		if x > math.MaxInt64 {
+			return map[string]interface{}{"$decimal": strconv.FormatUint(x, 10)}
+		}
+		return map[string]interface{}{"$numberLong": strconv.FormatUint(x, 10)}
+	case uint:
+		if x > maxSafeInteger {
+			return toExtendedJSON(uint64(x))
+		}
+	case int:
+		if x > maxSafeInteger || x < -maxSafeInteger {
+			return map[string]interface{}{"$numberLong": strconv.Itoa(x)}
+		}
+	}
+	return v
+}
+
+// unmarshalDocument decodes a stored document
+func unmarshalDocument(data []byte, useNumber bool) (Document, error) {
+	var doc map[string]interface{}
+	if err := decodeStored(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	return Document(fromExtendedJSON(doc, useNumber).(map[string]interface{})), nil
+}
+
+// unmarshalDocuments decodes a JSON array of stored documents
+func unmarshalDocuments(data []byte, useNumber bool) ([]Document, error) {
+	var raw []map[string]interface{}
+	if err := decodeStored(data, &raw); err != nil {
+		return nil, err
+	}
+	docs := make([]Document, len(raw))
+	for i, doc := range raw {
+		docs[i] = Document(fromExtendedJSON(doc, useNumber).(map[string]interface{}))
+	}
+	return docs, nil
+}
+
+func decodeStored(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// fromExtendedJSON replaces Extended JSON wrappers with Go values and
+// converts numbers, in a value decoded with UseNumber
+func fromExtendedJSON(v interface{}, useNumber bool) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		s := x.String()
+		if !strings.ContainsAny(s, ".eE") {
+			if n, err := x.Int64(); err == nil && (n > maxSafeInteger || n < -maxSafeInteger) {
+				return n
+			}
+		}
+		if useNumber {
+			return x
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i, elem := range x {
+			x[i] = fromExtendedJSON(elem, useNumber)
+		}
+		return x
+	case map[string]interface{}:
+		if len(x) <= 2 {
+			if value, ok := parseExtendedJSON(x); ok {
+				return value
+			}
+		}
+		for k, elem := range x {
+			x[k] = fromExtendedJSON(elem, useNumber)
+		}
+		return x
+	case D:
+		if len(x) <= 2 {
+			if value, ok := parseExtendedJSON(plainValue(x).(map[string]interface{})); ok {
+				return value
+			}
+		}
+		for i := range x {
+			x[i].Value = fromExtendedJSON(x[i].Value, useNumber)
+		}
+		return x
+	}
+	return v
+}
+
+// parseExtendedJSON decodes a single Extended JSON wrapper. A map that is
+// not a well-formed wrapper is left alone.
+func parseExtendedJSON(m map[string]interface{}) (interface{}, bool) {
+	if len(m) == 1 {
+		if s, ok := m["$numberLong"].(string); ok {
+			n, err := strconv.ParseInt(s, 10, 64)
+			return n, err == nil
+		}
+		if s, ok := m["$decimal"].(string); ok {
+			d, err := ParseDecimal(s)
+			return d, err == nil
+		}
+		if arg, ok := m["$date"]; ok {
+			return parseDate(arg)
+		}
+		if b, ok := m["$binary"].(map[string]interface{}); ok {
+			s, _ := b["base64"].(string)
+			data, err := base64.StdEncoding.DecodeString(s)
+			return data, err == nil
+		}
+	}
+
+	// Legacy binary form: {"$binary": "<base64>", "$type": "<hex>"}
+	if s, ok := m["$binary"].(string); ok {
+		if t, ok := m["$type"].(string); ok || len(m) == 1 {
+			if _, err := hex.DecodeString(t); err != nil && ok {
+				return nil, false
+			}
+			data, err := base64.StdEncoding.DecodeString(s)
+			return data, err == nil
+		}
+	}
+	return nil, false
+}
+
+// parseDate decodes the argument of $date: an RFC 3339 string, or
+// milliseconds since the Unix epoch as a number or a $numberLong
+func parseDate(arg interface{}) (interface{}, bool) {
+	switch d := arg.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, d)
+		return t.UTC(), err == nil
+	case json.Number:
+		ms, err := d.Int64()
+		return time.UnixMilli(ms).UTC(), err == nil
+	case map[string]interface{}:
+		if s, ok := d["$numberLong"].(string); ok && len(d) == 1 {
+			ms, err := strconv.ParseInt(s, 10, 64)
+			return time.UnixMilli(ms).UTC(), err == nil
+		}
+	}
+	return nil, false
+}
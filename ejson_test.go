@@ -0,0 +1,156 @@
+package keradb
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtendedJSONEncoding(t *testing.T) {
+	when := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "small int64", value: int64(7), want: `{"$numberLong":"7"}`},
+		{name: "negative int64", value: int64(-3), want: `{"$numberLong":"-3"}`},
+		{name: "large int64", value: int64(1)<<53 + 1, want: `{"$numberLong":"9007199254740993"}`},
+		{name: "min int64", value: int64(math.MinInt64), want: `{"$numberLong":"-9223372036854775808"}`},
+		{name: "small int", value: 42, want: `42`},
+		{name: "int at 2^53", value: 1 << 53, want: `9007199254740992`},
+		{name: "int beyond 2^53", value: 1<<53 + 1, want: `{"$numberLong":"9007199254740993"}`},
+		{name: "small uint", value: uint(5), want: `5`},
+		{name: "small uint64", value: uint64(5), want: `{"$numberLong":"5"}`},
+		{name: "max int64 as uint64", value: uint64(math.MaxInt64), want: `{"$numberLong":"9223372036854775807"}`},
+		{name: "uint64 beyond int64", value: uint64(math.MaxUint64), want: `{"$decimal":"18446744073709551615"}`},
+		{name: "float64", value: 1.5, want: `1.5`},
+		{name: "time", value: when, want: `{"$date":"2024-05-06T07:08:09.123456789Z"}`},
+		{name: "bytes", value: []byte{0, 1, 2}, want: `{"$binary":{"base64":"AAEC","subType":"00"}}`},
+		{name: "decimal", value: Decimal("0.10"), want: `{"$decimal":"0.10"}`},
+		{name: "nested", value: M{"a": []interface{}{int64(1)}}, want: `{"a":[{"$numberLong":"1"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := marshalStored(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("marshalStored(%#v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendedJSONRoundTrip(t *testing.T) {
+	when := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	tests := []struct {
+		name      string
+		value     interface{}
+		useNumber bool
+		want      interface{}
+	}{
+		{name: "small int64", value: int64(7), want: int64(7)},
+		{name: "large int64", value: int64(-1) << 60, want: int64(-1) << 60},
+		{name: "small int", value: 42, want: float64(42)},
+		{name: "small int as json.Number", value: 42, useNumber: true, want: json.Number("42")},
+		{name: "int beyond 2^53", value: 1<<53 + 1, want: int64(1)<<53 + 1},
+		{name: "uint64", value: uint64(9), want: int64(9)},
+		{name: "uint64 beyond int64", value: uint64(math.MaxUint64), want: Decimal("18446744073709551615")},
+		{name: "time", value: when, want: when},
+		{name: "bytes", value: []byte{0, 1, 2}, want: []byte{0, 1, 2}},
+		{name: "decimal", value: Decimal("0.10"), want: Decimal("0.10")},
+		{name: "nested int64", value: M{"n": int64(3)}, want: map[string]interface{}{"n": int64(3)}},
+		{name: "array of int64", value: []interface{}{int64(1), 2}, want: []interface{}{int64(1), float64(2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := marshalStored(M{"v": tt.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := unmarshalDocument(data, tt.useNumber)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := doc["v"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("round trip of %#v = %#v, want %#v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendedJSONDecoding(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{name: "plain integer beyond 2^53", data: `9007199254740993`, want: int64(9007199254740993)},
+		{name: "$numberLong", data: `{"$numberLong":"12"}`, want: int64(12)},
+		{name: "malformed $numberLong", data: `{"$numberLong":"x"}`, want: map[string]interface{}{"$numberLong": "x"}},
+		{name: "$date as milliseconds", data: `{"$date":1700000000000}`, want: time.UnixMilli(1700000000000).UTC()},
+		{name: "$date as $numberLong", data: `{"$date":{"$numberLong":"1700000000000"}}`, want: time.UnixMilli(1700000000000).UTC()},
+		{name: "legacy $binary", data: `{"$binary":"AAEC","$type":"00"}`, want: []byte{0, 1, 2}},
+		{name: "wrapper with extra keys", data: `{"$numberLong":"1","x":1}`, want: map[string]interface{}{"$numberLong": "1", "x": float64(1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := unmarshalDocument([]byte(`{"v":`+tt.data+`}`), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := doc["v"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %s as %#v, want %#v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtendedJSONStoredValues(t *testing.T) {
+	type record struct {
+		ID    string `json:"_id"`
+		Count int    `json:"count"`
+		Total int64  `json:"total"`
+		Max   uint64 `json:"max"`
+	}
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	in := record{ID: "a", Count: 3, Total: 1<<62 + 1, Max: math.MaxUint64}
+	if _, err := coll.InsertOne(in); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter M
+		want   int64
+	}{
+		{name: "int64 by value", filter: M{"total": int64(1)<<62 + 1}, want: 1},
+		{name: "int64 neighbour", filter: M{"total": int64(1) << 62}, want: 0},
+		{name: "int64 is a long", filter: M{"total": M{"$type": "long"}}, want: 1},
+		{name: "int is a plain number", filter: M{"count": M{"$type": "double"}}, want: 1},
+		{name: "uint64 beyond int64", filter: M{"max": M{"$gt": int64(math.MaxInt64)}}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := coll.CountDocuments(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want {
+				t.Errorf("CountDocuments(%v) = %d, want %d", tt.filter, n, tt.want)
+			}
+		})
+	}
+
+	var out record
+	if err := coll.FindOne(M{"_id": "a"}).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("decoded %+v, want %+v", out, in)
+	}
+}
@@ -0,0 +1,336 @@
+package keradb
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ============================================================================
+// Storage Engine
+// ============================================================================
+
+// Engine is the storage backend behind a Client. It mirrors the native
+// keradb C API one method per FFI call: documents, configs and results cross
+// it as JSON, exactly as they do over the C boundary, so every engine sees
+// the same payloads the native library does.
+//
+// Two implementations ship with the package: the cgo-backed native engine
+// (the default, requires libkeradb) and MemoryEngine, a pure-Go engine that
+// needs no native library and is useful for tests and CI.
+//
+// A method that reports a missing document or vector by returning nil or
+// false must return an error only when the call itself failed, so callers
+// can tell "not found" from a failure.
+//
+// A Client calls its engine from many goroutines at once, so an engine must
+// be safe for concurrent use. The Client calls Close once, after every other
+// call has returned, and makes no calls afterwards.
+type Engine interface {
+	// Insert stores a document and returns its ID.
+	Insert(collection string, doc []byte) (string, error)
+	// FindByID returns the document with the given ID, or nil if there is none.
+	FindByID(collection, id string) ([]byte, error)
+	// Update replaces the document with the given ID and returns the stored document.
+	Update(collection, id string, doc []byte) ([]byte, error)
+	// Delete removes the document with the given ID and returns the number of
+	// documents removed.
+	Delete(collection, id string) (int, error)
+	// FindAll returns a JSON array of documents. A negative limit or skip
+	// means no limit or no skip.
+	FindAll(collection string, limit, skip int) ([]byte, error)
+	// Count returns the number of documents in a collection.
+	Count(collection string) (int, error)
+	// ListCollections returns a JSON array of [name, count] pairs.
+	ListCollections() ([]byte, error)
+	// Sync flushes all changes to durable storage.
+	Sync() error
+	// Close releases the engine. No other method may be called afterwards.
+	Close() error
+
+	// CreateVectorCollection creates a vector collection from a JSON VectorConfig.
+	CreateVectorCollection(name string, config []byte) error
+	// ListVectorCollections returns a JSON array of {name, count} objects.
+	ListVectorCollections() ([]byte, error)
+	// DropVectorCollection deletes a vector collection.
+	DropVectorCollection(name string) (bool, error)
+	// InsertVector stores a JSON embedding with JSON metadata and returns the JSON ID.
+	InsertVector(collection string, vector, metadata []byte) ([]byte, error)
+	// InsertText stores text with JSON metadata and returns the JSON ID.
+	InsertText(collection, text string, metadata []byte) ([]byte, error)
+	// VectorSearch returns the JSON search results for a JSON query vector.
+	VectorSearch(collection string, query []byte, k int) ([]byte, error)
+	// VectorSearchText returns the JSON search results for a text query.
+	VectorSearchText(collection, text string, k int) ([]byte, error)
+	// VectorSearchFiltered returns the JSON search results for a JSON query
+	// vector restricted by a JSON MetadataFilter.
+	VectorSearchFiltered(collection string, query []byte, k int, filter []byte) ([]byte, error)
+	// GetVector returns the JSON vector document with the given ID, or nil if
+	// there is none.
+	GetVector(collection string, id VectorID) ([]byte, error)
+	// DeleteVector removes the vector document with the given ID.
+	DeleteVector(collection string, id VectorID) (bool, error)
+	// VectorStats returns JSON VectorCollectionStats for a vector collection.
+	VectorStats(collection string) ([]byte, error)
+}
+
+// openMode selects how the native engine opens its database file
+type openMode int
+
+const (
+	openOrCreate openMode = iota
+	openExisting
+	createNew
+)
+
+// ----------------------------------------------------------------------------
+// FFI Lock
+// ----------------------------------------------------------------------------
+
+// ffiLock serializes the calls made through one native database handle.
+// A failing call leaves its message in the library's last-error slot,
+// which the next call on the same thread may overwrite; holding the lock
+// from before the call until the message has been read, on a goroutine
+// pinned to its OS thread, makes reading the message atomic with the call.
+//
+// The library keeps the last error per thread, so calls through different
+// handles, which hold different locks, cannot see each other's messages.
+type ffiLock struct {
+	mu sync.Mutex
+}
+
+// lock takes the lock and pins the goroutine to its thread. It returns the
+// function that undoes both.
+func (l *ffiLock) lock() func() {
+	runtime.LockOSThread()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		runtime.UnlockOSThread()
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Guarded Engine
+// ----------------------------------------------------------------------------
+
+// guardedEngine wraps the engine of a Client and counts the calls in
+// flight. Once Close has begun, new calls fail with ErrClosed; Close waits
+// for the calls already running to return before it closes the wrapped
+// engine, so no call can reach an engine that has been released.
+type guardedEngine struct {
+	engine Engine
+
+	mu      sync.Mutex
+	idle    *sync.Cond // signalled when active drops to zero
+	active  int
+	closing bool
+	closed  chan struct{}
+	err     error // result of closing engine
+}
+
+func newGuardedEngine(engine Engine) *guardedEngine {
+	g := &guardedEngine{engine: engine, closed: make(chan struct{})}
+	g.idle = sync.NewCond(&g.mu)
+	return g
+}
+
+// acquire registers a call, failing with ErrClosed once Close has begun
+func (g *guardedEngine) acquire() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closing {
+		return ErrClosed
+	}
+	g.active++
+	return nil
+}
+
+// release ends a call registered by acquire
+func (g *guardedEngine) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.active == 0 {
+		g.idle.Broadcast()
+	}
+}
+
+// isClosed reports whether Close has begun
+func (g *guardedEngine) isClosed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closing
+}
+
+// Close refuses new calls, waits for the running ones and closes the
+// wrapped engine. Later calls wait for the first to finish and return its
+// result.
+func (g *guardedEngine) Close() error {
+	g.mu.Lock()
+	if g.closing {
+		g.mu.Unlock()
+		<-g.closed
+		return g.err
+	}
+	g.closing = true
+	for g.active > 0 {
+		g.idle.Wait()
+	}
+	g.mu.Unlock()
+
+	g.err = g.engine.Close()
+	close(g.closed)
+	return g.err
+}
+
+func (g *guardedEngine) Insert(collection string, doc []byte) (string, error) {
+	if err := g.acquire(); err != nil {
+		return "", err
+	}
+	defer g.release()
+	return g.engine.Insert(collection, doc)
+}
+
+func (g *guardedEngine) FindByID(collection, id string) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.FindByID(collection, id)
+}
+
+func (g *guardedEngine) Update(collection, id string, doc []byte) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.Update(collection, id, doc)
+}
+
+func (g *guardedEngine) Delete(collection, id string) (int, error) {
+	if err := g.acquire(); err != nil {
+		return 0, err
+	}
+	defer g.release()
+	return g.engine.Delete(collection, id)
+}
+
+func (g *guardedEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.FindAll(collection, limit, skip)
+}
+
+func (g *guardedEngine) Count(collection string) (int, error) {
+	if err := g.acquire(); err != nil {
+		return 0, err
+	}
+	defer g.release()
+	return g.engine.Count(collection)
+}
+
+func (g *guardedEngine) ListCollections() ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.ListCollections()
+}
+
+func (g *guardedEngine) Sync() error {
+	if err := g.acquire(); err != nil {
+		return err
+	}
+	defer g.release()
+	return g.engine.Sync()
+}
+
+func (g *guardedEngine) CreateVectorCollection(name string, config []byte) error {
+	if err := g.acquire(); err != nil {
+		return err
+	}
+	defer g.release()
+	return g.engine.CreateVectorCollection(name, config)
+}
+
+func (g *guardedEngine) ListVectorCollections() ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.ListVectorCollections()
+}
+
+func (g *guardedEngine) DropVectorCollection(name string) (bool, error) {
+	if err := g.acquire(); err != nil {
+		return false, err
+	}
+	defer g.release()
+	return g.engine.DropVectorCollection(name)
+}
+
+func (g *guardedEngine) InsertVector(collection string, vector, metadata []byte) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.InsertVector(collection, vector, metadata)
+}
+
+func (g *guardedEngine) InsertText(collection, text string, metadata []byte) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.InsertText(collection, text, metadata)
+}
+
+func (g *guardedEngine) VectorSearch(collection string, query []byte, k int) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.VectorSearch(collection, query, k)
+}
+
+func (g *guardedEngine) VectorSearchText(collection, text string, k int) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.VectorSearchText(collection, text, k)
+}
+
+func (g *guardedEngine) VectorSearchFiltered(collection string, query []byte, k int, filter []byte) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.VectorSearchFiltered(collection, query, k, filter)
+}
+
+func (g *guardedEngine) GetVector(collection string, id VectorID) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.GetVector(collection, id)
+}
+
+func (g *guardedEngine) DeleteVector(collection string, id VectorID) (bool, error) {
+	if err := g.acquire(); err != nil {
+		return false, err
+	}
+	defer g.release()
+	return g.engine.DeleteVector(collection, id)
+}
+
+func (g *guardedEngine) VectorStats(collection string) ([]byte, error) {
+	if err := g.acquire(); err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.engine.VectorStats(collection)
+}
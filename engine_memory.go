@@ -0,0 +1,637 @@
+package keradb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// Memory Engine
+// ============================================================================
+
+// MemoryEngine is a pure-Go Engine that keeps everything in memory. It needs
+// neither cgo nor libkeradb, so code written against Client, Database and
+// Collection can be exercised anywhere the Go toolchain runs:
+//
+//	client, _ := keradb.Connect("test.ndb",
+//		keradb.NewClientOptions().SetEngine(keradb.NewMemoryEngine()))
+//
+// Documents are stored as the JSON the SDK sends, with "_id" placed first,
+// and are returned in insertion order. Nothing is written to disk.
+// Text-based vector operations are not supported because there is no
+// embedding provider.
+type MemoryEngine struct {
+	mu          sync.RWMutex
+	closed      bool
+	collections map[string]*memCollection
+	vectors     map[string]*memVectorCollection
+}
+
+// memCollection holds the documents of one collection in insertion order
+type memCollection struct {
+	docs  map[string][]byte
+	order []string // deleted IDs are blanked out until the next compaction
+	pos   map[string]int
+	holes int
+}
+
+// memVectorCollection holds the vectors of one vector collection
+type memVectorCollection struct {
+	config VectorConfig
+	docs   map[VectorID]*VectorDocument
+	order  []VectorID
+	nextID VectorID
+}
+
+// NewMemoryEngine creates an empty in-memory engine
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{
+		collections: make(map[string]*memCollection),
+		vectors:     make(map[string]*memVectorCollection),
+	}
+}
+
+// rawField is a single top-level field of a JSON object, in document order
+type rawField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// splitObject splits a JSON object into its top-level fields, keeping order
+func splitObject(data []byte) ([]rawField, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, errors.New("document must be a JSON object")
+	}
+
+	var fields []rawField
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, rawField{Key: tok.(string), Value: value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// joinObject is the inverse of splitObject
+func joinObject(fields []rawField) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(f.Value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// withID rebuilds a document with its "_id" field set to id and moved to the front
+func withID(fields []rawField, id string) []byte {
+	idJSON, _ := json.Marshal(id)
+	out := []rawField{{Key: "_id", Value: idJSON}}
+	for _, f := range fields {
+		if f.Key != "_id" {
+			out = append(out, f)
+		}
+	}
+	return joinObject(out)
+}
+
+// newUUID returns a random (version 4) UUID string
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func (c *memCollection) add(id string, doc []byte) {
+	c.pos[id] = len(c.order)
+	c.order = append(c.order, id)
+	c.docs[id] = doc
+}
+
+func (c *memCollection) remove(id string) {
+	c.order[c.pos[id]] = ""
+	delete(c.pos, id)
+	delete(c.docs, id)
+	c.holes++
+
+	if c.holes > len(c.order)/2 {
+		order := make([]string, 0, len(c.docs))
+		for _, id := range c.order {
+			if id != "" {
+				c.pos[id] = len(order)
+				order = append(order, id)
+			}
+		}
+		c.order = order
+		c.holes = 0
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Documents
+// ----------------------------------------------------------------------------
+
+func (e *MemoryEngine) Insert(collection string, doc []byte) (string, error) {
+	fields, err := splitObject(doc)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	for _, f := range fields {
+		if f.Key == "_id" && string(f.Value) != "null" {
+			if err := json.Unmarshal(f.Value, &id); err != nil {
+				return "", errors.New("_id must be a string")
+			}
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return "", ErrClosed
+	}
+
+	coll, ok := e.collections[collection]
+	if !ok {
+		coll = &memCollection{
+			docs: make(map[string][]byte),
+			pos:  make(map[string]int),
+		}
+		e.collections[collection] = coll
+	}
+
+	if id == "" {
+		id = newUUID()
+	} else if _, exists := coll.docs[id]; exists {
+		return "", fmt.Errorf("document with _id %q already exists: %w", id, ErrDuplicateKey)
+	}
+
+	coll.add(id, withID(fields, id))
+	return id, nil
+}
+
+func (e *MemoryEngine) FindByID(collection, id string) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	coll, ok := e.collections[collection]
+	if !ok {
+		return nil, nil
+	}
+	return coll.docs[id], nil
+}
+
+func (e *MemoryEngine) Update(collection, id string, doc []byte) ([]byte, error) {
+	fields, err := splitObject(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	coll, ok := e.collections[collection]
+	if !ok {
+		return nil, fmt.Errorf("document not found: %s", id)
+	}
+	if _, ok := coll.docs[id]; !ok {
+		return nil, fmt.Errorf("document not found: %s", id)
+	}
+
+	stored := withID(fields, id)
+	coll.docs[id] = stored
+	return stored, nil
+}
+
+func (e *MemoryEngine) Delete(collection, id string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return 0, ErrClosed
+	}
+
+	coll, ok := e.collections[collection]
+	if !ok {
+		return 0, nil
+	}
+	if _, ok := coll.docs[id]; !ok {
+		return 0, nil
+	}
+	coll.remove(id)
+	return 1, nil
+}
+
+func (e *MemoryEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	if coll, ok := e.collections[collection]; ok {
+		n := 0
+		for _, id := range coll.order {
+			if id == "" {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if limit >= 0 && n >= limit {
+				break
+			}
+			if n > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(coll.docs[id])
+			n++
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+func (e *MemoryEngine) Count(collection string) (int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return 0, ErrClosed
+	}
+
+	if coll, ok := e.collections[collection]; ok {
+		return len(coll.docs), nil
+	}
+	return 0, nil
+}
+
+func (e *MemoryEngine) ListCollections() ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	names := make([]string, 0, len(e.collections))
+	for name := range e.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([][2]interface{}, len(names))
+	for i, name := range names {
+		pairs[i] = [2]interface{}{name, len(e.collections[name].docs)}
+	}
+	return json.Marshal(pairs)
+}
+
+func (e *MemoryEngine) Sync() error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (e *MemoryEngine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	e.collections = nil
+	e.vectors = nil
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Vectors
+// ----------------------------------------------------------------------------
+
+var errNoEmbeddingProvider = errors.New("memory engine has no embedding provider")
+
+func (e *MemoryEngine) vectorCollection(name string) (*memVectorCollection, error) {
+	if e.closed {
+		return nil, ErrClosed
+	}
+	coll, ok := e.vectors[name]
+	if !ok {
+		return nil, fmt.Errorf("vector %w: %s", ErrCollectionNotFound, name)
+	}
+	return coll, nil
+}
+
+func (e *MemoryEngine) CreateVectorCollection(name string, config []byte) error {
+	var cfg VectorConfig
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return err
+	}
+	if cfg.Dimensions <= 0 {
+		return errors.New("dimensions must be positive")
+	}
+	if cfg.Distance == "" {
+		cfg.Distance = Cosine
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	if _, exists := e.vectors[name]; exists {
+		return fmt.Errorf("vector collection already exists: %s", name)
+	}
+
+	e.vectors[name] = &memVectorCollection{
+		config: cfg,
+		docs:   make(map[VectorID]*VectorDocument),
+		nextID: 1,
+	}
+	return nil
+}
+
+func (e *MemoryEngine) ListVectorCollections() ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return nil, ErrClosed
+	}
+
+	type entry struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	entries := make([]entry, 0, len(e.vectors))
+	for name, coll := range e.vectors {
+		entries = append(entries, entry{Name: name, Count: len(coll.docs)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return json.Marshal(entries)
+}
+
+func (e *MemoryEngine) DropVectorCollection(name string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return false, ErrClosed
+	}
+
+	if _, ok := e.vectors[name]; !ok {
+		return false, nil
+	}
+	delete(e.vectors, name)
+	return true, nil
+}
+
+func (e *MemoryEngine) InsertVector(collection string, vector, metadata []byte) ([]byte, error) {
+	var embedding Embedding
+	if err := json.Unmarshal(vector, &embedding); err != nil {
+		return nil, err
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(metadata, &meta); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	coll, err := e.vectorCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if len(embedding) != coll.config.Dimensions {
+		return nil, fmt.Errorf("%w: expected %d, got %d", ErrDimensionMismatch, coll.config.Dimensions, len(embedding))
+	}
+
+	id := coll.nextID
+	coll.nextID++
+	coll.docs[id] = &VectorDocument{ID: id, Embedding: &embedding, Metadata: meta}
+	coll.order = append(coll.order, id)
+	return json.Marshal(id)
+}
+
+func (e *MemoryEngine) InsertText(collection, text string, metadata []byte) ([]byte, error) {
+	return nil, errNoEmbeddingProvider
+}
+
+func (e *MemoryEngine) VectorSearch(collection string, query []byte, k int) ([]byte, error) {
+	return e.search(collection, query, k, nil)
+}
+
+func (e *MemoryEngine) VectorSearchText(collection, text string, k int) ([]byte, error) {
+	return nil, errNoEmbeddingProvider
+}
+
+func (e *MemoryEngine) VectorSearchFiltered(collection string, query []byte, k int, filter []byte) ([]byte, error) {
+	var f MetadataFilter
+	if err := json.Unmarshal(filter, &f); err != nil {
+		return nil, err
+	}
+	return e.search(collection, query, k, &f)
+}
+
+// search ranks every vector in the collection against query by brute force
+func (e *MemoryEngine) search(collection string, query []byte, k int, filter *MetadataFilter) ([]byte, error) {
+	var q Embedding
+	if err := json.Unmarshal(query, &q); err != nil {
+		return nil, err
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	coll, err := e.vectorCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if len(q) != coll.config.Dimensions {
+		return nil, fmt.Errorf("%w: expected %d, got %d", ErrDimensionMismatch, coll.config.Dimensions, len(q))
+	}
+
+	results := []VectorSearchResult{}
+	for _, id := range coll.order {
+		doc, ok := coll.docs[id]
+		if !ok {
+			continue
+		}
+		if filter != nil && !matchesMetadataFilter(doc.Metadata, *filter) {
+			continue
+		}
+		results = append(results, VectorSearchResult{
+			Document: *doc,
+			Score:    vectorDistance(coll.config.Distance, q, *doc.Embedding),
+		})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score < results[j].Score })
+	if k >= 0 && k < len(results) {
+		results = results[:k]
+	}
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+	return json.Marshal(results)
+}
+
+func (e *MemoryEngine) GetVector(collection string, id VectorID) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	coll, err := e.vectorCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := coll.docs[id]
+	if !ok {
+		return nil, nil
+	}
+	return json.Marshal(doc)
+}
+
+func (e *MemoryEngine) DeleteVector(collection string, id VectorID) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	coll, err := e.vectorCollection(collection)
+	if err != nil {
+		return false, err
+	}
+
+	if _, ok := coll.docs[id]; !ok {
+		return false, nil
+	}
+	delete(coll.docs, id)
+	for i, other := range coll.order {
+		if other == id {
+			coll.order = append(coll.order[:i], coll.order[i+1:]...)
+			break
+		}
+	}
+	return true, nil
+}
+
+func (e *MemoryEngine) VectorStats(collection string) ([]byte, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	coll, err := e.vectorCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := VectorCollectionStats{
+		VectorCount:   len(coll.docs),
+		Dimensions:    coll.config.Dimensions,
+		Distance:      coll.config.Distance,
+		MemoryUsage:   int64(len(coll.docs) * coll.config.Dimensions * 4),
+		LayerCount:    1,
+		LazyEmbedding: coll.config.LazyEmbedding != nil && *coll.config.LazyEmbedding,
+	}
+	if coll.config.Compression != nil {
+		mode := coll.config.Compression.Mode
+		stats.Compression = &mode
+	}
+	return json.Marshal(stats)
+}
+
+// vectorDistance computes the distance between a and b, smaller is closer
+func vectorDistance(metric Distance, a, b Embedding) float32 {
+	var dot, normA, normB, l1, l2 float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		normA += x * x
+		normB += y * y
+		l1 += math.Abs(x - y)
+		l2 += (x - y) * (x - y)
+	}
+
+	switch metric {
+	case Euclidean:
+		return float32(math.Sqrt(l2))
+	case DotProduct:
+		return float32(-dot)
+	case Manhattan:
+		return float32(l1)
+	default:
+		if normA == 0 || normB == 0 {
+			return 1
+		}
+		return float32(1 - dot/(math.Sqrt(normA)*math.Sqrt(normB)))
+	}
+}
+
+// matchesMetadataFilter evaluates a MetadataFilter against vector metadata
+func matchesMetadataFilter(metadata map[string]interface{}, filter MetadataFilter) bool {
+	value, exists := metadata[filter.Field]
+
+	switch filter.Condition {
+	case "eq":
+		return exists && valuesEqual(value, filter.Value)
+	case "ne":
+		return !exists || !valuesEqual(value, filter.Value)
+	case "gt":
+		return exists && compareGT(value, filter.Value)
+	case "gte":
+		return exists && compareGTE(value, filter.Value)
+	case "lt":
+		return exists && compareLT(value, filter.Value)
+	case "lte":
+		return exists && compareLTE(value, filter.Value)
+	case "in":
+		return exists && containsValue(filter.Value, value)
+	case "not_in":
+		return !exists || !containsValue(filter.Value, value)
+	case "contains":
+		if s, ok := value.(string); ok {
+			sub, ok := filter.Value.(string)
+			return ok && strings.Contains(s, sub)
+		}
+		return containsValue(value, filter.Value)
+	case "starts_with":
+		s, ok := value.(string)
+		prefix, ok2 := filter.Value.(string)
+		return ok && ok2 && strings.HasPrefix(s, prefix)
+	case "ends_with":
+		s, ok := value.(string)
+		suffix, ok2 := filter.Value.(string)
+		return ok && ok2 && strings.HasSuffix(s, suffix)
+	}
+	return false
+}
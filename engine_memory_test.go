@@ -0,0 +1,395 @@
+package keradb
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// storedIDs returns the _id of each document in a JSON array
+func storedIDs(t *testing.T, data []byte) []string {
+	t.Helper()
+	var docs []struct {
+		ID string `json:"_id"`
+	}
+	if err := json.Unmarshal(data, &docs); err != nil {
+		t.Fatalf("invalid document array %s: %v", data, err)
+	}
+	ids := make([]string, len(docs))
+	for i, d := range docs {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func newMemoryClient(t *testing.T, engine Engine) *Client {
+	t.Helper()
+	client, err := Connect("memory.ndb", NewClientOptions().SetEngine(engine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestMemoryEngineInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantID  string // empty to accept a generated ID
+		wantErr error
+	}{
+		{name: "supplied id", doc: `{"_id":"a","n":1}`, wantID: "a"},
+		{name: "generated id", doc: `{"n":1}`},
+		{name: "null id", doc: `{"_id":null,"n":1}`},
+		{name: "taken id", doc: `{"_id":"taken"}`, wantErr: ErrDuplicateKey},
+		{name: "numeric id", doc: `{"_id":1}`, wantErr: errors.New("_id must be a string")},
+		{name: "not an object", doc: `[1]`, wantErr: errors.New("document must be a JSON object")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewMemoryEngine()
+			if _, err := e.Insert("c", []byte(`{"_id":"taken"}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := e.Insert("c", []byte(tt.doc))
+			if tt.wantErr != nil {
+				if err == nil || !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("id = %q, want %q", id, tt.wantID)
+			}
+			if id == "" {
+				t.Fatal("no id assigned")
+			}
+
+			stored, err := e.FindByID("c", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields, err := splitObject(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fields[0].Key != "_id" || string(fields[0].Value) != `"`+id+`"` {
+				t.Errorf("stored %s, want _id %q first", stored, id)
+			}
+		})
+	}
+}
+
+func TestMemoryEngineFindAll(t *testing.T) {
+	e := NewMemoryEngine()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := e.Insert("c", []byte(`{"_id":"`+id+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := e.Delete("c", "b"); err != nil || n != 1 {
+		t.Fatalf("delete = %d, %v", n, err)
+	}
+
+	tests := []struct {
+		limit, skip int
+		want        []string
+	}{
+		{limit: -1, skip: 0, want: []string{"a", "c", "d", "e"}},
+		{limit: 2, skip: 0, want: []string{"a", "c"}},
+		{limit: -1, skip: 1, want: []string{"c", "d", "e"}},
+		{limit: 2, skip: 2, want: []string{"d", "e"}},
+		{limit: 0, skip: 0, want: []string{}},
+		{limit: -1, skip: 10, want: []string{}},
+	}
+	for _, tt := range tests {
+		data, err := e.FindAll("c", tt.limit, tt.skip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := storedIDs(t, data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FindAll(limit %d, skip %d) = %v, want %v", tt.limit, tt.skip, got, tt.want)
+		}
+	}
+
+	data, err := e.FindAll("missing", -1, 0)
+	if err != nil || string(data) != "[]" {
+		t.Errorf("FindAll of a missing collection = %s, %v", data, err)
+	}
+}
+
+func TestMemoryEngineKeepsOrderAcrossCompaction(t *testing.T) {
+	e := NewMemoryEngine()
+	var want []string
+	for i := 0; i < 20; i++ {
+		id := string(rune('a' + i))
+		if _, err := e.Insert("c", []byte(`{"_id":"`+id+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			want = append(want, id)
+		}
+	}
+	// Deleting two thirds of the documents compacts the collection
+	for i := 0; i < 20; i++ {
+		if i%3 != 0 {
+			if _, err := e.Delete("c", string(rune('a'+i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	data, err := e.FindAll("c", -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storedIDs(t, data); !reflect.DeepEqual(got, want) {
+		t.Errorf("order after deletes = %v, want %v", got, want)
+	}
+	if n, _ := e.Count("c"); n != len(want) {
+		t.Errorf("count = %d, want %d", n, len(want))
+	}
+}
+
+func TestMemoryEngineUpdateAndDelete(t *testing.T) {
+	tests := []struct {
+		name       string
+		collection string
+		id         string
+		wantFound  bool
+	}{
+		{name: "existing", collection: "c", id: "a", wantFound: true},
+		{name: "missing document", collection: "c", id: "zz"},
+		{name: "missing collection", collection: "none", id: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewMemoryEngine()
+			if _, err := e.Insert("c", []byte(`{"_id":"a","n":1}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := e.Update(tt.collection, tt.id, []byte(`{"_id":"other","n":2}`))
+			if !tt.wantFound {
+				if err == nil {
+					t.Fatal("update of a missing document succeeded")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if string(stored) != `{"_id":"a","n":2}` {
+				t.Errorf("update stored %s, want the _id kept", stored)
+			}
+
+			found, err := e.FindByID(tt.collection, tt.id)
+			if err != nil || (found != nil) != tt.wantFound {
+				t.Errorf("FindByID = %s, %v", found, err)
+			}
+
+			n, err := e.Delete(tt.collection, tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]int{true: 1, false: 0}[tt.wantFound]; n != want {
+				t.Errorf("delete = %d, want %d", n, want)
+			}
+			if n, _ := e.Delete(tt.collection, tt.id); n != 0 {
+				t.Errorf("second delete = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestMemoryEngineListCollections(t *testing.T) {
+	e := NewMemoryEngine()
+	for _, c := range []string{"b", "a", "b"} {
+		if _, err := e.Insert(c, []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := e.ListCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `[["a",1],["b",2]]` {
+		t.Errorf("ListCollections = %s", data)
+	}
+}
+
+func TestMemoryEngineClosed(t *testing.T) {
+	e := NewMemoryEngine()
+	if _, err := e.Insert("c", []byte(`{"_id":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := map[string]func() error{
+		"Insert":   func() error { _, err := e.Insert("c", []byte(`{}`)); return err },
+		"FindByID": func() error { _, err := e.FindByID("c", "a"); return err },
+		"Update":   func() error { _, err := e.Update("c", "a", []byte(`{}`)); return err },
+		"Delete":   func() error { _, err := e.Delete("c", "a"); return err },
+		"FindAll":  func() error { _, err := e.FindAll("c", -1, 0); return err },
+		"Count":    func() error { _, err := e.Count("c"); return err },
+		"Sync":     e.Sync,
+		"GetVector": func() error {
+			_, err := e.GetVector("v", 1)
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, ErrClosed) {
+			t.Errorf("%s after Close: got %v, want ErrClosed", name, err)
+		}
+	}
+}
+
+func TestMemoryEngineVectorSearch(t *testing.T) {
+	vectors := []Embedding{{1, 0}, {0, 1}, {0.9, 0.1}, {-1, 0}}
+	tests := []struct {
+		distance Distance
+		query    Embedding
+		want     []VectorID
+	}{
+		{distance: Cosine, query: Embedding{1, 0}, want: []VectorID{1, 3, 2}},
+		{distance: Euclidean, query: Embedding{0, 1}, want: []VectorID{2, 3, 1}},
+		{distance: DotProduct, query: Embedding{-1, 0}, want: []VectorID{4, 2, 3}},
+		{distance: Manhattan, query: Embedding{-1, 0.2}, want: []VectorID{4, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.distance), func(t *testing.T) {
+			client := newMemoryClient(t, NewMemoryEngine())
+			if err := client.CreateVectorCollection("v", NewVectorConfig(2).WithDistance(tt.distance)); err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range vectors {
+				if _, err := client.InsertVector("v", v, M{"x": 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			results, err := client.VectorSearch("v", tt.query, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]VectorID, len(results))
+			for i, r := range results {
+				got[i] = r.Document.ID
+				if r.Rank != i+1 {
+					t.Errorf("result %d has rank %d", i, r.Rank)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("search = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryEngineVectorErrors(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	if err := client.CreateVectorCollection("v", NewVectorConfig(2)); err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.InsertVector("v", Embedding{1, 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{name: "insert wrong dimensions", want: ErrDimensionMismatch, call: func() error {
+			_, err := client.InsertVector("v", Embedding{1, 2, 3}, nil)
+			return err
+		}},
+		{name: "search wrong dimensions", want: ErrDimensionMismatch, call: func() error {
+			_, err := client.VectorSearch("v", Embedding{1}, 1)
+			return err
+		}},
+		{name: "insert missing collection", want: ErrCollectionNotFound, call: func() error {
+			_, err := client.InsertVector("none", Embedding{1, 2}, nil)
+			return err
+		}},
+		{name: "stats missing collection", want: ErrCollectionNotFound, call: func() error {
+			_, err := client.VectorStats("none")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if doc, err := client.GetVector("v", id+100); err != nil || doc != nil {
+		t.Errorf("GetVector of a missing id = %v, %v; want nil, nil", doc, err)
+	}
+	if ok, err := client.DeleteVector("v", id); err != nil || !ok {
+		t.Errorf("DeleteVector = %v, %v", ok, err)
+	}
+	if ok, err := client.DeleteVector("v", id); err != nil || ok {
+		t.Errorf("second DeleteVector = %v, %v", ok, err)
+	}
+}
+
+func TestCollectionOnMemoryEngine(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("users")
+	docs := []interface{}{
+		M{"_id": "ann", "name": "Ann", "age": 31},
+		M{"_id": "bob", "name": "Bob", "age": 25},
+		M{"_id": "cid", "name": "Cid", "age": 40},
+	}
+	if _, err := coll.InsertMany(docs); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter Filter
+		want   []string
+	}{
+		{filter: nil, want: []string{"ann", "bob", "cid"}},
+		{filter: M{"_id": "bob"}, want: []string{"bob"}},
+		{filter: M{"age": M{"$gt": 30}}, want: []string{"ann", "cid"}},
+		{filter: M{"name": "Nobody"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		found, err := coll.Find(tt.filter).All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(found))
+		for i, doc := range found {
+			got[i] = doc.ID()
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Find(%v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	if _, err := coll.UpdateOne(M{"_id": "bob"}, M{"$set": M{"age": 26}}); err != nil {
+		t.Fatal(err)
+	}
+	var bob struct{ Age int }
+	if err := coll.FindOne(M{"_id": "bob"}).Decode(&bob); err != nil || bob.Age != 26 {
+		t.Errorf("after update: age %d, %v", bob.Age, err)
+	}
+
+	if res, err := coll.DeleteOne(M{"_id": "ann"}); err != nil || res.DeletedCount != 1 {
+		t.Fatalf("DeleteOne = %+v, %v", res, err)
+	}
+	if n, err := coll.CountDocuments(nil); err != nil || n != 2 {
+		t.Errorf("count after delete = %d, %v", n, err)
+	}
+	if err := coll.FindOne(M{"_id": "ann"}).Err(); !errors.Is(err, ErrNoDocuments) {
+		t.Errorf("FindOne of a deleted document: got %v, want ErrNoDocuments", err)
+	}
+}
@@ -0,0 +1,461 @@
+//go:build cgo && !keradb_nonative
+
+package keradb
+
+/*
+#cgo LDFLAGS: -L${SRCDIR}/../../../target/release -lkeradb
+#cgo linux LDFLAGS: -lkeradb -lm -ldl -lpthread
+#cgo darwin LDFLAGS: -lkeradb -lm -ldl -lpthread
+#cgo windows LDFLAGS: -lkeradb -lws2_32 -luserenv -lbcrypt -lntdll
+
+#include <stdlib.h>
+
+typedef void* KeraDB;
+
+KeraDB keradb_create(const char* path);
+KeraDB keradb_open(const char* path);
+void keradb_close(KeraDB db);
+char* keradb_insert(KeraDB db, const char* collection, const char* json_data);
+char* keradb_find_by_id(KeraDB db, const char* collection, const char* doc_id);
+char* keradb_update(KeraDB db, const char* collection, const char* doc_id, const char* json_data);
+int keradb_delete(KeraDB db, const char* collection, const char* doc_id);
+char* keradb_find_all(KeraDB db, const char* collection, int limit, int skip);
+int keradb_count(KeraDB db, const char* collection);
+char* keradb_list_collections(KeraDB db);
+int keradb_sync(KeraDB db);
+char* keradb_last_error();
+void keradb_free_string(char* s);
+
+// Vector FFI functions
+char* keradb_create_vector_collection(KeraDB db, const char* name, const char* config_json);
+char* keradb_list_vector_collections(KeraDB db);
+int keradb_drop_vector_collection(KeraDB db, const char* name);
+char* keradb_insert_vector(KeraDB db, const char* collection, const char* vector_json, const char* metadata_json);
+char* keradb_insert_text(KeraDB db, const char* collection, const char* text, const char* metadata_json);
+char* keradb_vector_search(KeraDB db, const char* collection, const char* query_vector_json, int k);
+char* keradb_vector_search_text(KeraDB db, const char* collection, const char* query_text, int k);
+char* keradb_vector_search_filtered(KeraDB db, const char* collection, const char* query_vector_json, int k, const char* filter_json);
+char* keradb_get_vector(KeraDB db, const char* collection, unsigned long long id);
+int keradb_delete_vector(KeraDB db, const char* collection, unsigned long long id);
+char* keradb_vector_stats(KeraDB db, const char* collection);
+*/
+import "C"
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"unsafe"
+)
+
+// nativeEngine is the Engine backed by the libkeradb C library
+type nativeEngine struct {
+	ffi ffiLock
+	db  C.KeraDB
+}
+
+// The library reports failures through keradb_last_error. Each handle has
+// an ffiLock that every call through it holds until a failure's message
+// has been read, so that the message is the call's own; calls through
+// different handles run in parallel.
+//
+// A message is only read after a call has reported a failure, by a
+// negative status or a NULL result. A NULL from a lookup means either that
+// nothing was found or that the call failed; the lookup's own message tells
+// which when it is absent or reports the document missing. Any other
+// message may be left over from an earlier call, so the engine then asks
+// the library a second, unambiguous question to tell them apart.
+
+// lastMessage returns and clears the library's last error message
+func lastMessage() string {
+	cErr := C.keradb_last_error()
+	if cErr == nil {
+		return ""
+	}
+	defer C.keradb_free_string(cErr)
+	return C.GoString(cErr)
+}
+
+// lastError returns the library's last error as a *NativeError for the
+// function op, which has just reported a failure with status code
+func lastError(op string, code int) error {
+	msg := lastMessage()
+	if msg == "" {
+		msg = "unknown error"
+	}
+	return &NativeError{Op: op, Code: code, Message: msg}
+}
+
+// lookupMissed reports whether a lookup that has just returned NULL found
+// nothing, going by the message it left: none, or one saying that the
+// document does not exist, or with emptyIfMissing its collection. For any
+// other message it returns false, and the caller asks a second question to
+// decide.
+func lookupMissed(emptyIfMissing bool) bool {
+	msg := strings.TrimSpace(lastMessage())
+	switch classifyMessage(msg) {
+	case errDocumentNotFound:
+		return true
+	case ErrCollectionNotFound:
+		return emptyIfMissing
+	}
+	return msg == ""
+}
+
+// statusError returns the error for a negative status returned by op. Zero
+// and positive statuses are results, such as a count of 0 for "not found".
+func statusError(op string, status C.int) error {
+	if status < 0 {
+		return lastError(op, int(status))
+	}
+	return nil
+}
+
+// missingIsEmpty drops the error of a call on a collection that does not
+// exist, for calls where such a collection just has no documents
+func missingIsEmpty(err error) error {
+	if errors.Is(err, ErrCollectionNotFound) {
+		return nil
+	}
+	return err
+}
+
+// takeString copies a string returned by the library and frees the original
+func takeString(s *C.char) []byte {
+	defer C.keradb_free_string(s)
+	return []byte(C.GoString(s))
+}
+
+// openNativeEngine opens the database at path with the native library
+func openNativeEngine(path string, mode openMode) (Engine, error) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+
+	// There is no handle to lock yet; staying on one thread is enough for
+	// a failure's message to be this call's own
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var db C.KeraDB
+	op := "keradb_open"
+	switch mode {
+	case openOrCreate:
+		// Try to open first, then create if it doesn't exist
+		db = C.keradb_open(cPath)
+		if db == nil {
+			db = C.keradb_create(cPath)
+			op = "keradb_create"
+		}
+	case openExisting:
+		db = C.keradb_open(cPath)
+	case createNew:
+		db = C.keradb_create(cPath)
+		op = "keradb_create"
+	}
+
+	if db == nil {
+		return nil, lastError(op, 0)
+	}
+	return &nativeEngine{db: db}, nil
+}
+
+func (e *nativeEngine) Insert(collection string, doc []byte) (string, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cJSON := C.CString(string(doc))
+	defer C.free(unsafe.Pointer(cJSON))
+
+	cID := C.keradb_insert(e.db, cCollection, cJSON)
+	if cID == nil {
+		return "", lastError("keradb_insert", 0)
+	}
+	return string(takeString(cID)), nil
+}
+
+func (e *nativeEngine) FindByID(collection, id string) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cID := C.CString(id)
+	defer C.free(unsafe.Pointer(cID))
+
+	cDoc := C.keradb_find_by_id(e.db, cCollection, cID)
+	if cDoc == nil {
+		if lookupMissed(true) {
+			return nil, nil
+		}
+		// Counting the collection fails too if the lookup failed because
+		// the collection cannot be read
+		return nil, missingIsEmpty(statusError("keradb_find_by_id", C.keradb_count(e.db, cCollection)))
+	}
+	return takeString(cDoc), nil
+}
+
+func (e *nativeEngine) Update(collection, id string, doc []byte) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cID := C.CString(id)
+	defer C.free(unsafe.Pointer(cID))
+
+	cJSON := C.CString(string(doc))
+	defer C.free(unsafe.Pointer(cJSON))
+
+	cResult := C.keradb_update(e.db, cCollection, cID, cJSON)
+	if cResult == nil {
+		return nil, lastError("keradb_update", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) Delete(collection, id string) (int, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cID := C.CString(id)
+	defer C.free(unsafe.Pointer(cID))
+
+	status := C.keradb_delete(e.db, cCollection, cID)
+	if err := missingIsEmpty(statusError("keradb_delete", status)); err != nil {
+		return 0, err
+	}
+	return int(status), nil
+}
+
+func (e *nativeEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cDocs := C.keradb_find_all(e.db, cCollection, C.int(limit), C.int(skip))
+	if cDocs == nil {
+		return nil, lastError("keradb_find_all", 0)
+	}
+	return takeString(cDocs), nil
+}
+
+func (e *nativeEngine) Count(collection string) (int, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	status := C.keradb_count(e.db, cCollection)
+	if err := missingIsEmpty(statusError("keradb_count", status)); err != nil {
+		return 0, err
+	}
+	return int(status), nil
+}
+
+func (e *nativeEngine) ListCollections() ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollections := C.keradb_list_collections(e.db)
+	if cCollections == nil {
+		return nil, lastError("keradb_list_collections", 0)
+	}
+	return takeString(cCollections), nil
+}
+
+func (e *nativeEngine) Sync() error {
+	defer e.ffi.lock()()
+
+	return statusError("keradb_sync", C.keradb_sync(e.db))
+}
+
+func (e *nativeEngine) Close() error {
+	defer e.ffi.lock()()
+
+	if e.db != nil {
+		C.keradb_close(e.db)
+		e.db = nil
+	}
+	return nil
+}
+
+func (e *nativeEngine) CreateVectorCollection(name string, config []byte) error {
+	defer e.ffi.lock()()
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	cConfig := C.CString(string(config))
+	defer C.free(unsafe.Pointer(cConfig))
+
+	cResult := C.keradb_create_vector_collection(e.db, cName, cConfig)
+	if cResult == nil {
+		return lastError("keradb_create_vector_collection", 0)
+	}
+	C.keradb_free_string(cResult)
+	return nil
+}
+
+func (e *nativeEngine) ListVectorCollections() ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cResult := C.keradb_list_vector_collections(e.db)
+	if cResult == nil {
+		return nil, lastError("keradb_list_vector_collections", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) DropVectorCollection(name string) (bool, error) {
+	defer e.ffi.lock()()
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	status := C.keradb_drop_vector_collection(e.db, cName)
+	if err := missingIsEmpty(statusError("keradb_drop_vector_collection", status)); err != nil {
+		return false, err
+	}
+	return status > 0, nil
+}
+
+func (e *nativeEngine) InsertVector(collection string, vector, metadata []byte) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cVector := C.CString(string(vector))
+	defer C.free(unsafe.Pointer(cVector))
+
+	cMetadata := C.CString(string(metadata))
+	defer C.free(unsafe.Pointer(cMetadata))
+
+	cResult := C.keradb_insert_vector(e.db, cCollection, cVector, cMetadata)
+	if cResult == nil {
+		return nil, lastError("keradb_insert_vector", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) InsertText(collection, text string, metadata []byte) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cText := C.CString(text)
+	defer C.free(unsafe.Pointer(cText))
+
+	cMetadata := C.CString(string(metadata))
+	defer C.free(unsafe.Pointer(cMetadata))
+
+	cResult := C.keradb_insert_text(e.db, cCollection, cText, cMetadata)
+	if cResult == nil {
+		return nil, lastError("keradb_insert_text", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) VectorSearch(collection string, query []byte, k int) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cVector := C.CString(string(query))
+	defer C.free(unsafe.Pointer(cVector))
+
+	cResult := C.keradb_vector_search(e.db, cCollection, cVector, C.int(k))
+	if cResult == nil {
+		return nil, lastError("keradb_vector_search", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) VectorSearchText(collection, text string, k int) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cText := C.CString(text)
+	defer C.free(unsafe.Pointer(cText))
+
+	cResult := C.keradb_vector_search_text(e.db, cCollection, cText, C.int(k))
+	if cResult == nil {
+		return nil, lastError("keradb_vector_search_text", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) VectorSearchFiltered(collection string, query []byte, k int, filter []byte) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cVector := C.CString(string(query))
+	defer C.free(unsafe.Pointer(cVector))
+
+	cFilter := C.CString(string(filter))
+	defer C.free(unsafe.Pointer(cFilter))
+
+	cResult := C.keradb_vector_search_filtered(e.db, cCollection, cVector, C.int(k), cFilter)
+	if cResult == nil {
+		return nil, lastError("keradb_vector_search_filtered", 0)
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) GetVector(collection string, id VectorID) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cResult := C.keradb_get_vector(e.db, cCollection, C.ulonglong(id))
+	if cResult == nil {
+		if lookupMissed(false) {
+			return nil, nil
+		}
+		// The stats of an existing collection can always be read, so a
+		// failure there is the failure of the lookup
+		cStats := C.keradb_vector_stats(e.db, cCollection)
+		if cStats == nil {
+			return nil, lastError("keradb_get_vector", 0)
+		}
+		C.keradb_free_string(cStats)
+		return nil, nil
+	}
+	return takeString(cResult), nil
+}
+
+func (e *nativeEngine) DeleteVector(collection string, id VectorID) (bool, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	status := C.keradb_delete_vector(e.db, cCollection, C.ulonglong(id))
+	if err := statusError("keradb_delete_vector", status); err != nil {
+		return false, err
+	}
+	return status > 0, nil
+}
+
+func (e *nativeEngine) VectorStats(collection string) ([]byte, error) {
+	defer e.ffi.lock()()
+
+	cCollection := C.CString(collection)
+	defer C.free(unsafe.Pointer(cCollection))
+
+	cResult := C.keradb_vector_stats(e.db, cCollection)
+	if cResult == nil {
+		return nil, lastError("keradb_vector_stats", 0)
+	}
+	return takeString(cResult), nil
+}
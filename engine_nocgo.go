@@ -0,0 +1,12 @@
+//go:build !cgo || keradb_nonative
+
+package keradb
+
+import "errors"
+
+// openNativeEngine reports that the native engine is unavailable: it needs
+// cgo and libkeradb, and is left out by the keradb_nonative build tag. Use
+// MemoryEngine via ClientOptions.SetEngine instead.
+func openNativeEngine(path string, mode openMode) (Engine, error) {
+	return nil, errors.New("native engine unavailable: built without cgo or with the keradb_nonative tag")
+}
@@ -0,0 +1,159 @@
+package keradb
+
+import (
+	"errors"
+	"testing"
+)
+
+// errEngineFailed is the failure injected by failingEngine
+var errEngineFailed = errors.New("engine failed")
+
+// failingEngine is a memory engine whose named methods fail with
+// errEngineFailed
+type failingEngine struct {
+	*MemoryEngine
+	fail map[string]bool
+}
+
+func (e *failingEngine) FindByID(collection, id string) ([]byte, error) {
+	if e.fail["FindByID"] {
+		return nil, errEngineFailed
+	}
+	return e.MemoryEngine.FindByID(collection, id)
+}
+
+func (e *failingEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	if e.fail["FindAll"] {
+		return nil, errEngineFailed
+	}
+	return e.MemoryEngine.FindAll(collection, limit, skip)
+}
+
+func (e *failingEngine) Delete(collection, id string) (int, error) {
+	if e.fail["Delete"] {
+		return 0, errEngineFailed
+	}
+	return e.MemoryEngine.Delete(collection, id)
+}
+
+func (e *failingEngine) Count(collection string) (int, error) {
+	if e.fail["Count"] {
+		return 0, errEngineFailed
+	}
+	return e.MemoryEngine.Count(collection)
+}
+
+func (e *failingEngine) Sync() error {
+	if e.fail["Sync"] {
+		return errEngineFailed
+	}
+	return e.MemoryEngine.Sync()
+}
+
+func (e *failingEngine) ListCollections() ([]byte, error) {
+	if e.fail["ListCollections"] {
+		return nil, errEngineFailed
+	}
+	return e.MemoryEngine.ListCollections()
+}
+
+func (e *failingEngine) DropVectorCollection(name string) (bool, error) {
+	if e.fail["DropVectorCollection"] {
+		return false, errEngineFailed
+	}
+	return e.MemoryEngine.DropVectorCollection(name)
+}
+
+func (e *failingEngine) GetVector(collection string, id VectorID) ([]byte, error) {
+	if e.fail["GetVector"] {
+		return nil, errEngineFailed
+	}
+	return e.MemoryEngine.GetVector(collection, id)
+}
+
+func (e *failingEngine) DeleteVector(collection string, id VectorID) (bool, error) {
+	if e.fail["DeleteVector"] {
+		return false, errEngineFailed
+	}
+	return e.MemoryEngine.DeleteVector(collection, id)
+}
+
+func TestEngineFailuresAreReported(t *testing.T) {
+	tests := []struct {
+		method string
+		run    func(client *Client) error
+	}{
+		{method: "FindAll", run: func(client *Client) error {
+			cur := client.Database().Collection("c").Find(M{"n": 1})
+			for cur.Next() {
+			}
+			return cur.Err()
+		}},
+		{method: "FindAll", run: func(client *Client) error {
+			_, err := client.Database().Collection("c").CountDocuments(M{"n": 1})
+			return err
+		}},
+		{method: "Count", run: func(client *Client) error {
+			_, err := client.Database().Collection("c").CountDocuments(M{})
+			return err
+		}},
+		{method: "FindByID", run: func(client *Client) error {
+			var doc M
+			return client.Database().Collection("c").FindOne(M{"_id": "a"}).Decode(&doc)
+		}},
+		{method: "FindByID", run: func(client *Client) error {
+			_, err := client.Database().Collection("c").DeleteOne(M{"_id": "a"})
+			return err
+		}},
+		{method: "Delete", run: func(client *Client) error {
+			_, err := client.Database().Collection("c").DeleteOne(M{"_id": "a"})
+			return err
+		}},
+		{method: "Delete", run: func(client *Client) error {
+			_, err := client.Database().Collection("c").DeleteMany(M{})
+			return err
+		}},
+		{method: "Sync", run: func(client *Client) error {
+			return client.Sync()
+		}},
+		{method: "ListCollections", run: func(client *Client) error {
+			_, err := client.Database().ListCollectionNames()
+			return err
+		}},
+		{method: "DropVectorCollection", run: func(client *Client) error {
+			_, err := client.DropVectorCollection("v")
+			return err
+		}},
+		{method: "GetVector", run: func(client *Client) error {
+			_, err := client.GetVector("v", 1)
+			return err
+		}},
+		{method: "DeleteVector", run: func(client *Client) error {
+			_, err := client.DeleteVector("v", 1)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			for _, fail := range []bool{false, true} {
+				engine := &failingEngine{MemoryEngine: NewMemoryEngine(), fail: map[string]bool{}}
+				client := newMemoryClient(t, engine)
+				if _, err := client.Database().Collection("c").InsertOne(M{"_id": "a", "n": 1}); err != nil {
+					t.Fatal(err)
+				}
+				if err := client.CreateVectorCollection("v", NewVectorConfig(2)); err != nil {
+					t.Fatal(err)
+				}
+
+				engine.fail[tt.method] = fail
+				err := tt.run(client)
+				if !fail && err != nil {
+					t.Fatalf("without a failure: %v", err)
+				}
+				if fail && !errors.Is(err, errEngineFailed) {
+					t.Errorf("got %v, want the engine failure", err)
+				}
+			}
+		})
+	}
+}
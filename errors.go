@@ -0,0 +1,97 @@
+package keradb
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// ============================================================================
+// Errors
+// ============================================================================
+
+// Errors returned by the SDK can be matched with errors.Is against these
+// sentinels, whichever engine produced them. Errors from the native library
+// are *NativeError values, which also match the sentinel their message
+// describes.
+var (
+	// ErrNoDocuments is returned by SingleResult.Decode and Err when the
+	// query matched no document
+	ErrNoDocuments = errors.New("no documents in result")
+	// ErrClosed is returned by operations on a closed client
+	ErrClosed = errors.New("database is closed")
+	// ErrDuplicateKey is matched by errors for documents whose _id or unique
+	// index key is already taken, including *DuplicateKeyError
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrDimensionMismatch is matched by errors for vectors whose length
+	// differs from the dimensions of their collection
+	ErrDimensionMismatch = errors.New("dimension mismatch")
+	// ErrCollectionNotFound is matched by errors for operations on a
+	// collection, of documents or of vectors, that does not exist
+	ErrCollectionNotFound = errors.New("collection not found")
+	// ErrWriteConflict is matched by the error of a transaction commit that
+	// failed because another writer changed a document the transaction
+	// wrote; Session.WithTransaction retries such transactions
+	ErrWriteConflict = errors.New("write conflict")
+	// ErrChangeHistoryLost is matched by the error of a change stream asked
+	// to resume after an event that is no longer in the change log, or
+	// reaching a change that could not be logged
+	ErrChangeHistoryLost = errors.New("change history lost")
+)
+
+// errDocumentNotFound is the sentinel of native messages reporting that a
+// lookup found no document; the SDK reports that as a nil document instead
+var errDocumentNotFound = errors.New("document not found")
+
+// NativeError is an error reported by the native library
+type NativeError struct {
+	// Op is the library function that failed, such as "keradb_insert"
+	Op string
+	// Code is the status the function returned, for functions that return
+	// one; it is 0 for functions that signal failure by returning NULL
+	Code int
+	// Message is the text of keradb_last_error
+	Message string
+}
+
+func (e *NativeError) Error() string {
+	return e.Op + ": " + e.Message
+}
+
+// Is reports whether the error is the sentinel its message describes, so
+// that errors.Is(err, ErrClosed) works for native errors as well
+func (e *NativeError) Is(target error) bool {
+	return target != nil && target == classifyMessage(e.Message)
+}
+
+// nativeErrors maps the messages of the native library to sentinels. The
+// library reports failures as text only: its C API defines no error codes,
+// and a failed call returns NULL or a negative status whatever the cause.
+// Nor does it document its messages, so these patterns are a best guess at
+// its wording and may miss a message it words differently; such a message
+// leaves a *NativeError that matches no sentinel. This table is the one
+// place that inspects the text. Each pattern must match the whole message:
+// a message that merely mentions a word, such as a collection named
+// "closed", is not mistaken for the error.
+var nativeErrors = []struct {
+	pattern *regexp.Regexp
+	err     error
+}{
+	{regexp.MustCompile(`(?i)^(database|db) (is |has been )?closed$`), ErrClosed},
+	{regexp.MustCompile(`(?i)^(vector )?dimension mismatch\b`), ErrDimensionMismatch},
+	{regexp.MustCompile(`(?i)^(vector )?collection( '?[^' ]*'?)? (not found|does not exist)(: .*)?$`), ErrCollectionNotFound},
+	{regexp.MustCompile(`(?i)^document with (_?id )?'?[^' ]*'? already exists$`), ErrDuplicateKey},
+	{regexp.MustCompile(`(?i)^duplicate key\b`), ErrDuplicateKey},
+	{regexp.MustCompile(`(?i)^(document|vector)( with (_?id )?'?[^' ]*'?| '?[^' ]*'?)? not found(: .*)?$`), errDocumentNotFound},
+}
+
+// classifyMessage maps the message of a native error to a sentinel, or nil
+func classifyMessage(msg string) error {
+	msg = strings.TrimSpace(msg)
+	for _, e := range nativeErrors {
+		if e.pattern.MatchString(msg) {
+			return e.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyMessage(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want error
+	}{
+		{msg: "Database is closed", want: ErrClosed},
+		{msg: "database closed", want: ErrClosed},
+		{msg: "DB has been closed", want: ErrClosed},
+		{msg: "Dimension mismatch: expected 3, got 2", want: ErrDimensionMismatch},
+		{msg: "Vector dimension mismatch", want: ErrDimensionMismatch},
+		{msg: "Collection 'docs' not found", want: ErrCollectionNotFound},
+		{msg: "Vector collection embeddings does not exist", want: ErrCollectionNotFound},
+		{msg: "Collection not found: docs", want: ErrCollectionNotFound},
+		{msg: "Document with ID 'abc' already exists", want: ErrDuplicateKey},
+		{msg: "Duplicate key: abc", want: ErrDuplicateKey},
+		{msg: "Document not found", want: errDocumentNotFound},
+		{msg: "Document with ID 'abc' not found", want: errDocumentNotFound},
+		{msg: "Vector 42 not found", want: errDocumentNotFound},
+		{msg: "  Database is closed\n", want: ErrClosed},
+
+		// Messages that only mention the words must not match
+		{msg: "collection 'closed' is empty", want: nil},
+		{msg: "cannot open file: connection closed by peer", want: nil},
+		{msg: "Collection 'docs' already exists", want: nil},
+		{msg: "Document 'a' not found in the index", want: nil},
+		{msg: "the collection of settings not found", want: nil},
+		{msg: "Document with name x y already exists", want: nil},
+		{msg: "field 'duplicate key' is invalid", want: nil},
+		{msg: "no dimension mismatch here", want: nil},
+		{msg: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			if got := classifyMessage(tt.msg); got != tt.want {
+				t.Errorf("classifyMessage(%q) = %v, want %v", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorMatching(t *testing.T) {
+	native := &NativeError{Op: "keradb_insert", Code: -1, Message: "Document with ID 'a' already exists"}
+	dup := &DuplicateKeyError{Collection: "c", Index: "email_1", Key: D{{Key: "email", Value: "x"}}}
+
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		want   bool
+	}{
+		{name: "native duplicate", err: native, target: ErrDuplicateKey, want: true},
+		{name: "wrapped native duplicate", err: fmt.Errorf("insert failed: %w", native), target: ErrDuplicateKey, want: true},
+		{name: "native error is not closed", err: native, target: ErrClosed, want: false},
+		{name: "native closed", err: &NativeError{Op: "keradb_count", Message: "Database is closed"}, target: ErrClosed, want: true},
+		{name: "unknown native message", err: &NativeError{Op: "keradb_sync", Message: "disk full"}, target: ErrClosed, want: false},
+		{name: "DuplicateKeyError", err: dup, target: ErrDuplicateKey, want: true},
+		{name: "DuplicateKeyError is not closed", err: dup, target: ErrClosed, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errors.Is(tt.err, tt.target); got != tt.want {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, tt.target, got, tt.want)
+			}
+		})
+	}
+
+	var ne *NativeError
+	if !errors.As(fmt.Errorf("wrapped: %w", native), &ne) || ne.Op != "keradb_insert" || ne.Code != -1 {
+		t.Errorf("errors.As gave %+v", ne)
+	}
+	if got := native.Error(); got != "keradb_insert: Document with ID 'a' already exists" {
+		t.Errorf("Error() = %q", got)
+	}
+}
+
+func TestOperationErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(client *Client, c *Collection) error
+		want error
+	}{
+		{
+			name: "no documents",
+			run: func(client *Client, c *Collection) error {
+				var doc M
+				return c.FindOne(M{"_id": "missing"}).Decode(&doc)
+			},
+			want: ErrNoDocuments,
+		},
+		{
+			name: "duplicate _id",
+			run: func(client *Client, c *Collection) error {
+				_, err := c.InsertOne(M{"_id": "a"})
+				return err
+			},
+			want: ErrDuplicateKey,
+		},
+		{
+			name: "closed client",
+			run: func(client *Client, c *Collection) error {
+				if err := client.Close(); err != nil {
+					return err
+				}
+				_, err := c.CountDocuments(M{})
+				return err
+			},
+			want: ErrClosed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newMemoryClient(t, NewMemoryEngine())
+			coll := client.Database().Collection("c")
+			if _, err := coll.InsertOne(M{"_id": "a"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.run(client, coll); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ============================================================================
+// Expressions
+// ============================================================================
+
+// exprFunc is a compiled aggregation expression evaluated against a document
+type exprFunc func(doc Document) interface{}
+
+// compileExpr compiles an aggregation expression as used by $expr.
+//
+// A string starting with "$" is a field path ("$price", "$address.city"),
+// "$$ROOT" and "$$CURRENT" are the whole document, a document with a single
+// "$" key is an operator ({"$gt": ["$spent", "$budget"]}), any other
+// document or array is built from its evaluated members, and everything else
+// is a literal. Operators whose arguments have the wrong type evaluate to
+// nil rather than failing.
+func compileExpr(expr interface{}) (exprFunc, error) {
+	expr = normalizeLiteral(expr)
+
+	switch e := expr.(type) {
+	case string:
+		if !strings.HasPrefix(e, "$") {
+			return func(Document) interface{} { return e }, nil
+		}
+		if strings.HasPrefix(e, "$$") {
+			switch e {
+			case "$$ROOT", "$$CURRENT":
+				return func(doc Document) interface{} { return map[string]interface{}(doc) }, nil
+			}
+			return nil, fmt.Errorf("unknown variable: %s", e)
+		}
+		if len(e) == 1 {
+			return nil, errors.New("field path must not be empty")
+		}
+		return fieldRef(e[1:]), nil
+
+	case []interface{}:
+		items := make([]exprFunc, len(e))
+		for i, item := range e {
+			f, err := compileExpr(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = f
+		}
+		return func(doc Document) interface{} {
+			out := make([]interface{}, len(items))
+			for i, f := range items {
+				out[i] = f(doc)
+			}
+			return out
+		}, nil
+
+	case map[string]interface{}:
+		if _, ok := isOperatorMap(e); ok {
+			if len(e) != 1 {
+				return nil, errors.New("an expression operator must be the only field of its document")
+			}
+			for op, arg := range e {
+				return compileExprOperator(op, arg)
+			}
+		}
+		fields := make(map[string]exprFunc, len(e))
+		for k, v := range e {
+			f, err := compileExpr(v)
+			if err != nil {
+				return nil, err
+			}
+			fields[k] = f
+		}
+		return func(doc Document) interface{} {
+			out := make(map[string]interface{}, len(fields))
+			for k, f := range fields {
+				out[k] = f(doc)
+			}
+			return out
+		}, nil
+	}
+
+	return func(Document) interface{} { return expr }, nil
+}
+
+// fieldRef evaluates a field path. A path that runs through an array of
+// subdocuments evaluates to the array of the values found.
+func fieldRef(path string) exprFunc {
+	return func(doc Document) interface{} {
+		values := lookupPath(doc, path)
+		if len(values) == 1 {
+			return values[0].value
+		}
+		out := make([]interface{}, 0, len(values))
+		for _, pv := range values {
+			if pv.exists {
+				out = append(out, pv.value)
+			}
+		}
+		return out
+	}
+}
+
+// exprArgs compiles the arguments of an expression operator. A single
+// non-array argument counts as one argument. max < 0 means no upper bound.
+func exprArgs(op string, arg interface{}, min, max int) ([]exprFunc, error) {
+	list, ok := normalizeLiteral(arg).([]interface{})
+	if !ok {
+		list = []interface{}{arg}
+	}
+	if len(list) < min || (max >= 0 && len(list) > max) {
+		if min == max {
+			return nil, fmt.Errorf("%s takes exactly %d arguments", op, min)
+		}
+		return nil, fmt.Errorf("%s takes %d or more arguments", op, min)
+	}
+
+	args := make([]exprFunc, len(list))
+	for i, item := range list {
+		f, err := compileExpr(item)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = f
+	}
+	return args, nil
+}
+
+func compileExprOperator(op string, arg interface{}) (exprFunc, error) {
+	switch op {
+	case "$literal":
+		return func(Document) interface{} { return arg }, nil
+
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$cmp":
+		args, err := exprArgs(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			a, b := args[0](doc), args[1](doc)
+			switch op {
+			case "$eq":
+				return valuesEqual(a, b)
+			case "$ne":
+				return !valuesEqual(a, b)
+			}
+			c := compareValues(a, b)
+			switch op {
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			case "$lte":
+				return c <= 0
+			}
+			return float64(c)
+		}, nil
+
+	case "$and", "$or":
+		args, err := exprArgs(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			for _, f := range args {
+				truthy := isTruthy(f(doc))
+				if op == "$and" && !truthy {
+					return false
+				}
+				if op == "$or" && truthy {
+					return true
+				}
+			}
+			return op == "$and"
+		}, nil
+
+	case "$not":
+		args, err := exprArgs(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} { return !isTruthy(args[0](doc)) }, nil
+
+	case "$add", "$multiply":
+		args, err := exprArgs(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			result := 0.0
+			if op == "$multiply" {
+				result = 1
+			}
+			for _, f := range args {
+				n, ok := toFloat(f(doc))
+				if !ok {
+					return nil
+				}
+				if op == "$add" {
+					result += n
+				} else {
+					result *= n
+				}
+			}
+			return result
+		}, nil
+
+	case "$subtract", "$divide", "$mod":
+		args, err := exprArgs(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			a, ok1 := toFloat(args[0](doc))
+			b, ok2 := toFloat(args[1](doc))
+			if !ok1 || !ok2 {
+				return nil
+			}
+			switch op {
+			case "$subtract":
+				return a - b
+			case "$divide":
+				if b == 0 {
+					return nil
+				}
+				return a / b
+			}
+			if b == 0 {
+				return nil
+			}
+			return math.Mod(a, b)
+		}, nil
+
+	case "$abs":
+		args, err := exprArgs(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			n, ok := toFloat(args[0](doc))
+			if !ok {
+				return nil
+			}
+			return math.Abs(n)
+		}, nil
+
+	case "$concat":
+		args, err := exprArgs(op, arg, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			var b strings.Builder
+			for _, f := range args {
+				s, ok := f(doc).(string)
+				if !ok {
+					return nil
+				}
+				b.WriteString(s)
+			}
+			return b.String()
+		}, nil
+
+	case "$toLower", "$toUpper":
+		args, err := exprArgs(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			s, _ := args[0](doc).(string)
+			if op == "$toLower" {
+				return strings.ToLower(s)
+			}
+			return strings.ToUpper(s)
+		}, nil
+
+	case "$size":
+		args, err := exprArgs(op, arg, 1, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			arr, ok := args[0](doc).([]interface{})
+			if !ok {
+				return nil
+			}
+			return float64(len(arr))
+		}, nil
+
+	case "$cond":
+		if m, ok := asMap(normalizeLiteral(arg)); ok {
+			arg = []interface{}{m["if"], m["then"], m["else"]}
+		}
+		args, err := exprArgs(op, arg, 3, 3)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			if isTruthy(args[0](doc)) {
+				return args[1](doc)
+			}
+			return args[2](doc)
+		}, nil
+
+	case "$ifNull":
+		args, err := exprArgs(op, arg, 2, -1)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			for _, f := range args[:len(args)-1] {
+				if v := f(doc); v != nil {
+					return v
+				}
+			}
+			return args[len(args)-1](doc)
+		}, nil
+
+	case "$in":
+		args, err := exprArgs(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			v := args[0](doc)
+			arr, _ := args[1](doc).([]interface{})
+			for _, elem := range arr {
+				if valuesEqual(v, elem) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "$arrayElemAt":
+		args, err := exprArgs(op, arg, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) interface{} {
+			arr, ok := args[0](doc).([]interface{})
+			n, ok2 := toFloat(args[1](doc))
+			if !ok || !ok2 {
+				return nil
+			}
+			idx := int(n)
+			if idx < 0 {
+				idx += len(arr)
+			}
+			if idx < 0 || idx >= len(arr) {
+				return nil
+			}
+			return arr[idx]
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown expression operator: %s", op)
+}
@@ -0,0 +1,858 @@
+package keradb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Field Paths
+// ============================================================================
+
+// pathValue is one value reached by following a field path
+type pathValue struct {
+	value  interface{}
+	exists bool
+}
+
+// lookupPath resolves a dot-notation path such as "address.city" or
+// "tags.0" against a document.
+//
+// Like MongoDB, it traverses arrays along the way: a numeric component
+// selects an array element, and any other component is looked up in every
+// subdocument of the array. It therefore returns every value the path
+// reaches. A path that reaches nothing yields a single missing value.
+func lookupPath(doc Document, path string) []pathValue {
+	values := resolvePath(map[string]interface{}(doc), strings.Split(path, "."))
+	if len(values) == 0 {
+		return []pathValue{{}}
+	}
+	return values
+}
+
+func resolvePath(v interface{}, parts []string) []pathValue {
+	if len(parts) == 0 {
+		return []pathValue{{value: v, exists: true}}
+	}
+
+	if m, ok := asMap(v); ok {
+		child, ok := m[parts[0]]
+		if !ok {
+			return []pathValue{{}}
+		}
+		return resolvePath(child, parts[1:])
+	}
+
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var values []pathValue
+	if idx, err := strconv.Atoi(parts[0]); err == nil && idx >= 0 {
+		if idx < len(arr) {
+			values = append(values, resolvePath(arr[idx], parts[1:])...)
+		}
+		return values
+	}
+	for _, elem := range arr {
+		if _, ok := asMap(elem); ok {
+			values = append(values, resolvePath(elem, parts)...)
+		}
+	}
+	return values
+}
+
+// anyValue reports whether pred holds for any value at a path. A value that
+// is an array is tried both as a whole and element by element, which gives
+// MongoDB's "any element matches" semantics.
+func anyValue(values []pathValue, pred func(v interface{}) bool) bool {
+	for _, pv := range values {
+		if pred(pv.value) {
+			return true
+		}
+		if arr, ok := pv.value.([]interface{}); ok {
+			for _, elem := range arr {
+				if pred(elem) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// normalizeLiteral converts a filter literal to the shape documents have
+// after decoding: every kind of map becomes map[string]interface{} and every
+// slice becomes []interface{}, so literals compare equal to stored values.
+func normalizeLiteral(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, string, bool, float64, []byte, time.Time, *regexp.Regexp:
+		return v
+	case ObjectID:
+		return x.Hex()
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, elem := range x {
+			out[k] = normalizeLiteral(elem)
+		}
+		return out
+	case M:
+		return normalizeLiteral(map[string]interface{}(x))
+	case Document:
+		return normalizeLiteral(map[string]interface{}(x))
+	case D:
+		out := make(map[string]interface{}, len(x))
+		for _, e := range x {
+			out[e.Key] = normalizeLiteral(e.Value)
+		}
+		return out
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			out[i] = normalizeLiteral(rv.Index(i).Interface())
+		}
+		return out
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return v
+		}
+		out := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			out[iter.Key().String()] = normalizeLiteral(iter.Value().Interface())
+		}
+		return out
+	}
+	return v
+}
+
+// ============================================================================
+// Filter Matching
+// ============================================================================
+
+// docMatcher is a compiled filter
+type docMatcher func(doc Document) bool
+
+// valueMatcher is a compiled set of operators applied to the values at a path
+type valueMatcher func(values []pathValue) bool
+
+// matchesFilter reports whether doc matches filter
+func matchesFilter(doc Document, filter M) (bool, error) {
+	match, err := compileFilter(filter)
+	if err != nil {
+		return false, err
+	}
+	return match(doc), nil
+}
+
+// compileFilter validates a MongoDB-style filter and compiles it into a
+// matcher. Unknown operators and malformed arguments are reported here,
+// before any document is read.
+func compileFilter(filter M) (docMatcher, error) {
+	matchers := make([]docMatcher, 0, len(filter))
+	for key, value := range filter {
+		var m docMatcher
+		var err error
+		if strings.HasPrefix(key, "$") {
+			m, err = compileTopLevel(key, value)
+		} else {
+			m, err = compileField(key, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			matchers = append(matchers, m)
+		}
+	}
+
+	return func(doc Document) bool {
+		for _, m := range matchers {
+			if !m(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// toFilter converts a sub-filter argument to M
+func toFilter(v interface{}) (M, bool) {
+	if m, ok := v.(M); ok {
+		return m, true
+	}
+	if m, ok := asMap(v); ok {
+		return M(m), true
+	}
+	return nil, false
+}
+
+// compileFilterList compiles the array argument of $and, $or and $nor
+func compileFilterList(op string, value interface{}) ([]docMatcher, error) {
+	var filters []M
+	switch list := value.(type) {
+	case []M:
+		filters = list
+	default:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("%s argument must be an array", op)
+		}
+		for i := 0; i < rv.Len(); i++ {
+			f, ok := toFilter(rv.Index(i).Interface())
+			if !ok {
+				return nil, fmt.Errorf("%s entries must be documents", op)
+			}
+			filters = append(filters, f)
+		}
+	}
+	if len(filters) == 0 {
+		return nil, fmt.Errorf("%s argument must be a non-empty array", op)
+	}
+
+	matchers := make([]docMatcher, len(filters))
+	for i, f := range filters {
+		m, err := compileFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return matchers, nil
+}
+
+func compileTopLevel(op string, value interface{}) (docMatcher, error) {
+	switch op {
+	case "$and", "$or", "$nor":
+		matchers, err := compileFilterList(op, value)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) bool {
+			for _, m := range matchers {
+				matched := m(doc)
+				if op == "$and" && !matched {
+					return false
+				}
+				if op != "$and" && matched {
+					return op == "$or"
+				}
+			}
+			return op != "$or"
+		}, nil
+	case "$expr":
+		expr, err := compileExpr(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) bool { return isTruthy(expr(doc)) }, nil
+	case "$jsonSchema":
+		schema, ok := asMap(value)
+		if !ok {
+			return nil, errors.New("$jsonSchema must be a document")
+		}
+		validate, err := compileSchema(schema)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc Document) bool { return validate(map[string]interface{}(doc)) }, nil
+	case "$comment":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown top level operator: %s", op)
+}
+
+// isOperatorMap reports whether a filter value is an operator expression
+// such as {"$gt": 5} rather than a literal subdocument
+func isOperatorMap(v interface{}) (map[string]interface{}, bool) {
+	m, ok := asMap(v)
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if strings.HasPrefix(k, "$") {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func compileField(path string, cond interface{}) (docMatcher, error) {
+	if path == "" {
+		return nil, errors.New("field path must not be empty")
+	}
+
+	var match valueMatcher
+	if ops, ok := isOperatorMap(cond); ok {
+		m, err := compileOperators(ops)
+		if err != nil {
+			return nil, err
+		}
+		match = m
+	} else if re, ok := cond.(*regexp.Regexp); ok {
+		match = regexMatcher(re)
+	} else {
+		target := normalizeLiteral(cond)
+		match = func(values []pathValue) bool { return matchesEqual(values, target) }
+	}
+
+	return func(doc Document) bool {
+		return match(lookupPath(doc, path))
+	}, nil
+}
+
+// compileOperators compiles an operator expression such as
+// {"$gte": 18, "$lt": 65}. All operators must hold.
+func compileOperators(ops map[string]interface{}) (valueMatcher, error) {
+	matchers := make([]valueMatcher, 0, len(ops))
+	for op, arg := range ops {
+		var m valueMatcher
+		var err error
+		switch op {
+		case "$options":
+			if _, ok := ops["$regex"]; !ok {
+				return nil, errors.New("$options needs a $regex")
+			}
+			continue
+		case "$regex":
+			m, err = compileRegexOperator(arg, ops["$options"])
+		default:
+			m, err = compileOperator(op, arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return func(values []pathValue) bool {
+		for _, m := range matchers {
+			if !m(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileOperator(op string, arg interface{}) (valueMatcher, error) {
+	switch op {
+	case "$eq", "$ne":
+		target := normalizeLiteral(arg)
+		negate := op == "$ne"
+		return func(values []pathValue) bool {
+			return matchesEqual(values, target) != negate
+		}, nil
+
+	case "$gt", "$gte", "$lt", "$lte":
+		target := normalizeLiteral(arg)
+		var cmp func(a, b interface{}) bool
+		switch op {
+		case "$gt":
+			cmp = compareGT
+		case "$gte":
+			cmp = compareGTE
+		case "$lt":
+			cmp = compareLT
+		default:
+			cmp = compareLTE
+		}
+		return func(values []pathValue) bool {
+			return anyValue(values, func(v interface{}) bool { return cmp(v, target) })
+		}, nil
+
+	case "$in", "$nin":
+		list, ok := normalizeLiteral(arg).([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s needs an array", op)
+		}
+		negate := op == "$nin"
+		return func(values []pathValue) bool {
+			return matchesIn(values, list) != negate
+		}, nil
+
+	case "$exists":
+		want := isTruthy(arg)
+		return func(values []pathValue) bool {
+			for _, pv := range values {
+				if pv.exists {
+					return want
+				}
+			}
+			return !want
+		}, nil
+
+	case "$type":
+		types, err := parseTypeList(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(values []pathValue) bool {
+			for _, pv := range values {
+				if !pv.exists {
+					continue
+				}
+				if hasType(pv.value, types) {
+					return true
+				}
+				if arr, ok := pv.value.([]interface{}); ok {
+					for _, elem := range arr {
+						if hasType(elem, types) {
+							return true
+						}
+					}
+				}
+			}
+			return false
+		}, nil
+
+	case "$size":
+		n, ok := toFloat(arg)
+		if !ok || n < 0 || n != math.Trunc(n) {
+			return nil, errors.New("$size needs a non-negative integer")
+		}
+		return func(values []pathValue) bool {
+			for _, pv := range values {
+				if arr, ok := pv.value.([]interface{}); ok && len(arr) == int(n) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "$all":
+		list, ok := normalizeLiteral(arg).([]interface{})
+		if !ok {
+			return nil, errors.New("$all needs an array")
+		}
+		matchers := make([]valueMatcher, len(list))
+		for i, elem := range list {
+			if ops, ok := isOperatorMap(elem); ok {
+				if _, ok := ops["$elemMatch"]; !ok || len(ops) != 1 {
+					return nil, errors.New("$all entries can only use $elemMatch")
+				}
+				m, err := compileOperator("$elemMatch", ops["$elemMatch"])
+				if err != nil {
+					return nil, err
+				}
+				matchers[i] = m
+				continue
+			}
+			target := elem
+			matchers[i] = func(values []pathValue) bool { return matchesEqual(values, target) }
+		}
+		return func(values []pathValue) bool {
+			if len(matchers) == 0 {
+				return false
+			}
+			for _, m := range matchers {
+				if !m(values) {
+					return false
+				}
+			}
+			return true
+		}, nil
+
+	case "$elemMatch":
+		cond, ok := asMap(arg)
+		if !ok {
+			return nil, errors.New("$elemMatch needs a document")
+		}
+		elemMatch, err := compileElemMatch(cond)
+		if err != nil {
+			return nil, err
+		}
+		return func(values []pathValue) bool {
+			for _, pv := range values {
+				arr, ok := pv.value.([]interface{})
+				if !ok {
+					continue
+				}
+				for _, elem := range arr {
+					if elemMatch(elem) {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+
+	case "$not":
+		var inner valueMatcher
+		if re, ok := arg.(*regexp.Regexp); ok {
+			inner = regexMatcher(re)
+		} else if ops, ok := isOperatorMap(arg); ok {
+			m, err := compileOperators(ops)
+			if err != nil {
+				return nil, err
+			}
+			inner = m
+		} else {
+			return nil, errors.New("$not needs a regex or an operator document")
+		}
+		return func(values []pathValue) bool { return !inner(values) }, nil
+
+	case "$mod":
+		list, ok := normalizeLiteral(arg).([]interface{})
+		if !ok || len(list) != 2 {
+			return nil, errors.New("$mod needs an array of [divisor, remainder]")
+		}
+		divisor, ok1 := toFloat(list[0])
+		remainder, ok2 := toFloat(list[1])
+		if !ok1 || !ok2 {
+			return nil, errors.New("$mod divisor and remainder must be numbers")
+		}
+		d, r := int64(divisor), int64(remainder)
+		if d == 0 {
+			return nil, errors.New("$mod divisor must not be zero")
+		}
+		return func(values []pathValue) bool {
+			return anyValue(values, func(v interface{}) bool {
+				n, ok := toFloat(v)
+				return ok && int64(n)%d == r
+			})
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator: %s", op)
+}
+
+// compileElemMatch compiles the argument of $elemMatch. A document of
+// operators ({"$gte": 80}) applies to the element itself; anything else is a
+// filter applied to subdocument elements.
+func compileElemMatch(cond map[string]interface{}) (func(elem interface{}) bool, error) {
+	operatorForm := true
+	for k := range cond {
+		switch k {
+		case "$and", "$or", "$nor", "$expr", "$jsonSchema", "$comment":
+			operatorForm = false
+		default:
+			if !strings.HasPrefix(k, "$") {
+				operatorForm = false
+			}
+		}
+	}
+
+	if operatorForm {
+		m, err := compileOperators(cond)
+		if err != nil {
+			return nil, err
+		}
+		return func(elem interface{}) bool {
+			return m([]pathValue{{value: elem, exists: true}})
+		}, nil
+	}
+
+	m, err := compileFilter(M(cond))
+	if err != nil {
+		return nil, err
+	}
+	return func(elem interface{}) bool {
+		sub, ok := asMap(elem)
+		return ok && m(Document(sub))
+	}, nil
+}
+
+// matchesEqual reports whether any value at a path equals target. A missing
+// field is equal to nil.
+func matchesEqual(values []pathValue, target interface{}) bool {
+	if re, ok := target.(*regexp.Regexp); ok {
+		return regexMatcher(re)(values)
+	}
+	return anyValue(values, func(v interface{}) bool { return valuesEqual(v, target) })
+}
+
+// matchesIn reports whether any value at a path equals an entry of list.
+// Entries may be regular expressions.
+func matchesIn(values []pathValue, list []interface{}) bool {
+	for _, target := range list {
+		if matchesEqual(values, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------------------------------------------------------------------
+// Regular Expressions
+// ----------------------------------------------------------------------------
+
+func compileRegexOperator(pattern, options interface{}) (valueMatcher, error) {
+	var opts string
+	if options != nil {
+		s, ok := options.(string)
+		if !ok {
+			return nil, errors.New("$options must be a string")
+		}
+		opts = s
+	}
+
+	switch p := pattern.(type) {
+	case *regexp.Regexp:
+		if opts == "" {
+			return regexMatcher(p), nil
+		}
+		pattern = p.String()
+	case string:
+	default:
+		return nil, errors.New("$regex must be a string or a regular expression")
+	}
+
+	re, err := compileRegex(pattern.(string), opts)
+	if err != nil {
+		return nil, err
+	}
+	return regexMatcher(re), nil
+}
+
+// compileRegex compiles a pattern with MongoDB regex options: i (case
+// insensitive), m (multi-line), s (dot matches newline) and x (extended,
+// ignoring whitespace and # comments).
+func compileRegex(pattern, options string) (*regexp.Regexp, error) {
+	var flags string
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			if !strings.ContainsRune(flags, o) {
+				flags += string(o)
+			}
+		case 'x':
+			pattern = stripExtended(pattern)
+		default:
+			return nil, fmt.Errorf("invalid $regex option: %c", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid $regex: %w", err)
+	}
+	return re, nil
+}
+
+// stripExtended removes unescaped whitespace and # comments outside
+// character classes, as the x regex option does
+func stripExtended(pattern string) string {
+	var b strings.Builder
+	inClass, inComment, escaped := false, false, false
+	for _, r := range pattern {
+		switch {
+		case inComment:
+			if r == '\n' {
+				inComment = false
+			}
+			continue
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case inClass:
+			if r == ']' {
+				inClass = false
+			}
+		case r == '[':
+			inClass = true
+		case r == '#':
+			inComment = true
+			continue
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' || r == '\v':
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func regexMatcher(re *regexp.Regexp) valueMatcher {
+	return func(values []pathValue) bool {
+		return anyValue(values, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		})
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Types
+// ----------------------------------------------------------------------------
+
+// bsonTypeCodes maps MongoDB type aliases to their numeric codes
+var bsonTypeCodes = map[string]int{
+	"double":   1,
+	"string":   2,
+	"object":   3,
+	"array":    4,
+	"binData":  5,
+	"objectId": 7,
+	"bool":     8,
+	"date":     9,
+	"null":     10,
+	"regex":    11,
+	"int":      16,
+	"long":     18,
+	"decimal":  19,
+}
+
+// typeNumber matches any numeric type in $type
+const typeNumber = -1
+
+// bsonType returns the numeric MongoDB type code of a value
+func bsonType(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 10
+	case float64, float32:
+		return 1
+	case json.Number:
+		if n, err := v.(json.Number).Int64(); err == nil {
+			if n >= math.MinInt32 && n <= math.MaxInt32 {
+				return 16
+			}
+			return 18
+		}
+		return 1
+	case Decimal:
+		return 19
+	case string:
+		return 2
+	case map[string]interface{}, Document, M:
+		return 3
+	case []interface{}:
+		return 4
+	case []byte:
+		return 5
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case *regexp.Regexp:
+		return 11
+	case int, int8, int16, int32, uint8, uint16:
+		return 16
+	case int64, uint, uint32, uint64:
+		return 18
+	}
+	return 0
+}
+
+func isNumberType(code int) bool {
+	return code == 1 || code == 16 || code == 18 || code == 19
+}
+
+// parseTypeList parses the argument of $type: an alias, a code, or an array
+// of either
+func parseTypeList(arg interface{}) ([]int, error) {
+	items := []interface{}{arg}
+	if list, ok := normalizeLiteral(arg).([]interface{}); ok {
+		items = list
+	}
+
+	codes := make([]int, 0, len(items))
+	for _, item := range items {
+		switch t := item.(type) {
+		case string:
+			if t == "number" {
+				codes = append(codes, typeNumber)
+				continue
+			}
+			code, ok := bsonTypeCodes[t]
+			if !ok {
+				return nil, fmt.Errorf("unknown $type alias: %s", t)
+			}
+			codes = append(codes, code)
+		default:
+			n, ok := toFloat(item)
+			if !ok {
+				return nil, errors.New("$type needs a type alias or code")
+			}
+			codes = append(codes, int(n))
+		}
+	}
+	return codes, nil
+}
+
+// hasType reports whether v has one of the type codes. Stored numbers come
+// back as float64, since JSON does not tell an integer from a double, so a
+// whole float64 also has the integer type its value fits: int within the
+// 32-bit range and long beyond it. $type cannot tell a stored 3.0 from 3.
+func hasType(v interface{}, codes []int) bool {
+	code, alt := bsonType(v), 0
+	if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) <= maxSafeInteger {
+		alt = 18
+		if f >= math.MinInt32 && f <= math.MaxInt32 {
+			alt = 16
+		}
+	}
+	for _, want := range codes {
+		if want == code || (alt != 0 && want == alt) || (want == typeNumber && isNumberType(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTruthy reports whether a value counts as true in a boolean context:
+// everything except false, nil and zero
+func isTruthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	}
+	if n, ok := toFloat(v); ok {
+		return n != 0
+	}
+	return true
+}
+
+// sameBracket reports whether two values are in the same type bracket, which
+// range operators such as $gt require
+func sameBracket(a, b interface{}) bool {
+	t := typeOrder(a)
+	return t == typeOrder(b) && t != 10
+}
+
+func compareGT(a, b interface{}) bool {
+	return sameBracket(a, b) && compareValues(a, b) > 0
+}
+
+func compareGTE(a, b interface{}) bool {
+	return compareGT(a, b) || valuesEqual(a, b)
+}
+
+func compareLT(a, b interface{}) bool {
+	return sameBracket(a, b) && compareValues(a, b) < 0
+}
+
+func compareLTE(a, b interface{}) bool {
+	return compareLT(a, b) || valuesEqual(a, b)
+}
+
+func containsValue(arr interface{}, val interface{}) bool {
+	slice := reflect.ValueOf(arr)
+	if slice.Kind() != reflect.Slice {
+		return false
+	}
+	for i := 0; i < slice.Len(); i++ {
+		if valuesEqual(slice.Index(i).Interface(), val) {
+			return true
+		}
+	}
+	return false
+}
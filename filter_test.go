@@ -0,0 +1,145 @@
+package keradb
+
+import (
+	"reflect"
+	"testing"
+)
+
+// matchingNames returns the "n" field of every document matching filter, in
+// insertion order
+func matchingNames(t *testing.T, coll *Collection, filter Filter) []string {
+	t.Helper()
+	docs, err := coll.Find(filter).All()
+	if err != nil {
+		t.Fatalf("Find(%v): %v", filter, err)
+	}
+	names := []string{}
+	for _, d := range docs {
+		name, _ := d["n"].(string)
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestFilterPaths(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("people")
+	_, err := coll.InsertMany([]interface{}{
+		M{"n": "a", "address": M{"city": "Paris", "geo": M{"zip": "75001"}}, "tags": []string{"x", "y"},
+			"kids": []M{{"age": 3}, {"age": 10}}, "grid": []interface{}{[]int{1, 2}, []int{3}}},
+		M{"n": "b", "address": M{"city": "Rome"}, "tags": []string{"y"}, "kids": []M{{"age": 5}}},
+		M{"n": "c", "address": "unknown", "tags": []string{}, "nick": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter M
+		want   []string
+	}{
+		{name: "embedded field", filter: M{"address.city": "Paris"}, want: []string{"a"}},
+		{name: "deeply embedded field", filter: M{"address.geo.zip": "75001"}, want: []string{"a"}},
+		{name: "path through a scalar", filter: M{"address.city": M{"$exists": true}}, want: []string{"a", "b"}},
+		{name: "array element", filter: M{"tags": "y"}, want: []string{"a", "b"}},
+		{name: "whole array", filter: M{"tags": []string{"x", "y"}}, want: []string{"a"}},
+		{name: "array order matters", filter: M{"tags": []string{"y", "x"}}, want: []string{}},
+		{name: "empty array", filter: M{"tags": []string{}}, want: []string{"c"}},
+		{name: "positional index", filter: M{"tags.0": "y"}, want: []string{"b"}},
+		{name: "index out of range", filter: M{"tags.5": M{"$exists": true}}, want: []string{}},
+		{name: "field of array elements", filter: M{"kids.age": M{"$gt": 8}}, want: []string{"a"}},
+		{name: "index then field", filter: M{"kids.1.age": 10}, want: []string{"a"}},
+		{name: "$in over array elements", filter: M{"kids.age": M{"$in": []interface{}{5}}}, want: []string{"b"}},
+		{name: "$ne needs every element to differ", filter: M{"tags": M{"$ne": "x"}}, want: []string{"b", "c"}},
+		{name: "nested array element", filter: M{"grid": []int{3}}, want: []string{"a"}},
+		{name: "null matches missing", filter: M{"nick": nil}, want: []string{"a", "b", "c"}},
+		{name: "null matches missing path", filter: M{"address.geo.zip": nil}, want: []string{"b", "c"}},
+		{name: "missing path", filter: M{"kids.name": "x"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchingNames(t, coll, tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterOperators(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("people")
+	_, err := coll.InsertMany([]interface{}{
+		M{"n": "alice", "age": 30, "tags": []string{"a", "b", "c"}, "spent": 120, "budget": 100,
+			"items": []M{{"sku": "x", "qty": 5}, {"sku": "y", "qty": 1}}},
+		M{"n": "bob", "age": 41.5, "tags": []string{"b"}, "spent": 10, "budget": 100, "nick": nil,
+			"items": []M{{"sku": "x", "qty": 1}}},
+		M{"n": "carol", "age": "n/a", "scores": []int{1, 5, 9}, "big": int64(1) << 40},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter M
+		want   []string
+	}{
+		{name: "$exists", filter: M{"nick": M{"$exists": true}}, want: []string{"bob"}},
+		{name: "$exists false", filter: M{"nick": M{"$exists": false}}, want: []string{"alice", "carol"}},
+		{name: "$regex with options", filter: M{"n": M{"$regex": "^B", "$options": "i"}}, want: []string{"bob"}},
+		{name: "$regex is case sensitive", filter: M{"n": M{"$regex": "^B"}}, want: []string{}},
+		{name: "$size", filter: M{"tags": M{"$size": 3}}, want: []string{"alice"}},
+		{name: "$all", filter: M{"tags": M{"$all": []string{"a", "c"}}}, want: []string{"alice"}},
+		{name: "$elemMatch on documents", filter: M{"items": M{"$elemMatch": M{"sku": "x", "qty": M{"$gt": 2}}}}, want: []string{"alice"}},
+		{name: "$elemMatch on scalars", filter: M{"scores": M{"$elemMatch": M{"$gt": 4, "$lt": 6}}}, want: []string{"carol"}},
+		{name: "$not", filter: M{"age": M{"$not": M{"$gt": 35}}}, want: []string{"alice", "carol"}},
+		{name: "$nor", filter: M{"$nor": []M{{"n": "bob"}, {"n": "carol"}}}, want: []string{"alice"}},
+		{name: "$or", filter: M{"$or": []M{{"n": "bob"}, {"age": 30}}}, want: []string{"alice", "bob"}},
+		{name: "$mod", filter: M{"age": M{"$mod": []int{10, 0}}}, want: []string{"alice"}},
+		{name: "$expr", filter: M{"$expr": M{"$gt": []interface{}{"$spent", "$budget"}}}, want: []string{"alice"}},
+		{name: "$type string", filter: M{"age": M{"$type": "string"}}, want: []string{"carol"}},
+		{name: "$type number", filter: M{"age": M{"$type": "number"}}, want: []string{"alice", "bob"}},
+		{name: "$type int matches a whole number", filter: M{"age": M{"$type": "int"}}, want: []string{"alice"}},
+		{name: "$type int by code", filter: M{"age": M{"$type": 16}}, want: []string{"alice"}},
+		{name: "$type double", filter: M{"age": M{"$type": "double"}}, want: []string{"alice", "bob"}},
+		{name: "$type long", filter: M{"big": M{"$type": "long"}}, want: []string{"carol"}},
+		{name: "$type int of array elements", filter: M{"scores": M{"$type": "int"}}, want: []string{"carol"}},
+		{name: "$type list", filter: M{"age": M{"$type": []string{"string", "int"}}}, want: []string{"alice", "carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchingNames(t, coll, tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter M
+	}{
+		{name: "unknown field operator", filter: M{"a": M{"$bogus": 1}}},
+		{name: "unknown top-level operator", filter: M{"$where": "x"}},
+		{name: "unknown expression operator", filter: M{"$expr": M{"$nope": 1}}},
+		{name: "unknown schema keyword", filter: M{"$jsonSchema": M{"foo": 1}}},
+		{name: "unknown $type alias", filter: M{"a": M{"$type": "integer"}}},
+		{name: "$in needs an array", filter: M{"a": M{"$in": 1}}},
+		{name: "$and needs an array", filter: M{"$and": M{"a": 1}}},
+	}
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	if _, err := coll.InsertOne(M{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := coll.CountDocuments(tt.filter); err == nil {
+				t.Error("CountDocuments: expected an error")
+			}
+			cur := coll.Find(tt.filter)
+			if cur.Next() || cur.Err() == nil {
+				t.Error("Find: expected a cursor error")
+			}
+		})
+	}
+}
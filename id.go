@@ -0,0 +1,164 @@
+package keradb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// ID Generation
+// ============================================================================
+
+// IDStrategy selects how InsertOne assigns an _id to a document that has
+// none. A caller-supplied _id is always kept.
+type IDStrategy int
+
+const (
+	// IDNative lets the storage engine choose the ID
+	IDNative IDStrategy = iota
+	// IDObjectID assigns the hex form of a new ObjectID
+	IDObjectID
+	// IDUUIDv7 assigns a time-ordered version 7 UUID
+	IDUUIDv7
+	// IDULID assigns a ULID
+	IDULID
+)
+
+// String returns the strategy name
+func (s IDStrategy) String() string {
+	switch s {
+	case IDNative:
+		return "native"
+	case IDObjectID:
+		return "objectid"
+	case IDUUIDv7:
+		return "uuidv7"
+	case IDULID:
+		return "ulid"
+	}
+	return fmt.Sprintf("IDStrategy(%d)", int(s))
+}
+
+// generator returns the function producing new IDs, or nil to let the
+// engine choose
+func (s IDStrategy) generator() (func() string, error) {
+	switch s {
+	case IDNative:
+		return nil, nil
+	case IDObjectID:
+		return func() string { return NewObjectID().Hex() }, nil
+	case IDUUIDv7:
+		return newUUIDv7, nil
+	case IDULID:
+		return newULID, nil
+	}
+	return nil, fmt.Errorf("unknown ID strategy: %d", int(s))
+}
+
+// Every ID from the time-ordered generators below starts with a millisecond
+// timestamp. Within one millisecond, the following bits count up from a
+// random start, so IDs created by a process are strictly increasing and
+// sort in creation order.
+
+// monotonicClock hands out (millisecond, sequence) pairs
+type monotonicClock struct {
+	mu  sync.Mutex
+	ms  int64
+	seq uint64
+}
+
+// next returns the current millisecond and a sequence number below
+// 1<<bits that is larger than the last one returned for that millisecond
+func (c *monotonicClock) next(bits uint) (int64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ms := time.Now().UnixMilli()
+	limit := uint64(1) << bits
+	if ms > c.ms {
+		c.ms = ms
+		// Start in the lower half so the sequence has room to count up
+		c.seq = randomUint64() % (limit / 2)
+		return c.ms, c.seq
+	}
+	c.seq++
+	if c.seq >= limit {
+		c.ms++
+		c.seq = 0
+	}
+	return c.ms, c.seq
+}
+
+var (
+	uuidClock monotonicClock
+	ulidClock monotonicClock
+)
+
+func randomUint64() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+// newUUIDv7 returns a version 7 UUID: a 48-bit millisecond timestamp, a
+// 12-bit sequence and 62 random bits
+func newUUIDv7() string {
+	ms, seq := uuidClock.next(12)
+
+	var b [16]byte
+	if _, err := rand.Read(b[8:]); err != nil {
+		panic(err)
+	}
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = 0x70 | byte(seq>>8)
+	b[7] = byte(seq)
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// crockford is the Base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48-bit millisecond timestamp and 80 further
+// bits, of which the first 40 are a sequence and the rest random, in
+// Crockford Base32
+func newULID() string {
+	ms, seq := ulidClock.next(40)
+
+	var b [16]byte
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = byte(seq >> 32)
+	b[7] = byte(seq >> 24)
+	b[8] = byte(seq >> 16)
+	b[9] = byte(seq >> 8)
+	b[10] = byte(seq)
+	if _, err := rand.Read(b[11:]); err != nil {
+		panic(err)
+	}
+
+	// 128 bits in 26 characters of 5 bits, the first holding only 3
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
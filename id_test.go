@@ -0,0 +1,186 @@
+package keradb
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+// idReplacingEngine ignores the _id of inserted documents and lets the
+// memory engine choose one, as an engine assigning its own IDs would
+type idReplacingEngine struct {
+	*MemoryEngine
+}
+
+func (e idReplacingEngine) Insert(collection string, doc []byte) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return "", err
+	}
+	delete(fields, "_id")
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return e.MemoryEngine.Insert(collection, data)
+}
+
+func TestIDStrategies(t *testing.T) {
+	tests := []struct {
+		strategy IDStrategy
+		name     string
+		pattern  string
+	}{
+		{strategy: IDObjectID, name: "objectid", pattern: `^[0-9a-f]{24}$`},
+		{strategy: IDUUIDv7, name: "uuidv7", pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{strategy: IDULID, name: "ulid", pattern: `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strategy.String(); got != tt.name {
+				t.Errorf("String() = %q, want %q", got, tt.name)
+			}
+			gen, err := tt.strategy.generator()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const n = 2000
+			ids := make([]string, n)
+			for i := range ids {
+				ids[i] = gen()
+			}
+			re := regexp.MustCompile(tt.pattern)
+			for i, id := range ids {
+				if !re.MatchString(id) {
+					t.Fatalf("ID %q does not match %s", id, tt.pattern)
+				}
+				if i > 0 && id <= ids[i-1] {
+					t.Fatalf("ID %q does not sort after %q", id, ids[i-1])
+				}
+			}
+			if !sort.StringsAreSorted(ids) {
+				t.Error("IDs are not in creation order")
+			}
+		})
+	}
+
+	if gen, err := IDNative.generator(); gen != nil || err != nil {
+		t.Errorf("IDNative.generator() = %v, want no generator", err)
+	}
+	if _, err := IDStrategy(42).generator(); err == nil {
+		t.Error("expected an error for an unknown strategy")
+	}
+	if _, err := Connect("memory.ndb", NewClientOptions().SetEngine(NewMemoryEngine()).SetIDStrategy(IDStrategy(42))); err == nil {
+		t.Error("Connect: expected an error for an unknown strategy")
+	}
+}
+
+func TestInsertIDs(t *testing.T) {
+	oid, err := ObjectIDFromHex("65f1a2b3c4d5e6f708091a2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type withOID struct {
+		ID   ObjectID `json:"_id"`
+		Name string   `json:"name"`
+	}
+
+	tests := []struct {
+		name     string
+		engine   Engine
+		strategy IDStrategy
+		docs     []interface{}
+		wantID   string
+		pattern  string
+		wantErr  bool
+		wantDup  bool
+	}{
+		{name: "engine chooses", engine: NewMemoryEngine(), strategy: IDNative,
+			docs: []interface{}{M{"n": 1}}, pattern: `.+`},
+		{name: "strategy assigns", engine: NewMemoryEngine(), strategy: IDObjectID,
+			docs: []interface{}{M{"n": 1}}, pattern: `^[0-9a-f]{24}$`},
+		{name: "null _id is assigned", engine: NewMemoryEngine(), strategy: IDULID,
+			docs: []interface{}{M{"_id": nil}}, pattern: `^[0-9A-Z]{26}$`},
+		{name: "string _id is kept", engine: NewMemoryEngine(), strategy: IDObjectID,
+			docs: []interface{}{M{"_id": "mine"}}, wantID: "mine"},
+		{name: "ObjectID _id is kept", engine: NewMemoryEngine(), strategy: IDUUIDv7,
+			docs: []interface{}{withOID{ID: oid, Name: "a"}}, wantID: oid.Hex()},
+		{name: "taken _id", engine: NewMemoryEngine(), strategy: IDNative,
+			docs: []interface{}{M{"_id": "x"}, M{"_id": "x"}}, wantErr: true, wantDup: true},
+		{name: "non-string _id", engine: NewMemoryEngine(), strategy: IDNative,
+			docs: []interface{}{M{"_id": 7}}, wantErr: true},
+		{name: "engine replaces the _id", engine: idReplacingEngine{NewMemoryEngine()}, strategy: IDObjectID,
+			docs: []interface{}{M{"n": 1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := Connect("memory.ndb", NewClientOptions().SetEngine(tt.engine).SetIDStrategy(tt.strategy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			coll := client.Database().Collection("c")
+
+			var res *InsertOneResult
+			for _, doc := range tt.docs {
+				if res, err = coll.InsertOne(doc); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InsertOne error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var dup *DuplicateKeyError
+			if errors.As(err, &dup) != tt.wantDup {
+				t.Errorf("error %v: DuplicateKeyError = %v, want %v", err, !tt.wantDup, tt.wantDup)
+			}
+			if tt.wantErr {
+				if n, _ := coll.CountDocuments(M{}); n != int64(len(tt.docs)-1) {
+					t.Errorf("%d documents stored after the failed insert", n)
+				}
+				return
+			}
+
+			id := res.InsertedID
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("InsertedID = %q, want %q", id, tt.wantID)
+			}
+			if tt.pattern != "" && !regexp.MustCompile(tt.pattern).MatchString(id) {
+				t.Errorf("InsertedID %q does not match %s", id, tt.pattern)
+			}
+			if n, err := coll.CountDocuments(M{"_id": id}); err != nil || n != 1 {
+				t.Errorf("CountDocuments(_id %q) = %d, %v", id, n, err)
+			}
+		})
+	}
+}
+
+func TestObjectIDFilters(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	first := NewObjectID()
+	if _, err := coll.InsertOne(M{"_id": first, "n": "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter M
+		want   []string
+	}{
+		{name: "ObjectID value", filter: M{"_id": first}, want: []string{"a"}},
+		{name: "hex string", filter: M{"_id": first.Hex()}, want: []string{"a"}},
+		{name: "range", filter: M{"_id": M{"$gte": first}}, want: []string{"a"}},
+		{name: "other ID", filter: M{"_id": NewObjectID()}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchingNames(t, coll, tt.filter)
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
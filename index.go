@@ -0,0 +1,1017 @@
+package keradb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// Indexes
+// ============================================================================
+
+// reservedPrefix starts the names of collections the SDK uses for its own
+// bookkeeping. They are hidden from ListCollectionNames.
+const reservedPrefix = "_keradb_"
+
+// indexCollection holds the definitions of every secondary index
+const indexCollection = reservedPrefix + "indexes"
+
+// maxIndexPoints bounds the number of exact key prefixes a single query may
+// look up, such as the combinations of two $in lists
+const maxIndexPoints = 1000
+
+// IndexModel describes an index to create
+type IndexModel struct {
+	// Keys lists the indexed fields in order, each with a direction of 1 or
+	// -1. Dot notation reaches into subdocuments.
+	Keys D
+	// Options sets the name, uniqueness and sparseness of the index.
+	Options *IndexOptions
+}
+
+// IndexSpecification describes an existing index
+type IndexSpecification struct {
+	Name   string
+	Keys   D
+	Unique bool
+	Sparse bool
+}
+
+// DuplicateKeyError is returned when a write would give two documents the
+// same key in a unique index
+type DuplicateKeyError struct {
+	Collection string
+	Index      string
+	Key        D
+}
+
+func (e *DuplicateKeyError) Error() string {
+	parts := make([]string, len(e.Key))
+	for i, k := range e.Key {
+		value, _ := json.Marshal(k.Value)
+		parts[i] = fmt.Sprintf("%s: %s", k.Key, value)
+	}
+	return fmt.Sprintf("duplicate key in unique index %q of collection %q: {%s}",
+		e.Index, e.Collection, strings.Join(parts, ", "))
+}
+
+// Is reports whether target is ErrDuplicateKey
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
+// ----------------------------------------------------------------------------
+// IndexView
+// ----------------------------------------------------------------------------
+
+// IndexView manages the indexes of a collection.
+//
+// Index definitions are stored in the database, but their entries are kept
+// in memory by each Client: built from the collection when the Client first
+// uses it, then maintained by that Client's own writes only. Documents
+// written through another Client are missed or found under stale keys
+// until this Client is reopened, and a unique index is only enforced among
+// the writes of one Client. Use one Client per database when relying on
+// indexes.
+type IndexView struct {
+	coll *Collection
+}
+
+// Indexes returns the index view of the collection
+func (c *Collection) Indexes() IndexView {
+	return IndexView{coll: c}
+}
+
+// CreateOne creates an index and returns its name. Creating an index that
+// already exists with the same keys and options does nothing.
+func (iv IndexView) CreateOne(model IndexModel) (string, error) {
+	return iv.CreateOneContext(context.Background(), model)
+}
+
+// CreateOneContext creates an index and returns its name. The index is
+// built from the documents already in the collection; if a unique index
+// finds a duplicate key, it is not created.
+func (iv IndexView) CreateOneContext(ctx context.Context, model IndexModel) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	def, err := newIndexDef(iv.coll.name, model)
+	if err != nil {
+		return "", err
+	}
+	if iv.coll.indexes == nil {
+		return "", errors.New("indexes are not available on this collection")
+	}
+	if err := iv.coll.indexes.create(def); err != nil {
+		return "", err
+	}
+	return def.name, nil
+}
+
+// CreateMany creates several indexes and returns their names
+func (iv IndexView) CreateMany(models []IndexModel) ([]string, error) {
+	return iv.CreateManyContext(context.Background(), models)
+}
+
+// CreateManyContext creates several indexes and returns their names. It
+// stops at the first failure.
+func (iv IndexView) CreateManyContext(ctx context.Context, models []IndexModel) ([]string, error) {
+	names := make([]string, 0, len(models))
+	for _, model := range models {
+		name, err := iv.CreateOneContext(ctx, model)
+		if err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ListSpecifications describes the indexes of the collection
+func (iv IndexView) ListSpecifications() ([]*IndexSpecification, error) {
+	return iv.ListSpecificationsContext(context.Background())
+}
+
+// ListSpecificationsContext describes the indexes of the collection
+func (iv IndexView) ListSpecificationsContext(ctx context.Context) ([]*IndexSpecification, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if iv.coll.indexes == nil {
+		return []*IndexSpecification{}, nil
+	}
+	return iv.coll.indexes.list(iv.coll.name)
+}
+
+// DropOne drops the index with the given name
+func (iv IndexView) DropOne(name string) error {
+	return iv.DropOneContext(context.Background(), name)
+}
+
+// DropOneContext drops the index with the given name
+func (iv IndexView) DropOneContext(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if iv.coll.indexes == nil {
+		return fmt.Errorf("index not found: %s", name)
+	}
+	return iv.coll.indexes.drop(iv.coll.name, name)
+}
+
+// ----------------------------------------------------------------------------
+// Index Definitions
+// ----------------------------------------------------------------------------
+
+// indexDef is the persistent definition of an index
+type indexDef struct {
+	id         string // engine id of the definition document
+	collection string
+	name       string
+	keys       D
+	unique     bool
+	sparse     bool
+}
+
+// storedIndexDef is the shape of a definition in indexCollection
+type storedIndexDef struct {
+	ID         string           `json:"_id,omitempty"`
+	Collection string           `json:"collection"`
+	Name       string           `json:"name"`
+	Keys       [][2]interface{} `json:"keys"`
+	Unique     bool             `json:"unique"`
+	Sparse     bool             `json:"sparse"`
+}
+
+func newIndexDef(collection string, model IndexModel) (*indexDef, error) {
+	if strings.HasPrefix(collection, reservedPrefix) {
+		return nil, fmt.Errorf("cannot index reserved collection %s", collection)
+	}
+	if len(model.Keys) == 0 {
+		return nil, errors.New("index needs at least one key")
+	}
+
+	def := &indexDef{collection: collection}
+	nameParts := make([]string, 0, len(model.Keys))
+	seen := map[string]bool{}
+	for _, k := range model.Keys {
+		if err := checkUpdatePath(k.Key); err != nil {
+			return nil, fmt.Errorf("invalid index key: %w", err)
+		}
+		if seen[k.Key] {
+			return nil, fmt.Errorf("index key %q appears twice", k.Key)
+		}
+		seen[k.Key] = true
+		dir, ok := toFloat(k.Value)
+		if !ok || (dir != 1 && dir != -1) {
+			return nil, fmt.Errorf("index direction for %q must be 1 or -1", k.Key)
+		}
+		def.keys = append(def.keys, E{Key: k.Key, Value: int(dir)})
+		nameParts = append(nameParts, fmt.Sprintf("%s_%d", k.Key, int(dir)))
+	}
+	def.name = strings.Join(nameParts, "_")
+
+	if o := model.Options; o != nil {
+		if o.Name != nil {
+			if *o.Name == "" {
+				return nil, errors.New("index name must not be empty")
+			}
+			def.name = *o.Name
+		}
+		def.unique = o.Unique != nil && *o.Unique
+		def.sparse = o.Sparse != nil && *o.Sparse
+	}
+	return def, nil
+}
+
+func (d *indexDef) fields() []string {
+	fields := make([]string, len(d.keys))
+	for i, k := range d.keys {
+		fields[i] = k.Key
+	}
+	return fields
+}
+
+func (d *indexDef) sameAs(other *indexDef) bool {
+	if len(d.keys) != len(other.keys) || d.unique != other.unique || d.sparse != other.sparse {
+		return false
+	}
+	for i := range d.keys {
+		if d.keys[i].Key != other.keys[i].Key || d.keys[i].Value != other.keys[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *indexDef) spec() *IndexSpecification {
+	return &IndexSpecification{
+		Name:   d.name,
+		Keys:   append(D(nil), d.keys...),
+		Unique: d.unique,
+		Sparse: d.sparse,
+	}
+}
+
+func (d *indexDef) marshal() ([]byte, error) {
+	stored := storedIndexDef{Collection: d.collection, Name: d.name, Unique: d.unique, Sparse: d.sparse}
+	for _, k := range d.keys {
+		stored.Keys = append(stored.Keys, [2]interface{}{k.Key, k.Value})
+	}
+	return json.Marshal(stored)
+}
+
+func unmarshalIndexDef(data []byte) (*indexDef, error) {
+	var stored storedIndexDef
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	def := &indexDef{
+		id:         stored.ID,
+		collection: stored.Collection,
+		name:       stored.Name,
+		unique:     stored.Unique,
+		sparse:     stored.Sparse,
+	}
+	for _, k := range stored.Keys {
+		field, _ := k[0].(string)
+		dir, _ := toFloat(k[1])
+		def.keys = append(def.keys, E{Key: field, Value: int(dir)})
+	}
+	return def, nil
+}
+
+// ----------------------------------------------------------------------------
+// Index Entries
+// ----------------------------------------------------------------------------
+
+// indexEntry maps one key of an index to a document
+type indexEntry struct {
+	key []interface{}
+	id  string
+}
+
+// index is a secondary index held in memory as entries ordered by key,
+// then by document id
+type index struct {
+	def     *indexDef
+	fields  []string
+	entries entryList
+	// multikey is set once a document has given the index several keys
+	// from one field, so that range bounds on it cannot be intersected
+	multikey bool
+}
+
+func newIndex(def *indexDef) *index {
+	return &index{def: def, fields: def.fields()}
+}
+
+func compareKeys(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareValues(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a), len(b))
+}
+
+func compareEntries(a, b indexEntry) int {
+	if c := compareKeys(a.key, b.key); c != 0 {
+		return c
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+// keysOf returns the index keys of a document. A field holding an array
+// contributes one key per element, and marks the index multikey; a missing
+// field indexes as null. A sparse index has no keys for a document missing
+// every indexed field.
+func (ix *index) keysOf(doc Document) [][]interface{} {
+	keys := [][]interface{}{{}}
+	anyExists := false
+	for _, field := range ix.fields {
+		var values []interface{}
+		for _, pv := range lookupPath(doc, field) {
+			if !pv.exists {
+				values = append(values, nil)
+				continue
+			}
+			anyExists = true
+			if arr, ok := pv.value.([]interface{}); ok {
+				ix.multikey = true
+				if len(arr) == 0 {
+					values = append(values, nil)
+				}
+				values = append(values, arr...)
+				continue
+			}
+			values = append(values, pv.value)
+		}
+		if len(values) > 1 {
+			ix.multikey = true
+		}
+
+		next := make([][]interface{}, 0, len(keys)*len(values))
+		for _, prefix := range keys {
+			for _, v := range values {
+				key := append(append([]interface{}(nil), prefix...), v)
+				next = append(next, key)
+			}
+		}
+		keys = next
+	}
+	if ix.def.sparse && !anyExists {
+		return nil
+	}
+
+	// A document holding the same value twice in an array has one entry
+	sort.Slice(keys, func(i, j int) bool { return compareKeys(keys[i], keys[j]) < 0 })
+	unique := keys[:0]
+	for i, k := range keys {
+		if i == 0 || compareKeys(k, keys[i-1]) != 0 {
+			unique = append(unique, k)
+		}
+	}
+	return unique
+}
+
+func (ix *index) insert(e indexEntry) {
+	ix.entries.insert(e)
+}
+
+func (ix *index) remove(e indexEntry) {
+	ix.entries.remove(e)
+}
+
+// conflict returns the id of another document that already has key in a
+// unique index
+func (ix *index) conflict(key []interface{}, selfID string) (string, bool) {
+	node := ix.entries.seek(func(e indexEntry) bool { return compareKeys(e.key, key) < 0 }, nil)
+	for ; node != nil && compareKeys(node.entry.key, key) == 0; node = node.next[0] {
+		if node.entry.id != selfID {
+			return node.entry.id, true
+		}
+	}
+	return "", false
+}
+
+func (ix *index) duplicateKeyError(key []interface{}) error {
+	d := make(D, len(ix.fields))
+	for i, field := range ix.fields {
+		d[i] = E{Key: field, Value: key[i]}
+	}
+	return &DuplicateKeyError{Collection: ix.def.collection, Index: ix.def.name, Key: d}
+}
+
+// keyRange bounds the values of one index field
+type keyRange struct {
+	lo, hi       interface{}
+	hasLo, hasHi bool
+	loInc, hiInc bool
+}
+
+// scan calls visit for each entry whose key starts with prefix and, if r is
+// set, whose next field lies in r
+func (ix *index) scan(prefix []interface{}, r *keyRange, visit func(id string)) {
+	k := len(prefix)
+	node := ix.entries.seek(func(e indexEntry) bool {
+		if c := compareKeys(e.key[:k], prefix); c != 0 {
+			return c < 0
+		}
+		if r == nil || !r.hasLo {
+			return false
+		}
+		c := compareValues(e.key[k], r.lo)
+		return c < 0 || (c == 0 && !r.loInc)
+	}, nil)
+
+	for ; node != nil; node = node.next[0] {
+		e := node.entry
+		if compareKeys(e.key[:k], prefix) != 0 {
+			return
+		}
+		if r != nil && r.hasHi {
+			c := compareValues(e.key[k], r.hi)
+			if c > 0 || (c == 0 && !r.hiInc) {
+				return
+			}
+		}
+		visit(e.id)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Entry List
+// ----------------------------------------------------------------------------
+
+// maxEntryLevel bounds the height of an entry list. With a quarter of the
+// nodes reaching each next level, it suits lists of up to 2^32 entries.
+const maxEntryLevel = 16
+
+// entryList is a skip list of index entries in order, so that inserting,
+// removing and finding an entry take O(log n) time however large the index
+// grows
+type entryList struct {
+	head   entryNode
+	levels int
+}
+
+type entryNode struct {
+	entry indexEntry
+	next  []*entryNode
+}
+
+// seek returns the first node whose entry is not before the target, as
+// told by before, or nil if there is none. If path is set, it receives the
+// last node before the target on each level.
+func (l *entryList) seek(before func(indexEntry) bool, path []*entryNode) *entryNode {
+	if l.levels == 0 {
+		return nil
+	}
+	x := &l.head
+	for level := l.levels - 1; level >= 0; level-- {
+		for x.next[level] != nil && before(x.next[level].entry) {
+			x = x.next[level]
+		}
+		if path != nil {
+			path[level] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (l *entryList) insert(e indexEntry) {
+	if l.head.next == nil {
+		l.head.next = make([]*entryNode, maxEntryLevel)
+	}
+	var path [maxEntryLevel]*entryNode
+	l.seek(func(x indexEntry) bool { return compareEntries(x, e) < 0 }, path[:])
+
+	height := 1
+	for height < maxEntryLevel && rand.IntN(4) == 0 {
+		height++
+	}
+	for ; l.levels < height; l.levels++ {
+		path[l.levels] = &l.head
+	}
+	node := &entryNode{entry: e, next: make([]*entryNode, height)}
+	for level := range node.next {
+		node.next[level] = path[level].next[level]
+		path[level].next[level] = node
+	}
+}
+
+func (l *entryList) remove(e indexEntry) {
+	var path [maxEntryLevel]*entryNode
+	node := l.seek(func(x indexEntry) bool { return compareEntries(x, e) < 0 }, path[:])
+	if node == nil || compareEntries(node.entry, e) != 0 {
+		return
+	}
+	for level := range node.next {
+		path[level].next[level] = node.next[level]
+	}
+	for l.levels > 0 && l.head.next[l.levels-1] == nil {
+		l.levels--
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Query Planning
+// ----------------------------------------------------------------------------
+
+// fieldBounds are the index bounds a filter places on one field: either a
+// set of exact values or a range
+type fieldBounds struct {
+	points []interface{}
+	rng    *keyRange
+}
+
+// indexableValue reports whether a filter value can be looked up in an
+// index. Arrays match by their elements and regular expressions by pattern,
+// neither of which an index of exact keys can answer.
+func indexableValue(v interface{}) bool {
+	switch v.(type) {
+	case []interface{}, *regexp.Regexp:
+		return false
+	}
+	return true
+}
+
+// boundsFor returns the bounds a top-level filter condition places on a
+// field, if an index can use it. On a multikey field each bound of a range
+// may be met by a different array element, so only the lower bound is kept
+// and the filter checks the other.
+func boundsFor(cond interface{}, multikey bool) (*fieldBounds, bool) {
+	ops, isOps := isOperatorMap(cond)
+	if !isOps {
+		v := normalizeLiteral(cond)
+		if !indexableValue(v) {
+			return nil, false
+		}
+		return &fieldBounds{points: []interface{}{v}}, true
+	}
+
+	if v, ok := ops["$eq"]; ok {
+		v = normalizeLiteral(v)
+		if !indexableValue(v) {
+			return nil, false
+		}
+		return &fieldBounds{points: []interface{}{v}}, true
+	}
+	if list, ok := normalizeLiteral(ops["$in"]).([]interface{}); ok {
+		for _, v := range list {
+			if !indexableValue(v) {
+				return nil, false
+			}
+		}
+		return &fieldBounds{points: list}, true
+	}
+
+	r := &keyRange{}
+	for op, v := range ops {
+		v = normalizeLiteral(v)
+		if !indexableValue(v) {
+			continue
+		}
+		switch op {
+		case "$gt", "$gte":
+			inc := op == "$gte"
+			if !r.hasLo || compareValues(v, r.lo) > 0 || (compareValues(v, r.lo) == 0 && !inc) {
+				r.lo, r.hasLo, r.loInc = v, true, inc
+			}
+		case "$lt", "$lte":
+			inc := op == "$lte"
+			if !r.hasHi || compareValues(v, r.hi) < 0 || (compareValues(v, r.hi) == 0 && !inc) {
+				r.hi, r.hasHi, r.hiInc = v, true, inc
+			}
+		}
+	}
+	if !r.hasLo && !r.hasHi {
+		return nil, false
+	}
+	if multikey && r.hasLo && r.hasHi {
+		r.hi, r.hasHi, r.hiInc = nil, false, false
+	}
+	return &fieldBounds{rng: r}, true
+}
+
+// indexPlan is an index scan chosen for a filter
+type indexPlan struct {
+	index    *index
+	prefixes [][]interface{}
+	rng      *keyRange
+	fields   int // number of index fields the plan constrains
+}
+
+// planFor works out how ix can narrow a filter: exact values for a run of
+// leading fields, optionally followed by a range on the next field
+func planFor(ix *index, filter M) *indexPlan {
+	plan := &indexPlan{index: ix, prefixes: [][]interface{}{{}}}
+	for _, field := range ix.fields {
+		cond, ok := filter[field]
+		if !ok {
+			break
+		}
+		b, ok := boundsFor(cond, ix.multikey)
+		if !ok {
+			break
+		}
+		if b.rng != nil {
+			plan.rng = b.rng
+			plan.fields++
+			break
+		}
+		if ix.def.sparse {
+			for _, p := range b.points {
+				if p == nil {
+					return nil // a sparse index does not hold documents missing the field
+				}
+			}
+		}
+		if len(plan.prefixes)*len(b.points) > maxIndexPoints {
+			break
+		}
+		next := make([][]interface{}, 0, len(plan.prefixes)*len(b.points))
+		for _, prefix := range plan.prefixes {
+			for _, p := range b.points {
+				next = append(next, append(append([]interface{}(nil), prefix...), p))
+			}
+		}
+		plan.prefixes = next
+		plan.fields++
+	}
+	if plan.fields == 0 {
+		return nil
+	}
+	return plan
+}
+
+// ids returns the ids of the documents the plan selects, in index order
+func (p *indexPlan) ids() []string {
+	seen := map[string]bool{}
+	var ids []string
+	visit := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, prefix := range p.prefixes {
+		p.index.scan(prefix, p.rng, visit)
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return ids
+}
+
+// ----------------------------------------------------------------------------
+// Index Catalog
+// ----------------------------------------------------------------------------
+
+// indexCatalog holds the secondary indexes of every collection of a Client.
+//
+// Definitions are stored in indexCollection so that they persist. The
+// entries live in memory: they are built from a collection's documents the
+// first time the collection is used, and kept current by this Client's own
+// writes. Writes made through another Client on the same database are not
+// seen, as the engine offers no cheap way to tell that a collection has
+// changed.
+type indexCatalog struct {
+	mu     sync.Mutex
+	engine Engine
+	loaded bool
+	defs   map[string][]*indexDef        // by collection
+	colls  map[string]*collectionIndexes // built indexes by collection
+}
+
+// collectionIndexes holds the built indexes of one collection. Its lock is
+// held while they are used, and for the whole of each write that maintains
+// them, so writes to different collections do not wait for each other.
+type collectionIndexes struct {
+	mu      sync.Mutex
+	built   bool
+	indexes []*index
+}
+
+func newIndexCatalog(engine Engine) *indexCatalog {
+	return &indexCatalog{engine: engine, colls: map[string]*collectionIndexes{}}
+}
+
+// load reads the index definitions once. The caller holds ic.mu.
+func (ic *indexCatalog) load() error {
+	if ic.loaded {
+		return nil
+	}
+	data, err := ic.engine.FindAll(indexCollection, -1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to load indexes: %w", err)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to load indexes: %w", err)
+	}
+
+	defs := map[string][]*indexDef{}
+	for _, r := range raw {
+		def, err := unmarshalIndexDef(r)
+		if err != nil {
+			return fmt.Errorf("failed to load indexes: %w", err)
+		}
+		defs[def.collection] = append(defs[def.collection], def)
+	}
+	ic.defs = defs
+	ic.loaded = true
+	return nil
+}
+
+// definitions returns the index definitions of a collection
+func (ic *indexCatalog) definitions(collection string) ([]*indexDef, error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if err := ic.load(); err != nil {
+		return nil, err
+	}
+	return append([]*indexDef(nil), ic.defs[collection]...), nil
+}
+
+// lookup returns the built indexes of a collection, which the caller locks
+func (ic *indexCatalog) lookup(collection string) *collectionIndexes {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	ci, ok := ic.colls[collection]
+	if !ok {
+		ci = &collectionIndexes{}
+		ic.colls[collection] = ci
+	}
+	return ci
+}
+
+// current builds the indexes of a collection on first use. The caller holds
+// ci.mu.
+func (ic *indexCatalog) current(collection string, ci *collectionIndexes) error {
+	if ci.built {
+		return nil
+	}
+	if strings.HasPrefix(collection, reservedPrefix) {
+		ci.built = true
+		return nil
+	}
+
+	defs, err := ic.definitions(collection)
+	if err != nil {
+		return err
+	}
+	ci.indexes = make([]*index, len(defs))
+	for i, def := range defs {
+		ci.indexes[i] = newIndex(def)
+	}
+	if len(defs) > 0 {
+		if err := buildIndexes(ic.engine, collection, ci.indexes, false); err != nil {
+			ci.indexes = nil
+			return err
+		}
+	}
+	ci.built = true
+	return nil
+}
+
+// scanCollection calls visit for every document of a collection, reading
+// them in batches
+func scanCollection(engine Engine, collection string, visit func(Document) error) error {
+	for offset := 0; ; offset += defaultBatchSize {
+		data, err := engine.FindAll(collection, defaultBatchSize, offset)
+		if err != nil {
+			return err
+		}
+		docs, err := unmarshalDocuments(data, false)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := visit(doc); err != nil {
+				return err
+			}
+		}
+		if len(docs) < defaultBatchSize {
+			return nil
+		}
+	}
+}
+
+// buildIndexes adds the documents of a collection to empty indexes. With
+// strict set, duplicate keys in a unique index are an error.
+func buildIndexes(engine Engine, collection string, indexes []*index, strict bool) error {
+	return scanCollection(engine, collection, func(doc Document) error {
+		id := doc.ID()
+		for _, ix := range indexes {
+			for _, key := range ix.keysOf(doc) {
+				if strict && ix.def.unique {
+					if _, ok := ix.conflict(key, id); ok {
+						return ix.duplicateKeyError(key)
+					}
+				}
+				ix.insert(indexEntry{key: key, id: id})
+			}
+		}
+		return nil
+	})
+}
+
+func (ic *indexCatalog) create(def *indexDef) error {
+	ci := ic.lookup(def.collection)
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if err := ic.current(def.collection, ci); err != nil {
+		return err
+	}
+	for _, ix := range ci.indexes {
+		existing := ix.def
+		if existing.name == def.name {
+			if existing.sameAs(def) {
+				return nil
+			}
+			return fmt.Errorf("index %q already exists with different keys or options", def.name)
+		}
+		if existing.sameAs(def) {
+			return fmt.Errorf("index %q already exists with the same keys and options", existing.name)
+		}
+	}
+
+	ix := newIndex(def)
+	if err := buildIndexes(ic.engine, def.collection, []*index{ix}, true); err != nil {
+		return err
+	}
+
+	data, err := def.marshal()
+	if err != nil {
+		return err
+	}
+	id, err := ic.engine.Insert(indexCollection, data)
+	if err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	def.id = id
+
+	ic.mu.Lock()
+	ic.defs[def.collection] = append(ic.defs[def.collection], def)
+	ic.mu.Unlock()
+	ci.indexes = append(ci.indexes, ix)
+	return nil
+}
+
+func (ic *indexCatalog) list(collection string) ([]*IndexSpecification, error) {
+	defs, err := ic.definitions(collection)
+	if err != nil {
+		return nil, err
+	}
+	specs := []*IndexSpecification{}
+	for _, def := range defs {
+		specs = append(specs, def.spec())
+	}
+	return specs, nil
+}
+
+func (ic *indexCatalog) drop(collection, name string) error {
+	ci := ic.lookup(collection)
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if err := ic.load(); err != nil {
+		return err
+	}
+	defs := ic.defs[collection]
+	for i, def := range defs {
+		if def.name != name {
+			continue
+		}
+		if _, err := ic.engine.Delete(indexCollection, def.id); err != nil {
+			return fmt.Errorf("failed to drop index: %w", err)
+		}
+		ic.defs[collection] = append(defs[:i:i], defs[i+1:]...)
+		kept := make([]*index, 0, len(ci.indexes))
+		for _, ix := range ci.indexes {
+			if ix.def.name != name {
+				kept = append(kept, ix)
+			}
+		}
+		ci.indexes = kept
+		return nil
+	}
+	return fmt.Errorf("index not found: %s", name)
+}
+
+// plan picks the index that constrains the most leading fields of filter
+// and returns the ids of the candidate documents. ok is false when no index
+// applies and the collection must be scanned.
+func (ic *indexCatalog) plan(collection string, filter M) (ids []string, name string, ok bool, err error) {
+	if ic == nil || len(filter) == 0 {
+		return nil, "", false, nil
+	}
+	ci := ic.lookup(collection)
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if err := ic.current(collection, ci); err != nil {
+		return nil, "", false, err
+	}
+	var best *indexPlan
+	for _, ix := range ci.indexes {
+		if p := planFor(ix, filter); p != nil && (best == nil || p.fields > best.fields) {
+			best = p
+		}
+	}
+	if best == nil {
+		return nil, "", false, nil
+	}
+	return best.ids(), best.index.def.name, true, nil
+}
+
+// ----------------------------------------------------------------------------
+// Index Maintenance
+// ----------------------------------------------------------------------------
+
+// indexWrite is an index update in progress. It is created by beginWrite,
+// which locks the collection's indexes, and finished by done.
+type indexWrite struct {
+	ci *collectionIndexes
+}
+
+// beginWrite locks the indexes of collection for a write, bringing them up
+// to date first. The returned write must be finished with done.
+func (ic *indexCatalog) beginWrite(collection string) (*indexWrite, error) {
+	if ic == nil {
+		return &indexWrite{}, nil
+	}
+	ci := ic.lookup(collection)
+	ci.mu.Lock()
+	if err := ic.current(collection, ci); err != nil {
+		ci.mu.Unlock()
+		return nil, err
+	}
+	return &indexWrite{ci: ci}, nil
+}
+
+// active reports whether the collection has any index to maintain
+func (w *indexWrite) active() bool {
+	return w.ci != nil && len(w.ci.indexes) > 0
+}
+
+// check returns a DuplicateKeyError if storing doc under id would break a
+// unique index
+func (w *indexWrite) check(id string, doc Document) error {
+	if !w.active() {
+		return nil
+	}
+	for _, ix := range w.ci.indexes {
+		if !ix.def.unique {
+			continue
+		}
+		for _, key := range ix.keysOf(doc) {
+			if _, ok := ix.conflict(key, id); ok {
+				return ix.duplicateKeyError(key)
+			}
+		}
+	}
+	return nil
+}
+
+// replace moves a document's entries from its old version to its new one.
+// Either may be nil, for an insert or a delete.
+func (w *indexWrite) replace(id string, old, new Document) {
+	if !w.active() {
+		return
+	}
+	for _, ix := range w.ci.indexes {
+		if old != nil {
+			for _, key := range ix.keysOf(old) {
+				ix.remove(indexEntry{key: key, id: id})
+			}
+		}
+		if new != nil {
+			for _, key := range ix.keysOf(new) {
+				ix.insert(indexEntry{key: key, id: id})
+			}
+		}
+	}
+}
+
+// done unlocks the collection's indexes
+func (w *indexWrite) done() {
+	if w.ci != nil {
+		w.ci.mu.Unlock()
+	}
+}
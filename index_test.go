@@ -0,0 +1,314 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sharedEngine lets several Clients use one MemoryEngine, which stays open
+// when each Client closes
+type sharedEngine struct{ *MemoryEngine }
+
+func (sharedEngine) Close() error { return nil }
+
+func TestEntryList(t *testing.T) {
+	var list entryList
+	var model []indexEntry
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 5000; i++ {
+		e := indexEntry{key: []interface{}{float64(rng.IntN(200))}, id: fmt.Sprint(rng.IntN(50))}
+		j := sort.Search(len(model), func(j int) bool { return compareEntries(model[j], e) >= 0 })
+		present := j < len(model) && compareEntries(model[j], e) == 0
+		if rng.IntN(3) == 0 {
+			list.remove(e)
+			if present {
+				model = append(model[:j], model[j+1:]...)
+			}
+		} else if !present {
+			list.insert(e)
+			model = append(model[:j], append([]indexEntry{e}, model[j:]...)...)
+		}
+	}
+
+	var got []indexEntry
+	for node := list.seek(func(indexEntry) bool { return false }, nil); node != nil; node = node.next[0] {
+		got = append(got, node.entry)
+	}
+	if !reflect.DeepEqual(got, model) {
+		t.Fatalf("list holds %d entries in a different order from the %d expected", len(got), len(model))
+	}
+}
+
+func TestIndexScan(t *testing.T) {
+	ix := newIndex(&indexDef{name: "a_1_b_1", keys: D{{Key: "a", Value: 1}, {Key: "b", Value: 1}}})
+	for i := 0; i < 20; i++ {
+		ix.insert(indexEntry{key: []interface{}{float64(i % 4), float64(i)}, id: fmt.Sprintf("d%02d", i)})
+	}
+
+	tests := []struct {
+		name   string
+		prefix []interface{}
+		rng    *keyRange
+		want   []string
+	}{
+		{name: "prefix", prefix: []interface{}{1.0}, want: []string{"d01", "d05", "d09", "d13", "d17"}},
+		{name: "prefix and range", prefix: []interface{}{1.0}, rng: &keyRange{lo: 5.0, hasLo: true, hi: 13.0, hasHi: true, hiInc: true},
+			want: []string{"d09", "d13"}},
+		{name: "inclusive lower bound", prefix: []interface{}{2.0}, rng: &keyRange{lo: 6.0, hasLo: true, loInc: true},
+			want: []string{"d06", "d10", "d14", "d18"}},
+		{name: "range on the first field", rng: &keyRange{lo: 2.0, hasLo: true, loInc: true},
+			want: []string{"d02", "d06", "d10", "d14", "d18", "d03", "d07", "d11", "d15", "d19"}},
+		{name: "full key", prefix: []interface{}{3.0, 7.0}, want: []string{"d07"}},
+		{name: "no match", prefix: []interface{}{9.0}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			ix.scan(tt.prefix, tt.rng, func(id string) { got = append(got, id) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scan = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIndexQueries(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("people")
+	for i := 0; i < 30; i++ {
+		doc := M{"n": fmt.Sprintf("p%02d", i), "age": i, "city": []string{"Paris", "Rome", "Oslo"}[i%3]}
+		if i%10 == 0 {
+			doc["tags"] = []string{"x", "y"}
+		}
+		if _, err := coll.InsertOne(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := coll.Indexes().CreateMany([]IndexModel{
+		{Keys: D{{Key: "city", Value: 1}, {Key: "age", Value: -1}}},
+		{Keys: D{{Key: "tags", Value: 1}}, Options: NewIndexOptions().SetSparse(true)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    M
+		wantIndex string // empty for a collection scan
+		want      int
+	}{
+		{name: "equality", filter: M{"city": "Rome"}, wantIndex: "city_1_age_-1", want: 10},
+		{name: "equality and range", filter: M{"city": "Rome", "age": M{"$gte": 10, "$lt": 20}}, wantIndex: "city_1_age_-1", want: 4},
+		{name: "$in", filter: M{"city": M{"$in": []string{"Oslo", "Rome"}}}, wantIndex: "city_1_age_-1", want: 20},
+		{name: "array element", filter: M{"tags": "y"}, wantIndex: "tags_1", want: 3},
+		// Each bound may match a different element of the array, so the two
+		// cannot be intersected into one empty range
+		{name: "multikey range", filter: M{"tags": M{"$gt": "x", "$lt": "y"}}, wantIndex: "tags_1", want: 3},
+		{name: "sparse index skips null", filter: M{"tags": nil}, want: 27},
+		{name: "field after a gap", filter: M{"age": 5}, want: 1},
+		{name: "regex", filter: M{"city": M{"$regex": "^R"}}, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := coll.Explain(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.DocsReturned != int64(tt.want) {
+				t.Errorf("returned %d documents, want %d", result.DocsReturned, tt.want)
+			}
+			if tt.wantIndex == "" {
+				if result.Plan != PlanCollectionScan {
+					t.Errorf("plan %s %s, want a collection scan", result.Plan, result.IndexName)
+				}
+				return
+			}
+			if result.Plan != PlanIndexScan || result.IndexName != tt.wantIndex {
+				t.Errorf("plan %s %s, want an index scan of %s", result.Plan, result.IndexName, tt.wantIndex)
+			}
+			if result.DocsExamined != int64(tt.want) {
+				t.Errorf("examined %d documents, want %d", result.DocsExamined, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(c *Collection) error
+	}{
+		{name: "insert", write: func(c *Collection) error {
+			_, err := c.InsertOne(M{"email": "a@x"})
+			return err
+		}},
+		{name: "update", write: func(c *Collection) error {
+			_, err := c.UpdateOne(M{"email": "b@x"}, M{"$set": M{"email": "a@x"}})
+			return err
+		}},
+		{name: "replace", write: func(c *Collection) error {
+			_, err := c.ReplaceOne(M{"email": "b@x"}, M{"email": "a@x"})
+			return err
+		}},
+		{name: "upsert", write: func(c *Collection) error {
+			_, err := c.UpdateOne(M{"email": "a@x", "n": 1}, M{"$set": M{"v": 1}}, NewUpdateOptions().SetUpsert(true))
+			return err
+		}},
+		{name: "array element", write: func(c *Collection) error {
+			_, err := c.InsertOne(M{"email": []string{"c@x", "a@x"}})
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("users")
+			if _, err := coll.InsertMany([]interface{}{M{"email": "a@x"}, M{"email": "b@x"}}); err != nil {
+				t.Fatal(err)
+			}
+			_, err := coll.Indexes().CreateOne(IndexModel{Keys: D{{Key: "email", Value: 1}}, Options: NewIndexOptions().SetUnique(true)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = tt.write(coll)
+			var dup *DuplicateKeyError
+			if !errors.Is(err, ErrDuplicateKey) || !errors.As(err, &dup) || dup.Index != "email_1" {
+				t.Fatalf("got %v, want a duplicate key in email_1", err)
+			}
+			if n, _ := coll.CountDocuments(nil); n != 2 {
+				t.Errorf("collection holds %d documents after the failed write, want 2", n)
+			}
+		})
+	}
+}
+
+func TestUniqueIndexOverDuplicates(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("users")
+	if _, err := coll.InsertMany([]interface{}{M{"email": "a@x"}, M{"email": "a@x"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := coll.Indexes().CreateOne(IndexModel{Keys: D{{Key: "email", Value: 1}}, Options: NewIndexOptions().SetUnique(true)})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("got %v, want ErrDuplicateKey", err)
+	}
+	specs, err := coll.Indexes().ListSpecifications()
+	if err != nil || len(specs) != 0 {
+		t.Errorf("got %v, %v; want no index", specs, err)
+	}
+}
+
+// batchRecordingEngine records the limit of every scan of one collection
+type batchRecordingEngine struct {
+	*MemoryEngine
+	mu     sync.Mutex
+	limits []int
+}
+
+func (e *batchRecordingEngine) FindAll(collection string, limit, skip int) ([]byte, error) {
+	if collection == "big" {
+		e.mu.Lock()
+		e.limits = append(e.limits, limit)
+		e.mu.Unlock()
+	}
+	return e.MemoryEngine.FindAll(collection, limit, skip)
+}
+
+func TestIndexBuildReadsInBatches(t *testing.T) {
+	engine := &batchRecordingEngine{MemoryEngine: NewMemoryEngine()}
+	for i := 0; i < 2*defaultBatchSize+10; i++ {
+		if _, err := engine.Insert("big", []byte(fmt.Sprintf(`{"i":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	coll := newMemoryClient(t, engine).Database().Collection("big")
+	if _, err := coll.Indexes().CreateOne(IndexModel{Keys: D{{Key: "i", Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(engine.limits) != 3 {
+		t.Errorf("index build made %d scans, want 3", len(engine.limits))
+	}
+	for _, limit := range engine.limits {
+		if limit != defaultBatchSize {
+			t.Errorf("index build scanned with limit %d, want %d", limit, defaultBatchSize)
+		}
+	}
+	if n, err := coll.CountDocuments(M{"i": M{"$gte": 2 * defaultBatchSize}}); err != nil || n != 10 {
+		t.Errorf("got %d, %v; want 10", n, err)
+	}
+}
+
+func TestIndexesAcrossClients(t *testing.T) {
+	engine := sharedEngine{NewMemoryEngine()}
+	a := newMemoryClient(t, engine).Database().Collection("users")
+
+	_, err := a.Indexes().CreateOne(IndexModel{Keys: D{{Key: "email", Value: 1}}, Options: NewIndexOptions().SetUnique(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.InsertMany([]interface{}{M{"email": "a@x"}, M{"email": "old@x"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UpdateOne(M{"email": "old@x"}, M{"$set": M{"email": "new@x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Client builds its entries from the documents stored when it first
+	// uses the collection, with the definitions another Client created
+	b := newMemoryClient(t, engine).Database().Collection("users")
+	tests := []struct {
+		email string
+		want  int64
+	}{
+		{email: "a@x", want: 1},
+		{email: "new@x", want: 1},
+		{email: "old@x", want: 0},
+	}
+	for _, tt := range tests {
+		result, err := b.Explain(M{"email": tt.email})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Plan != PlanIndexScan || result.DocsReturned != tt.want {
+			t.Errorf("%s: b found %d documents with %s, want %d with an index scan", tt.email, result.DocsReturned, result.Plan, tt.want)
+		}
+	}
+	if _, err := b.InsertOne(M{"email": "new@x"}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("b inserted a duplicate of a's document: %v", err)
+	}
+}
+
+func TestIndexWritesToOtherCollectionsDoNotWait(t *testing.T) {
+	db := newMemoryClient(t, NewMemoryEngine()).Database()
+	for _, name := range []string{"a", "b"} {
+		if _, err := db.Collection(name).Indexes().CreateOne(IndexModel{Keys: D{{Key: "k", Value: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := db.indexes.beginWrite("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.done()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := db.Collection("a").InsertOne(M{"k": 1})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a write to collection a waited for the indexes of collection b")
+	}
+}
@@ -25,37 +25,12 @@
 //	users.DeleteOne(keradb.M{"_id": result.InsertedID})
 package keradb
 
-/*
-#cgo LDFLAGS: -L${SRCDIR}/../../../target/release -lkeradb
-#cgo linux LDFLAGS: -lkeradb -lm -ldl -lpthread
-#cgo darwin LDFLAGS: -lkeradb -lm -ldl -lpthread
-#cgo windows LDFLAGS: -lkeradb -lws2_32 -luserenv -lbcrypt -lntdll
-
-#include <stdlib.h>
-
-typedef void* KeraDB;
-
-KeraDB keradb_create(const char* path);
-KeraDB keradb_open(const char* path);
-void keradb_close(KeraDB db);
-char* keradb_insert(KeraDB db, const char* collection, const char* json_data);
-char* keradb_find_by_id(KeraDB db, const char* collection, const char* doc_id);
-char* keradb_update(KeraDB db, const char* collection, const char* doc_id, const char* json_data);
-int keradb_delete(KeraDB db, const char* collection, const char* doc_id);
-char* keradb_find_all(KeraDB db, const char* collection, int limit, int skip);
-int keradb_count(KeraDB db, const char* collection);
-char* keradb_list_collections(KeraDB db);
-int keradb_sync(KeraDB db);
-char* keradb_last_error();
-void keradb_free_string(char* s);
-*/
-import "C"
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"reflect"
-	"unsafe"
+	"strings"
+	"sync"
 )
 
 // M is a shorthand for map[string]interface{}, similar to MongoDB's bson.M
@@ -70,6 +45,42 @@ type E struct {
 	Value interface{}
 }
 
+// Map returns the elements of d as an M. Of repeated keys, the last wins.
+func (d D) Map() M {
+	m := make(M, len(d))
+	for _, e := range d {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+// Doc is a document given as an M, a D or a Document. Filters, updates and
+// projections accept any of them. A D keeps its keys in order, so a
+// document inserted as a D is stored with its fields in that order.
+type Doc interface {
+	// fields returns the document as a map
+	fields() map[string]interface{}
+}
+
+// Filter is a query filter, such as M{"age": M{"$gt": 30}}. A nil Filter
+// matches every document.
+type Filter = Doc
+
+// Update is an update document, such as M{"$set": M{"status": "active"}}
+type Update = Doc
+
+func (m M) fields() map[string]interface{}        { return m }
+func (d D) fields() map[string]interface{}        { return d.Map() }
+func (d Document) fields() map[string]interface{} { return d }
+
+// toM converts a Doc to an M; nil stays nil
+func toM(doc Doc) M {
+	if doc == nil {
+		return nil
+	}
+	return M(doc.fields())
+}
+
 // Document represents a document in the database
 type Document map[string]interface{}
 
@@ -99,6 +110,8 @@ type InsertManyResult struct {
 type UpdateResult struct {
 	MatchedCount  int64
 	ModifiedCount int64
+	UpsertedCount int64
+	UpsertedID    string
 }
 
 // DeleteResult is the result of a Delete operation
@@ -107,490 +120,625 @@ type DeleteResult struct {
 }
 
 // ============================================================================
-// Helper Functions
+// SingleResult
 // ============================================================================
 
-func getLastError() string {
-	cErr := C.keradb_last_error()
-	if cErr == nil {
-		return "Unknown error"
+// SingleResult represents a single query result
+type SingleResult struct {
+	doc      Document
+	err      error
+	registry *Registry
+}
+
+// Decode decodes the result into the provided value, using the client's
+// registry. If the query matched nothing, it returns ErrNoDocuments.
+func (r *SingleResult) Decode(v interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.doc == nil {
+		return ErrNoDocuments
 	}
-	defer C.keradb_free_string(cErr)
-	return C.GoString(cErr)
+	return r.registry.decodeDocument(r.doc, v)
 }
 
-func matchesFilter(doc Document, filter M) bool {
-	for key, value := range filter {
-		if key == "$and" {
-			filters, ok := value.([]M)
-			if !ok {
-				continue
-			}
-			for _, f := range filters {
-				if !matchesFilter(doc, f) {
-					return false
-				}
-			}
-		} else if key == "$or" {
-			filters, ok := value.([]M)
-			if !ok {
-				continue
-			}
-			matched := false
-			for _, f := range filters {
-				if matchesFilter(doc, f) {
-					matched = true
-					break
-				}
-			}
-			if !matched {
-				return false
-			}
-		} else if key[0] == '$' {
-			// Skip unknown operators
-			continue
-		} else {
-			docValue := doc[key]
-
-			if opMap, ok := value.(M); ok {
-				// Comparison operators
-				for op, opValue := range opMap {
-					switch op {
-					case "$eq":
-						if !reflect.DeepEqual(docValue, opValue) {
-							return false
-						}
-					case "$ne":
-						if reflect.DeepEqual(docValue, opValue) {
-							return false
-						}
-					case "$gt":
-						if !compareGT(docValue, opValue) {
-							return false
-						}
-					case "$gte":
-						if !compareGTE(docValue, opValue) {
-							return false
-						}
-					case "$lt":
-						if !compareLT(docValue, opValue) {
-							return false
-						}
-					case "$lte":
-						if !compareLTE(docValue, opValue) {
-							return false
-						}
-					case "$in":
-						if !containsValue(opValue, docValue) {
-							return false
-						}
-					case "$nin":
-						if containsValue(opValue, docValue) {
-							return false
-						}
-					}
-				}
-			} else {
-				// Direct equality
-				if !reflect.DeepEqual(docValue, value) {
-					return false
-				}
-			}
-		}
+// Err returns the error, if any. A query that matched nothing reports
+// ErrNoDocuments.
+func (r *SingleResult) Err() error {
+	return r.err
+}
+
+// ============================================================================
+// Collection
+// ============================================================================
+
+// Collection represents a MongoDB-compatible collection.
+//
+// Every operation has a Context variant (InsertOneContext, FindContext, ...)
+// that honours cancellation and deadlines. The plain methods use
+// context.Background().
+type Collection struct {
+	engine    Engine
+	name      string
+	writeMu   *sync.Mutex   // shared by every collection of a Client
+	view      *sync.RWMutex // shared by every collection of a Client; nil in a transaction
+	indexes   *indexCatalog // shared by every collection of a Client
+	changes   *changeLog    // shared by every collection of a Client; nil if off
+	registry  *Registry
+	useNumber bool          // read numbers as json.Number
+	newID     func() string // assigns missing IDs; nil lets the engine choose
+}
+
+// lockWrites serializes read-modify-write operations across all
+// collections of a Client, so that a document found by one operation cannot
+// change before that operation writes it back. It returns the unlock
+// function.
+func (c *Collection) lockWrites() func() {
+	if c.writeMu == nil {
+		return func() {}
 	}
-	return true
+	c.writeMu.Lock()
+	return c.writeMu.Unlock
 }
 
-func compareGT(a, b interface{}) bool {
-	switch av := a.(type) {
-	case float64:
-		if bv, ok := b.(float64); ok {
-			return av > bv
-		}
-	case int:
-		if bv, ok := b.(int); ok {
-			return av > bv
-		}
-	case string:
-		if bv, ok := b.(string); ok {
-			return av > bv
-		}
+// rlock takes the view lock mu shared, so that a transaction cannot commit
+// while the caller reads from the engine, and returns the unlock function.
+// A nil mu, as inside a transaction, is not locked.
+func rlock(mu *sync.RWMutex) func() {
+	if mu == nil {
+		return func() {}
 	}
-	return false
+	mu.RLock()
+	return mu.RUnlock
+}
+
+// sibling returns another collection of the same database
+func (c *Collection) sibling(name string) *Collection {
+	sibling := *c
+	sibling.name = name
+	return &sibling
+}
+
+// Name returns the collection name
+func (c *Collection) Name() string {
+	return c.name
+}
+
+// InsertOne inserts a single document
+func (c *Collection) InsertOne(doc interface{}) (*InsertOneResult, error) {
+	return c.InsertOneContext(context.Background(), doc)
 }
 
-func compareGTE(a, b interface{}) bool {
-	return compareGT(a, b) || reflect.DeepEqual(a, b)
+// InsertOneContext inserts a single document. A caller-supplied _id, a
+// string or an ObjectID, is kept; otherwise the client's ID strategy assigns
+// one. If the _id is taken or the document would break a unique index, it
+// returns a *DuplicateKeyError.
+func (c *Collection) InsertOneContext(ctx context.Context, doc interface{}) (*InsertOneResult, error) {
+	c = c.forContext(ctx)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	id, err := c.insertDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &InsertOneResult{
+		InsertedID: id,
+	}
+	c.finalID(id, func(id string) { result.InsertedID = id })
+	return result, nil
 }
 
-func compareLT(a, b interface{}) bool {
-	switch av := a.(type) {
-	case float64:
-		if bv, ok := b.(float64); ok {
-			return av < bv
+// insertDocument stores a new document and adds it to the collection's
+// indexes. The fields are stored in the order of a D or a struct, after the
+// _id.
+func (c *Collection) insertDocument(doc interface{}) (string, error) {
+	fields, err := c.registry.encodeOrdered(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal document: %w", err)
+	}
+	fields = idFirst(fields)
+
+	// supplied is the caller's _id, want the _id the engine must keep
+	var supplied, want string
+	var idValue interface{}
+	if len(fields) > 0 && fields[0].Key == "_id" {
+		idValue = fields[0].Value
+	}
+	switch id := idValue.(type) {
+	case nil:
+		if len(fields) > 0 && fields[0].Key == "_id" {
+			fields = fields[1:]
 		}
-	case int:
-		if bv, ok := b.(int); ok {
-			return av < bv
+		if c.newID != nil {
+			want = c.newID()
+			fields = append(D{{Key: "_id", Value: want}}, fields...)
 		}
 	case string:
-		if bv, ok := b.(string); ok {
-			return av < bv
-		}
+		supplied, want = id, id
+	default:
+		return "", fmt.Errorf("_id must be a string or an ObjectID, not %T", id)
 	}
-	return false
-}
 
-func compareLTE(a, b interface{}) bool {
-	return compareLT(a, b) || reflect.DeepEqual(a, b)
-}
+	jsonData, err := marshalStored(fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal document: %w", err)
+	}
 
-func containsValue(arr interface{}, val interface{}) bool {
-	slice := reflect.ValueOf(arr)
-	if slice.Kind() != reflect.Slice {
-		return false
+	w, err := c.indexes.beginWrite(c.name)
+	if err != nil {
+		return "", err
 	}
-	for i := 0; i < slice.Len(); i++ {
-		if reflect.DeepEqual(slice.Index(i).Interface(), val) {
-			return true
+	defer w.done()
+
+	if supplied != "" {
+		existing, err := c.engine.FindByID(c.name, supplied)
+		if err != nil {
+			return "", fmt.Errorf("insert failed: %w", err)
+		}
+		if existing != nil {
+			return "", &DuplicateKeyError{Collection: c.name, Index: "_id_", Key: D{{Key: "_id", Value: supplied}}}
 		}
 	}
-	return false
-}
 
-func applyUpdate(doc Document, update M) Document {
-	result := make(Document)
-	for k, v := range doc {
-		result[k] = v
+	var stored Document
+	if w.active() {
+		if stored, err = unmarshalDocument(jsonData, false); err != nil {
+			return "", fmt.Errorf("failed to marshal document: %w", err)
+		}
+		if err := w.check(stored.ID(), stored); err != nil {
+			return "", err
+		}
 	}
 
-	for op, fields := range update {
-		switch op {
-		case "$set":
-			if setFields, ok := fields.(M); ok {
-				for k, v := range setFields {
-					result[k] = v
-				}
-			}
-		case "$unset":
-			if unsetFields, ok := fields.(M); ok {
-				for k := range unsetFields {
-					delete(result, k)
-				}
-			}
-		case "$inc":
-			if incFields, ok := fields.(M); ok {
-				for k, v := range incFields {
-					if incVal, ok := v.(float64); ok {
-						if curr, ok := result[k].(float64); ok {
-							result[k] = curr + incVal
-						} else {
-							result[k] = incVal
-						}
-					}
-				}
-			}
-		case "$push":
-			if pushFields, ok := fields.(M); ok {
-				for k, v := range pushFields {
-					if arr, ok := result[k].([]interface{}); ok {
-						result[k] = append(arr, v)
-					} else {
-						result[k] = []interface{}{v}
-					}
-				}
-			}
-		default:
-			if op[0] != '$' {
-				// Replacement mode
-				result = Document{"_id": doc["_id"]}
-				for k, v := range update {
-					result[k] = v
-				}
-				return result
+	id, err := c.engine.Insert(c.name, jsonData)
+	if err != nil {
+		return "", fmt.Errorf("insert failed: %w", err)
+	}
+	if want != "" && id != want {
+		// An engine that assigns its own IDs would silently break the
+		// caller's references, so undo the insert
+		_, _ = c.engine.Delete(c.name, id)
+		return "", fmt.Errorf("insert failed: engine replaced _id %q with %q", want, id)
+	}
+
+	if w.active() {
+		stored["_id"] = id
+		w.replace(id, nil, stored)
+	}
+	if c.changes != nil {
+		if stored == nil {
+			if stored, err = unmarshalDocument(jsonData, c.useNumber); err != nil {
+				c.changes.skip()
+				return id, nil
 			}
+			stored["_id"] = id
 		}
+		c.recordChange("insert", id, nil, stored)
 	}
+	return id, nil
+}
 
-	return result
+// InsertMany inserts multiple documents
+func (c *Collection) InsertMany(docs []interface{}) (*InsertManyResult, error) {
+	return c.InsertManyContext(context.Background(), docs)
 }
 
-// ============================================================================
-// Cursor
-// ============================================================================
+// InsertManyContext inserts multiple documents in order, stopping at the
+// first that cannot be inserted. It always returns the IDs inserted; on
+// failure the error is a *BulkWriteException giving the index of the
+// document that failed, or the context error if ctx was done.
+func (c *Collection) InsertManyContext(ctx context.Context, docs []interface{}) (*InsertManyResult, error) {
+	if len(docs) == 0 {
+		return &InsertManyResult{}, nil
+	}
 
-// Cursor allows iteration over query results
-type Cursor struct {
-	documents []Document
-	index     int
-	limit     int
-	skip      int
-}
+	models := make([]WriteModel, len(docs))
+	for i, doc := range docs {
+		models[i] = &InsertOneModel{Document: doc}
+	}
+	result, err := c.BulkWriteContext(ctx, models)
+	if result == nil {
+		return nil, err
+	}
 
-// NewCursor creates a new cursor from documents
-func NewCursor(docs []Document) *Cursor {
-	return &Cursor{
-		documents: docs,
-		index:     0,
-		limit:     -1,
-		skip:      0,
+	insertedIDs := make([]string, 0, result.InsertedCount)
+	for i := range docs {
+		if id, ok := result.InsertedIDs[int64(i)]; ok {
+			n := len(insertedIDs)
+			insertedIDs = append(insertedIDs, id)
+			c.forContext(ctx).finalID(id, func(id string) { insertedIDs[n] = id })
+		}
 	}
+	return &InsertManyResult{
+		InsertedIDs: insertedIDs,
+	}, err
 }
 
-// Limit sets the maximum number of documents to return
-func (c *Cursor) Limit(n int) *Cursor {
-	c.limit = n
-	return c
+// FindOne finds a single document matching the filter
+func (c *Collection) FindOne(filter Filter, opts ...*FindOptions) *SingleResult {
+	return c.FindOneContext(context.Background(), filter, opts...)
 }
 
-// Skip sets the number of documents to skip
-func (c *Cursor) Skip(n int) *Cursor {
-	c.skip = n
-	return c
-}
+// FindOneContext finds a single document matching the filter. With a sort
+// option, it returns the first document in sort order. If nothing matches,
+// the result reports ErrNoDocuments.
+func (c *Collection) FindOneContext(ctx context.Context, filter Filter, opts ...*FindOptions) *SingleResult {
+	c = c.forContext(ctx)
 
-// All returns all documents as a slice
-func (c *Cursor) All() ([]Document, error) {
-	docs := c.documents
-	if c.skip > 0 && c.skip < len(docs) {
-		docs = docs[c.skip:]
-	} else if c.skip >= len(docs) {
-		docs = []Document{}
+	doc, _, err := c.findOne(ctx, toM(filter), false, opts...)
+	if err != nil {
+		return &SingleResult{err: err}
 	}
-	if c.limit >= 0 && c.limit < len(docs) {
-		docs = docs[:c.limit]
+	if doc == nil {
+		return &SingleResult{err: ErrNoDocuments}
 	}
-	return docs, nil
+	return &SingleResult{doc: doc, registry: c.registry}
 }
 
-// Next advances the cursor and returns true if there are more documents
-func (c *Cursor) Next() bool {
-	docs, _ := c.All()
-	return c.index < len(docs)
-}
+// findOne returns the first document matching the filter, or nil. With
+// ordered set, it also returns the document's stored field order.
+func (c *Collection) findOne(ctx context.Context, filter M, ordered bool, opts ...*FindOptions) (Document, D, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
 
-// Decode decodes the current document into the provided value
-func (c *Cursor) Decode(v interface{}) error {
-	docs, _ := c.All()
-	if c.index >= len(docs) {
-		return errors.New("cursor exhausted")
+	options := mergeFindOptions(opts...)
+	cursor, err := c.find(ctx, filter, ordered, options, NewFindOptions().SetLimit(1))
+	if err != nil {
+		return nil, nil, err
+	}
+	docs, orders, err := cursor.allOrdered()
+	if err != nil || len(docs) == 0 {
+		return nil, nil, err
 	}
-	doc := docs[c.index]
-	c.index++
+	return docs[0], orders[0], nil
+}
 
-	// Convert to JSON and back to decode into target
-	data, err := json.Marshal(doc)
+// Find returns a cursor over documents matching the filter. If the query is
+// invalid, the cursor is empty and Err reports why; Err also reports an
+// engine failure or an undecodable document met during iteration.
+func (c *Collection) Find(filter Filter, opts ...*FindOptions) *Cursor {
+	cursor, err := c.FindContext(context.Background(), filter, opts...)
 	if err != nil {
-		return err
+		return newErrorCursor(err)
 	}
-	return json.Unmarshal(data, v)
+	return cursor
 }
 
-// ============================================================================
-// SingleResult
-// ============================================================================
+// FindContext returns a cursor over documents matching the filter. The
+// cursor fetches documents lazily; iteration stops with the context error if
+// ctx is done before it completes.
+//
+// Documents are filtered, then sorted, then skipped and limited, and finally
+// projected. When there is neither a filter nor a sort, skip and limit are
+// passed straight to the engine so only the requested page is read. The
+// query planner decides whether documents are looked up by _id, read
+// through an index or found by scanning the collection; Explain shows its
+// choice.
+func (c *Collection) FindContext(ctx context.Context, filter Filter, opts ...*FindOptions) (*Cursor, error) {
+	return c.forContext(ctx).find(ctx, toM(filter), false, opts...)
+}
 
-// SingleResult represents a single query result
-type SingleResult struct {
-	doc Document
-	err error
+// FindRaw returns the documents matching the filter as D values, with their
+// fields in the order they are stored
+func (c *Collection) FindRaw(filter Filter, opts ...*FindOptions) ([]D, error) {
+	return c.FindRawContext(context.Background(), filter, opts...)
 }
 
-// Decode decodes the result into the provided value
-func (r *SingleResult) Decode(v interface{}) error {
-	if r.err != nil {
-		return r.err
+// FindRawContext returns the documents matching the filter as D values, with
+// their fields in the order they are stored. Nested documents are D values
+// as well.
+func (c *Collection) FindRawContext(ctx context.Context, filter Filter, opts ...*FindOptions) ([]D, error) {
+	c = c.forContext(ctx)
+
+	cursor, err := c.find(ctx, toM(filter), true, opts...)
+	if err != nil {
+		return nil, err
 	}
-	if r.doc == nil {
-		return errors.New("no document found")
+	defer cursor.Close()
+
+	docs := []D{}
+	for cursor.Next() {
+		var doc D
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
 	}
-	data, err := json.Marshal(r.doc)
-	if err != nil {
-		return err
+	if err := cursor.Err(); err != nil {
+		return nil, err
 	}
-	return json.Unmarshal(data, v)
+	return docs, nil
 }
 
-// Err returns the error, if any
-func (r *SingleResult) Err() error {
-	return r.err
-}
+// find implements FindContext. With ordered set, the cursor keeps the stored
+// field order of the documents it reads.
+func (c *Collection) find(ctx context.Context, filter M, ordered bool, opts ...*FindOptions) (*Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-// ============================================================================
-// Collection
-// ============================================================================
+	options := mergeFindOptions(opts...)
+	var match docMatcher
+	if len(filter) > 0 {
+		m, err := compileFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		match = m
+	}
+	if _, err := parseSort(options.Sort); err != nil {
+		return nil, err
+	}
+	proj, err := parseProjection(toM(options.Projection))
+	if err != nil {
+		return nil, err
+	}
 
-// Collection represents a MongoDB-compatible collection
-type Collection struct {
-	db   C.KeraDB
-	name string
+	cursor := &Cursor{
+		ctx:        ctx,
+		engine:     c.engine,
+		view:       c.view,
+		collection: c.name,
+		filter:     filter,
+		match:      match,
+		sort:       options.Sort,
+		proj:       proj,
+		batchSize:  defaultBatchSize,
+		registry:   c.registry,
+		useNumber:  c.useNumber,
+		ordered:    ordered,
+		limit:      -1,
+	}
+	if cursor.plan, err = c.planQuery(filter); err != nil {
+		return nil, err
+	}
+	cursor.ids = cursor.plan.ids
+	if options.Skip != nil && *options.Skip > 0 {
+		cursor.skip = int(*options.Skip)
+	}
+	if options.Limit != nil && *options.Limit != 0 {
+		cursor.limit = int(*options.Limit)
+		if cursor.limit < 0 {
+			cursor.limit = -cursor.limit
+		}
+	}
+	if options.BatchSize != nil && *options.BatchSize > 0 {
+		cursor.batchSize = int(*options.BatchSize)
+	}
+
+	return cursor, nil
 }
 
-// Name returns the collection name
-func (c *Collection) Name() string {
-	return c.name
+// UpdateOne updates a single document matching the filter
+func (c *Collection) UpdateOne(filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	return c.UpdateOneContext(context.Background(), filter, update, opts...)
 }
 
-// InsertOne inserts a single document
-func (c *Collection) InsertOne(doc interface{}) (*InsertOneResult, error) {
-	jsonData, err := json.Marshal(doc)
+// UpdateOneContext updates a single document matching the filter
+func (c *Collection) UpdateOneContext(ctx context.Context, filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	c = c.forContext(ctx)
+
+	spec, err := c.parseUpdate(toM(update))
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal document: %w", err)
+		return nil, err
 	}
+	options := mergeUpdateOptions(opts...)
+	return c.updateOne(ctx, toM(filter), spec, options.Upsert != nil && *options.Upsert)
+}
 
-	cCollection := C.CString(c.name)
-	defer C.free(unsafe.Pointer(cCollection))
+// ReplaceOne replaces a single document matching the filter. The
+// replacement keeps the _id of the document it replaces.
+func (c *Collection) ReplaceOne(filter Filter, replacement interface{}, opts ...*ReplaceOptions) (*UpdateResult, error) {
+	return c.ReplaceOneContext(context.Background(), filter, replacement, opts...)
+}
 
-	cJSON := C.CString(string(jsonData))
-	defer C.free(unsafe.Pointer(cJSON))
+// ReplaceOneContext replaces a single document matching the filter
+func (c *Collection) ReplaceOneContext(ctx context.Context, filter Filter, replacement interface{}, opts ...*ReplaceOptions) (*UpdateResult, error) {
+	c = c.forContext(ctx)
 
-	cID := C.keradb_insert(c.db, cCollection, cJSON)
-	if cID == nil {
-		return nil, fmt.Errorf("insert failed: %s", getLastError())
+	spec, err := c.parseReplacement(replacement)
+	if err != nil {
+		return nil, err
 	}
-	defer C.keradb_free_string(cID)
-
-	return &InsertOneResult{
-		InsertedID: C.GoString(cID),
-	}, nil
+	options := mergeReplaceOptions(opts...)
+	return c.updateOne(ctx, toM(filter), spec, options.Upsert != nil && *options.Upsert)
 }
 
-// InsertMany inserts multiple documents
-func (c *Collection) InsertMany(docs []interface{}) (*InsertManyResult, error) {
-	var insertedIDs []string
-
-	for _, doc := range docs {
-		result, err := c.InsertOne(doc)
-		if err != nil {
-			return nil, err
+// parseUpdate parses an update document. The values of $set and
+// $setOnInsert are first encoded with the collection's registry.
+func (c *Collection) parseUpdate(update M) (*updateSpec, error) {
+	encoded := make(M, len(update))
+	for op, arg := range update {
+		if (op == "$set" || op == "$setOnInsert") && arg != nil {
+			fields, err := c.registry.encodeDocument(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", op, err)
+			}
+			arg = fields
 		}
-		insertedIDs = append(insertedIDs, result.InsertedID)
+		encoded[op] = arg
 	}
+	return parseUpdate(encoded)
+}
 
-	return &InsertManyResult{
-		InsertedIDs: insertedIDs,
-	}, nil
+// parseReplacement parses a replacement document, encoding it with the
+// collection's registry
+func (c *Collection) parseReplacement(replacement interface{}) (*updateSpec, error) {
+	doc, err := c.registry.encodeOrdered(replacement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal replacement: %w", err)
+	}
+	spec, err := parseReplacement(doc.Map())
+	if err != nil {
+		return nil, err
+	}
+	spec.order = doc
+	return spec, nil
 }
 
-// FindOne finds a single document matching the filter
-func (c *Collection) FindOne(filter M) *SingleResult {
-	// Optimize for _id lookup
-	if id, ok := filter["_id"].(string); ok && len(filter) == 1 {
-		cCollection := C.CString(c.name)
-		defer C.free(unsafe.Pointer(cCollection))
-
-		cID := C.CString(id)
-		defer C.free(unsafe.Pointer(cID))
-
-		cDoc := C.keradb_find_by_id(c.db, cCollection, cID)
-		if cDoc == nil {
-			return &SingleResult{doc: nil, err: nil}
-		}
-		defer C.keradb_free_string(cDoc)
+func (c *Collection) updateOne(ctx context.Context, filter M, spec *updateSpec, upsert bool) (*UpdateResult, error) {
+	defer c.lockWrites()()
 
-		var doc Document
-		if err := json.Unmarshal([]byte(C.GoString(cDoc)), &doc); err != nil {
-			return &SingleResult{err: err}
+	doc, order, err := c.findOne(ctx, filter, true)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		if upsert {
+			return c.upsert(ctx, filter, spec)
 		}
-		return &SingleResult{doc: doc}
+		return &UpdateResult{MatchedCount: 0, ModifiedCount: 0}, nil
 	}
 
-	// General filter
-	cursor := c.Find(filter).Limit(1)
-	docs, err := cursor.All()
+	_, modified, err := c.updateDocument(doc, order, spec)
 	if err != nil {
-		return &SingleResult{err: err}
+		return nil, err
 	}
-	if len(docs) == 0 {
-		return &SingleResult{doc: nil}
+
+	var modifiedCount int64
+	if modified {
+		modifiedCount = 1
 	}
-	return &SingleResult{doc: docs[0]}
+	return &UpdateResult{MatchedCount: 1, ModifiedCount: modifiedCount}, nil
 }
 
-// Find returns a cursor over documents matching the filter
-func (c *Collection) Find(filter M) *Cursor {
-	cCollection := C.CString(c.name)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cDocs := C.keradb_find_all(c.db, cCollection, -1, -1)
-	if cDocs == nil {
-		return NewCursor([]Document{})
+// upsert inserts the document an update builds when nothing matched
+func (c *Collection) upsert(ctx context.Context, filter M, spec *updateSpec) (*UpdateResult, error) {
+	seed, err := upsertSeed(filter)
+	if err != nil {
+		return nil, err
 	}
-	defer C.keradb_free_string(cDocs)
-
-	var docs []Document
-	if err := json.Unmarshal([]byte(C.GoString(cDocs)), &docs); err != nil {
-		return NewCursor([]Document{})
+	doc, err := spec.apply(seed, true)
+	if err != nil {
+		return nil, err
 	}
 
-	// Apply filter
-	if filter != nil && len(filter) > 0 {
-		var filtered []Document
-		for _, doc := range docs {
-			if matchesFilter(doc, filter) {
-				filtered = append(filtered, doc)
-			}
-		}
-		docs = filtered
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	return NewCursor(docs)
-}
-
-// UpdateOne updates a single document matching the filter
-func (c *Collection) UpdateOne(filter M, update M) (*UpdateResult, error) {
-	result := c.FindOne(filter)
-	if result.err != nil {
-		return nil, result.err
+	var ordered interface{} = doc
+	if spec.order != nil {
+		ordered = orderLike(doc, spec.order)
 	}
-	if result.doc == nil {
-		return &UpdateResult{MatchedCount: 0, ModifiedCount: 0}, nil
+	id, err := c.insertDocument(ordered)
+	if err != nil {
+		return nil, err
 	}
+	result := &UpdateResult{UpsertedCount: 1, UpsertedID: id}
+	c.finalID(id, func(id string) { result.UpsertedID = id })
+	return result, nil
+}
 
-	updatedDoc := applyUpdate(result.doc, update)
-	docID := result.doc.ID()
+// updateDocument applies an update to a stored document and writes it back,
+// returning the document as stored. The fields keep their stored order,
+// given by order, with new fields after them; a replacement is stored in
+// its own order. If the update leaves the document as it was, the write is
+// skipped and modified is false.
+func (c *Collection) updateDocument(doc Document, order D, spec *updateSpec) (after Document, modified bool, err error) {
+	updatedDoc, err := spec.apply(doc, false)
+	if err != nil {
+		return nil, false, err
+	}
+	docID := doc.ID()
 
 	// Remove _id from update
 	delete(updatedDoc, "_id")
 
-	jsonData, err := json.Marshal(updatedDoc)
+	if spec.order != nil {
+		order = spec.order
+	}
+	jsonData, err := marshalStored(orderLike(updatedDoc, order))
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	cCollection := C.CString(c.name)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cID := C.CString(docID)
-	defer C.free(unsafe.Pointer(cID))
+	// Compare what would be stored, so values that only differ in their Go
+	// type, such as int and float64, do not count as changes
+	if after, err = unmarshalDocument(jsonData, c.useNumber); err != nil {
+		return nil, false, err
+	}
+	after["_id"] = doc["_id"]
+	if valuesEqual(doc, after) {
+		return after, false, nil
+	}
 
-	cJSON := C.CString(string(jsonData))
-	defer C.free(unsafe.Pointer(cJSON))
+	w, err := c.indexes.beginWrite(c.name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer w.done()
+	if err := w.check(docID, after); err != nil {
+		return nil, false, err
+	}
 
-	cResult := C.keradb_update(c.db, cCollection, cID, cJSON)
-	if cResult == nil {
-		return nil, fmt.Errorf("update failed: %s", getLastError())
+	if _, err := c.engine.Update(c.name, docID, jsonData); err != nil {
+		return nil, false, fmt.Errorf("update failed: %w", err)
 	}
-	C.keradb_free_string(cResult)
+	w.replace(docID, doc, after)
 
-	return &UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+	op := "update"
+	if spec.replacement != nil {
+		op = "replace"
+		c.markReplaced(docID)
+	}
+	c.recordChange(op, docID, doc, after)
+	return after, true, nil
 }
 
 // UpdateMany updates all documents matching the filter
-func (c *Collection) UpdateMany(filter M, update M) (*UpdateResult, error) {
-	cursor := c.Find(filter)
-	docs, err := cursor.All()
+func (c *Collection) UpdateMany(filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	return c.UpdateManyContext(context.Background(), filter, update, opts...)
+}
+
+// UpdateManyContext updates all documents matching the filter. If ctx is
+// done or a write fails part way through, it returns the counts reached so
+// far along with the error.
+func (c *Collection) UpdateManyContext(ctx context.Context, filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	c = c.forContext(ctx)
+
+	spec, err := c.parseUpdate(toM(update))
 	if err != nil {
 		return nil, err
 	}
+	options := mergeUpdateOptions(opts...)
+
+	defer c.lockWrites()()
+
+	cursor, err := c.find(ctx, toM(filter), true)
+	if err != nil {
+		return nil, err
+	}
+	docs, orders, err := cursor.allOrdered()
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 && options.Upsert != nil && *options.Upsert {
+		return c.upsert(ctx, toM(filter), spec)
+	}
 
 	var modifiedCount int64 = 0
-	for _, doc := range docs {
-		_, err := c.UpdateOne(M{"_id": doc.ID()}, update)
+	for i, doc := range docs {
+		if err := ctx.Err(); err != nil {
+			return &UpdateResult{
+				MatchedCount:  int64(len(docs)),
+				ModifiedCount: modifiedCount,
+			}, err
+		}
+		_, modified, err := c.updateDocument(doc, orders[i], spec)
 		if err != nil {
-			return nil, err
+			return &UpdateResult{
+				MatchedCount:  int64(len(docs)),
+				ModifiedCount: modifiedCount,
+			}, err
+		}
+		if modified {
+			modifiedCount++
 		}
-		modifiedCount++
 	}
 
 	return &UpdateResult{
@@ -600,31 +748,69 @@ func (c *Collection) UpdateMany(filter M, update M) (*UpdateResult, error) {
 }
 
 // DeleteOne deletes a single document matching the filter
-func (c *Collection) DeleteOne(filter M) (*DeleteResult, error) {
-	result := c.FindOne(filter)
-	if result.err != nil {
-		return nil, result.err
+func (c *Collection) DeleteOne(filter Filter) (*DeleteResult, error) {
+	return c.DeleteOneContext(context.Background(), filter)
+}
+
+// DeleteOneContext deletes a single document matching the filter
+func (c *Collection) DeleteOneContext(ctx context.Context, filter Filter) (*DeleteResult, error) {
+	c = c.forContext(ctx)
+	defer c.lockWrites()()
+
+	doc, _, err := c.findOne(ctx, toM(filter), false)
+	if err != nil {
+		return nil, err
 	}
-	if result.doc == nil {
+	if doc == nil {
 		return &DeleteResult{DeletedCount: 0}, nil
 	}
 
-	cCollection := C.CString(c.name)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cID := C.CString(result.doc.ID())
-	defer C.free(unsafe.Pointer(cID))
-
-	deleteResult := C.keradb_delete(c.db, cCollection, cID)
+	deleted, err := c.deleteDocument(doc)
+	if err != nil {
+		return nil, err
+	}
 
 	return &DeleteResult{
-		DeletedCount: int64(deleteResult),
+		DeletedCount: deleted,
 	}, nil
 }
 
+// deleteDocument deletes a stored document by its _id and removes it from
+// the collection's indexes
+func (c *Collection) deleteDocument(doc Document) (int64, error) {
+	w, err := c.indexes.beginWrite(c.name)
+	if err != nil {
+		return 0, err
+	}
+	defer w.done()
+
+	deleteResult, err := c.engine.Delete(c.name, doc.ID())
+	if err != nil {
+		return 0, fmt.Errorf("delete failed: %w", err)
+	}
+	if deleteResult > 0 {
+		w.replace(doc.ID(), doc, nil)
+		c.recordChange("delete", doc.ID(), doc, nil)
+	}
+	return int64(deleteResult), nil
+}
+
 // DeleteMany deletes all documents matching the filter
-func (c *Collection) DeleteMany(filter M) (*DeleteResult, error) {
-	cursor := c.Find(filter)
+func (c *Collection) DeleteMany(filter Filter) (*DeleteResult, error) {
+	return c.DeleteManyContext(context.Background(), filter)
+}
+
+// DeleteManyContext deletes all documents matching the filter. If ctx is
+// done or a delete fails part way through, it returns the count deleted so
+// far along with the error.
+func (c *Collection) DeleteManyContext(ctx context.Context, filter Filter) (*DeleteResult, error) {
+	c = c.forContext(ctx)
+	defer c.lockWrites()()
+
+	cursor, err := c.FindContext(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
 	docs, err := cursor.All()
 	if err != nil {
 		return nil, err
@@ -632,37 +818,188 @@ func (c *Collection) DeleteMany(filter M) (*DeleteResult, error) {
 
 	var deletedCount int64 = 0
 	for _, doc := range docs {
-		result, err := c.DeleteOne(M{"_id": doc.ID()})
+		if err := ctx.Err(); err != nil {
+			return &DeleteResult{DeletedCount: deletedCount}, err
+		}
+		deleted, err := c.deleteDocument(doc)
 		if err != nil {
-			return nil, err
+			return &DeleteResult{DeletedCount: deletedCount}, err
 		}
-		deletedCount += result.DeletedCount
+		deletedCount += deleted
 	}
 
 	return &DeleteResult{DeletedCount: deletedCount}, nil
 }
 
+// FindOneAndUpdate updates a single document matching the filter and
+// returns it, either as it was before the update or, with
+// SetReturnDocument(After), as it is afterwards. The find and the update
+// are atomic with respect to other operations on the same Client.
+func (c *Collection) FindOneAndUpdate(filter Filter, update Update, opts ...*FindOneAndUpdateOptions) *SingleResult {
+	return c.FindOneAndUpdateContext(context.Background(), filter, update, opts...)
+}
+
+// FindOneAndUpdateContext updates a single document matching the filter and
+// returns it
+func (c *Collection) FindOneAndUpdateContext(ctx context.Context, filter Filter, update Update, opts ...*FindOneAndUpdateOptions) *SingleResult {
+	c = c.forContext(ctx)
+
+	spec, err := c.parseUpdate(toM(update))
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	options := mergeFindOneAndUpdateOptions(opts...)
+	return c.findOneAndModify(ctx, toM(filter), spec, findAndModifyOptions{
+		sort:        options.Sort,
+		projection:  options.Projection,
+		returnAfter: options.ReturnDocument != nil && *options.ReturnDocument == After,
+		upsert:      options.Upsert != nil && *options.Upsert,
+	})
+}
+
+// FindOneAndReplace replaces a single document matching the filter and
+// returns either the original or, with SetReturnDocument(After), the
+// replacement
+func (c *Collection) FindOneAndReplace(filter Filter, replacement interface{}, opts ...*FindOneAndReplaceOptions) *SingleResult {
+	return c.FindOneAndReplaceContext(context.Background(), filter, replacement, opts...)
+}
+
+// FindOneAndReplaceContext replaces a single document matching the filter
+// and returns it
+func (c *Collection) FindOneAndReplaceContext(ctx context.Context, filter Filter, replacement interface{}, opts ...*FindOneAndReplaceOptions) *SingleResult {
+	c = c.forContext(ctx)
+
+	spec, err := c.parseReplacement(replacement)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	options := mergeFindOneAndReplaceOptions(opts...)
+	return c.findOneAndModify(ctx, toM(filter), spec, findAndModifyOptions{
+		sort:        options.Sort,
+		projection:  options.Projection,
+		returnAfter: options.ReturnDocument != nil && *options.ReturnDocument == After,
+		upsert:      options.Upsert != nil && *options.Upsert,
+	})
+}
+
+// FindOneAndDelete deletes a single document matching the filter and
+// returns it
+func (c *Collection) FindOneAndDelete(filter Filter, opts ...*FindOneAndDeleteOptions) *SingleResult {
+	return c.FindOneAndDeleteContext(context.Background(), filter, opts...)
+}
+
+// FindOneAndDeleteContext deletes a single document matching the filter and
+// returns it
+func (c *Collection) FindOneAndDeleteContext(ctx context.Context, filter Filter, opts ...*FindOneAndDeleteOptions) *SingleResult {
+	c = c.forContext(ctx)
+
+	options := mergeFindOneAndDeleteOptions(opts...)
+	return c.findOneAndModify(ctx, toM(filter), nil, findAndModifyOptions{
+		sort:       options.Sort,
+		projection: options.Projection,
+	})
+}
+
+// findAndModifyOptions are the options shared by the FindOneAnd* family
+type findAndModifyOptions struct {
+	sort        D
+	projection  Doc
+	returnAfter bool
+	upsert      bool
+}
+
+// findOneAndModify implements the FindOneAnd* family. A nil spec deletes the
+// document found. Like FindOne, it reports ErrNoDocuments when there is no
+// document to return, including an upsert that returns the document before
+// the update.
+func (c *Collection) findOneAndModify(ctx context.Context, filter M, spec *updateSpec, opts findAndModifyOptions) *SingleResult {
+	proj, err := parseProjection(toM(opts.projection))
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+
+	defer c.lockWrites()()
+
+	doc, order, err := c.findOne(ctx, filter, spec != nil, NewFindOptions().SetSort(opts.sort))
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+
+	if doc == nil {
+		if spec == nil || !opts.upsert {
+			return &SingleResult{err: ErrNoDocuments}
+		}
+		upserted, err := c.upsert(ctx, filter, spec)
+		if err != nil {
+			return &SingleResult{err: err}
+		}
+		if !opts.returnAfter {
+			return &SingleResult{err: ErrNoDocuments}
+		}
+		return c.FindOneContext(ctx, M{"_id": upserted.UpsertedID}, NewFindOptions().SetProjection(opts.projection))
+	}
+
+	if spec == nil {
+		if _, err := c.deleteDocument(doc); err != nil {
+			return &SingleResult{err: err}
+		}
+		return &SingleResult{doc: proj.apply(doc), registry: c.registry}
+	}
+
+	after, _, err := c.updateDocument(doc, order, spec)
+	if err != nil {
+		return &SingleResult{err: err}
+	}
+	if opts.returnAfter {
+		return &SingleResult{doc: proj.apply(after), registry: c.registry}
+	}
+	return &SingleResult{doc: proj.apply(doc), registry: c.registry}
+}
+
 // CountDocuments counts documents matching the filter
-func (c *Collection) CountDocuments(filter M) (int64, error) {
-	if filter == nil || len(filter) == 0 {
-		cCollection := C.CString(c.name)
-		defer C.free(unsafe.Pointer(cCollection))
+func (c *Collection) CountDocuments(filter Filter) (int64, error) {
+	return c.CountDocumentsContext(context.Background(), filter)
+}
+
+// CountDocumentsContext counts documents matching the filter
+func (c *Collection) CountDocumentsContext(ctx context.Context, filter Filter) (int64, error) {
+	c = c.forContext(ctx)
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
-		count := C.keradb_count(c.db, cCollection)
+	if len(toM(filter)) == 0 {
+		unlock := rlock(c.view)
+		count, err := c.engine.Count(c.name)
+		unlock()
+		if err != nil {
+			return 0, err
+		}
 		return int64(count), nil
 	}
 
-	cursor := c.Find(filter)
-	docs, err := cursor.All()
+	cursor, err := c.FindContext(ctx, filter)
 	if err != nil {
 		return 0, err
 	}
-	return int64(len(docs)), nil
+	defer cursor.Close()
+
+	var count int64
+	for cursor.Next() {
+		count++
+	}
+	return count, cursor.Err()
 }
 
 // Drop deletes all documents in the collection
 func (c *Collection) Drop() error {
-	_, err := c.DeleteMany(M{})
+	return c.DropContext(context.Background())
+}
+
+// DropContext deletes all documents in the collection
+func (c *Collection) DropContext(ctx context.Context) error {
+	_, err := c.DeleteManyContext(ctx, M{})
 	return err
 }
 
@@ -672,39 +1009,75 @@ func (c *Collection) Drop() error {
 
 // Database represents a KeraDB database
 type Database struct {
-	db          C.KeraDB
+	engine      Engine
+	mu          sync.Mutex // guards collections
 	collections map[string]*Collection
+	writeMu     *sync.Mutex
+	view        *sync.RWMutex // held shared by reads, exclusively by commits
+	indexes     *indexCatalog
+	changes     *changeLog
+	registry    *Registry
+	useNumber   bool
+	newID       func() string
 }
 
-// Collection returns a collection by name
+// Collection returns a collection by name. Every call with the same name
+// returns the same *Collection.
 func (d *Database) Collection(name string) *Collection {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if d.collections == nil {
 		d.collections = make(map[string]*Collection)
 	}
 	if coll, ok := d.collections[name]; ok {
 		return coll
 	}
-	coll := &Collection{db: d.db, name: name}
+	coll := &Collection{
+		engine:    d.engine,
+		name:      name,
+		writeMu:   d.writeMu,
+		view:      d.view,
+		indexes:   d.indexes,
+		changes:   d.changes,
+		registry:  d.registry,
+		useNumber: d.useNumber,
+		newID:     d.newID,
+	}
 	d.collections[name] = coll
 	return coll
 }
 
 // ListCollectionNames returns the names of all collections
 func (d *Database) ListCollectionNames() ([]string, error) {
-	cCollections := C.keradb_list_collections(d.db)
-	if cCollections == nil {
+	return d.ListCollectionNamesContext(context.Background())
+}
+
+// ListCollectionNamesContext returns the names of all collections
+func (d *Database) ListCollectionNamesContext(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := d.engine.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
 		return []string{}, nil
 	}
-	defer C.keradb_free_string(cCollections)
 
 	var collections [][2]interface{}
-	if err := json.Unmarshal([]byte(C.GoString(cCollections)), &collections); err != nil {
+	if err := json.Unmarshal(data, &collections); err != nil {
 		return nil, err
 	}
 
-	names := make([]string, len(collections))
-	for i, c := range collections {
-		names[i] = c[0].(string)
+	names := make([]string, 0, len(collections))
+	for _, c := range collections {
+		name := c[0].(string)
+		if strings.HasPrefix(name, reservedPrefix) {
+			continue
+		}
+		names = append(names, name)
 	}
 	return names, nil
 }
@@ -713,67 +1086,101 @@ func (d *Database) ListCollectionNames() ([]string, error) {
 // Client
 // ============================================================================
 
-// Client is the main KeraDB client (MongoDB-compatible)
+// Client is the main KeraDB client (MongoDB-compatible).
+//
+// A Client and its Database and Collections are safe for concurrent use by
+// multiple goroutines. Operations that read and then write, such as
+// UpdateOne or FindOneAndDelete, are serialized across the client so that
+// each sees the result of the last; reads take no client-wide lock. The
+// native engine runs one call at a time per open database, so reads of one
+// database queue in the engine while separate databases run in parallel;
+// MemoryEngine runs reads in parallel. A Cursor, like a SingleResult,
+// belongs to the goroutine that iterates it.
+//
+// Close may be called while operations are running. It waits for the calls
+// into the engine already in progress to return, and every operation after
+// it fails with ErrClosed, including further iteration of open cursors.
 type Client struct {
-	db       C.KeraDB
+	engine   *guardedEngine
 	path     string
 	database *Database
 }
 
-// Connect creates or opens a KeraDB database
-func Connect(path string) (*Client, error) {
-	cPath := C.CString(path)
-	defer C.free(unsafe.Pointer(cPath))
+// newClient opens the engine for path, honouring a caller-supplied engine
+func newClient(path string, mode openMode, opts []*ClientOptions) (*Client, error) {
+	options := mergeClientOptions(opts...)
+	registry := options.Registry
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+	var newID func() string
+	if options.IDStrategy != nil {
+		var err error
+		if newID, err = options.IDStrategy.generator(); err != nil {
+			return nil, err
+		}
+	}
 
-	// Try to open first, then create if it doesn't exist
-	db := C.keradb_open(cPath)
-	if db == nil {
-		db = C.keradb_create(cPath)
+	opened := options.Engine
+	if opened == nil {
+		var err error
+		opened, err = openNativeEngine(path, mode)
+		if err != nil {
+			return nil, err
+		}
 	}
+	engine := newGuardedEngine(opened)
 
-	if db == nil {
-		return nil, fmt.Errorf("failed to connect: %s", getLastError())
+	var changes *changeLog
+	size := defaultChangeLogSize
+	if options.ChangeLogSize != nil {
+		size = *options.ChangeLogSize
+	}
+	if size > 0 {
+		changes = newChangeLog(engine, size)
 	}
 
 	return &Client{
-		db:       db,
-		path:     path,
-		database: &Database{db: db},
+		engine: engine,
+		path:   path,
+		database: &Database{
+			engine:    engine,
+			writeMu:   &sync.Mutex{},
+			view:      &sync.RWMutex{},
+			indexes:   newIndexCatalog(engine),
+			changes:   changes,
+			registry:  registry,
+			useNumber: options.UseJSONNumber != nil && *options.UseJSONNumber,
+			newID:     newID,
+		},
 	}, nil
 }
 
-// Create creates a new KeraDB database
-func Create(path string) (*Client, error) {
-	cPath := C.CString(path)
-	defer C.free(unsafe.Pointer(cPath))
-
-	db := C.keradb_create(cPath)
-	if db == nil {
-		return nil, fmt.Errorf("failed to create database: %s", getLastError())
+// Connect creates or opens a KeraDB database
+func Connect(path string, opts ...*ClientOptions) (*Client, error) {
+	client, err := newClient(path, openOrCreate, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
+	return client, nil
+}
 
-	return &Client{
-		db:       db,
-		path:     path,
-		database: &Database{db: db},
-	}, nil
+// Create creates a new KeraDB database
+func Create(path string, opts ...*ClientOptions) (*Client, error) {
+	client, err := newClient(path, createNew, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create database: %w", err)
+	}
+	return client, nil
 }
 
 // Open opens an existing KeraDB database
-func Open(path string) (*Client, error) {
-	cPath := C.CString(path)
-	defer C.free(unsafe.Pointer(cPath))
-
-	db := C.keradb_open(cPath)
-	if db == nil {
-		return nil, fmt.Errorf("failed to open database: %s", getLastError())
+func Open(path string, opts ...*ClientOptions) (*Client, error) {
+	client, err := newClient(path, openExisting, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-
-	return &Client{
-		db:       db,
-		path:     path,
-		database: &Database{db: db},
-	}, nil
+	return client, nil
 }
 
 // Database returns the database object
@@ -781,21 +1188,30 @@ func (c *Client) Database() *Database {
 	return c.database
 }
 
-// Close closes the database connection
+// Close closes the database connection. It waits for the engine calls in
+// progress to return; operations started afterwards fail with ErrClosed.
+// Closing it again returns the result of the first Close.
 func (c *Client) Close() error {
-	if c.db != nil {
-		C.keradb_close(c.db)
-		c.db = nil
-	}
-	return nil
+	c.database.changes.close()
+	return c.engine.Close()
 }
 
 // Sync flushes all changes to disk
 func (c *Client) Sync() error {
-	if c.db == nil {
-		return errors.New("database is closed")
+	return c.SyncContext(context.Background())
+}
+
+// SyncContext flushes all changes to disk
+func (c *Client) SyncContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.engine.isClosed() {
+		return ErrClosed
+	}
+	if err := c.engine.Sync(); err != nil {
+		return fmt.Errorf("sync failed: %w", err)
 	}
-	C.keradb_sync(c.db)
 	return nil
 }
 
@@ -0,0 +1,396 @@
+package keradb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// jsonValue decodes JSON text into the generic form documents are compared in
+func jsonValue(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+// countingEngine counts the updates that reach the engine
+type countingEngine struct {
+	*MemoryEngine
+	mu      sync.Mutex
+	updates int
+}
+
+func (e *countingEngine) Update(collection, id string, doc []byte) ([]byte, error) {
+	e.mu.Lock()
+	e.updates++
+	e.mu.Unlock()
+	return e.MemoryEngine.Update(collection, id, doc)
+}
+
+func TestFindOptions(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	_, err := coll.InsertMany([]interface{}{
+		M{"_id": "a", "n": 3, "g": "x", "sub": M{"p": 1, "q": 2}, "arr": []interface{}{M{"p": 1, "q": 2}, 5, M{"q": 3}}},
+		M{"_id": "b", "n": 1, "g": "y", "sub": M{"p": 3}},
+		M{"_id": "c", "n": 2, "g": "x"},
+		M{"_id": "d", "n": 4, "g": "y"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts *FindOptions
+		want string
+	}{
+		{name: "sort", opts: NewFindOptions().SetSort(D{{Key: "n", Value: 1}}).SetProjection(M{"n": 1}),
+			want: `[{"_id":"b","n":1},{"_id":"c","n":2},{"_id":"a","n":3},{"_id":"d","n":4}]`},
+		{name: "sort on two keys", opts: NewFindOptions().SetSort(D{{Key: "g", Value: -1}, {Key: "n", Value: 1}}).SetProjection(M{"_id": 1}),
+			want: `[{"_id":"b"},{"_id":"d"},{"_id":"c"},{"_id":"a"}]`},
+		{name: "skip", opts: NewFindOptions().SetSkip(3).SetProjection(M{"_id": 1}),
+			want: `[{"_id":"d"}]`},
+		{name: "limit", opts: NewFindOptions().SetLimit(2).SetProjection(M{"_id": 1}),
+			want: `[{"_id":"a"},{"_id":"b"}]`},
+		{name: "sort, skip and limit", opts: NewFindOptions().SetSort(D{{Key: "n", Value: -1}}).SetSkip(1).SetLimit(2).SetProjection(M{"_id": 1}),
+			want: `[{"_id":"a"},{"_id":"c"}]`},
+		{name: "include", opts: NewFindOptions().SetLimit(2).SetProjection(M{"g": 1, "_id": 0}),
+			want: `[{"g":"x"},{"g":"y"}]`},
+		{name: "exclude", opts: NewFindOptions().SetSkip(2).SetProjection(M{"g": 0, "n": false}),
+			want: `[{"_id":"c"},{"_id":"d"}]`},
+		{name: "include a path", opts: NewFindOptions().SetLimit(3).SetProjection(M{"sub.q": 1}),
+			want: `[{"_id":"a","sub":{"q":2}},{"_id":"b","sub":{}},{"_id":"c"}]`},
+		{name: "include paths through an array", opts: NewFindOptions().SetLimit(1).SetProjection(M{"arr.p": 1, "arr.q": 1, "_id": 0}),
+			want: `[{"arr":[{"p":1,"q":2},{"q":3}]}]`},
+		{name: "exclude paths", opts: NewFindOptions().SetLimit(2).SetProjection(M{"sub.p": 0, "arr.q": 0, "n": 0, "g": 0}),
+			want: `[{"_id":"a","sub":{"q":2},"arr":[{"p":1},5,{}]},{"_id":"b","sub":{}}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := coll.Find(nil, tt.opts).All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := json.Marshal(docs); !reflect.DeepEqual(jsonValue(t, data), jsonValue(t, []byte(tt.want))) {
+				t.Errorf("found %s, want %s", data, tt.want)
+			}
+		})
+	}
+
+	// Excluding a path leaves the stored document alone
+	var doc struct{ Sub M }
+	if err := coll.FindOne(M{"_id": "a"}).Decode(&doc); err != nil || len(doc.Sub) != 2 {
+		t.Errorf("FindOne(_id a) = %+v, %v", doc, err)
+	}
+}
+
+func TestProjectionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec M
+	}{
+		{name: "mixed", spec: M{"a": 1, "b": 0}},
+		{name: "invalid value", spec: M{"a": "yes"}},
+		{name: "path inside another", spec: M{"a": 1, "a.b": 1}},
+		{name: "empty path segment", spec: M{"a..b": 0}},
+	}
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseProjection(tt.spec); err == nil {
+				t.Error("parseProjection succeeded")
+			}
+			if _, err := coll.FindContext(context.Background(), nil, NewFindOptions().SetProjection(tt.spec)); err == nil {
+				t.Error("FindContext succeeded")
+			}
+		})
+	}
+}
+
+func TestUpdateModifiedCount(t *testing.T) {
+	tests := []struct {
+		name         string
+		many         bool
+		replace      bool
+		filter       M
+		update       M
+		wantMatched  int64
+		wantModified int64
+	}{
+		{name: "no-op $set", filter: M{"n": 1}, update: M{"$set": M{"g": "a"}}, wantMatched: 1, wantModified: 0},
+		{name: "changing $set", filter: M{"n": 1}, update: M{"$set": M{"g": "b"}}, wantMatched: 1, wantModified: 1},
+		{name: "same number of another type", filter: M{"n": 1}, update: M{"$set": M{"n": int64(1)}}, wantMatched: 1, wantModified: 0},
+		{name: "$inc by zero", filter: M{"n": 1}, update: M{"$inc": M{"n": 0}}, wantMatched: 1, wantModified: 0},
+		{name: "$unset missing field", filter: M{"n": 1}, update: M{"$unset": M{"x": ""}}, wantMatched: 1, wantModified: 0},
+		{name: "$addToSet present value", filter: M{"n": 1}, update: M{"$addToSet": M{"tags": "x"}}, wantMatched: 1, wantModified: 0},
+		{name: "many with some changes", many: true, filter: M{}, update: M{"$set": M{"g": "a"}}, wantMatched: 3, wantModified: 1},
+		{name: "many $max", many: true, filter: M{}, update: M{"$max": M{"n": 2}}, wantMatched: 3, wantModified: 1},
+		{name: "no match", many: true, filter: M{"n": 9}, update: M{"$set": M{"g": "z"}}, wantMatched: 0, wantModified: 0},
+		{name: "identical replacement", replace: true, filter: M{"n": 3}, update: M{"n": 3, "g": "b"}, wantMatched: 1, wantModified: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &countingEngine{MemoryEngine: NewMemoryEngine()}
+			coll := newMemoryClient(t, engine).Database().Collection("c")
+			_, err := coll.InsertMany([]interface{}{
+				M{"n": 1, "g": "a", "tags": []string{"x"}},
+				M{"n": 2, "g": "a"},
+				M{"n": 3, "g": "b"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var result *UpdateResult
+			switch {
+			case tt.many:
+				result, err = coll.UpdateMany(tt.filter, tt.update)
+			case tt.replace:
+				result, err = coll.ReplaceOne(tt.filter, tt.update)
+			default:
+				result, err = coll.UpdateOne(tt.filter, tt.update)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.MatchedCount != tt.wantMatched || result.ModifiedCount != tt.wantModified {
+				t.Errorf("matched %d, modified %d; want %d, %d",
+					result.MatchedCount, result.ModifiedCount, tt.wantMatched, tt.wantModified)
+			}
+			if int64(engine.updates) != tt.wantModified {
+				t.Errorf("engine received %d updates, want %d", engine.updates, tt.wantModified)
+			}
+		})
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       string // "one", "many" or "replace"
+		filter   M
+		update   M
+		wantID   string // expected UpsertedID, if fixed by the filter
+		wantDoc  string // the inserted document without _id; empty when nothing is inserted
+		wantErr  bool
+		matching int64
+	}{
+		{name: "equality fields seed the document", op: "one",
+			filter:  M{"name": "a", "addr.city": "x", "age": M{"$gt": 3}, "$and": []M{{"k": M{"$eq": 2}}}},
+			update:  M{"$set": M{"v": 1}, "$setOnInsert": M{"created": true}},
+			wantDoc: `{"name":"a","addr":{"city":"x"},"k":2,"v":1,"created":true}`},
+		{name: "$in is not an equality", op: "one", filter: M{"g": M{"$in": []string{"a"}}},
+			update: M{"$set": M{"v": 1}}, wantDoc: `{"v":1}`},
+		{name: "existing match is updated", op: "one", filter: M{"name": "seed"},
+			update: M{"$set": M{"v": 2}, "$setOnInsert": M{"created": true}}, matching: 1},
+		{name: "many inserts one document", op: "many", filter: M{"g": "z"},
+			update: M{"$inc": M{"n": 1}}, wantDoc: `{"g":"z","n":1}`},
+		{name: "replacement", op: "replace", filter: M{"name": "b"},
+			update: M{"x": 1}, wantDoc: `{"x":1}`},
+		{name: "replacement takes the filter _id", op: "replace", filter: M{"_id": "fixed"},
+			update: M{"name": "c"}, wantID: "fixed", wantDoc: `{"name":"c"}`},
+		{name: "update takes the filter _id", op: "one", filter: M{"_id": "fixed"},
+			update: M{"$set": M{"v": 1}}, wantID: "fixed", wantDoc: `{"v":1}`},
+		{name: "replacement with operators", op: "replace", filter: M{}, update: M{"$set": M{"a": 1}}, wantErr: true},
+		{name: "conflicting update", op: "one", filter: M{"name": "q"}, update: M{"$set": M{"name.first": "x"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+			if _, err := coll.InsertOne(M{"name": "seed"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var result *UpdateResult
+			var err error
+			switch tt.op {
+			case "one":
+				result, err = coll.UpdateOne(tt.filter, tt.update, NewUpdateOptions().SetUpsert(true))
+			case "many":
+				result, err = coll.UpdateMany(tt.filter, tt.update, NewUpdateOptions().SetUpsert(true))
+			case "replace":
+				result, err = coll.ReplaceOne(tt.filter, tt.update, NewReplaceOptions().SetUpsert(true))
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.MatchedCount != tt.matching {
+				t.Errorf("matched %d, want %d", result.MatchedCount, tt.matching)
+			}
+			if tt.wantDoc == "" {
+				if result.UpsertedCount != 0 || result.UpsertedID != "" {
+					t.Errorf("unexpected upsert %+v", result)
+				}
+				return
+			}
+			if result.UpsertedCount != 1 || result.UpsertedID == "" || tt.wantID != "" && result.UpsertedID != tt.wantID {
+				t.Fatalf("got %+v, want one upsert with id %q", result, tt.wantID)
+			}
+
+			var doc Document
+			err = coll.FindOne(M{"_id": result.UpsertedID}, NewFindOptions().SetProjection(M{"_id": 0})).Decode(&doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := json.Marshal(doc)
+			if !reflect.DeepEqual(jsonValue(t, data), jsonValue(t, []byte(tt.wantDoc))) {
+				t.Errorf("inserted %s, want %s", data, tt.wantDoc)
+			}
+		})
+	}
+}
+
+func TestFindOneAndModify(t *testing.T) {
+	noID := M{"_id": 0}
+	tests := []struct {
+		name      string
+		run       func(c *Collection) *SingleResult
+		want      string // returned document without _id; empty for ErrNoDocuments
+		wantAfter string // every document without _id, ordered by i
+	}{
+		{
+			name: "update returns the original",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndUpdate(M{"s": "new"}, M{"$set": M{"s": "taken"}},
+					NewFindOneAndUpdateOptions().SetProjection(noID))
+			},
+			want:      `{"i":1,"s":"new"}`,
+			wantAfter: `[{"i":1,"s":"taken"},{"i":2,"s":"new"},{"i":3,"s":"done"}]`,
+		},
+		{
+			name: "update returns the new document and honours sort",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndUpdate(M{"s": "new"}, M{"$inc": M{"i": 10}},
+					NewFindOneAndUpdateOptions().SetSort(D{{Key: "i", Value: -1}}).SetReturnDocument(After).SetProjection(noID))
+			},
+			want:      `{"i":12,"s":"new"}`,
+			wantAfter: `[{"i":1,"s":"new"},{"i":3,"s":"done"},{"i":12,"s":"new"}]`,
+		},
+		{
+			name: "update without a match",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndUpdate(M{"s": "none"}, M{"$set": M{"s": "x"}})
+			},
+			wantAfter: `[{"i":1,"s":"new"},{"i":2,"s":"new"},{"i":3,"s":"done"}]`,
+		},
+		{
+			name: "update upserts",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndUpdate(M{"i": 4}, M{"$set": M{"s": "up"}},
+					NewFindOneAndUpdateOptions().SetUpsert(true).SetReturnDocument(After).SetProjection(noID))
+			},
+			want:      `{"i":4,"s":"up"}`,
+			wantAfter: `[{"i":1,"s":"new"},{"i":2,"s":"new"},{"i":3,"s":"done"},{"i":4,"s":"up"}]`,
+		},
+		{
+			name: "upsert returning the original finds nothing",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndUpdate(M{"i": 4}, M{"$set": M{"s": "up"}}, NewFindOneAndUpdateOptions().SetUpsert(true))
+			},
+			wantAfter: `[{"i":1,"s":"new"},{"i":2,"s":"new"},{"i":3,"s":"done"},{"i":4,"s":"up"}]`,
+		},
+		{
+			name: "replace",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndReplace(M{"i": 3}, M{"i": 3, "x": 1},
+					NewFindOneAndReplaceOptions().SetReturnDocument(After).SetProjection(noID))
+			},
+			want:      `{"i":3,"x":1}`,
+			wantAfter: `[{"i":1,"s":"new"},{"i":2,"s":"new"},{"i":3,"x":1}]`,
+		},
+		{
+			name: "delete the last by sort",
+			run: func(c *Collection) *SingleResult {
+				return c.FindOneAndDelete(M{"s": "new"},
+					NewFindOneAndDeleteOptions().SetSort(D{{Key: "i", Value: -1}}).SetProjection(noID))
+			},
+			want:      `{"i":2,"s":"new"}`,
+			wantAfter: `[{"i":1,"s":"new"},{"i":3,"s":"done"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("jobs")
+			_, err := coll.InsertMany([]interface{}{
+				M{"i": 1, "s": "new"}, M{"i": 2, "s": "new"}, M{"i": 3, "s": "done"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var doc Document
+			err = tt.run(coll).Decode(&doc)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNoDocuments) {
+					t.Errorf("got %v, %v; want ErrNoDocuments", doc, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if data, _ := json.Marshal(doc); !reflect.DeepEqual(jsonValue(t, data), jsonValue(t, []byte(tt.want))) {
+				t.Errorf("returned %s, want %s", data, tt.want)
+			}
+
+			docs, err := coll.Find(nil, NewFindOptions().SetSort(D{{Key: "i", Value: 1}}).SetProjection(noID)).All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := json.Marshal(docs); !reflect.DeepEqual(jsonValue(t, data), jsonValue(t, []byte(tt.wantAfter))) {
+				t.Errorf("collection holds %s, want %s", data, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func TestFindOneAndUpdateClaimsEachDocumentOnce(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("jobs")
+	for i := 0; i < 50; i++ {
+		if _, err := coll.InsertOne(M{"i": i, "state": "new"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := map[string]int{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var doc Document
+				err := coll.FindOneAndUpdate(M{"state": "new"}, M{"$set": M{"state": "taken"}}).Decode(&doc)
+				if err != nil {
+					if !errors.Is(err, ErrNoDocuments) {
+						t.Error(err)
+					}
+					return
+				}
+				mu.Lock()
+				claimed[doc["_id"].(string)]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != 50 {
+		t.Errorf("claimed %d documents, want 50", len(claimed))
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("document %s claimed %d times", id, n)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package keradb
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// Numbers
+// ============================================================================
+
+// Documents read back from the engine hold every number as float64, while
+// filters and updates written in Go carry int, int64, uint8, json.Number and
+// so on. Every comparison, equality check and arithmetic update goes through
+// the helpers below so that 30, int64(30) and 30.0 are the same value.
+
+// isNumber reports whether v is one of the numeric types the SDK accepts
+func isNumber(v interface{}) bool {
+	switch n := v.(type) {
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	case json.Number:
+		_, err := n.Float64()
+		return err == nil
+	case Decimal:
+		_, err := strconv.ParseFloat(string(n), 64)
+		return err == nil
+	}
+	return false
+}
+
+// toFloat returns v as a float64 if it is a number
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case Decimal:
+		f, err := strconv.ParseFloat(string(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toInt64 returns v as an int64 if it is an integer type, or a json.Number
+// written as an integer, that fits in an int64. Floats are never converted,
+// so callers can tell integer arithmetic from floating point.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// compareNumbers orders two numbers, returning -1, 0 or +1. Integers are
+// compared exactly; anything else is compared as float64.
+func compareNumbers(a, b interface{}) int {
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			switch {
+			case ai < bi:
+				return -1
+			case ai > bi:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	af, _ := toFloat(a)
+	bf, _ := toFloat(b)
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+// valuesEqual reports whether two values are equal, treating numbers of any
+// type as equal when they have the same value. Documents and arrays are
+// compared member by member.
+func valuesEqual(a, b interface{}) bool {
+	if isNumber(a) && isNumber(b) {
+		return compareNumbers(a, b) == 0
+	}
+
+	if am, ok := asMap(a); ok {
+		bm, ok := asMap(b)
+		if !ok || len(am) != len(bm) {
+			return false
+		}
+		for k, av := range am {
+			bv, ok := bm[k]
+			if !ok || !valuesEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if as, ok := a.([]interface{}); ok {
+		bs, ok := b.([]interface{})
+		if !ok || len(as) != len(bs) {
+			return false
+		}
+		for i := range as {
+			if !valuesEqual(as[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if at, ok := a.(time.Time); ok {
+		bt, ok := b.(time.Time)
+		return ok && at.Equal(bt)
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// addNumbers returns a + b. Two integers give an int64 unless the sum
+// overflows; any other combination gives a float64.
+func addNumbers(a, b interface{}) (interface{}, bool) {
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			sum := ai + bi
+			if (sum > ai) == (bi > 0) {
+				return sum, true
+			}
+		}
+	}
+
+	af, ok1 := toFloat(a)
+	bf, ok2 := toFloat(b)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	return af + bf, true
+}
+
+// multiplyNumbers returns a * b. Two integers give an int64 unless the
+// product overflows; any other combination gives a float64.
+func multiplyNumbers(a, b interface{}) (interface{}, bool) {
+	if ai, ok := toInt64(a); ok {
+		if bi, ok := toInt64(b); ok {
+			product := ai * bi
+			if ai == 0 || (product/ai == bi && !(ai == -1 && bi == math.MinInt64) && !(bi == -1 && ai == math.MinInt64)) {
+				return product, true
+			}
+		}
+	}
+
+	af, ok1 := toFloat(a)
+	bf, ok2 := toFloat(b)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	return af * bf, true
+}
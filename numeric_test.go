@@ -0,0 +1,120 @@
+package keradb
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCompareNumbers(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want int
+	}{
+		{name: "int and float", a: 30, b: 30.0, want: 0},
+		{name: "int64 and uint8", a: int64(7), b: uint8(8), want: -1},
+		{name: "json.Number and float32", a: json.Number("41.5"), b: float32(41.5), want: 0},
+		{name: "decimal and int", a: Decimal("2.5"), b: 2, want: 1},
+		{name: "large int64 compared exactly", a: int64(1<<53 + 1), b: int64(1 << 53), want: 1},
+		{name: "uint64 beyond int64", a: uint64(math.MaxUint64), b: int64(math.MaxInt64), want: 1},
+		{name: "negative", a: int8(-3), b: uint16(0), want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareNumbers(tt.a, tt.b); got != tt.want {
+				t.Errorf("compareNumbers(%v, %v) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := compareNumbers(tt.b, tt.a); got != -tt.want {
+				t.Errorf("compareNumbers(%v, %v) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b interface{}
+		want bool
+	}{
+		{name: "numbers of different types", a: uint16(30), b: 30.0, want: true},
+		{name: "different numbers", a: 30, b: 30.5, want: false},
+		{name: "number and string", a: 1, b: "1", want: false},
+		{name: "arrays of mixed numbers", a: []interface{}{1, int64(2)}, b: []interface{}{1.0, 2.0}, want: true},
+		{name: "arrays of different length", a: []interface{}{1}, b: []interface{}{1.0, 2.0}, want: false},
+		{name: "documents", a: M{"a": int32(1)}, b: map[string]interface{}{"a": 1.0}, want: true},
+		{name: "documents with different keys", a: M{"a": 1}, b: M{"b": 1}, want: false},
+		{name: "nil", a: nil, b: nil, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := valuesEqual(tt.a, tt.b); got != tt.want {
+				t.Errorf("valuesEqual(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumberArithmetic(t *testing.T) {
+	tests := []struct {
+		name       string
+		op         func(a, b interface{}) (interface{}, bool)
+		a, b, want interface{}
+	}{
+		{name: "add integers", op: addNumbers, a: 2, b: uint8(3), want: int64(5)},
+		{name: "add float", op: addNumbers, a: 2, b: 0.5, want: 2.5},
+		{name: "add json.Number", op: addNumbers, a: 41.5, b: json.Number("1"), want: 42.5},
+		{name: "add overflows to float", op: addNumbers, a: int64(math.MaxInt64), b: 1, want: float64(math.MaxInt64) + 1},
+		{name: "add negative", op: addNumbers, a: int64(math.MinInt64), b: -1, want: float64(math.MinInt64) - 1},
+		{name: "add non-number", op: addNumbers, a: 1, b: "x", want: nil},
+		{name: "multiply integers", op: multiplyNumbers, a: int32(6), b: int64(7), want: int64(42)},
+		{name: "multiply float", op: multiplyNumbers, a: 10, b: 1.5, want: 15.0},
+		{name: "multiply overflows to float", op: multiplyNumbers, a: int64(math.MinInt64), b: -1, want: -float64(math.MinInt64)},
+		{name: "multiply by zero", op: multiplyNumbers, a: 0, b: int64(math.MaxInt64), want: int64(0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.op(tt.a, tt.b)
+			if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v (%T), %v; want %v (%T)", got, got, ok, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericFilters(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	_, err := coll.InsertMany([]interface{}{
+		M{"n": "a", "age": 30, "tags": []int{1, 2}},
+		M{"n": "b", "age": 41.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter M
+		want   []string
+	}{
+		{name: "$gt int", filter: M{"age": M{"$gt": 30}}, want: []string{"b"}},
+		{name: "$gte int32", filter: M{"age": M{"$gte": int32(30)}}, want: []string{"a", "b"}},
+		{name: "equal int", filter: M{"age": 30}, want: []string{"a"}},
+		{name: "equal uint16", filter: M{"age": uint16(30)}, want: []string{"a"}},
+		{name: "equal json.Number", filter: M{"age": json.Number("41.5")}, want: []string{"b"}},
+		{name: "$lt json.Number", filter: M{"age": M{"$lt": json.Number("31")}}, want: []string{"a"}},
+		{name: "$in mixed types", filter: M{"age": M{"$in": []interface{}{int64(30), float32(41.5)}}}, want: []string{"a", "b"}},
+		{name: "array of int64", filter: M{"tags": []int64{1, 2}}, want: []string{"a"}},
+		{name: "array element uint", filter: M{"tags": uint(2)}, want: []string{"a"}},
+		{name: "number against string", filter: M{"age": M{"$gt": "a"}}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchingNames(t, coll, tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
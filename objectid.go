@@ -0,0 +1,145 @@
+package keradb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// ObjectID
+// ============================================================================
+
+// ObjectID is a 12-byte identifier laid out like a MongoDB ObjectId: a
+// 4-byte big-endian timestamp in seconds, 5 random bytes fixed for the
+// process and a 3-byte counter. ObjectIDs created later sort after earlier
+// ones, both as bytes and as hex strings.
+//
+// An ObjectID is stored as its 24-character hex string, so it can be used
+// as an _id and in filters on _id.
+type ObjectID [12]byte
+
+// NilObjectID is the zero ObjectID
+var NilObjectID ObjectID
+
+var (
+	objectIDProcess = processUnique()
+	objectIDCounter = randomCounter()
+)
+
+func processUnique() [5]byte {
+	var b [5]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("cannot initialize ObjectID generator: %w", err))
+	}
+	return b
+}
+
+func randomCounter() *atomic.Uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("cannot initialize ObjectID generator: %w", err))
+	}
+	c := &atomic.Uint32{}
+	c.Store(binary.BigEndian.Uint32(b[:]))
+	return c
+}
+
+// NewObjectID returns a new ObjectID for the current time
+func NewObjectID() ObjectID {
+	return NewObjectIDFromTimestamp(time.Now())
+}
+
+// NewObjectIDFromTimestamp returns a new ObjectID for the given time
+func NewObjectIDFromTimestamp(t time.Time) ObjectID {
+	var id ObjectID
+	binary.BigEndian.PutUint32(id[0:4], uint32(t.Unix()))
+	copy(id[4:9], objectIDProcess[:])
+	n := objectIDCounter.Add(1)
+	id[9] = byte(n >> 16)
+	id[10] = byte(n >> 8)
+	id[11] = byte(n)
+	return id
+}
+
+// ObjectIDFromHex parses a 24-character hex string
+func ObjectIDFromHex(s string) (ObjectID, error) {
+	var id ObjectID
+	if len(s) != 24 {
+		return NilObjectID, fmt.Errorf("invalid ObjectID %q: must be 24 hex characters", s)
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return NilObjectID, fmt.Errorf("invalid ObjectID %q: %w", s, err)
+	}
+	return id, nil
+}
+
+// IsValidObjectID reports whether s is the hex form of an ObjectID
+func IsValidObjectID(s string) bool {
+	_, err := ObjectIDFromHex(s)
+	return err == nil
+}
+
+// Hex returns the 24-character hex form
+func (id ObjectID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+// String returns the ID as ObjectID("<hex>"), as the mongo shell shows it
+func (id ObjectID) String() string {
+	return fmt.Sprintf("ObjectID(%q)", id.Hex())
+}
+
+// IsZero reports whether id is NilObjectID
+func (id ObjectID) IsZero() bool {
+	return id == NilObjectID
+}
+
+// Timestamp returns the creation time recorded in the ID, to the second
+func (id ObjectID) Timestamp() time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(id[0:4])), 0).UTC()
+}
+
+// MarshalText encodes the ID as hex
+func (id ObjectID) MarshalText() ([]byte, error) {
+	return []byte(id.Hex()), nil
+}
+
+// UnmarshalText decodes the ID from hex
+func (id *ObjectID) UnmarshalText(text []byte) error {
+	parsed, err := ObjectIDFromHex(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// MarshalJSON encodes the ID as a hex string
+func (id ObjectID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(id.Hex())
+}
+
+// UnmarshalJSON decodes the ID from a hex string or from Extended JSON
+// {"$oid": "..."}. null leaves the ID unchanged.
+func (id *ObjectID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var wrapped struct {
+			OID *string `json:"$oid"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err != nil || wrapped.OID == nil {
+			return errors.New("ObjectID must be a hex string or {\"$oid\": ...}")
+		}
+		s = *wrapped.OID
+	}
+	return id.UnmarshalText([]byte(s))
+}
@@ -0,0 +1,106 @@
+package keradb
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestObjectIDFromHex(t *testing.T) {
+	tests := []struct {
+		name    string
+		hex     string
+		wantErr bool
+	}{
+		{name: "valid", hex: "65f1a2b3c4d5e6f708091a2b"},
+		{name: "upper case", hex: "65F1A2B3C4D5E6F708091A2B"},
+		{name: "too short", hex: "65f1a2b3", wantErr: true},
+		{name: "too long", hex: "65f1a2b3c4d5e6f708091a2b00", wantErr: true},
+		{name: "not hex", hex: "zzf1a2b3c4d5e6f708091a2b", wantErr: true},
+		{name: "empty", hex: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := ObjectIDFromHex(tt.hex)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ObjectIDFromHex(%q) error = %v, wantErr %v", tt.hex, err, tt.wantErr)
+			}
+			if IsValidObjectID(tt.hex) == tt.wantErr {
+				t.Errorf("IsValidObjectID(%q) = %v", tt.hex, !tt.wantErr)
+			}
+			if !tt.wantErr && id.Hex() != "65f1a2b3c4d5e6f708091a2b" {
+				t.Errorf("Hex() = %q", id.Hex())
+			}
+		})
+	}
+}
+
+func TestObjectIDOrdering(t *testing.T) {
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name         string
+		first, later time.Time
+	}{
+		{name: "same second", first: base, later: base},
+		{name: "next second", first: base, later: base.Add(time.Second)},
+		{name: "next year", first: base, later: base.AddDate(1, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewObjectIDFromTimestamp(tt.first)
+			b := NewObjectIDFromTimestamp(tt.later)
+			if a.Hex() >= b.Hex() {
+				t.Errorf("%s does not sort before %s", a.Hex(), b.Hex())
+			}
+			if !a.Timestamp().Equal(tt.first) || !b.Timestamp().Equal(tt.later) {
+				t.Errorf("Timestamp() = %v, %v, want %v, %v", a.Timestamp(), b.Timestamp(), tt.first, tt.later)
+			}
+		})
+	}
+}
+
+func TestObjectIDMarshaling(t *testing.T) {
+	id, err := ObjectIDFromHex("65f1a2b3c4d5e6f708091a2b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    string
+		want    ObjectID
+		wantErr bool
+	}{
+		{name: "hex string", data: `"65f1a2b3c4d5e6f708091a2b"`, want: id},
+		{name: "$oid wrapper", data: `{"$oid":"65f1a2b3c4d5e6f708091a2b"}`, want: id},
+		{name: "null keeps the value", data: `null`, want: id},
+		{name: "bad hex", data: `"nope"`, wantErr: true},
+		{name: "number", data: `12`, wantErr: true},
+		{name: "wrapper without $oid", data: `{"oid":"65f1a2b3c4d5e6f708091a2b"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := id
+			err := json.Unmarshal([]byte(tt.data), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Unmarshal(%s) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+
+	data, err := json.Marshal(struct{ ID ObjectID }{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"ID":"65f1a2b3c4d5e6f708091a2b"}` {
+		t.Errorf("Marshal = %s", data)
+	}
+	if id.String() != `ObjectID("65f1a2b3c4d5e6f708091a2b")` {
+		t.Errorf("String() = %s", id.String())
+	}
+	if id.IsZero() || !NilObjectID.IsZero() {
+		t.Error("IsZero is wrong")
+	}
+}
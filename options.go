@@ -0,0 +1,564 @@
+package keradb
+
+// ============================================================================
+// Client Options
+// ============================================================================
+
+// ClientOptions configures a Client created by Connect, Create or Open
+type ClientOptions struct {
+	// Engine is the storage backend. When nil, the native libkeradb engine
+	// is opened at the client path.
+	Engine Engine
+	// Registry holds custom encoders and decoders. When nil, DefaultRegistry
+	// is used.
+	Registry *Registry
+	// UseJSONNumber reads plain JSON numbers in documents as json.Number
+	// rather than float64.
+	UseJSONNumber *bool
+	// IDStrategy chooses how IDs are assigned to inserted documents that
+	// have no _id. The default, IDNative, lets the engine choose.
+	IDStrategy *IDStrategy
+	// ChangeLogSize is the number of recent changes kept for change
+	// streams. The default is 10000; 0 turns change streams off. While they
+	// are on, every write also stores an event, deleting the oldest one once
+	// the log is full, and the retained events are held in memory.
+	ChangeLogSize *int
+}
+
+// NewClientOptions creates an empty set of client options
+func NewClientOptions() *ClientOptions {
+	return &ClientOptions{}
+}
+
+// SetEngine sets the storage backend used instead of the native library
+func (o *ClientOptions) SetEngine(engine Engine) *ClientOptions {
+	o.Engine = engine
+	return o
+}
+
+// SetRegistry sets the registry used to encode and decode documents
+func (o *ClientOptions) SetRegistry(registry *Registry) *ClientOptions {
+	o.Registry = registry
+	return o
+}
+
+// SetUseJSONNumber sets whether documents hold numbers as json.Number
+func (o *ClientOptions) SetUseJSONNumber(useNumber bool) *ClientOptions {
+	o.UseJSONNumber = &useNumber
+	return o
+}
+
+// SetIDStrategy sets how IDs are assigned to inserted documents
+func (o *ClientOptions) SetIDStrategy(strategy IDStrategy) *ClientOptions {
+	o.IDStrategy = &strategy
+	return o
+}
+
+// SetChangeLogSize sets the number of recent changes kept for change
+// streams; 0 turns them off
+func (o *ClientOptions) SetChangeLogSize(size int) *ClientOptions {
+	o.ChangeLogSize = &size
+	return o
+}
+
+// mergeClientOptions combines options, later values overriding earlier ones
+func mergeClientOptions(opts ...*ClientOptions) *ClientOptions {
+	merged := NewClientOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Engine != nil {
+			merged.Engine = o.Engine
+		}
+		if o.Registry != nil {
+			merged.Registry = o.Registry
+		}
+		if o.UseJSONNumber != nil {
+			merged.UseJSONNumber = o.UseJSONNumber
+		}
+		if o.IDStrategy != nil {
+			merged.IDStrategy = o.IDStrategy
+		}
+		if o.ChangeLogSize != nil {
+			merged.ChangeLogSize = o.ChangeLogSize
+		}
+	}
+	return merged
+}
+
+// ============================================================================
+// Find Options
+// ============================================================================
+
+// FindOptions configures Find and FindOne
+type FindOptions struct {
+	// Sort orders the results. Each element names a field and a direction,
+	// 1 for ascending or -1 for descending; earlier keys take precedence.
+	Sort D
+	// Projection limits the fields returned, either by inclusion
+	// (M{"name": 1}) or by exclusion (M{"password": 0}). Fields may be
+	// dot-notation paths such as "address.city".
+	Projection Doc
+	// Skip is the number of matching documents to skip.
+	Skip *int64
+	// Limit is the maximum number of documents to return.
+	Limit *int64
+	// BatchSize is the number of documents fetched from the engine at a time.
+	BatchSize *int32
+}
+
+// NewFindOptions creates an empty set of find options
+func NewFindOptions() *FindOptions {
+	return &FindOptions{}
+}
+
+// SetSort sets the sort specification
+func (o *FindOptions) SetSort(sort D) *FindOptions {
+	o.Sort = sort
+	return o
+}
+
+// SetProjection sets the projection specification
+func (o *FindOptions) SetProjection(projection Doc) *FindOptions {
+	o.Projection = projection
+	return o
+}
+
+// SetSkip sets the number of documents to skip
+func (o *FindOptions) SetSkip(skip int64) *FindOptions {
+	o.Skip = &skip
+	return o
+}
+
+// SetLimit sets the maximum number of documents to return
+func (o *FindOptions) SetLimit(limit int64) *FindOptions {
+	o.Limit = &limit
+	return o
+}
+
+// SetBatchSize sets the number of documents fetched from the engine at a time
+func (o *FindOptions) SetBatchSize(size int32) *FindOptions {
+	o.BatchSize = &size
+	return o
+}
+
+// mergeFindOptions combines options, later values overriding earlier ones
+func mergeFindOptions(opts ...*FindOptions) *FindOptions {
+	merged := NewFindOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Sort != nil {
+			merged.Sort = o.Sort
+		}
+		if o.Projection != nil {
+			merged.Projection = o.Projection
+		}
+		if o.Skip != nil {
+			merged.Skip = o.Skip
+		}
+		if o.Limit != nil {
+			merged.Limit = o.Limit
+		}
+		if o.BatchSize != nil {
+			merged.BatchSize = o.BatchSize
+		}
+	}
+	return merged
+}
+
+// ============================================================================
+// Update Options
+// ============================================================================
+
+// UpdateOptions configures UpdateOne and UpdateMany
+type UpdateOptions struct {
+	// Upsert inserts a new document when no document matches the filter.
+	// The new document is built from the filter's equality conditions with
+	// the update applied, including any $setOnInsert fields.
+	Upsert *bool
+}
+
+// NewUpdateOptions creates an empty set of update options
+func NewUpdateOptions() *UpdateOptions {
+	return &UpdateOptions{}
+}
+
+// SetUpsert sets whether to insert a document when none matches
+func (o *UpdateOptions) SetUpsert(upsert bool) *UpdateOptions {
+	o.Upsert = &upsert
+	return o
+}
+
+// mergeUpdateOptions combines options, later values overriding earlier ones
+func mergeUpdateOptions(opts ...*UpdateOptions) *UpdateOptions {
+	merged := NewUpdateOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Upsert != nil {
+			merged.Upsert = o.Upsert
+		}
+	}
+	return merged
+}
+
+// ============================================================================
+// Replace Options
+// ============================================================================
+
+// ReplaceOptions configures ReplaceOne
+type ReplaceOptions struct {
+	// Upsert inserts the replacement document when no document matches the
+	// filter. It takes its _id from the filter if the filter has one.
+	Upsert *bool
+}
+
+// NewReplaceOptions creates an empty set of replace options
+func NewReplaceOptions() *ReplaceOptions {
+	return &ReplaceOptions{}
+}
+
+// SetUpsert sets whether to insert the replacement when no document matches
+func (o *ReplaceOptions) SetUpsert(upsert bool) *ReplaceOptions {
+	o.Upsert = &upsert
+	return o
+}
+
+// mergeReplaceOptions combines options, later values overriding earlier ones
+func mergeReplaceOptions(opts ...*ReplaceOptions) *ReplaceOptions {
+	merged := NewReplaceOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Upsert != nil {
+			merged.Upsert = o.Upsert
+		}
+	}
+	return merged
+}
+
+// ============================================================================
+// FindOneAnd* Options
+// ============================================================================
+
+// ReturnDocument selects which version of a document FindOneAndUpdate and
+// FindOneAndReplace return
+type ReturnDocument int
+
+const (
+	// Before returns the document as it was before the modification
+	Before ReturnDocument = iota
+	// After returns the document as it is after the modification
+	After
+)
+
+// FindOneAndUpdateOptions configures FindOneAndUpdate
+type FindOneAndUpdateOptions struct {
+	// ReturnDocument selects the original or the updated document. The
+	// default is Before.
+	ReturnDocument *ReturnDocument
+	// Sort picks which document is updated when several match.
+	Sort D
+	// Projection limits the fields of the returned document.
+	Projection Doc
+	// Upsert inserts a new document when no document matches the filter.
+	Upsert *bool
+}
+
+// NewFindOneAndUpdateOptions creates an empty set of options
+func NewFindOneAndUpdateOptions() *FindOneAndUpdateOptions {
+	return &FindOneAndUpdateOptions{}
+}
+
+// SetReturnDocument sets which version of the document is returned
+func (o *FindOneAndUpdateOptions) SetReturnDocument(rd ReturnDocument) *FindOneAndUpdateOptions {
+	o.ReturnDocument = &rd
+	return o
+}
+
+// SetSort sets the sort specification
+func (o *FindOneAndUpdateOptions) SetSort(sort D) *FindOneAndUpdateOptions {
+	o.Sort = sort
+	return o
+}
+
+// SetProjection sets the projection specification
+func (o *FindOneAndUpdateOptions) SetProjection(projection Doc) *FindOneAndUpdateOptions {
+	o.Projection = projection
+	return o
+}
+
+// SetUpsert sets whether to insert a document when none matches
+func (o *FindOneAndUpdateOptions) SetUpsert(upsert bool) *FindOneAndUpdateOptions {
+	o.Upsert = &upsert
+	return o
+}
+
+// mergeFindOneAndUpdateOptions combines options, later values overriding
+// earlier ones
+func mergeFindOneAndUpdateOptions(opts ...*FindOneAndUpdateOptions) *FindOneAndUpdateOptions {
+	merged := NewFindOneAndUpdateOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.ReturnDocument != nil {
+			merged.ReturnDocument = o.ReturnDocument
+		}
+		if o.Sort != nil {
+			merged.Sort = o.Sort
+		}
+		if o.Projection != nil {
+			merged.Projection = o.Projection
+		}
+		if o.Upsert != nil {
+			merged.Upsert = o.Upsert
+		}
+	}
+	return merged
+}
+
+// FindOneAndReplaceOptions configures FindOneAndReplace
+type FindOneAndReplaceOptions struct {
+	// ReturnDocument selects the original or the replacement document. The
+	// default is Before.
+	ReturnDocument *ReturnDocument
+	// Sort picks which document is replaced when several match.
+	Sort D
+	// Projection limits the fields of the returned document.
+	Projection Doc
+	// Upsert inserts the replacement when no document matches the filter.
+	Upsert *bool
+}
+
+// NewFindOneAndReplaceOptions creates an empty set of options
+func NewFindOneAndReplaceOptions() *FindOneAndReplaceOptions {
+	return &FindOneAndReplaceOptions{}
+}
+
+// SetReturnDocument sets which version of the document is returned
+func (o *FindOneAndReplaceOptions) SetReturnDocument(rd ReturnDocument) *FindOneAndReplaceOptions {
+	o.ReturnDocument = &rd
+	return o
+}
+
+// SetSort sets the sort specification
+func (o *FindOneAndReplaceOptions) SetSort(sort D) *FindOneAndReplaceOptions {
+	o.Sort = sort
+	return o
+}
+
+// SetProjection sets the projection specification
+func (o *FindOneAndReplaceOptions) SetProjection(projection Doc) *FindOneAndReplaceOptions {
+	o.Projection = projection
+	return o
+}
+
+// SetUpsert sets whether to insert the replacement when no document matches
+func (o *FindOneAndReplaceOptions) SetUpsert(upsert bool) *FindOneAndReplaceOptions {
+	o.Upsert = &upsert
+	return o
+}
+
+// mergeFindOneAndReplaceOptions combines options, later values overriding
+// earlier ones
+func mergeFindOneAndReplaceOptions(opts ...*FindOneAndReplaceOptions) *FindOneAndReplaceOptions {
+	merged := NewFindOneAndReplaceOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.ReturnDocument != nil {
+			merged.ReturnDocument = o.ReturnDocument
+		}
+		if o.Sort != nil {
+			merged.Sort = o.Sort
+		}
+		if o.Projection != nil {
+			merged.Projection = o.Projection
+		}
+		if o.Upsert != nil {
+			merged.Upsert = o.Upsert
+		}
+	}
+	return merged
+}
+
+// FindOneAndDeleteOptions configures FindOneAndDelete
+type FindOneAndDeleteOptions struct {
+	// Sort picks which document is deleted when several match.
+	Sort D
+	// Projection limits the fields of the returned document.
+	Projection Doc
+}
+
+// NewFindOneAndDeleteOptions creates an empty set of options
+func NewFindOneAndDeleteOptions() *FindOneAndDeleteOptions {
+	return &FindOneAndDeleteOptions{}
+}
+
+// SetSort sets the sort specification
+func (o *FindOneAndDeleteOptions) SetSort(sort D) *FindOneAndDeleteOptions {
+	o.Sort = sort
+	return o
+}
+
+// SetProjection sets the projection specification
+func (o *FindOneAndDeleteOptions) SetProjection(projection Doc) *FindOneAndDeleteOptions {
+	o.Projection = projection
+	return o
+}
+
+// mergeFindOneAndDeleteOptions combines options, later values overriding
+// earlier ones
+func mergeFindOneAndDeleteOptions(opts ...*FindOneAndDeleteOptions) *FindOneAndDeleteOptions {
+	merged := NewFindOneAndDeleteOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Sort != nil {
+			merged.Sort = o.Sort
+		}
+		if o.Projection != nil {
+			merged.Projection = o.Projection
+		}
+	}
+	return merged
+}
+
+// IndexOptions configures an index created through IndexView
+type IndexOptions struct {
+	// Name overrides the default name, which joins each key and direction,
+	// as in "age_1_name_-1".
+	Name *string
+	// Unique rejects writes that would give two documents the same key.
+	Unique *bool
+	// Sparse leaves out documents that have none of the indexed fields.
+	Sparse *bool
+}
+
+// NewIndexOptions creates an empty set of index options
+func NewIndexOptions() *IndexOptions {
+	return &IndexOptions{}
+}
+
+// SetName sets the index name
+func (o *IndexOptions) SetName(name string) *IndexOptions {
+	o.Name = &name
+	return o
+}
+
+// SetUnique sets whether the index is unique
+func (o *IndexOptions) SetUnique(unique bool) *IndexOptions {
+	o.Unique = &unique
+	return o
+}
+
+// SetSparse sets whether the index is sparse
+func (o *IndexOptions) SetSparse(sparse bool) *IndexOptions {
+	o.Sparse = &sparse
+	return o
+}
+
+// ============================================================================
+// Bulk Write Options
+// ============================================================================
+
+// BulkWriteOptions configures BulkWrite
+type BulkWriteOptions struct {
+	// Ordered stops the writes at the first failure. The default is true;
+	// with false, every write is attempted.
+	Ordered *bool
+}
+
+// NewBulkWriteOptions creates an empty set of bulk write options
+func NewBulkWriteOptions() *BulkWriteOptions {
+	return &BulkWriteOptions{}
+}
+
+// SetOrdered sets whether the writes stop at the first failure
+func (o *BulkWriteOptions) SetOrdered(ordered bool) *BulkWriteOptions {
+	o.Ordered = &ordered
+	return o
+}
+
+// mergeBulkWriteOptions combines options, later values overriding earlier
+// ones
+func mergeBulkWriteOptions(opts ...*BulkWriteOptions) *BulkWriteOptions {
+	merged := NewBulkWriteOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.Ordered != nil {
+			merged.Ordered = o.Ordered
+		}
+	}
+	return merged
+}
+
+// ============================================================================
+// Change Stream Options
+// ============================================================================
+
+// FullDocument chooses whether update events carry the updated document
+type FullDocument string
+
+const (
+	// FullDocumentDefault leaves fullDocument out of update events
+	FullDocumentDefault FullDocument = "default"
+	// FullDocumentUpdateLookup includes in update events the document as it
+	// was right after the update
+	FullDocumentUpdateLookup FullDocument = "updateLookup"
+)
+
+// ChangeStreamOptions configures Watch
+type ChangeStreamOptions struct {
+	// FullDocument chooses whether update events carry the updated
+	// document. Insert and replace events always do.
+	FullDocument *FullDocument
+	// ResumeAfter starts the stream after the event with this token, rather
+	// than at the next change.
+	ResumeAfter *ResumeToken
+}
+
+// NewChangeStreamOptions creates an empty set of options
+func NewChangeStreamOptions() *ChangeStreamOptions {
+	return &ChangeStreamOptions{}
+}
+
+// SetFullDocument sets whether update events carry the updated document
+func (o *ChangeStreamOptions) SetFullDocument(fullDocument FullDocument) *ChangeStreamOptions {
+	o.FullDocument = &fullDocument
+	return o
+}
+
+// SetResumeAfter sets the token of the event to resume after
+func (o *ChangeStreamOptions) SetResumeAfter(token ResumeToken) *ChangeStreamOptions {
+	o.ResumeAfter = &token
+	return o
+}
+
+// mergeChangeStreamOptions combines options, later values overriding
+// earlier ones
+func mergeChangeStreamOptions(opts ...*ChangeStreamOptions) *ChangeStreamOptions {
+	merged := NewChangeStreamOptions()
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		if o.FullDocument != nil {
+			merged.FullDocument = o.FullDocument
+		}
+		if o.ResumeAfter != nil {
+			merged.ResumeAfter = o.ResumeAfter
+		}
+	}
+	return merged
+}
@@ -0,0 +1,231 @@
+package keradb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ============================================================================
+// Ordered Documents
+// ============================================================================
+
+// Queries work on documents as maps, which have no key order. The order of
+// a document's fields is kept where it enters and leaves storage instead:
+// a D or a struct is written with its fields in order, an update rewrites a
+// document in the order it was stored, with new fields after the existing
+// ones, and FindRaw reads documents back as D values in stored order.
+
+// MarshalJSON encodes d as a JSON object with its keys in order
+func (d D) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", e.Key, err)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a JSON object into d, keeping its keys in order.
+// Nested objects become D values as well.
+func (d *D) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	v, err := readOrdered(dec)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		*d = nil
+		return nil
+	}
+	doc, ok := v.(D)
+	if !ok {
+		return errors.New("D must be decoded from a JSON object")
+	}
+	*d = doc
+	return nil
+}
+
+// readOrdered reads one JSON value, decoding objects as D
+func readOrdered(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return tok, nil
+	}
+
+	switch delim {
+	case '{':
+		doc := D{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, E{Key: key.(string), Value: value})
+		}
+		_, err = dec.Token()
+		return doc, err
+	case '[':
+		arr := []interface{}{}
+		for dec.More() {
+			value, err := readOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err = dec.Token()
+		return arr, err
+	}
+	return nil, fmt.Errorf("unexpected %v", delim)
+}
+
+// unmarshalOrderedDocuments decodes a JSON array of stored documents as D
+// values in stored order
+func unmarshalOrderedDocuments(data []byte, useNumber bool) ([]D, error) {
+	v, err := decodeOrderedStored(data, useNumber)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("expected an array of documents")
+	}
+	docs := make([]D, len(arr))
+	for i, elem := range arr {
+		if docs[i], ok = elem.(D); !ok {
+			return nil, errors.New("expected an array of documents")
+		}
+	}
+	return docs, nil
+}
+
+// unmarshalOrdered decodes a stored document as a D in stored order
+func unmarshalOrdered(data []byte, useNumber bool) (D, error) {
+	v, err := decodeOrderedStored(data, useNumber)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	doc, ok := v.(D)
+	if !ok {
+		return nil, errors.New("expected a document")
+	}
+	return doc, nil
+}
+
+func decodeOrderedStored(data []byte, useNumber bool) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := readOrdered(dec)
+	if err != nil {
+		return nil, err
+	}
+	return fromExtendedJSON(v, useNumber), nil
+}
+
+// plainValue converts the D values in v to maps, as queries expect
+func plainValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case D:
+		m := make(map[string]interface{}, len(x))
+		for _, e := range x {
+			m[e.Key] = plainValue(e.Value)
+		}
+		return m
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, elem := range x {
+			out[i] = plainValue(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// documentFromD converts a D read from storage to a Document
+func documentFromD(d D) Document {
+	return Document(plainValue(d).(map[string]interface{}))
+}
+
+// orderLike converts the maps in v to D values, ordering their keys like
+// template, a value of the same shape as read by unmarshalOrdered. Keys the
+// template lacks follow in sorted order.
+func orderLike(v, template interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return orderMap(x, template)
+	case Document:
+		return orderMap(x, template)
+	case M:
+		return orderMap(x, template)
+	case []interface{}:
+		tmpl, _ := template.([]interface{})
+		out := make([]interface{}, len(x))
+		for i, elem := range x {
+			var t interface{}
+			if i < len(tmpl) {
+				t = tmpl[i]
+			}
+			out[i] = orderLike(elem, t)
+		}
+		return out
+	}
+	return v
+}
+
+func orderMap(m map[string]interface{}, template interface{}) D {
+	tmpl, _ := template.(D)
+	out := make(D, 0, len(m))
+	seen := make(map[string]bool, len(tmpl))
+	for _, e := range tmpl {
+		if value, ok := m[e.Key]; ok && !seen[e.Key] {
+			seen[e.Key] = true
+			out = append(out, E{Key: e.Key, Value: orderLike(value, e.Value)})
+		}
+	}
+	for _, k := range sortedKeys(m) {
+		if !seen[k] {
+			out = append(out, E{Key: k, Value: orderLike(m[k], nil)})
+		}
+	}
+	return out
+}
+
+// idFirst moves the _id element of d to the front
+func idFirst(d D) D {
+	for i, e := range d {
+		if e.Key == "_id" {
+			if i == 0 {
+				return d
+			}
+			out := make(D, 0, len(d))
+			out = append(out, e)
+			out = append(out, d[:i]...)
+			return append(out, d[i+1:]...)
+		}
+	}
+	return d
+}
@@ -0,0 +1,217 @@
+package keradb
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    D
+		wantErr bool
+	}{
+		{name: "keys in order", data: `{"b":1,"a":"x"}`, want: D{{Key: "b", Value: float64(1)}, {Key: "a", Value: "x"}}},
+		{name: "nested objects", data: `{"z":{"y":1,"x":2}}`,
+			want: D{{Key: "z", Value: D{{Key: "y", Value: float64(1)}, {Key: "x", Value: float64(2)}}}}},
+		{name: "objects in arrays", data: `{"a":[{"k":1},2]}`,
+			want: D{{Key: "a", Value: []interface{}{D{{Key: "k", Value: float64(1)}}, float64(2)}}}},
+		{name: "empty object", data: `{}`, want: D{}},
+		{name: "null", data: `null`, want: nil},
+		{name: "not an object", data: `[1]`, wantErr: true},
+		{name: "malformed", data: `{"a":`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got D
+			err := json.Unmarshal([]byte(tt.data), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%s) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.data, got, tt.want)
+			}
+			if tt.want == nil {
+				return
+			}
+			out, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.data {
+				t.Errorf("Marshal = %s, want %s", out, tt.data)
+			}
+		})
+	}
+}
+
+func TestStoredFieldOrder(t *testing.T) {
+	type ordered struct {
+		ID    string `json:"_id"`
+		Zeta  int    `json:"zeta"`
+		Alpha string `json:"alpha"`
+	}
+
+	tests := []struct {
+		name string
+		doc  interface{}
+		// change, if set, modifies the inserted document with _id "a"
+		change func(c *Collection) error
+		want   D
+	}{
+		{
+			name: "D keeps its order",
+			doc:  D{{Key: "_id", Value: "a"}, {Key: "z", Value: 1}, {Key: "a", Value: 2}},
+			want: D{{Key: "_id", Value: "a"}, {Key: "z", Value: float64(1)}, {Key: "a", Value: float64(2)}},
+		},
+		{
+			name: "struct fields in declaration order",
+			doc:  ordered{ID: "a", Zeta: 1, Alpha: "x"},
+			want: D{{Key: "_id", Value: "a"}, {Key: "zeta", Value: float64(1)}, {Key: "alpha", Value: "x"}},
+		},
+		{
+			name: "nested D",
+			doc:  D{{Key: "_id", Value: "a"}, {Key: "sub", Value: D{{Key: "y", Value: 1}, {Key: "x", Value: 2}}}},
+			want: D{{Key: "_id", Value: "a"}, {Key: "sub", Value: D{{Key: "y", Value: float64(1)}, {Key: "x", Value: float64(2)}}}},
+		},
+		{
+			name: "_id moves to the front",
+			doc:  D{{Key: "z", Value: 1}, {Key: "_id", Value: "a"}},
+			want: D{{Key: "_id", Value: "a"}, {Key: "z", Value: float64(1)}},
+		},
+		{
+			name: "update keeps existing fields in place",
+			doc:  D{{Key: "_id", Value: "a"}, {Key: "z", Value: 1}, {Key: "a", Value: 2}},
+			change: func(c *Collection) error {
+				_, err := c.UpdateOne(M{"_id": "a"}, D{{Key: "$set", Value: D{{Key: "z", Value: 5}, {Key: "new", Value: true}}}})
+				return err
+			},
+			want: D{{Key: "_id", Value: "a"}, {Key: "z", Value: float64(5)}, {Key: "a", Value: float64(2)}, {Key: "new", Value: true}},
+		},
+		{
+			name: "unset removes a field",
+			doc:  D{{Key: "_id", Value: "a"}, {Key: "z", Value: 1}, {Key: "a", Value: 2}},
+			change: func(c *Collection) error {
+				_, err := c.UpdateOne(D{{Key: "_id", Value: "a"}}, M{"$unset": M{"z": ""}})
+				return err
+			},
+			want: D{{Key: "_id", Value: "a"}, {Key: "a", Value: float64(2)}},
+		},
+		{
+			name: "replacement takes its own order",
+			doc:  D{{Key: "_id", Value: "a"}, {Key: "z", Value: 1}},
+			change: func(c *Collection) error {
+				_, err := c.ReplaceOne(M{"_id": "a"}, D{{Key: "q", Value: 1}, {Key: "b", Value: 2}})
+				return err
+			},
+			want: D{{Key: "_id", Value: "a"}, {Key: "q", Value: float64(1)}, {Key: "b", Value: float64(2)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+			if _, err := coll.InsertOne(tt.doc); err != nil {
+				t.Fatal(err)
+			}
+			if tt.change != nil {
+				if err := tt.change(coll); err != nil {
+					t.Fatal(err)
+				}
+			}
+			docs, err := coll.FindRaw(M{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != 1 || !reflect.DeepEqual(docs[0], tt.want) {
+				t.Errorf("FindRaw = %#v, want [%#v]", docs, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderedQueries(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	_, err := coll.InsertMany([]interface{}{
+		D{{Key: "n", Value: "a"}, {Key: "g", Value: 2}, {Key: "v", Value: 1}},
+		D{{Key: "n", Value: "b"}, {Key: "g", Value: 1}, {Key: "v", Value: 2}},
+		D{{Key: "n", Value: "c"}, {Key: "g", Value: 1}, {Key: "v", Value: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		sort   D
+		want   []string
+	}{
+		{name: "D filter", filter: D{{Key: "g", Value: 1}}, want: []string{"b", "c"}},
+		{name: "D operator filter", filter: D{{Key: "v", Value: D{{Key: "$gt", Value: 1}}}}, want: []string{"b"}},
+		{name: "sort by g then v", filter: M{}, sort: D{{Key: "g", Value: 1}, {Key: "v", Value: 1}}, want: []string{"c", "b", "a"}},
+		{name: "sort by v then g", filter: M{}, sort: D{{Key: "v", Value: 1}, {Key: "g", Value: 1}}, want: []string{"c", "a", "b"}},
+		{name: "sort descending first", filter: D{}, sort: D{{Key: "v", Value: -1}, {Key: "n", Value: 1}}, want: []string{"b", "a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewFindOptions()
+			if tt.sort != nil {
+				opts.SetSort(tt.sort)
+			}
+			docs, err := coll.FindRaw(tt.filter, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, d := range docs {
+				if d[1].Key != "n" {
+					t.Fatalf("fields out of order: %#v", d)
+				}
+				got = append(got, d[1].Value.(string))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectionKeepsStoredOrder(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	doc := D{
+		{Key: "_id", Value: "a"},
+		{Key: "z", Value: 1},
+		{Key: "sub", Value: D{{Key: "y", Value: 2}, {Key: "x", Value: 3}, {Key: "w", Value: 4}}},
+		{Key: "b", Value: 5},
+	}
+	if _, err := coll.InsertOne(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		spec D
+		want D
+	}{
+		{name: "include", spec: D{{Key: "b", Value: 1}, {Key: "sub.w", Value: 1}, {Key: "sub.y", Value: 1}, {Key: "z", Value: 1}},
+			want: D{{Key: "_id", Value: "a"}, {Key: "z", Value: 1.0}, {Key: "sub", Value: D{{Key: "y", Value: 2.0}, {Key: "w", Value: 4.0}}}, {Key: "b", Value: 5.0}}},
+		{name: "exclude", spec: D{{Key: "sub.x", Value: 0}, {Key: "_id", Value: 0}},
+			want: D{{Key: "z", Value: 1.0}, {Key: "sub", Value: D{{Key: "y", Value: 2.0}, {Key: "w", Value: 4.0}}}, {Key: "b", Value: 5.0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := coll.FindRaw(M{}, NewFindOptions().SetProjection(tt.spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != 1 || !reflect.DeepEqual(docs[0], tt.want) {
+				t.Errorf("FindRaw = %#v, want [%#v]", docs, tt.want)
+			}
+		})
+	}
+}
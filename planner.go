@@ -0,0 +1,131 @@
+package keradb
+
+import (
+	"context"
+	"time"
+)
+
+// ============================================================================
+// Query Planner
+// ============================================================================
+
+// PlanType names the strategy a query uses to find its documents
+type PlanType string
+
+const (
+	// PlanIDLookup fetches documents directly by their _id
+	PlanIDLookup PlanType = "IDLOOKUP"
+	// PlanIndexScan reads the documents a secondary index selects
+	PlanIndexScan PlanType = "IXSCAN"
+	// PlanCollectionScan reads every document in the collection
+	PlanCollectionScan PlanType = "COLLSCAN"
+)
+
+// queryPlan is the strategy chosen for a filter
+type queryPlan struct {
+	kind  PlanType
+	index string   // for PlanIndexScan
+	ids   []string // candidate documents, in the order they are read
+}
+
+// planQuery chooses how to read the documents a filter may match. An _id
+// equality or $in of string ids is answered by id lookups; otherwise the
+// index constraining the most leading fields is used; otherwise the
+// collection is scanned. The chosen documents are a superset of the
+// matches, so the filter is still applied to each of them.
+func (c *Collection) planQuery(filter M) (*queryPlan, error) {
+	if ids, ok := idLookup(filter); ok {
+		return &queryPlan{kind: PlanIDLookup, ids: ids}, nil
+	}
+
+	ids, name, ok, err := c.indexes.plan(c.name, filter)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &queryPlan{kind: PlanIndexScan, index: name, ids: ids}, nil
+	}
+	return &queryPlan{kind: PlanCollectionScan}, nil
+}
+
+// idLookup returns the ids a filter's _id condition allows, if it names
+// them exactly
+func idLookup(filter M) ([]string, bool) {
+	cond, ok := filter["_id"]
+	if !ok {
+		return nil, false
+	}
+	b, ok := boundsFor(cond, false)
+	if !ok || b.points == nil {
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	ids := make([]string, 0, len(b.points))
+	for _, p := range b.points {
+		id, ok := p.(string)
+		if !ok {
+			return nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, true
+}
+
+// ----------------------------------------------------------------------------
+// Explain
+// ----------------------------------------------------------------------------
+
+// ExplainResult describes how a query was executed
+type ExplainResult struct {
+	// Plan is the strategy the planner chose.
+	Plan PlanType
+	// IndexName is the index used by an index scan.
+	IndexName string
+	// DocsExamined counts the documents read from the engine.
+	DocsExamined int64
+	// DocsReturned counts the documents the query returned.
+	DocsReturned int64
+	// PlanningTime is the time spent compiling the query and choosing a plan.
+	PlanningTime time.Duration
+	// ExecutionTime is the time spent reading and matching documents.
+	ExecutionTime time.Duration
+}
+
+// Explain runs a query as Find would and reports the plan it used and the
+// work it did
+func (c *Collection) Explain(filter Filter, opts ...*FindOptions) (*ExplainResult, error) {
+	return c.ExplainContext(context.Background(), filter, opts...)
+}
+
+// ExplainContext runs a query as FindContext would and reports the plan it
+// used and the work it did. The documents themselves are discarded.
+func (c *Collection) ExplainContext(ctx context.Context, filter Filter, opts ...*FindOptions) (*ExplainResult, error) {
+	start := time.Now()
+	cursor, err := c.FindContext(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	planned := time.Now()
+
+	var returned int64
+	for cursor.Next() {
+		returned++
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ExplainResult{
+		Plan:          cursor.plan.kind,
+		IndexName:     cursor.plan.index,
+		DocsExamined:  int64(cursor.examined),
+		DocsReturned:  returned,
+		PlanningTime:  planned.Sub(start),
+		ExecutionTime: time.Since(planned),
+	}, nil
+}
@@ -0,0 +1,153 @@
+package keradb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIDLookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter M
+		want   []string
+		ok     bool
+	}{
+		{name: "equality", filter: M{"_id": "a"}, want: []string{"a"}, ok: true},
+		{name: "$eq", filter: M{"_id": M{"$eq": "a"}}, want: []string{"a"}, ok: true},
+		{name: "$in drops repeats", filter: M{"_id": M{"$in": []string{"a", "b", "a"}}}, want: []string{"a", "b"}, ok: true},
+		{name: "with other fields", filter: M{"_id": "a", "n": 1}, want: []string{"a"}, ok: true},
+		{name: "empty $in", filter: M{"_id": M{"$in": []string{}}}, want: []string{}, ok: true},
+		{name: "no _id", filter: M{"n": 1}},
+		{name: "range", filter: M{"_id": M{"$gt": "a"}}},
+		{name: "non-string id", filter: M{"_id": 1}},
+		{name: "$in with a non-string id", filter: M{"_id": M{"$in": []interface{}{"a", 1}}}},
+		{name: "$ne", filter: M{"_id": M{"$ne": "a"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := idLookup(tt.filter)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("idLookup = %v, %v; want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	var ids []string
+	for i := 0; i < 20; i++ {
+		result, err := coll.InsertOne(M{"n": i, "g": i % 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, result.InsertedID)
+	}
+	if _, err := coll.Indexes().CreateOne(IndexModel{Keys: D{{Key: "g", Value: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		filter       M
+		opts         *FindOptions
+		wantPlan     PlanType
+		wantExamined int64
+		wantReturned int64
+	}{
+		{name: "id", filter: M{"_id": ids[3]}, wantPlan: PlanIDLookup, wantExamined: 1, wantReturned: 1},
+		{name: "missing id", filter: M{"_id": "nope"}, wantPlan: PlanIDLookup, wantExamined: 0, wantReturned: 0},
+		{name: "ids and a condition", filter: M{"_id": M{"$in": []string{ids[1], ids[2], "nope"}}, "n": 2},
+			wantPlan: PlanIDLookup, wantExamined: 2, wantReturned: 1},
+		{name: "index", filter: M{"g": 1}, wantPlan: PlanIndexScan, wantExamined: 5, wantReturned: 5},
+		{name: "index and a condition", filter: M{"g": 1, "n": M{"$gt": 10}}, wantPlan: PlanIndexScan, wantExamined: 5, wantReturned: 2},
+		{name: "unindexed field", filter: M{"n": 1}, wantPlan: PlanCollectionScan, wantExamined: 20, wantReturned: 1},
+		{name: "everything", filter: M{}, wantPlan: PlanCollectionScan, wantExamined: 20, wantReturned: 20},
+		{name: "skip and limit pushed down", filter: M{}, opts: NewFindOptions().SetSkip(2).SetLimit(3),
+			wantPlan: PlanCollectionScan, wantExamined: 3, wantReturned: 3},
+		{name: "index with limit in batches", filter: M{"g": 2}, opts: NewFindOptions().SetLimit(2).SetBatchSize(2),
+			wantPlan: PlanIndexScan, wantExamined: 2, wantReturned: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts == nil {
+				opts = NewFindOptions()
+			}
+			result, err := coll.Explain(tt.filter, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Plan != tt.wantPlan || result.DocsExamined != tt.wantExamined || result.DocsReturned != tt.wantReturned {
+				t.Errorf("got %s examining %d and returning %d; want %s examining %d and returning %d",
+					result.Plan, result.DocsExamined, result.DocsReturned, tt.wantPlan, tt.wantExamined, tt.wantReturned)
+			}
+			if (result.IndexName != "") != (tt.wantPlan == PlanIndexScan) {
+				t.Errorf("index name %q for a %s", result.IndexName, result.Plan)
+			}
+		})
+	}
+}
+
+func TestWritesUsePlanner(t *testing.T) {
+	var ids []string
+	tests := []struct {
+		name  string
+		write func(c *Collection) (int64, error)
+		want  int64
+	}{
+		{name: "count by ids", want: 4, write: func(c *Collection) (int64, error) {
+			return c.CountDocuments(M{"_id": M{"$in": ids[:4]}})
+		}},
+		{name: "update by index", want: 5, write: func(c *Collection) (int64, error) {
+			r, err := c.UpdateMany(M{"g": 2}, M{"$inc": M{"n": 100}})
+			if err != nil {
+				return 0, err
+			}
+			return r.ModifiedCount, nil
+		}},
+		{name: "delete by ids", want: 4, write: func(c *Collection) (int64, error) {
+			r, err := c.DeleteMany(M{"_id": M{"$in": ids[:4]}})
+			if err != nil {
+				return 0, err
+			}
+			return r.DeletedCount, nil
+		}},
+		{name: "delete one by index", want: 1, write: func(c *Collection) (int64, error) {
+			r, err := c.DeleteOne(M{"g": 3})
+			if err != nil {
+				return 0, err
+			}
+			return r.DeletedCount, nil
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newScanCountingEngine()
+			coll := newMemoryClient(t, engine).Database().Collection("c")
+			ids = ids[:0]
+			for i := 0; i < 20; i++ {
+				result, err := coll.InsertOne(M{"n": i, "g": i % 4})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, result.InsertedID)
+			}
+			if _, err := coll.Indexes().CreateOne(IndexModel{Keys: D{{Key: "g", Value: 1}}}); err != nil {
+				t.Fatal(err)
+			}
+			engine.scanned = map[string]int{}
+
+			got, err := tt.write(coll)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("affected %d documents, want %d", got, tt.want)
+			}
+			if n := engine.scanned["c"]; n != 0 {
+				t.Errorf("scanned %d documents, want none", n)
+			}
+		})
+	}
+}
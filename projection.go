@@ -0,0 +1,186 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ============================================================================
+// Projection
+// ============================================================================
+
+// projection is a validated projection specification. A field may be a
+// dot-notation path, which reaches into subdocuments and into the
+// subdocuments of arrays.
+type projection struct {
+	fields    []string
+	include   bool // true for an inclusion projection, false for exclusion
+	excludeID bool
+}
+
+// parseProjection validates a projection specification. Inclusion and
+// exclusion cannot be mixed, except that _id may always be excluded, and no
+// path may lie inside another.
+func parseProjection(spec M) (*projection, error) {
+	if len(spec) == 0 {
+		return nil, nil
+	}
+
+	p := &projection{}
+	mode := 0 // 0 unknown, 1 include, -1 exclude
+	for _, field := range sortedKeys(spec) {
+		value := spec[field]
+		var on bool
+		switch v := value.(type) {
+		case bool:
+			on = v
+		default:
+			n, ok := toFloat(value)
+			if !ok {
+				return nil, fmt.Errorf("invalid projection value for %q", field)
+			}
+			on = n != 0
+		}
+
+		if field == "_id" {
+			p.excludeID = !on
+			continue
+		}
+		if slices.Contains(strings.Split(field, "."), "") {
+			return nil, fmt.Errorf("invalid projection path %q", field)
+		}
+
+		fieldMode := -1
+		if on {
+			fieldMode = 1
+		}
+		if mode != 0 && mode != fieldMode {
+			return nil, errors.New("cannot mix inclusion and exclusion in projection")
+		}
+		mode = fieldMode
+		p.fields = append(p.fields, field)
+	}
+
+	// Sorted, a path directly follows any path it lies inside
+	for i := 1; i < len(p.fields); i++ {
+		if strings.HasPrefix(p.fields[i], p.fields[i-1]+".") {
+			return nil, fmt.Errorf("projection paths %q and %q collide", p.fields[i-1], p.fields[i])
+		}
+	}
+
+	// {_id: 1} alone includes just the _id
+	p.include = mode == 1 || mode == 0 && !p.excludeID
+	return p, nil
+}
+
+// apply returns a copy of doc restricted by the projection
+func (p *projection) apply(doc Document) Document {
+	if p == nil {
+		return doc
+	}
+
+	result := make(Document)
+	if p.include {
+		for _, field := range p.fields {
+			includePath(result, doc, strings.Split(field, "."))
+		}
+		if id, ok := doc["_id"]; ok && !p.excludeID {
+			result["_id"] = id
+		}
+		return result
+	}
+
+	for k, v := range doc {
+		result[k] = v
+	}
+	for _, field := range p.fields {
+		excludePath(result, strings.Split(field, "."))
+	}
+	if p.excludeID {
+		delete(result, "_id")
+	}
+	return result
+}
+
+// includePath copies the value at path from src into dst. Along the way a
+// subdocument becomes a subdocument holding only the included fields, and
+// an array the subdocuments among its elements, as in MongoDB.
+func includePath(dst, src map[string]interface{}, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+
+	if m, ok := asMap(v); ok {
+		sub, _ := dst[path[0]].(map[string]interface{})
+		if sub == nil {
+			sub = map[string]interface{}{}
+			dst[path[0]] = sub
+		}
+		includePath(sub, m, path[1:])
+		return
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return
+	}
+	var elems []map[string]interface{}
+	for _, elem := range arr {
+		if m, ok := asMap(elem); ok {
+			elems = append(elems, m)
+		}
+	}
+	// Another path through the same array has already made its elements
+	out, _ := dst[path[0]].([]interface{})
+	if out == nil {
+		out = make([]interface{}, len(elems))
+		for i := range out {
+			out[i] = map[string]interface{}{}
+		}
+		dst[path[0]] = out
+	}
+	for i, elem := range elems {
+		includePath(out[i].(map[string]interface{}), elem, path[1:])
+	}
+}
+
+// excludePath removes the value at path from doc. The subdocuments and
+// arrays along the path are copied rather than modified.
+func excludePath(doc map[string]interface{}, path []string) {
+	v, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		delete(doc, path[0])
+		return
+	}
+
+	if m, ok := asMap(v); ok {
+		sub := maps.Clone(m)
+		excludePath(sub, path[1:])
+		doc[path[0]] = sub
+		return
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return
+	}
+	out := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		out[i] = elem
+		if m, ok := asMap(elem); ok {
+			sub := maps.Clone(m)
+			excludePath(sub, path[1:])
+			out[i] = sub
+		}
+	}
+	doc[path[0]] = out
+}
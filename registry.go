@@ -0,0 +1,145 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ============================================================================
+// Registry
+// ============================================================================
+
+// EncoderFunc converts a value of a registered type to a document value. It
+// should return nil, a bool, a string, a number, a time.Time, a []byte, a
+// Decimal, a []interface{}, a map[string]interface{} or a D; any other
+// result is encoded in turn.
+type EncoderFunc func(v reflect.Value) (interface{}, error)
+
+// DecoderFunc stores a document value into dst, a settable value of the
+// registered type. src is nil, a bool, a string, a float64, an int64, a
+// json.Number, a time.Time, a []byte, a Decimal, a []interface{} or a
+// map[string]interface{}.
+type DecoderFunc func(src interface{}, dst reflect.Value) error
+
+// Registry holds custom encoders and decoders for Go types. A Client uses
+// its registry to encode inserted documents, replacements and $set values,
+// and to decode results in SingleResult.Decode, Cursor.Decode and
+// TypedCollection. A type without a registered codec falls back to its
+// json.Marshaler and json.Unmarshaler methods, if any, and otherwise to
+// the default struct mapping.
+//
+// Register codecs before the registry is used; registration is safe for
+// concurrent use, but changing a codec while operations run gives
+// unpredictable results.
+type Registry struct {
+	mu       sync.RWMutex
+	encoders map[reflect.Type]EncoderFunc
+	decoders map[reflect.Type]DecoderFunc
+}
+
+// DefaultRegistry is used by clients created without SetRegistry
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		encoders: map[reflect.Type]EncoderFunc{},
+		decoders: map[reflect.Type]DecoderFunc{},
+	}
+}
+
+// RegisterTypeEncoder sets the encoder for values of type t
+func (r *Registry) RegisterTypeEncoder(t reflect.Type, enc EncoderFunc) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.encoders[t] = enc
+	return r
+}
+
+// RegisterTypeDecoder sets the decoder for values of type t
+func (r *Registry) RegisterTypeDecoder(t reflect.Type, dec DecoderFunc) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decoders[t] = dec
+	return r
+}
+
+// RegisterEncoder sets the encoder for values of type T
+func RegisterEncoder[T any](r *Registry, enc func(v T) (interface{}, error)) {
+	r.RegisterTypeEncoder(reflect.TypeFor[T](), func(v reflect.Value) (interface{}, error) {
+		return enc(v.Interface().(T))
+	})
+}
+
+// RegisterDecoder sets the decoder for values of type T
+func RegisterDecoder[T any](r *Registry, dec func(src interface{}) (T, error)) {
+	r.RegisterTypeDecoder(reflect.TypeFor[T](), func(src interface{}, dst reflect.Value) error {
+		v, err := dec(src)
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(&v).Elem())
+		return nil
+	})
+}
+
+func (r *Registry) encoder(t reflect.Type) EncoderFunc {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.encoders[t]
+}
+
+func (r *Registry) decoder(t reflect.Type) DecoderFunc {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.decoders[t]
+}
+
+// encodeDocument converts a document given as a struct, a map, an M or a D
+// to a map, applying registered encoders
+func (r *Registry) encodeDocument(doc interface{}) (map[string]interface{}, error) {
+	v, err := r.encodeValue(reflect.ValueOf(doc))
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return x, nil
+	case D:
+		return x.Map(), nil
+	}
+	return nil, fmt.Errorf("document must be a struct or a map, not %T", doc)
+}
+
+// encodeOrdered is like encodeDocument but keeps the field order of a D or
+// a struct. The keys of a map are sorted.
+func (r *Registry) encodeOrdered(doc interface{}) (D, error) {
+	v, err := r.encodeValue(reflect.ValueOf(doc))
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return orderMap(x, nil), nil
+	case D:
+		return x, nil
+	}
+	return nil, fmt.Errorf("document must be a struct or a map, not %T", doc)
+}
+
+// decodeDocument stores a document into v, which must be a non-nil pointer
+func (r *Registry) decodeDocument(doc Document, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+	return r.decodeValue(map[string]interface{}(doc), rv.Elem())
+}
@@ -0,0 +1,483 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"unicode/utf8"
+)
+
+// ============================================================================
+// $jsonSchema
+// ============================================================================
+
+// schemaCheck is a compiled JSON Schema applied to a single value
+type schemaCheck func(v interface{}) bool
+
+// jsonSchemaTypes maps JSON Schema "type" names to MongoDB type codes
+var jsonSchemaTypes = map[string]int{
+	"object":  3,
+	"array":   4,
+	"string":  2,
+	"boolean": 8,
+	"null":    10,
+	"number":  typeNumber,
+}
+
+// compileSchema compiles the $jsonSchema subset MongoDB supports (draft 4
+// plus bsonType). Like JSON Schema, keywords that constrain one type, such
+// as minLength, pass values of any other type.
+func compileSchema(schema map[string]interface{}) (schemaCheck, error) {
+	var checks []schemaCheck
+	add := func(c schemaCheck) { checks = append(checks, c) }
+
+	for keyword, arg := range schema {
+		arg = normalizeLiteral(arg)
+		switch keyword {
+		case "title", "description":
+			continue
+
+		case "bsonType":
+			types, err := parseTypeList(arg)
+			if err != nil {
+				return nil, err
+			}
+			add(func(v interface{}) bool { return hasType(v, types) })
+
+		case "type":
+			names, ok := arg.([]interface{})
+			if !ok {
+				names = []interface{}{arg}
+			}
+			types := make([]int, 0, len(names))
+			for _, n := range names {
+				s, _ := n.(string)
+				code, ok := jsonSchemaTypes[s]
+				if !ok {
+					return nil, fmt.Errorf("unsupported $jsonSchema type: %v", n)
+				}
+				types = append(types, code)
+			}
+			add(func(v interface{}) bool { return hasType(v, types) })
+
+		case "enum":
+			values, ok := arg.([]interface{})
+			if !ok || len(values) == 0 {
+				return nil, errors.New("$jsonSchema enum must be a non-empty array")
+			}
+			add(func(v interface{}) bool {
+				for _, want := range values {
+					if valuesEqual(v, want) {
+						return true
+					}
+				}
+				return false
+			})
+
+		case "required":
+			names, err := schemaStrings(keyword, arg)
+			if err != nil {
+				return nil, err
+			}
+			add(func(v interface{}) bool {
+				m, ok := asMap(v)
+				if !ok {
+					return true
+				}
+				for _, name := range names {
+					if _, ok := m[name]; !ok {
+						return false
+					}
+				}
+				return true
+			})
+
+		case "properties", "patternProperties":
+			m, err := compileSchemaMap(keyword, arg)
+			if err != nil {
+				return nil, err
+			}
+			if keyword == "properties" {
+				add(func(v interface{}) bool {
+					obj, ok := asMap(v)
+					if !ok {
+						return true
+					}
+					for name, check := range m {
+						if val, ok := obj[name]; ok && !check(val) {
+							return false
+						}
+					}
+					return true
+				})
+				continue
+			}
+			patterns := make(map[*regexp.Regexp]schemaCheck, len(m))
+			for p, check := range m {
+				re, err := regexp.Compile(p)
+				if err != nil {
+					return nil, fmt.Errorf("invalid $jsonSchema patternProperties: %w", err)
+				}
+				patterns[re] = check
+			}
+			add(func(v interface{}) bool {
+				obj, ok := asMap(v)
+				if !ok {
+					return true
+				}
+				for name, val := range obj {
+					for re, check := range patterns {
+						if re.MatchString(name) && !check(val) {
+							return false
+						}
+					}
+				}
+				return true
+			})
+
+		case "additionalProperties":
+			extra, err := compileSchemaOrBool(keyword, arg)
+			if err != nil {
+				return nil, err
+			}
+			known, _ := asMap(normalizeLiteral(schema["properties"]))
+			var patterns []*regexp.Regexp
+			if pp, ok := asMap(normalizeLiteral(schema["patternProperties"])); ok {
+				for p := range pp {
+					if re, err := regexp.Compile(p); err == nil {
+						patterns = append(patterns, re)
+					}
+				}
+			}
+			add(func(v interface{}) bool {
+				obj, ok := asMap(v)
+				if !ok {
+					return true
+				}
+			next:
+				for name, val := range obj {
+					if _, ok := known[name]; ok {
+						continue
+					}
+					for _, re := range patterns {
+						if re.MatchString(name) {
+							continue next
+						}
+					}
+					if !extra(val) {
+						return false
+					}
+				}
+				return true
+			})
+
+		case "minProperties", "maxProperties":
+			n, err := schemaCount(keyword, arg)
+			if err != nil {
+				return nil, err
+			}
+			isMin := keyword == "minProperties"
+			add(func(v interface{}) bool {
+				obj, ok := asMap(v)
+				if !ok {
+					return true
+				}
+				if isMin {
+					return len(obj) >= n
+				}
+				return len(obj) <= n
+			})
+
+		case "minimum", "maximum":
+			limit, ok := toFloat(arg)
+			if !ok {
+				return nil, fmt.Errorf("$jsonSchema %s must be a number", keyword)
+			}
+			isMin := keyword == "minimum"
+			exclusive := false
+			if isMin {
+				exclusive = isTruthy(schema["exclusiveMinimum"])
+			} else {
+				exclusive = isTruthy(schema["exclusiveMaximum"])
+			}
+			add(func(v interface{}) bool {
+				n, ok := toFloat(v)
+				if !ok {
+					return true
+				}
+				switch {
+				case isMin && exclusive:
+					return n > limit
+				case isMin:
+					return n >= limit
+				case exclusive:
+					return n < limit
+				}
+				return n <= limit
+			})
+
+		case "exclusiveMinimum", "exclusiveMaximum":
+			if _, ok := arg.(bool); !ok {
+				return nil, fmt.Errorf("$jsonSchema %s must be a boolean", keyword)
+			}
+
+		case "multipleOf":
+			d, ok := toFloat(arg)
+			if !ok || d <= 0 {
+				return nil, errors.New("$jsonSchema multipleOf must be a positive number")
+			}
+			add(func(v interface{}) bool {
+				n, ok := toFloat(v)
+				return !ok || math.Mod(n, d) == 0
+			})
+
+		case "minLength", "maxLength":
+			n, err := schemaCount(keyword, arg)
+			if err != nil {
+				return nil, err
+			}
+			isMin := keyword == "minLength"
+			add(func(v interface{}) bool {
+				s, ok := v.(string)
+				if !ok {
+					return true
+				}
+				if isMin {
+					return utf8.RuneCountInString(s) >= n
+				}
+				return utf8.RuneCountInString(s) <= n
+			})
+
+		case "pattern":
+			p, ok := arg.(string)
+			if !ok {
+				return nil, errors.New("$jsonSchema pattern must be a string")
+			}
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid $jsonSchema pattern: %w", err)
+			}
+			add(func(v interface{}) bool {
+				s, ok := v.(string)
+				return !ok || re.MatchString(s)
+			})
+
+		case "items":
+			if list, ok := arg.([]interface{}); ok {
+				tuple := make([]schemaCheck, len(list))
+				for i, item := range list {
+					sub, ok := asMap(item)
+					if !ok {
+						return nil, errors.New("$jsonSchema items must be schemas")
+					}
+					check, err := compileSchema(sub)
+					if err != nil {
+						return nil, err
+					}
+					tuple[i] = check
+				}
+				extra := func(interface{}) bool { return true }
+				if ai, ok := schema["additionalItems"]; ok {
+					c, err := compileSchemaOrBool("additionalItems", normalizeLiteral(ai))
+					if err != nil {
+						return nil, err
+					}
+					extra = c
+				}
+				add(func(v interface{}) bool {
+					arr, ok := v.([]interface{})
+					if !ok {
+						return true
+					}
+					for i, elem := range arr {
+						if i < len(tuple) && !tuple[i](elem) {
+							return false
+						}
+						if i >= len(tuple) && !extra(elem) {
+							return false
+						}
+					}
+					return true
+				})
+				continue
+			}
+			sub, ok := asMap(arg)
+			if !ok {
+				return nil, errors.New("$jsonSchema items must be a schema or an array of schemas")
+			}
+			check, err := compileSchema(sub)
+			if err != nil {
+				return nil, err
+			}
+			add(func(v interface{}) bool {
+				arr, ok := v.([]interface{})
+				if !ok {
+					return true
+				}
+				for _, elem := range arr {
+					if !check(elem) {
+						return false
+					}
+				}
+				return true
+			})
+
+		case "additionalItems":
+			// Applied together with a tuple "items"
+			if _, err := compileSchemaOrBool(keyword, arg); err != nil {
+				return nil, err
+			}
+
+		case "minItems", "maxItems":
+			n, err := schemaCount(keyword, arg)
+			if err != nil {
+				return nil, err
+			}
+			isMin := keyword == "minItems"
+			add(func(v interface{}) bool {
+				arr, ok := v.([]interface{})
+				if !ok {
+					return true
+				}
+				if isMin {
+					return len(arr) >= n
+				}
+				return len(arr) <= n
+			})
+
+		case "uniqueItems":
+			if !isTruthy(arg) {
+				continue
+			}
+			add(func(v interface{}) bool {
+				arr, ok := v.([]interface{})
+				if !ok {
+					return true
+				}
+				for i := range arr {
+					for j := i + 1; j < len(arr); j++ {
+						if valuesEqual(arr[i], arr[j]) {
+							return false
+						}
+					}
+				}
+				return true
+			})
+
+		case "allOf", "anyOf", "oneOf":
+			list, ok := arg.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("$jsonSchema %s must be a non-empty array", keyword)
+			}
+			subs := make([]schemaCheck, len(list))
+			for i, item := range list {
+				sub, ok := asMap(item)
+				if !ok {
+					return nil, fmt.Errorf("$jsonSchema %s entries must be schemas", keyword)
+				}
+				check, err := compileSchema(sub)
+				if err != nil {
+					return nil, err
+				}
+				subs[i] = check
+			}
+			kw := keyword
+			add(func(v interface{}) bool {
+				passed := 0
+				for _, check := range subs {
+					if check(v) {
+						passed++
+					}
+				}
+				switch kw {
+				case "allOf":
+					return passed == len(subs)
+				case "anyOf":
+					return passed > 0
+				}
+				return passed == 1
+			})
+
+		case "not":
+			sub, ok := asMap(arg)
+			if !ok {
+				return nil, errors.New("$jsonSchema not must be a schema")
+			}
+			check, err := compileSchema(sub)
+			if err != nil {
+				return nil, err
+			}
+			add(func(v interface{}) bool { return !check(v) })
+
+		default:
+			return nil, fmt.Errorf("unsupported $jsonSchema keyword: %s", keyword)
+		}
+	}
+
+	return func(v interface{}) bool {
+		for _, check := range checks {
+			if !check(v) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileSchemaMap compiles a document of named subschemas
+func compileSchemaMap(keyword string, arg interface{}) (map[string]schemaCheck, error) {
+	m, ok := asMap(arg)
+	if !ok {
+		return nil, fmt.Errorf("$jsonSchema %s must be a document", keyword)
+	}
+	out := make(map[string]schemaCheck, len(m))
+	for name, v := range m {
+		sub, ok := asMap(v)
+		if !ok {
+			return nil, fmt.Errorf("$jsonSchema %s.%s must be a schema", keyword, name)
+		}
+		check, err := compileSchema(sub)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = check
+	}
+	return out, nil
+}
+
+// compileSchemaOrBool compiles a keyword that takes a schema or a boolean
+func compileSchemaOrBool(keyword string, arg interface{}) (schemaCheck, error) {
+	if b, ok := arg.(bool); ok {
+		return func(interface{}) bool { return b }, nil
+	}
+	sub, ok := asMap(arg)
+	if !ok {
+		return nil, fmt.Errorf("$jsonSchema %s must be a boolean or a schema", keyword)
+	}
+	return compileSchema(sub)
+}
+
+func schemaStrings(keyword string, arg interface{}) ([]string, error) {
+	list, ok := arg.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("$jsonSchema %s must be an array of strings", keyword)
+	}
+	out := make([]string, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("$jsonSchema %s must be an array of strings", keyword)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func schemaCount(keyword string, arg interface{}) (int, error) {
+	n, ok := toFloat(arg)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("$jsonSchema %s must be a non-negative integer", keyword)
+	}
+	return int(n), nil
+}
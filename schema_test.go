@@ -0,0 +1,44 @@
+package keradb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONSchema(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("people")
+	_, err := coll.InsertMany([]interface{}{
+		M{"n": "alice", "age": 30, "email": "alice@example.com", "tags": []string{"a", "b"}},
+		M{"n": "bob", "age": 41.5, "email": "bob"},
+		M{"n": "carol", "age": "n/a", "address": M{"city": "Rome"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		schema M
+		want   []string
+	}{
+		{name: "required", schema: M{"required": []string{"tags"}}, want: []string{"alice"}},
+		{name: "bsonType number", schema: M{"properties": M{"age": M{"bsonType": "number"}}}, want: []string{"alice", "bob"}},
+		{name: "bsonType int matches a whole number", schema: M{"properties": M{"age": M{"bsonType": "int"}}}, want: []string{"alice"}},
+		{name: "bsonType list", schema: M{"properties": M{"age": M{"bsonType": []string{"int", "string"}}}}, want: []string{"alice", "carol"}},
+		{name: "type", schema: M{"properties": M{"age": M{"type": "string"}}}, want: []string{"carol"}},
+		{name: "minimum skips other types", schema: M{"properties": M{"age": M{"minimum": 35}}}, want: []string{"bob", "carol"}},
+		{name: "pattern", schema: M{"properties": M{"email": M{"pattern": "@"}}}, want: []string{"alice", "carol"}},
+		{name: "enum", schema: M{"properties": M{"n": M{"enum": []string{"bob", "carol"}}}}, want: []string{"bob", "carol"}},
+		{name: "nested object", schema: M{"properties": M{"address": M{"required": []string{"zip"}}}}, want: []string{"alice", "bob"}},
+		{name: "array items", schema: M{"properties": M{"tags": M{"items": M{"bsonType": "string"}, "minItems": 2}}}, want: []string{"alice", "bob", "carol"}},
+		{name: "additionalProperties", schema: M{"properties": M{"_id": M{}, "n": M{}, "age": M{}, "email": M{}}, "additionalProperties": false}, want: []string{"bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchingNames(t, coll, M{"$jsonSchema": tt.schema})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
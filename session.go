@@ -0,0 +1,933 @@
+package keradb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Sessions and Transactions
+// ============================================================================
+
+// A transaction buffers the writes of the operations run inside it and
+// applies them together when it commits. Operations join a transaction
+// through their context: within Session.WithTransaction, every Collection
+// method given the context passed to the callback reads and writes through
+// the transaction. Its reads see its own writes; other clients and
+// operations outside it see none of them until the commit. A collection the
+// transaction scans is read from the engine once, and later scans see that
+// snapshot with the transaction's writes applied.
+//
+// Conflicts are detected optimistically. The transaction remembers each
+// document as it first read it, and the commit fails with ErrWriteConflict
+// if a document it writes has since been changed by someone else.
+// WithTransaction then runs the callback again, after a random delay that
+// grows with each attempt.
+//
+// Reads outside a transaction hold the database's view lock shared while
+// they read from the engine, and a commit holds it exclusively while it
+// checks for conflicts and applies its writes. A single-document read of
+// the same client, such as FindOne, therefore sees all of a commit or none
+// of it. A cursor takes the lock for each batch it reads, so one whose
+// results span several batches can see a commit land between two of them.
+//
+// Vector operations and index management are not transactional; they act
+// on the database directly even inside a transaction.
+
+// maxTransactionAttempts bounds how often WithTransaction runs a
+// transaction that keeps failing with a write conflict
+const maxTransactionAttempts = 10
+
+// Between attempts WithTransaction waits a random time up to a limit that
+// starts at minTransactionBackoff and doubles with each attempt, up to
+// maxTransactionBackoff, so that conflicting transactions drift apart
+const (
+	minTransactionBackoff = time.Millisecond
+	maxTransactionBackoff = 100 * time.Millisecond
+)
+
+var (
+	errSessionEnded     = errors.New("session has ended")
+	errTransactionBusy  = errors.New("transaction already in progress")
+	errTransactionEnded = errors.New("transaction has already been committed or aborted")
+)
+
+// Session runs transactions on a Client. A session runs one transaction at
+// a time.
+type Session struct {
+	client *Client
+
+	mu     sync.Mutex
+	active bool
+	ended  bool
+}
+
+// StartSession starts a session
+func (c *Client) StartSession() (*Session, error) {
+	if c.engine.isClosed() {
+		return nil, ErrClosed
+	}
+	return &Session{client: c}, nil
+}
+
+// EndSession ends the session. A transaction in progress runs to
+// completion; no new one can start.
+func (s *Session) EndSession(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+}
+
+// WithTransaction runs fn in a transaction and commits it. Operations inside
+// fn join the transaction by being given the ctx passed to fn. If fn
+// returns an error the transaction is discarded and the error returned. If
+// the commit fails with ErrWriteConflict, fn is run again in a new
+// transaction after a short random delay, up to maxTransactionAttempts
+// times in all or until ctx is done; fn should therefore have no side
+// effects outside the transaction.
+//
+// The commit applies every buffered write or, if the engine fails part way,
+// undoes those it made. Reads and writes of the same client wait while it
+// runs, so a single-document read sees all of its writes or none; a cursor
+// reading several batches can see some batches from before the commit and
+// some from after. Other clients of the same database do not wait and can
+// see a commit half done, as can the database after the process crashes
+// part way through.
+func (s *Session) WithTransaction(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	switch {
+	case s.ended:
+		s.mu.Unlock()
+		return nil, errSessionEnded
+	case s.active:
+		s.mu.Unlock()
+		return nil, errTransactionBusy
+	}
+	s.active = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active = false
+		s.mu.Unlock()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		result, err := s.runTransaction(ctx, fn)
+		if err == nil {
+			return result, nil
+		}
+		if !errors.Is(err, ErrWriteConflict) || attempt+1 >= maxTransactionAttempts {
+			return nil, err
+		}
+		if err := sleepContext(ctx, transactionBackoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// transactionBackoff returns a random delay before retrying a transaction
+// that has failed attempt+1 times
+func transactionBackoff(attempt int) time.Duration {
+	limit := maxTransactionBackoff
+	if attempt < 10 {
+		limit = min(minTransactionBackoff<<attempt, maxTransactionBackoff)
+	}
+	return time.Duration(rand.Int64N(int64(limit) + 1))
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runTransaction makes one attempt at a transaction
+func (s *Session) runTransaction(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	t := newTransaction(s.client)
+	defer t.abort()
+
+	result, err := fn(context.WithValue(ctx, transactionKey{}, t))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.commit(); err != nil {
+		return nil, err
+	}
+	t.resolveIDs()
+	return result, nil
+}
+
+// transactionKey is the context key of the transaction an operation joins
+type transactionKey struct{}
+
+// forContext returns the view of c that reads and writes through the
+// transaction of ctx, or c itself outside a transaction. A transaction of
+// another client is ignored.
+func (c *Collection) forContext(ctx context.Context) *Collection {
+	t, ok := ctx.Value(transactionKey{}).(*transaction)
+	if !ok || c.engine != t.base {
+		return c
+	}
+	view := *c
+	view.engine = t
+	view.indexes = nil // unique indexes are checked when the transaction commits
+	view.writeMu = &t.writeMu
+	view.view = nil    // the transaction locks the view for its own reads
+	view.changes = nil // changes are logged when the transaction commits
+	return &view
+}
+
+// finalID arranges for set to be called with the ID the engine assigns at
+// commit to a document this collection inserted with a provisional ID. It
+// does nothing for an ID that is already final.
+func (c *Collection) finalID(id string, set func(id string)) {
+	if t, ok := c.engine.(*transaction); ok {
+		t.onFinalID(c.name, id, set)
+	}
+}
+
+// markReplaced notes that this collection's write to id replaced the
+// document, so that a transaction logs the change as a replacement when it
+// commits. Outside a transaction it does nothing.
+func (c *Collection) markReplaced(id string) {
+	if t, ok := c.engine.(*transaction); ok {
+		t.markReplaced(c.name, id)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Transaction
+// ----------------------------------------------------------------------------
+
+// transaction is an Engine layered over the client's engine. It passes
+// reads through, recording the version of each document it sees, and keeps
+// writes in memory until commit.
+type transaction struct {
+	db      *Database
+	base    Engine
+	writeMu sync.Mutex // serializes read-modify-write operations inside the transaction
+
+	mu       sync.Mutex
+	done     bool
+	colls    map[string]*txnCollection
+	names    []string // collections in the order the transaction first used them
+	pending  []pendingID
+	resolved map[string]map[string]string // final IDs of provisional inserts by collection, after commit
+}
+
+// txnCollection is the state of a transaction in one collection
+type txnCollection struct {
+	seen        map[string][]byte // each document as first read from the engine, nil if absent
+	writes      map[string][]byte // each buffered version, nil if deleted
+	order       []string          // written IDs in the order of their first write
+	provisional map[string]bool   // inserted IDs the engine replaces at commit
+	replaced    map[string]bool   // IDs written by a replacement rather than an update
+
+	// The documents visible to the transaction, built by the first scan and
+	// kept up to date by its writes; nil until then. A deleted document
+	// leaves a nil hole in view until the next scan closes it.
+	view    []json.RawMessage
+	viewIDs []string       // the _id of each entry of view
+	viewPos map[string]int // position in view of each document
+	holes   int            // entries of view deleted since the last scan
+}
+
+// txnWrite is a buffered change to one document. A nil version means the
+// document is absent.
+type txnWrite struct {
+	id            string
+	before, after []byte
+	provisional   bool // an insert whose ID the engine chooses
+	replace       bool // a replacement, logged as such for change streams
+}
+
+// pendingID is a request for the final ID of a provisional insert
+type pendingID struct {
+	collection, id string
+	set            func(id string)
+}
+
+func newTransaction(c *Client) *transaction {
+	return &transaction{
+		db:    c.database,
+		base:  c.database.engine,
+		colls: map[string]*txnCollection{},
+	}
+}
+
+// collection returns the state for name, creating it. The caller holds t.mu.
+func (t *transaction) collection(name string) *txnCollection {
+	tc, ok := t.colls[name]
+	if !ok {
+		tc = &txnCollection{seen: map[string][]byte{}, writes: map[string][]byte{}, provisional: map[string]bool{}, replaced: map[string]bool{}}
+		t.colls[name] = tc
+		t.names = append(t.names, name)
+	}
+	return tc
+}
+
+// current returns a document as the transaction sees it, reading it from
+// the engine if the transaction has not written it. The caller holds t.mu.
+func (t *transaction) current(name, id string) ([]byte, error) {
+	tc := t.collection(name)
+	if doc, ok := tc.writes[id]; ok {
+		return doc, nil
+	}
+	if doc, ok := tc.seen[id]; ok {
+		return doc, nil
+	}
+	defer rlock(t.db.view)()
+	doc, err := t.base.FindByID(name, id)
+	if err != nil {
+		return nil, err
+	}
+	tc.seen[id] = doc
+	return doc, nil
+}
+
+// write buffers a new version of a document. The caller holds t.mu and has
+// read the document with current.
+func (t *transaction) write(name, id string, doc []byte) {
+	tc := t.collection(name)
+	if _, ok := tc.writes[id]; !ok {
+		tc.order = append(tc.order, id)
+	}
+	tc.writes[id] = doc
+
+	if tc.view == nil {
+		return
+	}
+	i, listed := tc.viewPos[id]
+	switch {
+	case listed && doc != nil:
+		tc.view[i] = doc
+	case listed:
+		// Closing the hole now would renumber every later document, which
+		// makes deleting many documents quadratic
+		tc.view[i] = nil
+		delete(tc.viewPos, id)
+		tc.holes++
+	case doc != nil:
+		tc.viewPos[id] = len(tc.view)
+		tc.view = append(tc.view, doc)
+		tc.viewIDs = append(tc.viewIDs, id)
+	}
+}
+
+// compact closes the holes deleted documents left in the view; later
+// documents move up, as in an engine
+func (tc *txnCollection) compact() {
+	if tc.holes == 0 {
+		return
+	}
+	n := 0
+	for i, doc := range tc.view {
+		if doc == nil {
+			continue
+		}
+		tc.view[n], tc.viewIDs[n] = doc, tc.viewIDs[i]
+		tc.viewPos[tc.viewIDs[n]] = n
+		n++
+	}
+	clear(tc.view[n:])
+	tc.view, tc.viewIDs = tc.view[:n], tc.viewIDs[:n]
+	tc.holes = 0
+}
+
+// visible returns the documents of a collection as the transaction sees
+// them: the engine's documents in order with the buffered writes applied,
+// followed by the documents the transaction inserted. The engine is read
+// once per collection; the caller holds t.mu and must not modify the
+// result.
+func (t *transaction) visible(name string) ([]json.RawMessage, error) {
+	tc := t.collection(name)
+	if tc.view != nil {
+		tc.compact()
+		return tc.view, nil
+	}
+
+	unlock := rlock(t.db.view)
+	data, err := t.base.FindAll(name, -1, 0)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	var stored []json.RawMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	docs := make([]json.RawMessage, 0, len(stored))
+	ids := make([]string, 0, len(stored))
+	pos := make(map[string]int, len(stored))
+	for _, raw := range stored {
+		id, err := storedID(raw)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tc.seen[id]; !ok {
+			tc.seen[id] = raw
+		}
+		doc, written := tc.writes[id]
+		if !written {
+			doc = raw
+		}
+		if doc != nil {
+			pos[id] = len(docs)
+			docs = append(docs, doc)
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range tc.order {
+		if _, listed := pos[id]; !listed {
+			if doc := tc.writes[id]; doc != nil {
+				pos[id] = len(docs)
+				docs = append(docs, doc)
+				ids = append(ids, id)
+			}
+		}
+	}
+	tc.view, tc.viewIDs, tc.viewPos = docs, ids, pos
+	return docs, nil
+}
+
+// storedID reads the _id of a stored document
+func storedID(doc []byte) (string, error) {
+	var v struct {
+		ID string `json:"_id"`
+	}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return "", err
+	}
+	return v.ID, nil
+}
+
+// begin locks the transaction for an operation and fails if it has ended.
+// On success the caller must unlock t.mu.
+func (t *transaction) begin() error {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return errTransactionEnded
+	}
+	return nil
+}
+
+// Insert buffers a new document. A document without an _id, which outside
+// a transaction would be given one by the engine, gets a provisional ID
+// that the transaction uses until it commits; the commit inserts the
+// document without it and takes the engine's ID instead.
+func (t *transaction) Insert(collection string, doc []byte) (string, error) {
+	fields, err := splitObject(doc)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	for _, f := range fields {
+		if f.Key == "_id" && string(f.Value) != "null" {
+			if err := json.Unmarshal(f.Value, &id); err != nil {
+				return "", errors.New("_id must be a string")
+			}
+		}
+	}
+	provisional := id == ""
+	if provisional {
+		id = newUUID()
+	}
+
+	if err := t.begin(); err != nil {
+		return "", err
+	}
+	defer t.mu.Unlock()
+
+	existing, err := t.current(collection, id)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("document with _id %q already exists: %w", id, ErrDuplicateKey)
+	}
+	t.write(collection, id, withID(fields, id))
+	if provisional {
+		t.collection(collection).provisional[id] = true
+	}
+	return id, nil
+}
+
+// onFinalID arranges for set to be called after a successful commit with
+// the engine's ID for id, if id is provisional
+func (t *transaction) onFinalID(collection, id string, set func(id string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc, ok := t.colls[collection]; ok && tc.provisional[id] {
+		t.pending = append(t.pending, pendingID{collection: collection, id: id, set: set})
+	}
+}
+
+// markReplaced records that a write to id replaced the document. The
+// transaction logs one change per document, which is then a replacement
+// even if later updates followed.
+func (t *transaction) markReplaced(collection, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.collection(collection).replaced[id] = true
+}
+
+// resolveIDs replaces the provisional IDs handed out by the transaction,
+// once it has committed
+func (t *transaction) resolveIDs() {
+	for _, p := range t.pending {
+		if id, ok := t.resolved[p.collection][p.id]; ok {
+			p.set(id)
+		}
+	}
+	t.pending = nil
+}
+
+func (t *transaction) FindByID(collection, id string) ([]byte, error) {
+	if err := t.begin(); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+	return t.current(collection, id)
+}
+
+func (t *transaction) Update(collection, id string, doc []byte) ([]byte, error) {
+	fields, err := splitObject(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.begin(); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	existing, err := t.current(collection, id)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("document not found: %s", id)
+	}
+	stored := withID(fields, id)
+	t.write(collection, id, stored)
+	return stored, nil
+}
+
+func (t *transaction) Delete(collection, id string) (int, error) {
+	if err := t.begin(); err != nil {
+		return 0, err
+	}
+	defer t.mu.Unlock()
+
+	existing, err := t.current(collection, id)
+	if err != nil || existing == nil {
+		return 0, err
+	}
+	t.write(collection, id, nil)
+	return 1, nil
+}
+
+func (t *transaction) FindAll(collection string, limit, skip int) ([]byte, error) {
+	if err := t.begin(); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	docs, err := t.visible(collection)
+	if err != nil {
+		return nil, err
+	}
+	if skip > 0 {
+		docs = docs[min(skip, len(docs)):]
+	}
+	if limit >= 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	return json.Marshal(docs)
+}
+
+func (t *transaction) Count(collection string) (int, error) {
+	if err := t.begin(); err != nil {
+		return 0, err
+	}
+	defer t.mu.Unlock()
+
+	docs, err := t.visible(collection)
+	return len(docs), err
+}
+
+func (t *transaction) ListCollections() ([]byte, error) {
+	if err := t.begin(); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	unlock := rlock(t.db.view)
+	data, err := t.base.ListCollections()
+	unlock()
+	if err != nil || data == nil {
+		return data, err
+	}
+	var pairs [][2]interface{}
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, err
+	}
+	counts := map[string]interface{}{}
+	for _, p := range pairs {
+		if name, ok := p[0].(string); ok {
+			counts[name] = p[1]
+		}
+	}
+	for _, name := range t.names {
+		if len(t.colls[name].order) == 0 {
+			continue
+		}
+		docs, err := t.visible(name)
+		if err != nil {
+			return nil, err
+		}
+		counts[name] = len(docs)
+	}
+
+	pairs = pairs[:0]
+	for _, name := range sortedKeys(counts) {
+		pairs = append(pairs, [2]interface{}{name, counts[name]})
+	}
+	return json.Marshal(pairs)
+}
+
+func (t *transaction) Sync() error {
+	return t.base.Sync()
+}
+
+// Close does nothing: a transaction ends by commit or abort
+func (t *transaction) Close() error {
+	return nil
+}
+
+func (t *transaction) CreateVectorCollection(name string, config []byte) error {
+	return t.base.CreateVectorCollection(name, config)
+}
+
+func (t *transaction) ListVectorCollections() ([]byte, error) {
+	return t.base.ListVectorCollections()
+}
+
+func (t *transaction) DropVectorCollection(name string) (bool, error) {
+	return t.base.DropVectorCollection(name)
+}
+
+func (t *transaction) InsertVector(collection string, vector, metadata []byte) ([]byte, error) {
+	return t.base.InsertVector(collection, vector, metadata)
+}
+
+func (t *transaction) InsertText(collection, text string, metadata []byte) ([]byte, error) {
+	return t.base.InsertText(collection, text, metadata)
+}
+
+func (t *transaction) VectorSearch(collection string, query []byte, k int) ([]byte, error) {
+	return t.base.VectorSearch(collection, query, k)
+}
+
+func (t *transaction) VectorSearchText(collection, text string, k int) ([]byte, error) {
+	return t.base.VectorSearchText(collection, text, k)
+}
+
+func (t *transaction) VectorSearchFiltered(collection string, query []byte, k int, filter []byte) ([]byte, error) {
+	return t.base.VectorSearchFiltered(collection, query, k, filter)
+}
+
+func (t *transaction) GetVector(collection string, id VectorID) ([]byte, error) {
+	return t.base.GetVector(collection, id)
+}
+
+func (t *transaction) DeleteVector(collection string, id VectorID) (bool, error) {
+	return t.base.DeleteVector(collection, id)
+}
+
+func (t *transaction) VectorStats(collection string) ([]byte, error) {
+	return t.base.VectorStats(collection)
+}
+
+// ----------------------------------------------------------------------------
+// Commit
+// ----------------------------------------------------------------------------
+
+// abort discards the buffered writes. It does nothing after commit.
+func (t *transaction) abort() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done = true
+}
+
+// commit checks the buffered writes for conflicts and applies them. It
+// holds the client's write lock, so that no other write of the client
+// interleaves with it, and the view lock exclusively, so that no read of
+// the client sees the writes half applied.
+func (t *transaction) commit() error {
+	if err := t.begin(); err != nil {
+		return err
+	}
+	defer t.mu.Unlock()
+	t.done = true
+
+	t.db.writeMu.Lock()
+	defer t.db.writeMu.Unlock()
+
+	pending, err := t.applyAll()
+	if err != nil {
+		return err
+	}
+
+	for i, name := range t.names {
+		for _, wr := range pending[i] {
+			t.recordChange(name, wr)
+		}
+	}
+	return nil
+}
+
+// applyAll checks the buffered writes for conflicts and applies them,
+// holding the view lock. It returns the writes made in each collection.
+func (t *transaction) applyAll() ([][]txnWrite, error) {
+	t.db.view.Lock()
+	defer t.db.view.Unlock()
+
+	pending := make([][]txnWrite, 0, len(t.names))
+	for _, name := range t.names {
+		tc := t.colls[name]
+		writes := make([]txnWrite, 0, len(tc.order))
+		for _, id := range tc.order {
+			before, after := tc.seen[id], tc.writes[id]
+			if tc.provisional[id] {
+				if after != nil {
+					writes = append(writes, txnWrite{id: id, after: after, provisional: true})
+				}
+				continue
+			}
+			now, err := t.base.FindByID(name, id)
+			if err != nil {
+				return nil, fmt.Errorf("commit failed: %w", err)
+			}
+			if !sameStored(now, before) {
+				return nil, fmt.Errorf("commit failed: %w on document %q in collection %q", ErrWriteConflict, id, name)
+			}
+			if before != nil || after != nil {
+				writes = append(writes, txnWrite{id: id, before: before, after: after, replace: tc.replaced[id]})
+			}
+		}
+		pending = append(pending, writes)
+	}
+
+	for i, name := range t.names {
+		if err := t.apply(name, pending[i]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				_ = t.apply(t.names[j], inverse(pending[j]))
+			}
+			return nil, fmt.Errorf("commit failed: %w", err)
+		}
+	}
+
+	return pending, nil
+}
+
+// recordChange logs a committed write for change streams
+func (t *transaction) recordChange(name string, wr txnWrite) {
+	if t.db.changes == nil {
+		return
+	}
+	before, err := decodeVersion(wr.before)
+	if err != nil {
+		t.db.changes.skip()
+		return
+	}
+	after, err := decodeVersion(wr.after)
+	if err != nil {
+		t.db.changes.skip()
+		return
+	}
+	op := "update"
+	switch {
+	case before == nil:
+		op = "insert"
+	case after == nil:
+		op = "delete"
+	case wr.replace:
+		op = "replace"
+	}
+	t.db.changes.record(name, op, wr.id, before, after)
+}
+
+// apply writes changes to one collection of the engine and its indexes. If
+// a change would break a unique index, or the engine fails, the changes
+// already made are undone.
+func (t *transaction) apply(name string, writes []txnWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	w, err := t.db.indexes.beginWrite(name)
+	if err != nil {
+		return err
+	}
+	defer w.done()
+
+	// Index entries are moved in two passes, removing every old version
+	// before adding any new one, so that documents may swap unique keys
+	olds := make([]Document, len(writes))
+	news := make([]Document, len(writes))
+	if w.active() {
+		for i, wr := range writes {
+			if olds[i], err = decodeVersion(wr.before); err != nil {
+				return err
+			}
+			if news[i], err = decodeVersion(wr.after); err != nil {
+				return err
+			}
+		}
+		for i, wr := range writes {
+			w.replace(wr.id, olds[i], nil)
+		}
+		for i, wr := range writes {
+			if news[i] == nil {
+				continue
+			}
+			if err := w.check(wr.id, news[i]); err != nil {
+				for j := range i {
+					w.replace(writes[j].id, news[j], nil)
+				}
+				for j, wr := range writes {
+					w.replace(wr.id, nil, olds[j])
+				}
+				return err
+			}
+			w.replace(wr.id, nil, news[i])
+		}
+	}
+
+	for i := range writes {
+		id := writes[i].id
+		if err := t.applyWrite(name, &writes[i]); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				inv := writes[j].inverse()
+				_ = t.applyWrite(name, &inv)
+			}
+			for j, wr := range writes {
+				w.replace(wr.id, news[j], olds[j])
+			}
+			return err
+		}
+		if writes[i].id != id && news[i] != nil {
+			// The engine chose the ID of a provisional insert
+			w.replace(id, news[i], nil)
+			news[i]["_id"] = writes[i].id
+			w.replace(writes[i].id, nil, news[i])
+		}
+	}
+	return nil
+}
+
+// decodeVersion decodes a stored version of a document; nil stays nil
+func decodeVersion(doc []byte) (Document, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	return unmarshalDocument(doc, false)
+}
+
+// applyWrite makes one change in the engine. A provisional insert is made
+// without its _id, and wr is updated with the ID the engine chose.
+func (t *transaction) applyWrite(name string, wr *txnWrite) error {
+	switch {
+	case wr.before == nil && wr.after == nil:
+		return nil
+	case wr.before == nil && wr.provisional:
+		fields, err := splitObject(wr.after)
+		if err != nil {
+			return err
+		}
+		fields = slices.DeleteFunc(fields, func(f rawField) bool { return f.Key == "_id" })
+		id, err := t.base.Insert(name, joinObject(fields))
+		if err != nil {
+			return err
+		}
+		t.resolve(name, wr.id, id)
+		wr.id, wr.after, wr.provisional = id, withID(fields, id), false
+		return nil
+	case wr.before == nil:
+		id, err := t.base.Insert(name, wr.after)
+		if err != nil {
+			return err
+		}
+		if id != wr.id {
+			_, _ = t.base.Delete(name, id)
+			return fmt.Errorf("engine replaced _id %q with %q", wr.id, id)
+		}
+		return nil
+	case wr.after == nil:
+		_, err := t.base.Delete(name, wr.id)
+		return err
+	default:
+		_, err := t.base.Update(name, wr.id, wr.after)
+		return err
+	}
+}
+
+// resolve records the ID the engine chose for a provisional insert
+func (t *transaction) resolve(name, provisional, id string) {
+	if t.resolved == nil {
+		t.resolved = map[string]map[string]string{}
+	}
+	if t.resolved[name] == nil {
+		t.resolved[name] = map[string]string{}
+	}
+	t.resolved[name][provisional] = id
+}
+
+// inverse returns the change that undoes wr
+func (wr txnWrite) inverse() txnWrite {
+	return txnWrite{id: wr.id, before: wr.after, after: wr.before}
+}
+
+// inverse returns the changes that undo writes, in reverse order
+func inverse(writes []txnWrite) []txnWrite {
+	out := make([]txnWrite, len(writes))
+	for i, wr := range writes {
+		out[len(writes)-1-i] = wr.inverse()
+	}
+	return out
+}
+
+// sameStored reports whether two stored versions of a document are equal;
+// nil is an absent document
+func sameStored(a, b []byte) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var x, y interface{}
+	if decodeStored(a, &x) != nil || decodeStored(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,380 @@
+package keradb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowCommitEngine holds the second Update of a commit until release is
+// closed, leaving the commit half applied in the engine
+type slowCommitEngine struct {
+	*MemoryEngine
+	entered chan struct{}
+	release chan struct{}
+
+	mu      sync.Mutex
+	updates int
+}
+
+func (e *slowCommitEngine) Update(collection, id string, doc []byte) ([]byte, error) {
+	e.mu.Lock()
+	e.updates++
+	n := e.updates
+	e.mu.Unlock()
+	if n == 2 {
+		close(e.entered)
+		<-e.release
+	}
+	return e.MemoryEngine.Update(collection, id, doc)
+}
+
+func TestReadsDuringCommitSeeAllOrNothing(t *testing.T) {
+	engine := &slowCommitEngine{MemoryEngine: NewMemoryEngine(), entered: make(chan struct{}), release: make(chan struct{})}
+	client := newMemoryClient(t, engine)
+	accounts := client.Database().Collection("accounts")
+	for _, id := range []string{"a", "b"} {
+		if _, err := accounts.InsertOne(M{"_id": id, "balance": 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(context.Background())
+	committed := make(chan error, 1)
+	go func() {
+		_, err := session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+			if _, err := accounts.UpdateOneContext(ctx, M{"_id": "a"}, M{"$inc": M{"balance": -10}}); err != nil {
+				return nil, err
+			}
+			_, err := accounts.UpdateOneContext(ctx, M{"_id": "b"}, M{"$inc": M{"balance": 10}})
+			return nil, err
+		})
+		committed <- err
+	}()
+	<-engine.entered
+
+	tests := []struct {
+		name string
+		read func() (a, b int, err error)
+	}{
+		{name: "Find", read: func() (int, int, error) {
+			cur := accounts.Find(M{}, NewFindOptions().SetSort(D{{Key: "_id", Value: 1}}))
+			var balances []int
+			for cur.Next() {
+				var doc struct{ Balance int }
+				if err := cur.Decode(&doc); err != nil {
+					return 0, 0, err
+				}
+				balances = append(balances, doc.Balance)
+			}
+			if err := cur.Err(); err != nil {
+				return 0, 0, err
+			}
+			if len(balances) != 2 {
+				return 0, 0, errors.New("wrong number of documents")
+			}
+			return balances[0], balances[1], nil
+		}},
+		{name: "FindOne", read: func() (int, int, error) {
+			var a, b struct{ Balance int }
+			if err := accounts.FindOne(M{"_id": "a"}).Decode(&a); err != nil {
+				return 0, 0, err
+			}
+			err := accounts.FindOne(M{"_id": "b"}).Decode(&b)
+			return a.Balance, b.Balance, err
+		}},
+	}
+	results := make([]chan [2]int, len(tests))
+	for i, tt := range tests {
+		results[i] = make(chan [2]int, 1)
+		go func() {
+			a, b, err := tt.read()
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] <- [2]int{a, b}
+		}()
+	}
+
+	// The readers must wait for the commit rather than see it half done
+	got := make([][2]int, len(tests))
+	early := make([]bool, len(tests))
+	for i, tt := range tests {
+		select {
+		case got[i] = <-results[i]:
+			early[i] = true
+			t.Errorf("%s returned %v during the commit", tt.name, got[i])
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	close(engine.release)
+	if err := <-committed; err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range tests {
+		if !early[i] {
+			got[i] = <-results[i]
+		}
+		if got[i] != [2]int{90, 110} {
+			t.Errorf("%s read balances %v, want [90 110]", tt.name, got[i])
+		}
+	}
+}
+
+func TestTransactionInsertIDs(t *testing.T) {
+	client := newMemoryClient(t, idReplacingEngine{NewMemoryEngine()})
+	coll := client.Database().Collection("c")
+	session, err := client.StartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(context.Background())
+
+	var one *InsertOneResult
+	var many *InsertManyResult
+	var bulk *BulkWriteResult
+	_, err = session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+		var err error
+		if one, err = coll.InsertOneContext(ctx, M{"n": "one"}); err != nil {
+			return nil, err
+		}
+		// The provisional ID finds the document until the commit
+		if n, err := coll.CountDocumentsContext(ctx, M{"_id": one.InsertedID}); err != nil || n != 1 {
+			t.Errorf("CountDocuments(provisional _id) = %d, %v", n, err)
+		}
+		if many, err = coll.InsertManyContext(ctx, []interface{}{M{"n": "many0"}, M{"n": "many1"}}); err != nil {
+			return nil, err
+		}
+		bulk, err = coll.BulkWriteContext(ctx, []WriteModel{
+			NewInsertOneModel().SetDocument(M{"n": "bulk"}),
+			NewUpdateOneModel().SetFilter(M{"n": "upsert"}).SetUpdate(M{"$set": M{"v": 1}}).SetUpsert(true),
+		})
+		return nil, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{name: "one", id: one.InsertedID},
+		{name: "many0", id: many.InsertedIDs[0]},
+		{name: "many1", id: many.InsertedIDs[1]},
+		{name: "bulk", id: bulk.InsertedIDs[0]},
+		{name: "upsert", id: bulk.UpsertedIDs[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc struct {
+				ID string `json:"_id"`
+				N  string
+			}
+			if err := coll.FindOne(M{"_id": tt.id}).Decode(&doc); err != nil {
+				t.Fatalf("FindOne(_id %q): %v", tt.id, err)
+			}
+			if doc.N != tt.name {
+				t.Errorf("_id %q holds %q", tt.id, doc.N)
+			}
+		})
+	}
+	if n, err := coll.CountDocuments(M{}); err != nil || n != int64(len(tests)) {
+		t.Errorf("CountDocuments = %d, %v, want %d", n, err, len(tests))
+	}
+}
+
+func TestTransactionScansReadOnce(t *testing.T) {
+	engine := newScanCountingEngine()
+	client := newMemoryClient(t, engine)
+	coll := client.Database().Collection("c")
+	const n = 10
+	for i := range n {
+		if _, err := coll.InsertOne(M{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine.scanned["c"] = 0
+
+	session, err := client.StartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(context.Background())
+	_, err = session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+		// Updating each document as it is read must not disturb the scan
+		cur, err := coll.FindContext(ctx, M{}, NewFindOptions().SetBatchSize(3))
+		if err != nil {
+			return nil, err
+		}
+		seen := 0
+		for cur.Next() {
+			var doc struct {
+				ID string `json:"_id"`
+			}
+			if err := cur.Decode(&doc); err != nil {
+				return nil, err
+			}
+			if _, err := coll.UpdateOneContext(ctx, M{"_id": doc.ID}, M{"$set": M{"seen": true}}); err != nil {
+				return nil, err
+			}
+			seen++
+		}
+		if err := cur.Err(); err != nil {
+			return nil, err
+		}
+		if seen != n {
+			t.Errorf("scan returned %d documents, want %d", seen, n)
+		}
+		_, err = coll.CountDocumentsContext(ctx, M{"seen": true})
+		return nil, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := engine.scanned["c"]; got != n {
+		t.Errorf("transaction scanned %d stored documents, want %d", got, n)
+	}
+	if got, err := coll.CountDocuments(M{"seen": true}); err != nil || got != n {
+		t.Errorf("CountDocuments(seen) = %d, %v, want %d", got, err, n)
+	}
+}
+
+func TestTransactionDeletesKeepOrder(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	coll := client.Database().Collection("c")
+	for i := range 6 {
+		if _, err := coll.InsertOne(M{"_id": fmt.Sprint(i), "i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(context.Background())
+
+	ids := func(ctx context.Context, opts *FindOptions) []string {
+		cur, err := coll.FindContext(ctx, M{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for cur.Next() {
+			var doc struct {
+				ID string `json:"_id"`
+			}
+			if err := cur.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, doc.ID)
+		}
+		if err := cur.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	_, err = session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+		if got := ids(ctx, nil); len(got) != 6 {
+			t.Fatalf("scan returned %v", got)
+		}
+		if _, err := coll.DeleteManyContext(ctx, M{"i": M{"$in": []int{1, 3}}}); err != nil {
+			return nil, err
+		}
+		// Later documents move up into the places the deleted ones left
+		if got, want := ids(ctx, NewFindOptions().SetSkip(1).SetLimit(2)), []string{"2", "4"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("after deleting, skip 1 limit 2 returned %v, want %v", got, want)
+		}
+		if _, err := coll.DeleteOneContext(ctx, M{"_id": "0"}); err != nil {
+			return nil, err
+		}
+		if _, err := coll.InsertOneContext(ctx, M{"_id": "1", "i": 10}); err != nil {
+			return nil, err
+		}
+		if _, err := coll.UpdateOneContext(ctx, M{"_id": "4"}, M{"$set": M{"i": 40}}); err != nil {
+			return nil, err
+		}
+		if got, want := ids(ctx, nil), []string{"2", "4", "5", "1"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("transaction sees %v, want %v", got, want)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct{ I int }
+	if err := coll.FindOne(M{"_id": "4"}).Decode(&doc); err != nil || doc.I != 40 {
+		t.Errorf("FindOne(_id 4) = %+v, %v", doc, err)
+	}
+	if n, err := coll.CountDocuments(M{}); err != nil || n != 4 {
+		t.Errorf("CountDocuments = %d, %v, want 4", n, err)
+	}
+}
+
+func TestTransactionBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		limit   time.Duration
+	}{
+		{attempt: 0, limit: time.Millisecond},
+		{attempt: 1, limit: 2 * time.Millisecond},
+		{attempt: 3, limit: 8 * time.Millisecond},
+		{attempt: 7, limit: maxTransactionBackoff},
+		{attempt: 64, limit: maxTransactionBackoff},
+	}
+	for _, tt := range tests {
+		var largest time.Duration
+		for range 200 {
+			d := transactionBackoff(tt.attempt)
+			if d < 0 || d > tt.limit {
+				t.Fatalf("transactionBackoff(%d) = %v, want at most %v", tt.attempt, d, tt.limit)
+			}
+			largest = max(largest, d)
+		}
+		if largest == 0 {
+			t.Errorf("transactionBackoff(%d) never waited", tt.attempt)
+		}
+	}
+}
+
+func TestWithTransactionGivesUp(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	coll := client.Database().Collection("c")
+	if _, err := coll.InsertOne(M{"_id": "a", "n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(context.Background())
+
+	// Every attempt is overtaken by a write outside the transaction
+	attempts := 0
+	_, err = session.WithTransaction(context.Background(), func(ctx context.Context) (interface{}, error) {
+		attempts++
+		var doc struct{ N int }
+		if err := coll.FindOneContext(ctx, M{"_id": "a"}).Decode(&doc); err != nil {
+			return nil, err
+		}
+		if _, err := coll.UpdateOne(M{"_id": "a"}, M{"$inc": M{"n": 1}}); err != nil {
+			return nil, err
+		}
+		_, err := coll.UpdateOneContext(ctx, M{"_id": "a"}, M{"$set": M{"n": doc.N - 1}})
+		return nil, err
+	})
+	if !errors.Is(err, ErrWriteConflict) {
+		t.Fatalf("got %v, want ErrWriteConflict", err)
+	}
+	if attempts != maxTransactionAttempts {
+		t.Errorf("ran %d attempts, want %d", attempts, maxTransactionAttempts)
+	}
+}
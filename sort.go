@@ -0,0 +1,232 @@
+package keradb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ============================================================================
+// Value Ordering
+// ============================================================================
+
+// typeOrder ranks values by type the way MongoDB does when comparing values
+// of different types: null < numbers < strings < objects < arrays < binary
+// data < booleans < dates
+func typeOrder(v interface{}) int {
+	if isNumber(v) {
+		return 2
+	}
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case map[string]interface{}, Document, M:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte:
+		return 6
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+	return 10
+}
+
+// asMap returns v as a plain map if it is a document
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case Document:
+		return m, true
+	case M:
+		return m, true
+	case D:
+		return m.Map(), true
+	}
+	return nil, false
+}
+
+// compareValues orders two values using MongoDB's cross-type ordering. It
+// returns -1, 0 or +1.
+func compareValues(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		if ta < tb {
+			return -1
+		}
+		return 1
+	}
+
+	switch av := a.(type) {
+	case nil:
+		return 0
+	case string:
+		bv := b.(string)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case bool:
+		bv := b.(bool)
+		switch {
+		case av == bv:
+			return 0
+		case !av:
+			return -1
+		}
+		return 1
+	case []interface{}:
+		bv := b.([]interface{})
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			if c := compareValues(av[i], bv[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(av), len(bv))
+	case []byte:
+		bv := b.([]byte)
+		if c := compareInts(len(av), len(bv)); c != 0 {
+			return c
+		}
+		return bytes.Compare(av, bv)
+	case time.Time:
+		return av.Compare(b.(time.Time))
+	}
+
+	if ta == 2 {
+		return compareNumbers(a, b)
+	}
+
+	if am, ok := asMap(a); ok {
+		bm, _ := asMap(b)
+		ak, bk := sortedKeys(am), sortedKeys(bm)
+		for i := 0; i < len(ak) && i < len(bk); i++ {
+			if ak[i] != bk[i] {
+				if ak[i] < bk[i] {
+					return -1
+				}
+				return 1
+			}
+			if c := compareValues(am[ak[i]], bm[bk[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(ak), len(bk))
+	}
+
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ============================================================================
+// Sorting
+// ============================================================================
+
+// sortKey is a single field of a sort specification
+type sortKey struct {
+	field      string
+	descending bool
+}
+
+// parseSort validates a sort specification
+func parseSort(spec D) ([]sortKey, error) {
+	keys := make([]sortKey, 0, len(spec))
+	for _, e := range spec {
+		if e.Key == "" {
+			return nil, errors.New("sort key must not be empty")
+		}
+		dir, ok := toFloat(e.Value)
+		if !ok || (dir != 1 && dir != -1) {
+			return nil, fmt.Errorf("sort direction for %q must be 1 or -1", e.Key)
+		}
+		keys = append(keys, sortKey{field: e.Key, descending: dir == -1})
+	}
+	return keys, nil
+}
+
+// sortValue returns the value of a document used to sort on a field path.
+// When the path reaches several values, or an array, the smallest one is
+// used for an ascending sort and the largest for a descending sort.
+func sortValue(doc Document, key sortKey) interface{} {
+	var candidates []interface{}
+	for _, pv := range lookupPath(doc, key.field) {
+		if arr, ok := pv.value.([]interface{}); ok {
+			candidates = append(candidates, arr...)
+		} else {
+			candidates = append(candidates, pv.value)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	best := candidates[0]
+	for _, v := range candidates[1:] {
+		c := compareValues(v, best)
+		if (key.descending && c > 0) || (!key.descending && c < 0) {
+			best = v
+		}
+	}
+	return best
+}
+
+// sortDocuments sorts docs in place by a multi-key specification. The sort is
+// stable, so documents that compare equal keep their storage order.
+func sortDocuments(docs []Document, spec D) error {
+	keys, err := parseSort(spec)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		return compareDocuments(docs[i], docs[j], keys) < 0
+	})
+	return nil
+}
+
+// compareDocuments orders two documents by a parsed sort specification,
+// returning -1, 0 or +1
+func compareDocuments(a, b Document, keys []sortKey) int {
+	for _, key := range keys {
+		c := compareValues(sortValue(a, key), sortValue(b, key))
+		if c == 0 {
+			continue
+		}
+		if key.descending {
+			return -c
+		}
+		return c
+	}
+	return 0
+}
@@ -0,0 +1,233 @@
+package keradb
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"reflect"
+	"slices"
+)
+
+// ============================================================================
+// TypedCollection
+// ============================================================================
+
+// TypedCollection is a view of a Collection whose documents are values of
+// the struct type T.
+//
+// Documents are converted to and from T by a codec built once per type
+// rather than by a JSON round trip, using the collection's Registry. Fields
+// are named by their keradb tags, or their json tags when they have none;
+// the field named "_id" holds the document ID. When that field is empty on
+// insert, the engine assigns the ID.
+//
+//	type User struct {
+//		ID   string `keradb:"_id,omitempty"`
+//		Name string `keradb:"name"`
+//	}
+//
+//	users := keradb.NewTypedCollection[User](db.Collection("users"))
+//	for user, err := range users.Find(keradb.M{"name": "Alice"}) {
+//		...
+//	}
+type TypedCollection[T any] struct {
+	coll  *Collection
+	codec *structCodec
+	err   error // set if T is not a struct type
+}
+
+// NewTypedCollection returns a typed view of a collection. T must be a
+// struct type; otherwise every operation returns an error.
+func NewTypedCollection[T any](coll *Collection) *TypedCollection[T] {
+	t := reflect.TypeFor[T]()
+	if t.Kind() != reflect.Struct {
+		return &TypedCollection[T]{coll: coll, err: fmt.Errorf("typed collection needs a struct type, not %s", t)}
+	}
+	return &TypedCollection[T]{coll: coll, codec: codecFor(t)}
+}
+
+// Collection returns the underlying untyped collection
+func (tc *TypedCollection[T]) Collection() *Collection {
+	return tc.coll
+}
+
+// encode converts a value to a document, leaving out an empty _id so that
+// the ID is assigned on insert
+func (tc *TypedCollection[T]) encode(v T) (D, error) {
+	if tc.err != nil {
+		return nil, tc.err
+	}
+	doc, err := tc.codec.encode(tc.coll.registry, reflect.ValueOf(&v).Elem())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode document: %w", err)
+	}
+	if id := tc.codec.id; id != nil {
+		if fv, ok := fieldForEncode(reflect.ValueOf(&v).Elem(), id.index); ok && fv.IsZero() {
+			doc = slices.DeleteFunc(doc, func(e E) bool { return e.Key == "_id" })
+		}
+	}
+	return doc, nil
+}
+
+// decode converts a document to a value
+func (tc *TypedCollection[T]) decode(doc Document) (T, error) {
+	var v T
+	if err := tc.codec.decode(tc.coll.registry, doc, reflect.ValueOf(&v).Elem()); err != nil {
+		return v, fmt.Errorf("failed to decode document: %w", err)
+	}
+	return v, nil
+}
+
+// InsertOne inserts a single value
+func (tc *TypedCollection[T]) InsertOne(v T) (*InsertOneResult, error) {
+	return tc.InsertOneContext(context.Background(), v)
+}
+
+// InsertOneContext inserts a single value
+func (tc *TypedCollection[T]) InsertOneContext(ctx context.Context, v T) (*InsertOneResult, error) {
+	doc, err := tc.encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return tc.coll.InsertOneContext(ctx, doc)
+}
+
+// InsertMany inserts several values
+func (tc *TypedCollection[T]) InsertMany(vs []T) (*InsertManyResult, error) {
+	return tc.InsertManyContext(context.Background(), vs)
+}
+
+// InsertManyContext inserts several values. Every value is encoded before
+// any is inserted.
+func (tc *TypedCollection[T]) InsertManyContext(ctx context.Context, vs []T) (*InsertManyResult, error) {
+	docs := make([]interface{}, len(vs))
+	for i, v := range vs {
+		doc, err := tc.encode(v)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+	return tc.coll.InsertManyContext(ctx, docs)
+}
+
+// FindOne returns the first value matching the filter
+func (tc *TypedCollection[T]) FindOne(filter Filter, opts ...*FindOptions) (T, error) {
+	return tc.FindOneContext(context.Background(), filter, opts...)
+}
+
+// FindOneContext returns the first value matching the filter. If nothing
+// matches, it returns the zero value and ErrNoDocuments.
+func (tc *TypedCollection[T]) FindOneContext(ctx context.Context, filter Filter, opts ...*FindOptions) (T, error) {
+	var zero T
+	if tc.err != nil {
+		return zero, tc.err
+	}
+	result := tc.coll.FindOneContext(ctx, filter, opts...)
+	if result.err != nil {
+		return zero, result.err
+	}
+	if result.doc == nil {
+		return zero, ErrNoDocuments
+	}
+	return tc.decode(result.doc)
+}
+
+// Find returns the values matching the filter as an iterator
+func (tc *TypedCollection[T]) Find(filter Filter, opts ...*FindOptions) iter.Seq2[T, error] {
+	return tc.FindContext(context.Background(), filter, opts...)
+}
+
+// FindContext returns the values matching the filter as an iterator. The
+// query runs when iteration starts. A value that cannot be decoded is
+// yielded with its error and iteration continues; a failed query yields a
+// single error.
+func (tc *TypedCollection[T]) FindContext(ctx context.Context, filter Filter, opts ...*FindOptions) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if tc.err != nil {
+			yield(zero, tc.err)
+			return
+		}
+		cursor, err := tc.coll.FindContext(ctx, filter, opts...)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		defer cursor.Close()
+
+		for cursor.Next() {
+			if !yield(tc.decode(cursor.current)) {
+				return
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			yield(zero, err)
+		}
+	}
+}
+
+// ReplaceOne replaces a single document matching the filter with a value
+func (tc *TypedCollection[T]) ReplaceOne(filter Filter, v T, opts ...*ReplaceOptions) (*UpdateResult, error) {
+	return tc.ReplaceOneContext(context.Background(), filter, v, opts...)
+}
+
+// ReplaceOneContext replaces a single document matching the filter with a
+// value
+func (tc *TypedCollection[T]) ReplaceOneContext(ctx context.Context, filter Filter, v T, opts ...*ReplaceOptions) (*UpdateResult, error) {
+	doc, err := tc.encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return tc.coll.ReplaceOneContext(ctx, filter, doc, opts...)
+}
+
+// UpdateOne updates a single document matching the filter
+func (tc *TypedCollection[T]) UpdateOne(filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	return tc.coll.UpdateOne(filter, update, opts...)
+}
+
+// UpdateOneContext updates a single document matching the filter
+func (tc *TypedCollection[T]) UpdateOneContext(ctx context.Context, filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	return tc.coll.UpdateOneContext(ctx, filter, update, opts...)
+}
+
+// UpdateMany updates all documents matching the filter
+func (tc *TypedCollection[T]) UpdateMany(filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	return tc.coll.UpdateMany(filter, update, opts...)
+}
+
+// UpdateManyContext updates all documents matching the filter
+func (tc *TypedCollection[T]) UpdateManyContext(ctx context.Context, filter Filter, update Update, opts ...*UpdateOptions) (*UpdateResult, error) {
+	return tc.coll.UpdateManyContext(ctx, filter, update, opts...)
+}
+
+// DeleteOne deletes a single document matching the filter
+func (tc *TypedCollection[T]) DeleteOne(filter Filter) (*DeleteResult, error) {
+	return tc.coll.DeleteOne(filter)
+}
+
+// DeleteOneContext deletes a single document matching the filter
+func (tc *TypedCollection[T]) DeleteOneContext(ctx context.Context, filter Filter) (*DeleteResult, error) {
+	return tc.coll.DeleteOneContext(ctx, filter)
+}
+
+// DeleteMany deletes all documents matching the filter
+func (tc *TypedCollection[T]) DeleteMany(filter Filter) (*DeleteResult, error) {
+	return tc.coll.DeleteMany(filter)
+}
+
+// DeleteManyContext deletes all documents matching the filter
+func (tc *TypedCollection[T]) DeleteManyContext(ctx context.Context, filter Filter) (*DeleteResult, error) {
+	return tc.coll.DeleteManyContext(ctx, filter)
+}
+
+// CountDocuments counts documents matching the filter
+func (tc *TypedCollection[T]) CountDocuments(filter Filter) (int64, error) {
+	return tc.coll.CountDocuments(filter)
+}
+
+// CountDocumentsContext counts documents matching the filter
+func (tc *TypedCollection[T]) CountDocumentsContext(ctx context.Context, filter Filter) (int64, error) {
+	return tc.coll.CountDocumentsContext(ctx, filter)
+}
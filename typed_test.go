@@ -0,0 +1,167 @@
+package keradb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type typedBase struct {
+	Created time.Time `json:"created"`
+}
+
+type typedUser struct {
+	ID    string         `json:"_id,omitempty"`
+	Name  string         `json:"name"`
+	Age   int            `json:"age"`
+	Tags  []string       `json:"tags,omitempty"`
+	Raw   []byte         `json:"raw,omitempty"`
+	Attrs map[string]int `json:"attrs,omitempty"`
+	Score *float64       `json:"score"`
+	Skip  string         `json:"-"`
+	Plain string
+	typedBase
+	Sub   struct{ X int8 } `json:"sub"`
+	Extra map[int]string   `json:"extra,omitempty"`
+}
+
+func TestTypedCollectionRoundTrip(t *testing.T) {
+	score := 2.5
+	tests := []struct {
+		name  string
+		value typedUser
+	}{
+		{name: "zero value", value: typedUser{}},
+		{name: "scalars", value: typedUser{Name: "a", Age: -3, Plain: "p"}},
+		{name: "supplied id", value: typedUser{ID: "fixed", Name: "b"}},
+		{name: "slices and maps", value: typedUser{Tags: []string{"x", "y"}, Raw: []byte{0, 1, 255}, Attrs: map[string]int{"k": 1}}},
+		{name: "pointer", value: typedUser{Score: &score}},
+		{name: "embedded struct", value: typedUser{typedBase: typedBase{Created: time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)}}},
+		{name: "nested struct", value: typedUser{Sub: struct{ X int8 }{X: -8}}},
+		{name: "integer map keys", value: typedUser{Extra: map[int]string{4: "four", -1: "minus"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("users")
+			users := NewTypedCollection[typedUser](coll)
+
+			in := tt.value
+			in.Skip = "not stored"
+			result, err := users.InsertOne(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.value.ID != "" && result.InsertedID != tt.value.ID {
+				t.Errorf("inserted as %q, want %q", result.InsertedID, tt.value.ID)
+			}
+
+			got, err := users.FindOne(M{"_id": result.InsertedID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.value
+			want.ID = result.InsertedID
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+
+			// The codec agrees with decoding through the untyped collection
+			var viaDecode typedUser
+			if err := coll.FindOne(M{"_id": result.InsertedID}).Decode(&viaDecode); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, viaDecode) {
+				t.Errorf("typed %+v, decoded %+v", got, viaDecode)
+			}
+		})
+	}
+}
+
+func TestTypedCollectionFind(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("users")
+	users := NewTypedCollection[typedUser](coll)
+	if _, err := users.InsertMany([]typedUser{{Name: "a", Age: 3}, {Name: "b", Age: 5}, {ID: "c", Name: "c", Age: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coll.InsertOne(M{"name": "bad", "age": "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    M
+		opts      *FindOptions
+		wantNames []string
+		wantErrs  int
+	}{
+		{name: "sorted", filter: M{"age": M{"$gte": 5}}, opts: NewFindOptions().SetSort(D{{Key: "age", Value: -1}}),
+			wantNames: []string{"c", "b"}},
+		{name: "undecodable document", filter: M{}, wantNames: []string{"a", "b", "c"}, wantErrs: 1},
+		{name: "invalid filter", filter: M{"$bogus": 1}, wantErrs: 1},
+		{name: "no match", filter: M{"name": "zz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts == nil {
+				opts = NewFindOptions()
+			}
+			var names []string
+			errs := 0
+			for user, err := range users.Find(tt.filter, opts) {
+				if err != nil {
+					errs++
+					continue
+				}
+				names = append(names, user.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) || errs != tt.wantErrs {
+				t.Errorf("got %v with %d errors, want %v with %d", names, errs, tt.wantNames, tt.wantErrs)
+			}
+		})
+	}
+
+	// Stopping early ends the query
+	for range users.Find(nil) {
+		break
+	}
+}
+
+func TestTypedCollectionErrors(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("users")
+	users := NewTypedCollection[typedUser](coll)
+	if _, err := users.InsertOne(typedUser{ID: "x", Name: "x"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := users.FindOne(M{"name": "zz"}); !errors.Is(err, ErrNoDocuments) {
+		t.Errorf("FindOne without a match: %v, want ErrNoDocuments", err)
+	}
+	if _, err := users.InsertOne(typedUser{ID: "x"}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("InsertOne of a taken id: %v, want ErrDuplicateKey", err)
+	}
+	result, err := users.ReplaceOne(M{"_id": "x"}, typedUser{Name: "y"})
+	if err != nil || result.ModifiedCount != 1 {
+		t.Errorf("ReplaceOne: %+v, %v", result, err)
+	}
+
+	ints := NewTypedCollection[int](coll)
+	if _, err := ints.FindOne(nil); err == nil {
+		t.Error("a typed collection of int should fail")
+	}
+	if _, err := ints.InsertOne(1); err == nil {
+		t.Error("a typed collection of int should fail")
+	}
+}
+
+func TestCodecIsCachedPerType(t *testing.T) {
+	a := codecFor(reflect.TypeFor[typedUser]())
+	b := codecFor(reflect.TypeFor[typedUser]())
+	if a != b {
+		t.Error("codecFor built a second codec for the same type")
+	}
+	if a.id == nil || a.id.name != "_id" {
+		t.Errorf("codec id field = %+v, want the _id field", a.id)
+	}
+}
@@ -0,0 +1,687 @@
+package keradb
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Updates
+// ============================================================================
+
+// updateOp is a single field modification of an update document, such as
+// the "count" entry of {"$inc": {"count": 1}}
+type updateOp struct {
+	op   string
+	path string
+	arg  interface{}
+}
+
+// updateSpec is a validated update document: either a list of operator
+// modifications or a replacement document
+type updateSpec struct {
+	ops         []updateOp
+	replacement map[string]interface{}
+	order       D // field order of the replacement, if given
+}
+
+// parseReplacement validates a replacement document for ReplaceOne
+func parseReplacement(doc map[string]interface{}) (*updateSpec, error) {
+	for key := range doc {
+		if strings.HasPrefix(key, "$") {
+			return nil, errors.New("replacement document cannot contain update operators")
+		}
+	}
+	return &updateSpec{replacement: doc}, nil
+}
+
+// upsertSeed returns the starting point of a document inserted by an
+// upsert: the fields the filter requires to be equal to a value, including
+// those inside $and. Dot-notation paths become subdocuments.
+func upsertSeed(filter M) (Document, error) {
+	seed := map[string]interface{}{}
+	if err := addEqualityFields(seed, filter); err != nil {
+		return nil, err
+	}
+	return Document(seed), nil
+}
+
+func addEqualityFields(seed map[string]interface{}, filter M) error {
+	for _, key := range sortedKeys(filter) {
+		cond := filter[key]
+		if key == "$and" {
+			list, _ := normalizeLiteral(cond).([]interface{})
+			for _, item := range list {
+				if sub, ok := toFilter(item); ok {
+					if err := addEqualityFields(seed, sub); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+
+		if ops, ok := isOperatorMap(cond); ok {
+			value, ok := ops["$eq"]
+			if !ok {
+				continue
+			}
+			cond = value
+		}
+		if _, ok := cond.(*regexp.Regexp); ok {
+			continue
+		}
+		if err := setPath(seed, key, normalizeLiteral(cond)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateOperators lists the supported update operators
+var updateOperators = map[string]bool{
+	"$set": true, "$setOnInsert": true, "$unset": true, "$inc": true, "$mul": true,
+	"$min": true, "$max": true, "$rename": true, "$currentDate": true,
+	"$addToSet": true, "$push": true, "$pull": true, "$pullAll": true, "$pop": true,
+}
+
+// parseUpdate validates an update document, which uses only operators
+// ({"$set": {...}, "$inc": {...}}); documents are replaced with
+// parseReplacement. An empty update, plain fields, unknown operators,
+// malformed arguments and two operators touching the same path are all
+// errors.
+func parseUpdate(update M) (*updateSpec, error) {
+	if len(update) == 0 {
+		return nil, errors.New("update document must not be empty")
+	}
+	for key := range update {
+		if !strings.HasPrefix(key, "$") {
+			return nil, fmt.Errorf("update document must contain only update operators, not %q; use ReplaceOne to replace a document", key)
+		}
+	}
+
+	spec := &updateSpec{}
+	var paths []string
+	for _, op := range sortedKeys(update) {
+		if !updateOperators[op] {
+			return nil, fmt.Errorf("unknown update operator: %s", op)
+		}
+		fields, ok := normalizeLiteral(update[op]).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("modifier %s needs a document argument", op)
+		}
+		for _, path := range sortedKeys(fields) {
+			arg := fields[path]
+			if err := checkUpdatePath(path); err != nil {
+				return nil, err
+			}
+			if err := validateUpdateOp(op, path, arg); err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+			if op == "$rename" {
+				paths = append(paths, arg.(string))
+			}
+			spec.ops = append(spec.ops, updateOp{op: op, path: path, arg: arg})
+		}
+	}
+
+	// Two modifications of the same path, or of a path and its parent, are
+	// ambiguous
+	sort.Strings(paths)
+	for i := 1; i < len(paths); i++ {
+		prev, cur := paths[i-1], paths[i]
+		if cur == prev || strings.HasPrefix(cur, prev+".") {
+			return nil, fmt.Errorf("updating the path %q would create a conflict at %q", cur, prev)
+		}
+	}
+	return spec, nil
+}
+
+func checkUpdatePath(path string) error {
+	if path == "" {
+		return errors.New("update path must not be empty")
+	}
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			return fmt.Errorf("update path %q contains an empty field name", path)
+		}
+		if strings.HasPrefix(part, "$") {
+			return fmt.Errorf("update path %q must not contain operators", path)
+		}
+	}
+	return nil
+}
+
+// validateUpdateOp checks the argument of one operator modification
+func validateUpdateOp(op, path string, arg interface{}) error {
+	switch op {
+	case "$set", "$setOnInsert", "$unset", "$min", "$max", "$addToSet", "$push", "$pull":
+		if op == "$addToSet" || op == "$push" {
+			if mods, ok := asMap(arg); ok {
+				if _, err := parseArrayModifiers(op, mods); err != nil {
+					return err
+				}
+			}
+		}
+		if op == "$pull" {
+			if _, err := compilePullMatcher(arg); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "$inc", "$mul":
+		if !isNumber(arg) {
+			return fmt.Errorf("cannot %s with non-numeric argument for %q", strings.TrimPrefix(op, "$"), path)
+		}
+		return nil
+
+	case "$rename":
+		to, ok := arg.(string)
+		if !ok {
+			return fmt.Errorf("$rename target for %q must be a string", path)
+		}
+		if err := checkUpdatePath(to); err != nil {
+			return err
+		}
+		if to == path || strings.HasPrefix(to, path+".") || strings.HasPrefix(path, to+".") {
+			return fmt.Errorf("$rename source %q and target %q must not overlap", path, to)
+		}
+		return nil
+
+	case "$currentDate":
+		if _, ok := arg.(bool); ok {
+			return nil
+		}
+		if m, ok := asMap(arg); ok && len(m) == 1 {
+			if t, _ := m["$type"].(string); t == "date" || t == "timestamp" {
+				return nil
+			}
+		}
+		return fmt.Errorf("$currentDate for %q must be true or {$type: \"date\"|\"timestamp\"}", path)
+
+	case "$pullAll":
+		if _, ok := arg.([]interface{}); !ok {
+			return fmt.Errorf("$pullAll for %q needs an array", path)
+		}
+		return nil
+
+	case "$pop":
+		if n, ok := toFloat(arg); !ok || (n != 1 && n != -1) {
+			return fmt.Errorf("$pop for %q must be 1 or -1", path)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown update operator: %s", op)
+}
+
+// apply returns a copy of doc with the update applied. The _id field can
+// not be changed.
+func (u *updateSpec) apply(doc Document, inserting bool) (Document, error) {
+	if u.replacement != nil {
+		result, _ := normalizeLiteral(u.replacement).(map[string]interface{})
+		if id, ok := doc["_id"]; ok {
+			if newID, ok := result["_id"]; ok && !valuesEqual(id, newID) {
+				return nil, errors.New("the _id field cannot be changed by a replacement")
+			}
+			result["_id"] = id
+		}
+		return Document(result), nil
+	}
+
+	result, _ := normalizeLiteral(map[string]interface{}(doc)).(map[string]interface{})
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	for _, op := range u.ops {
+		if op.op == "$setOnInsert" && !inserting {
+			continue
+		}
+		if err := op.apply(result); err != nil {
+			return nil, err
+		}
+	}
+
+	if id, ok := doc["_id"]; ok && !valuesEqual(id, result["_id"]) {
+		return nil, errors.New("performing an update on the path '_id' would modify the immutable field '_id'")
+	}
+	return Document(result), nil
+}
+
+func (o updateOp) apply(doc map[string]interface{}) error {
+	switch o.op {
+	case "$set", "$setOnInsert":
+		return setPath(doc, o.path, o.arg)
+
+	case "$unset":
+		unsetPath(doc, o.path)
+		return nil
+
+	case "$inc", "$mul":
+		return modifyPath(doc, o.path, true, func(cur interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				cur = 0
+			} else if !isNumber(cur) {
+				return nil, false, fmt.Errorf("cannot apply %s to non-numeric field %q", o.op, o.path)
+			}
+			var v interface{}
+			if o.op == "$inc" {
+				v, _ = addNumbers(cur, o.arg)
+			} else {
+				v, _ = multiplyNumbers(cur, o.arg)
+			}
+			return v, true, nil
+		})
+
+	case "$min", "$max":
+		return modifyPath(doc, o.path, true, func(cur interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return o.arg, true, nil
+			}
+			c := compareValues(o.arg, cur)
+			if (o.op == "$min" && c < 0) || (o.op == "$max" && c > 0) {
+				return o.arg, true, nil
+			}
+			return cur, true, nil
+		})
+
+	case "$rename":
+		value, ok := getPath(doc, o.path)
+		if !ok {
+			return nil
+		}
+		unsetPath(doc, o.path)
+		return setPath(doc, o.arg.(string), value)
+
+	case "$currentDate":
+		now := time.Now().UTC()
+		var v interface{} = now
+		if m, ok := asMap(o.arg); ok && m["$type"] == "timestamp" {
+			v = now.UnixMilli()
+		}
+		return setPath(doc, o.path, v)
+
+	case "$addToSet", "$push":
+		mods := &arrayModifiers{each: []interface{}{o.arg}}
+		if m, ok := asMap(o.arg); ok {
+			if parsed, _ := parseArrayModifiers(o.op, m); parsed != nil {
+				mods = parsed
+			}
+		}
+		return modifyPath(doc, o.path, true, func(cur interface{}, exists bool) (interface{}, bool, error) {
+			arr, err := arrayAt(o.op, o.path, cur, exists)
+			if err != nil {
+				return nil, false, err
+			}
+			if o.op == "$addToSet" {
+				return addToSet(arr, mods.each), true, nil
+			}
+			return mods.push(arr), true, nil
+		})
+
+	case "$pull", "$pullAll", "$pop":
+		return modifyPath(doc, o.path, false, func(cur interface{}, exists bool) (interface{}, bool, error) {
+			if !exists {
+				return nil, false, nil
+			}
+			arr, err := arrayAt(o.op, o.path, cur, exists)
+			if err != nil {
+				return nil, false, err
+			}
+			switch o.op {
+			case "$pop":
+				if len(arr) == 0 {
+					return arr, true, nil
+				}
+				if n, _ := toFloat(o.arg); n == 1 {
+					return arr[:len(arr)-1], true, nil
+				}
+				return arr[1:], true, nil
+			case "$pullAll":
+				values := o.arg.([]interface{})
+				return removeElements(arr, func(elem interface{}) bool {
+					for _, v := range values {
+						if valuesEqual(elem, v) {
+							return true
+						}
+					}
+					return false
+				}), true, nil
+			}
+			match, _ := compilePullMatcher(o.arg)
+			return removeElements(arr, match), true, nil
+		})
+	}
+	return fmt.Errorf("unknown update operator: %s", o.op)
+}
+
+// ----------------------------------------------------------------------------
+// Array Modifiers
+// ----------------------------------------------------------------------------
+
+// arrayModifiers holds the $each, $position, $sort and $slice modifiers of
+// $push and $addToSet
+type arrayModifiers struct {
+	each     []interface{}
+	position *int
+	sort     interface{} // 1, -1 or a D of element fields
+	slice    *int
+}
+
+// parseArrayModifiers parses a {"$each": [...], ...} argument. A document
+// without "$" keys is an ordinary value and yields nil.
+func parseArrayModifiers(op string, m map[string]interface{}) (*arrayModifiers, error) {
+	if _, ok := isOperatorMap(m); !ok {
+		return nil, nil
+	}
+	each, ok := m["$each"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s modifiers need an $each array", op)
+	}
+
+	mods := &arrayModifiers{each: each}
+	for key, v := range m {
+		switch key {
+		case "$each":
+		case "$position", "$slice":
+			if op != "$push" {
+				return nil, fmt.Errorf("%s does not support %s", op, key)
+			}
+			n, ok := toFloat(v)
+			if !ok || n != float64(int(n)) {
+				return nil, fmt.Errorf("%s must be an integer", key)
+			}
+			i := int(n)
+			if key == "$position" {
+				mods.position = &i
+			} else {
+				mods.slice = &i
+			}
+		case "$sort":
+			if op != "$push" {
+				return nil, fmt.Errorf("%s does not support %s", op, key)
+			}
+			if dir, ok := toFloat(v); ok {
+				if dir != 1 && dir != -1 {
+					return nil, errors.New("$sort direction must be 1 or -1")
+				}
+				mods.sort = dir
+				continue
+			}
+			spec, ok := asMap(v)
+			if !ok || len(spec) == 0 {
+				return nil, errors.New("$sort must be 1, -1 or a document of fields")
+			}
+			var d D
+			for _, k := range sortedKeys(spec) {
+				d = append(d, E{Key: k, Value: spec[k]})
+			}
+			if _, err := parseSort(d); err != nil {
+				return nil, err
+			}
+			mods.sort = d
+		default:
+			return nil, fmt.Errorf("unknown %s modifier: %s", op, key)
+		}
+	}
+	return mods, nil
+}
+
+// push appends the $each values to arr, honouring $position, then applies
+// $sort and $slice
+func (m *arrayModifiers) push(arr []interface{}) []interface{} {
+	pos := len(arr)
+	if m.position != nil {
+		pos = *m.position
+		if pos < 0 {
+			pos += len(arr)
+		}
+		if pos < 0 {
+			pos = 0
+		}
+		if pos > len(arr) {
+			pos = len(arr)
+		}
+	}
+	out := make([]interface{}, 0, len(arr)+len(m.each))
+	out = append(out, arr[:pos]...)
+	out = append(out, m.each...)
+	out = append(out, arr[pos:]...)
+
+	switch s := m.sort.(type) {
+	case float64:
+		sort.SliceStable(out, func(i, j int) bool {
+			c := compareValues(out[i], out[j])
+			if s < 0 {
+				return c > 0
+			}
+			return c < 0
+		})
+	case D:
+		keys, _ := parseSort(s)
+		sort.SliceStable(out, func(i, j int) bool {
+			a, _ := asMap(out[i])
+			b, _ := asMap(out[j])
+			return compareDocuments(a, b, keys) < 0
+		})
+	}
+
+	if m.slice != nil {
+		n := *m.slice
+		switch {
+		case n >= 0 && n < len(out):
+			out = out[:n]
+		case n < 0 && -n < len(out):
+			out = out[len(out)+n:]
+		}
+	}
+	return out
+}
+
+func addToSet(arr []interface{}, values []interface{}) []interface{} {
+	out := append([]interface{}{}, arr...)
+next:
+	for _, v := range values {
+		for _, existing := range out {
+			if valuesEqual(existing, v) {
+				continue next
+			}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// compilePullMatcher compiles the condition of $pull. A document of
+// operators ({"$gte": 6}) is applied to each element, a plain document is a
+// query against elements that are documents, and anything else is matched
+// by equality.
+func compilePullMatcher(cond interface{}) (func(elem interface{}) bool, error) {
+	if ops, ok := isOperatorMap(cond); ok {
+		match, err := compileOperators(ops)
+		if err != nil {
+			return nil, err
+		}
+		return func(elem interface{}) bool {
+			return match([]pathValue{{value: elem, exists: true}})
+		}, nil
+	}
+	if m, ok := asMap(cond); ok {
+		match, err := compileFilter(M(m))
+		if err != nil {
+			return nil, err
+		}
+		return func(elem interface{}) bool {
+			doc, ok := asMap(elem)
+			return ok && match(Document(doc))
+		}, nil
+	}
+	return func(elem interface{}) bool {
+		return matchesEqual([]pathValue{{value: elem, exists: true}}, cond)
+	}, nil
+}
+
+func removeElements(arr []interface{}, match func(interface{}) bool) []interface{} {
+	out := make([]interface{}, 0, len(arr))
+	for _, elem := range arr {
+		if !match(elem) {
+			out = append(out, elem)
+		}
+	}
+	return out
+}
+
+// arrayAt returns the array an array operator works on. A missing field
+// counts as an empty array.
+func arrayAt(op, path string, cur interface{}, exists bool) ([]interface{}, error) {
+	if !exists {
+		return []interface{}{}, nil
+	}
+	arr, ok := cur.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot apply %s to non-array field %q", op, path)
+	}
+	return arr, nil
+}
+
+// ----------------------------------------------------------------------------
+// Path Modification
+// ----------------------------------------------------------------------------
+
+// modifier computes the new value of a field from its current value. It
+// returns keep false to remove the field.
+type modifier func(cur interface{}, exists bool) (value interface{}, keep bool, err error)
+
+// modifyPath applies fn to the field at a dot-notation path. Numeric path
+// components index into arrays. With create set, missing intermediate
+// documents are created and arrays are padded with nulls; otherwise a path
+// that does not exist is left alone.
+func modifyPath(doc map[string]interface{}, path string, create bool, fn modifier) error {
+	_, err := modifyValue(doc, strings.Split(path, "."), path, create, fn)
+	return err
+}
+
+func modifyValue(v interface{}, parts []string, path string, create bool, fn modifier) (interface{}, error) {
+	key, last := parts[0], len(parts) == 1
+
+	switch c := v.(type) {
+	case map[string]interface{}:
+		child, exists := c[key]
+		if last {
+			nv, keep, err := fn(child, exists)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				c[key] = nv
+			} else {
+				delete(c, key)
+			}
+			return c, nil
+		}
+		if !exists {
+			if !create {
+				return c, nil
+			}
+			child = map[string]interface{}{}
+		}
+		nc, err := modifyValue(child, parts[1:], path, create, fn)
+		if err != nil {
+			return nil, err
+		}
+		c[key] = nc
+		return c, nil
+
+	case []interface{}:
+		idx, err := strconv.Atoi(key)
+		if err != nil || idx < 0 {
+			if create {
+				return nil, fmt.Errorf("cannot create field %q in array at %q", key, path)
+			}
+			return c, nil
+		}
+		exists := idx < len(c)
+		if !exists {
+			if !create {
+				return c, nil
+			}
+			for len(c) <= idx {
+				c = append(c, nil)
+			}
+		}
+		if last {
+			nv, keep, err := fn(c[idx], exists)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				nv = nil // removing an array element leaves a null behind
+			}
+			c[idx] = nv
+			return c, nil
+		}
+		child := c[idx]
+		if child == nil && create {
+			child = map[string]interface{}{}
+		}
+		nc, err := modifyValue(child, parts[1:], path, create, fn)
+		if err != nil {
+			return nil, err
+		}
+		c[idx] = nc
+		return c, nil
+	}
+
+	if create {
+		return nil, fmt.Errorf("cannot create field %q in non-document value at %q", key, path)
+	}
+	return v, nil
+}
+
+// setPath sets the field at path, creating intermediate documents
+func setPath(doc map[string]interface{}, path string, value interface{}) error {
+	return modifyPath(doc, path, true, func(interface{}, bool) (interface{}, bool, error) {
+		return value, true, nil
+	})
+}
+
+// unsetPath removes the field at path if it exists
+func unsetPath(doc map[string]interface{}, path string) {
+	modifyPath(doc, path, false, func(interface{}, bool) (interface{}, bool, error) {
+		return nil, false, nil
+	})
+}
+
+// getPath returns the single value at path, indexing arrays only by
+// position
+func getPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			child, ok := c[part]
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= len(c) {
+				return nil, false
+			}
+			v = c[idx]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,182 @@
+package keradb
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		update    M
+		inserting bool
+		replace   bool   // update is a replacement document
+		want      string // empty when the update must fail to apply
+	}{
+		{name: "$set", doc: `{"a":1}`, update: M{"$set": M{"a": 2, "b": "x"}}, want: `{"a":2,"b":"x"}`},
+		{name: "$set creates paths", doc: `{}`, update: M{"$set": M{"deep.a.b": 1}}, want: `{"deep":{"a":{"b":1}}}`},
+		{name: "$set array index", doc: `{"a":[1,2]}`, update: M{"$set": M{"a.1": 5}}, want: `{"a":[1,5]}`},
+		{name: "$set pads array", doc: `{"a":[1]}`, update: M{"$set": M{"a.3": 5}}, want: `{"a":[1,null,null,5]}`},
+		{name: "$set through a scalar", doc: `{"a":1}`, update: M{"$set": M{"a.b": 1}}},
+		{name: "$unset", doc: `{"a":1,"b":{"c":1,"d":2}}`, update: M{"$unset": M{"a": "", "b.c": ""}}, want: `{"b":{"d":2}}`},
+		{name: "$unset missing path", doc: `{"a":1}`, update: M{"$unset": M{"x.y": ""}}, want: `{"a":1}`},
+		{name: "$inc", doc: `{"a":1}`, update: M{"$inc": M{"a": 2, "b": 1.5}}, want: `{"a":3,"b":1.5}`},
+		{name: "$inc non-number", doc: `{"a":"x"}`, update: M{"$inc": M{"a": 1}}},
+		{name: "$mul", doc: `{"p":10}`, update: M{"$mul": M{"p": 1.5, "q": 2}}, want: `{"p":15,"q":0}`},
+		{name: "$min", doc: `{"lo":5}`, update: M{"$min": M{"lo": 3}}, want: `{"lo":3}`},
+		{name: "$min keeps smaller", doc: `{"lo":1}`, update: M{"$min": M{"lo": 3}}, want: `{"lo":1}`},
+		{name: "$max", doc: `{"hi":5}`, update: M{"$max": M{"hi": 3, "new": 1}}, want: `{"hi":5,"new":1}`},
+		{name: "$rename", doc: `{"old":"x"}`, update: M{"$rename": M{"old": "new.name"}}, want: `{"new":{"name":"x"}}`},
+		{name: "$rename missing", doc: `{"a":1}`, update: M{"$rename": M{"old": "new"}}, want: `{"a":1}`},
+		{name: "$setOnInsert on update", doc: `{"a":1}`, update: M{"$setOnInsert": M{"b": 1}}, want: `{"a":1}`},
+		{name: "$setOnInsert on insert", doc: `{"a":1}`, update: M{"$setOnInsert": M{"b": 1}}, inserting: true, want: `{"a":1,"b":1}`},
+		{name: "$push", doc: `{"s":[1]}`, update: M{"$push": M{"s": 2}}, want: `{"s":[1,2]}`},
+		{name: "$push creates array", doc: `{}`, update: M{"$push": M{"s": 2}}, want: `{"s":[2]}`},
+		{name: "$push onto scalar", doc: `{"s":1}`, update: M{"$push": M{"s": 2}}},
+		{name: "$push with modifiers", doc: `{"s":[5,1,9]}`, update: M{"$push": M{"s": M{"$each": []int{7, 2}, "$sort": -1, "$slice": 3}}}, want: `{"s":[9,7,5]}`},
+		{name: "$push at position", doc: `{"s":[9,7]}`, update: M{"$push": M{"s": M{"$each": []int{0}, "$position": 0}}}, want: `{"s":[0,9,7]}`},
+		{name: "$push sorts documents", doc: `{"s":[{"k":2},{"k":1}]}`, update: M{"$push": M{"s": M{"$each": []M{{"k": 3}}, "$sort": M{"k": 1}}}}, want: `{"s":[{"k":1},{"k":2},{"k":3}]}`},
+		{name: "$addToSet", doc: `{"t":["a"]}`, update: M{"$addToSet": M{"t": M{"$each": []string{"a", "b", "b"}}}}, want: `{"t":["a","b"]}`},
+		{name: "$addToSet numbers of any type", doc: `{"t":[1]}`, update: M{"$addToSet": M{"t": int64(1)}}, want: `{"t":[1]}`},
+		{name: "$pop last", doc: `{"n":[1,2,3]}`, update: M{"$pop": M{"n": 1}}, want: `{"n":[1,2]}`},
+		{name: "$pop first", doc: `{"n":[1,2,3]}`, update: M{"$pop": M{"n": -1}}, want: `{"n":[2,3]}`},
+		{name: "$pull value", doc: `{"t":["a","b","a"]}`, update: M{"$pull": M{"t": "a"}}, want: `{"t":["b"]}`},
+		{name: "$pull condition", doc: `{"t":["a","b","c"]}`, update: M{"$pull": M{"t": M{"$in": []string{"a", "c"}}}}, want: `{"t":["b"]}`},
+		{name: "$pull documents", doc: `{"i":[{"k":1,"x":1},{"k":2}]}`, update: M{"$pull": M{"i": M{"k": 1}}}, want: `{"i":[{"k":2}]}`},
+		{name: "$pullAll", doc: `{"n":[1,2,3,4]}`, update: M{"$pullAll": M{"n": []int{1, 3}}}, want: `{"n":[2,4]}`},
+		{name: "replacement keeps _id", doc: `{"_id":"x","a":1}`, update: M{"b": 2}, replace: true, want: `{"_id":"x","b":2}`},
+		{name: "replacement changes _id", doc: `{"_id":"x"}`, update: M{"_id": "y"}, replace: true},
+		{name: "$set changes _id", doc: `{"_id":"x"}`, update: M{"$set": M{"_id": "y"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := parseUpdate
+			if tt.replace {
+				parse = func(update M) (*updateSpec, error) { return parseReplacement(update) }
+			}
+			spec, err := parse(tt.update)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			var doc Document
+			if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := spec.apply(doc, tt.inserting)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(jsonValue(t, data), jsonValue(t, []byte(tt.want))) {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+			if !reflect.DeepEqual(map[string]interface{}(doc), jsonValue(t, []byte(tt.doc))) {
+				t.Errorf("apply modified its input: %v", doc)
+			}
+		})
+	}
+}
+
+func TestParseUpdateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		update M
+	}{
+		{name: "empty", update: M{}},
+		{name: "nil", update: nil},
+		{name: "unknown operator", update: M{"$bogus": M{"a": 1}}},
+		{name: "operators and fields", update: M{"$set": M{"a": 1}, "b": 2}},
+		{name: "replacement document", update: M{"b": 2}},
+		{name: "conflicting paths", update: M{"$set": M{"a": 1, "a.b": 2}}},
+		{name: "same path twice", update: M{"$set": M{"a": 1}, "$inc": M{"a": 1}}},
+		{name: "$inc by a string", update: M{"$inc": M{"a": "x"}}},
+		{name: "operator without a document", update: M{"$set": 1}},
+		{name: "empty path", update: M{"$set": M{"": 1}}},
+		{name: "empty path segment", update: M{"$set": M{"a..b": 1}}},
+		{name: "$rename to itself", update: M{"$rename": M{"a": "a"}}},
+		{name: "$pop by two", update: M{"$pop": M{"a": 2}}},
+		{name: "$pullAll without an array", update: M{"$pullAll": M{"a": 1}}},
+		{name: "$push with unknown modifier", update: M{"$push": M{"a": M{"$each": []int{1}, "$bogus": 1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseUpdate(tt.update); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestUpdateCurrentDate(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	if _, err := coll.InsertOne(M{"n": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Second)
+	if _, err := coll.UpdateOne(M{"n": "a"}, M{"$currentDate": M{"at": true, "ts": M{"$type": "date"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var doc Document
+	if err := coll.FindOne(M{"n": "a"}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"at", "ts"} {
+		if at, ok := doc[field].(time.Time); !ok || at.Before(before) {
+			t.Errorf("%s = %#v, want the current time", field, doc[field])
+		}
+	}
+
+	// Invalid updates fail even when nothing matches
+	if _, err := coll.UpdateMany(M{"n": "none"}, M{"$bogus": M{}}); err == nil {
+		t.Error("expected an error for an unknown operator")
+	}
+}
+
+func TestEmptyUpdateIsRejected(t *testing.T) {
+	coll := newMemoryClient(t, NewMemoryEngine()).Database().Collection("c")
+	if _, err := coll.InsertOne(M{"_id": "a", "n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		update Update
+		many   bool
+	}{
+		{name: "UpdateOne empty", update: M{}},
+		{name: "UpdateOne nil", update: M(nil)},
+		{name: "UpdateMany empty", update: M{}, many: true},
+		{name: "UpdateOne replacement", update: M{"n": 2}},
+		{name: "UpdateMany replacement", update: D{{Key: "n", Value: 2}}, many: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.many {
+				_, err = coll.UpdateMany(M{}, tt.update)
+			} else {
+				_, err = coll.UpdateOne(M{"_id": "a"}, tt.update)
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			var doc struct{ N int }
+			if err := coll.FindOne(M{"_id": "a"}).Decode(&doc); err != nil || doc.N != 1 {
+				t.Errorf("document changed to %+v, %v", doc, err)
+			}
+		})
+	}
+}
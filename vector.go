@@ -1,34 +1,9 @@
 package keradb
 
-/*
-#cgo LDFLAGS: -L${SRCDIR}/../../../target/release -lkeradb
-#cgo linux LDFLAGS: -lkeradb -lm -ldl -lpthread
-#cgo darwin LDFLAGS: -lkeradb -lm -ldl -lpthread
-#cgo windows LDFLAGS: -lkeradb -lws2_32 -luserenv -lbcrypt -lntdll
-
-#include <stdlib.h>
-
-typedef void* KeraDB;
-
-// Vector FFI functions
-char* keradb_create_vector_collection(KeraDB db, const char* name, const char* config_json);
-char* keradb_list_vector_collections(KeraDB db);
-int keradb_drop_vector_collection(KeraDB db, const char* name);
-char* keradb_insert_vector(KeraDB db, const char* collection, const char* vector_json, const char* metadata_json);
-char* keradb_insert_text(KeraDB db, const char* collection, const char* text, const char* metadata_json);
-char* keradb_vector_search(KeraDB db, const char* collection, const char* query_vector_json, int k);
-char* keradb_vector_search_text(KeraDB db, const char* collection, const char* query_text, int k);
-char* keradb_vector_search_filtered(KeraDB db, const char* collection, const char* query_vector_json, int k, const char* filter_json);
-char* keradb_get_vector(KeraDB db, const char* collection, unsigned long long id);
-int keradb_delete_vector(KeraDB db, const char* collection, unsigned long long id);
-char* keradb_vector_stats(KeraDB db, const char* collection);
-void keradb_free_string(char* s);
-*/
-import "C"
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"unsafe"
 )
 
 // ============================================================================
@@ -78,14 +53,14 @@ type CompressionConfig struct {
 
 // VectorConfig defines configuration for a vector collection
 type VectorConfig struct {
-	Dimensions      int                `json:"dimensions"`
-	Distance        Distance           `json:"distance,omitempty"`
-	M               *int               `json:"m,omitempty"`                // HNSW M parameter (default 16)
-	EfConstruction  *int               `json:"ef_construction,omitempty"`  // Build quality (default 200)
-	EfSearch        *int               `json:"ef_search,omitempty"`        // Query quality (default 50)
-	LazyEmbedding   *bool              `json:"lazy_embedding,omitempty"`   // Enable lazy recomputation
-	EmbeddingModel  *string            `json:"embedding_model,omitempty"`  // Model name
-	Compression     *CompressionConfig `json:"compression,omitempty"`
+	Dimensions     int                `json:"dimensions"`
+	Distance       Distance           `json:"distance,omitempty"`
+	M              *int               `json:"m,omitempty"`               // HNSW M parameter (default 16)
+	EfConstruction *int               `json:"ef_construction,omitempty"` // Build quality (default 200)
+	EfSearch       *int               `json:"ef_search,omitempty"`       // Query quality (default 50)
+	LazyEmbedding  *bool              `json:"lazy_embedding,omitempty"`  // Enable lazy recomputation
+	EmbeddingModel *string            `json:"embedding_model,omitempty"` // Model name
+	Compression    *CompressionConfig `json:"compression,omitempty"`
 }
 
 // VectorDocument represents a document in a vector collection
@@ -105,15 +80,15 @@ type VectorSearchResult struct {
 
 // VectorCollectionStats provides statistics about a vector collection
 type VectorCollectionStats struct {
-	VectorCount    int              `json:"vector_count"`
-	Dimensions     int              `json:"dimensions"`
-	Distance       Distance         `json:"distance"`
-	MemoryUsage    int64            `json:"memory_usage"`
-	LayerCount     int              `json:"layer_count"`
-	LazyEmbedding  bool             `json:"lazy_embedding"`
-	Compression    *CompressionMode `json:"compression,omitempty"`
-	AnchorCount    *int             `json:"anchor_count,omitempty"`
-	DeltaCount     *int             `json:"delta_count,omitempty"`
+	VectorCount   int              `json:"vector_count"`
+	Dimensions    int              `json:"dimensions"`
+	Distance      Distance         `json:"distance"`
+	MemoryUsage   int64            `json:"memory_usage"`
+	LayerCount    int              `json:"layer_count"`
+	LazyEmbedding bool             `json:"lazy_embedding"`
+	Compression   *CompressionMode `json:"compression,omitempty"`
+	AnchorCount   *int             `json:"anchor_count,omitempty"`
+	DeltaCount    *int             `json:"delta_count,omitempty"`
 }
 
 // MetadataFilter represents a filter condition for metadata fields
@@ -191,22 +166,23 @@ func (vc *VectorConfig) WithQuantizedCompression() *VectorConfig {
 
 // CreateVectorCollection creates a new vector collection
 func (c *Client) CreateVectorCollection(name string, config *VectorConfig) error {
+	return c.CreateVectorCollectionContext(context.Background(), name, config)
+}
+
+// CreateVectorCollectionContext creates a new vector collection
+func (c *Client) CreateVectorCollectionContext(ctx context.Context, name string, config *VectorConfig) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	configJSON, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %w", err)
 	}
 
-	cName := C.CString(name)
-	defer C.free(unsafe.Pointer(cName))
-
-	cConfig := C.CString(string(configJSON))
-	defer C.free(unsafe.Pointer(cConfig))
-
-	cResult := C.keradb_create_vector_collection(c.db, cName, cConfig)
-	if cResult == nil {
-		return fmt.Errorf("create vector collection failed: %s", getLastError())
+	if err := c.engine.CreateVectorCollection(name, configJSON); err != nil {
+		return fmt.Errorf("create vector collection failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	return nil
 }
@@ -216,17 +192,28 @@ func (c *Client) ListVectorCollections() ([]struct {
 	Name  string
 	Count int
 }, error) {
-	cResult := C.keradb_list_vector_collections(c.db)
-	if cResult == nil {
-		return nil, fmt.Errorf("list vector collections failed: %s", getLastError())
+	return c.ListVectorCollectionsContext(context.Background())
+}
+
+// ListVectorCollectionsContext returns a list of vector collections with their sizes
+func (c *Client) ListVectorCollectionsContext(ctx context.Context) ([]struct {
+	Name  string
+	Count int
+}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := c.engine.ListVectorCollections()
+	if err != nil {
+		return nil, fmt.Errorf("list vector collections failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var collections []struct {
 		Name  string
 		Count int
 	}
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &collections); err != nil {
+	if err := json.Unmarshal(data, &collections); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal collections: %w", err)
 	}
 
@@ -235,15 +222,33 @@ func (c *Client) ListVectorCollections() ([]struct {
 
 // DropVectorCollection deletes a vector collection
 func (c *Client) DropVectorCollection(name string) (bool, error) {
-	cName := C.CString(name)
-	defer C.free(unsafe.Pointer(cName))
+	return c.DropVectorCollectionContext(context.Background(), name)
+}
+
+// DropVectorCollectionContext deletes a vector collection
+func (c *Client) DropVectorCollectionContext(ctx context.Context, name string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 
-	result := C.keradb_drop_vector_collection(c.db, cName)
-	return result != 0, nil
+	dropped, err := c.engine.DropVectorCollection(name)
+	if err != nil {
+		return false, fmt.Errorf("drop vector collection failed: %w", err)
+	}
+	return dropped, nil
 }
 
 // InsertVector inserts a vector with optional metadata
-func (c *Client) InsertVector(collection string, embedding Embedding, metadata M) (VectorID, error) {
+func (c *Client) InsertVector(collection string, embedding Embedding, metadata Doc) (VectorID, error) {
+	return c.InsertVectorContext(context.Background(), collection, embedding, metadata)
+}
+
+// InsertVectorContext inserts a vector with optional metadata
+func (c *Client) InsertVectorContext(ctx context.Context, collection string, embedding Embedding, metadata Doc) (VectorID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	vectorJSON, err := json.Marshal(embedding)
 	if err != nil {
 		return 0, fmt.Errorf("failed to marshal vector: %w", err)
@@ -254,23 +259,13 @@ func (c *Client) InsertVector(collection string, embedding Embedding, metadata M
 		return 0, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cVector := C.CString(string(vectorJSON))
-	defer C.free(unsafe.Pointer(cVector))
-
-	cMetadata := C.CString(string(metadataJSON))
-	defer C.free(unsafe.Pointer(cMetadata))
-
-	cResult := C.keradb_insert_vector(c.db, cCollection, cVector, cMetadata)
-	if cResult == nil {
-		return 0, fmt.Errorf("insert vector failed: %s", getLastError())
+	data, err := c.engine.InsertVector(collection, vectorJSON, metadataJSON)
+	if err != nil {
+		return 0, fmt.Errorf("insert vector failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var id VectorID
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &id); err != nil {
+	if err := json.Unmarshal(data, &id); err != nil {
 		return 0, fmt.Errorf("failed to unmarshal ID: %w", err)
 	}
 
@@ -278,29 +273,28 @@ func (c *Client) InsertVector(collection string, embedding Embedding, metadata M
 }
 
 // InsertText inserts text with optional metadata (requires embedding provider)
-func (c *Client) InsertText(collection string, text string, metadata M) (VectorID, error) {
+func (c *Client) InsertText(collection string, text string, metadata Doc) (VectorID, error) {
+	return c.InsertTextContext(context.Background(), collection, text, metadata)
+}
+
+// InsertTextContext inserts text with optional metadata (requires embedding provider)
+func (c *Client) InsertTextContext(ctx context.Context, collection string, text string, metadata Doc) (VectorID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	metadataJSON, err := json.Marshal(metadata)
 	if err != nil {
 		return 0, fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cText := C.CString(text)
-	defer C.free(unsafe.Pointer(cText))
-
-	cMetadata := C.CString(string(metadataJSON))
-	defer C.free(unsafe.Pointer(cMetadata))
-
-	cResult := C.keradb_insert_text(c.db, cCollection, cText, cMetadata)
-	if cResult == nil {
-		return 0, fmt.Errorf("insert text failed: %s", getLastError())
+	data, err := c.engine.InsertText(collection, text, metadataJSON)
+	if err != nil {
+		return 0, fmt.Errorf("insert text failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var id VectorID
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &id); err != nil {
+	if err := json.Unmarshal(data, &id); err != nil {
 		return 0, fmt.Errorf("failed to unmarshal ID: %w", err)
 	}
 
@@ -309,25 +303,27 @@ func (c *Client) InsertText(collection string, text string, metadata M) (VectorI
 
 // VectorSearch performs a vector similarity search
 func (c *Client) VectorSearch(collection string, queryVector Embedding, k int) ([]VectorSearchResult, error) {
+	return c.VectorSearchContext(context.Background(), collection, queryVector, k)
+}
+
+// VectorSearchContext performs a vector similarity search
+func (c *Client) VectorSearchContext(ctx context.Context, collection string, queryVector Embedding, k int) ([]VectorSearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	vectorJSON, err := json.Marshal(queryVector)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal query vector: %w", err)
 	}
 
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cVector := C.CString(string(vectorJSON))
-	defer C.free(unsafe.Pointer(cVector))
-
-	cResult := C.keradb_vector_search(c.db, cCollection, cVector, C.int(k))
-	if cResult == nil {
-		return nil, fmt.Errorf("vector search failed: %s", getLastError())
+	data, err := c.engine.VectorSearch(collection, vectorJSON, k)
+	if err != nil {
+		return nil, fmt.Errorf("vector search failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var results []VectorSearchResult
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &results); err != nil {
+	if err := json.Unmarshal(data, &results); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal results: %w", err)
 	}
 
@@ -336,20 +332,22 @@ func (c *Client) VectorSearch(collection string, queryVector Embedding, k int) (
 
 // VectorSearchText performs a text-based similarity search (requires embedding provider)
 func (c *Client) VectorSearchText(collection string, queryText string, k int) ([]VectorSearchResult, error) {
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
+	return c.VectorSearchTextContext(context.Background(), collection, queryText, k)
+}
 
-	cText := C.CString(queryText)
-	defer C.free(unsafe.Pointer(cText))
+// VectorSearchTextContext performs a text-based similarity search (requires embedding provider)
+func (c *Client) VectorSearchTextContext(ctx context.Context, collection string, queryText string, k int) ([]VectorSearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	cResult := C.keradb_vector_search_text(c.db, cCollection, cText, C.int(k))
-	if cResult == nil {
-		return nil, fmt.Errorf("vector search text failed: %s", getLastError())
+	data, err := c.engine.VectorSearchText(collection, queryText, k)
+	if err != nil {
+		return nil, fmt.Errorf("vector search text failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var results []VectorSearchResult
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &results); err != nil {
+	if err := json.Unmarshal(data, &results); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal results: %w", err)
 	}
 
@@ -358,6 +356,15 @@ func (c *Client) VectorSearchText(collection string, queryText string, k int) ([
 
 // VectorSearchFiltered performs a filtered vector similarity search
 func (c *Client) VectorSearchFiltered(collection string, queryVector Embedding, k int, filter MetadataFilter) ([]VectorSearchResult, error) {
+	return c.VectorSearchFilteredContext(context.Background(), collection, queryVector, k, filter)
+}
+
+// VectorSearchFilteredContext performs a filtered vector similarity search
+func (c *Client) VectorSearchFilteredContext(ctx context.Context, collection string, queryVector Embedding, k int, filter MetadataFilter) ([]VectorSearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	vectorJSON, err := json.Marshal(queryVector)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal query vector: %w", err)
@@ -368,23 +375,13 @@ func (c *Client) VectorSearchFiltered(collection string, queryVector Embedding,
 		return nil, fmt.Errorf("failed to marshal filter: %w", err)
 	}
 
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
-
-	cVector := C.CString(string(vectorJSON))
-	defer C.free(unsafe.Pointer(cVector))
-
-	cFilter := C.CString(string(filterJSON))
-	defer C.free(unsafe.Pointer(cFilter))
-
-	cResult := C.keradb_vector_search_filtered(c.db, cCollection, cVector, C.int(k), cFilter)
-	if cResult == nil {
-		return nil, fmt.Errorf("vector search filtered failed: %s", getLastError())
+	data, err := c.engine.VectorSearchFiltered(collection, vectorJSON, k, filterJSON)
+	if err != nil {
+		return nil, fmt.Errorf("vector search filtered failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var results []VectorSearchResult
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &results); err != nil {
+	if err := json.Unmarshal(data, &results); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal results: %w", err)
 	}
 
@@ -393,17 +390,27 @@ func (c *Client) VectorSearchFiltered(collection string, queryVector Embedding,
 
 // GetVector retrieves a vector document by ID
 func (c *Client) GetVector(collection string, id VectorID) (*VectorDocument, error) {
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
+	return c.GetVectorContext(context.Background(), collection, id)
+}
+
+// GetVectorContext retrieves a vector document by ID. It returns nil and no
+// error if the collection has no vector with that ID; any other failure,
+// including a missing collection, is returned as an error.
+func (c *Client) GetVectorContext(ctx context.Context, collection string, id VectorID) (*VectorDocument, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	cResult := C.keradb_get_vector(c.db, cCollection, C.ulonglong(id))
-	if cResult == nil {
+	data, err := c.engine.GetVector(collection, id)
+	if err != nil {
+		return nil, fmt.Errorf("get vector failed: %w", err)
+	}
+	if data == nil {
 		return nil, nil // Not found
 	}
-	defer C.keradb_free_string(cResult)
 
 	var doc VectorDocument
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &doc); err != nil {
+	if err := json.Unmarshal(data, &doc); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal document: %w", err)
 	}
 
@@ -412,26 +419,40 @@ func (c *Client) GetVector(collection string, id VectorID) (*VectorDocument, err
 
 // DeleteVector deletes a vector document by ID
 func (c *Client) DeleteVector(collection string, id VectorID) (bool, error) {
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
+	return c.DeleteVectorContext(context.Background(), collection, id)
+}
 
-	result := C.keradb_delete_vector(c.db, cCollection, C.ulonglong(id))
-	return result != 0, nil
+// DeleteVectorContext deletes a vector document by ID
+func (c *Client) DeleteVectorContext(ctx context.Context, collection string, id VectorID) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	deleted, err := c.engine.DeleteVector(collection, id)
+	if err != nil {
+		return false, fmt.Errorf("delete vector failed: %w", err)
+	}
+	return deleted, nil
 }
 
 // VectorStats returns statistics about a vector collection
 func (c *Client) VectorStats(collection string) (*VectorCollectionStats, error) {
-	cCollection := C.CString(collection)
-	defer C.free(unsafe.Pointer(cCollection))
+	return c.VectorStatsContext(context.Background(), collection)
+}
+
+// VectorStatsContext returns statistics about a vector collection
+func (c *Client) VectorStatsContext(ctx context.Context, collection string) (*VectorCollectionStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	cResult := C.keradb_vector_stats(c.db, cCollection)
-	if cResult == nil {
-		return nil, fmt.Errorf("vector stats failed: %s", getLastError())
+	data, err := c.engine.VectorStats(collection)
+	if err != nil {
+		return nil, fmt.Errorf("vector stats failed: %w", err)
 	}
-	defer C.keradb_free_string(cResult)
 
 	var stats VectorCollectionStats
-	if err := json.Unmarshal([]byte(C.GoString(cResult)), &stats); err != nil {
+	if err := json.Unmarshal(data, &stats); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal stats: %w", err)
 	}
 
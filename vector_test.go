@@ -0,0 +1,67 @@
+package keradb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVectorNotFound(t *testing.T) {
+	client := newMemoryClient(t, NewMemoryEngine())
+	if err := client.CreateVectorCollection("v", NewVectorConfig(2)); err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.InsertVector("v", Embedding{1, 0}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		run     func() (found bool, err error)
+		want    bool
+		wantErr error
+	}{
+		{name: "get existing", run: func() (bool, error) {
+			doc, err := client.GetVector("v", id)
+			return doc != nil, err
+		}, want: true},
+		{name: "get missing ID", run: func() (bool, error) {
+			doc, err := client.GetVector("v", id+1)
+			return doc != nil, err
+		}},
+		{name: "get from missing collection", run: func() (bool, error) {
+			doc, err := client.GetVector("nope", id)
+			return doc != nil, err
+		}, wantErr: ErrCollectionNotFound},
+		{name: "delete missing ID", run: func() (bool, error) {
+			return client.DeleteVector("v", id+1)
+		}},
+		{name: "delete from missing collection", run: func() (bool, error) {
+			return client.DeleteVector("nope", id)
+		}, wantErr: ErrCollectionNotFound},
+		{name: "drop missing collection", run: func() (bool, error) {
+			return client.DropVectorCollection("nope")
+		}},
+		{name: "dimension mismatch", run: func() (bool, error) {
+			_, err := client.InsertVector("v", Embedding{1, 2, 3}, nil)
+			return false, err
+		}, wantErr: ErrDimensionMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.run()
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("found = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}